@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,22 +13,27 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/go-kit/kit/metrics"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/mainflux/mainflux"
 	authapi "github.com/mainflux/mainflux/authn/api/grpc"
 	"github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/pkg/messaging"
 	"github.com/mainflux/mainflux/pkg/messaging/nats"
+	mfsdk "github.com/mainflux/mainflux/pkg/sdk/go"
+	uuidProvider "github.com/mainflux/mainflux/pkg/uuid"
 	localusers "github.com/mainflux/mainflux/things/users"
 	"github.com/mainflux/mainflux/twins"
 	"github.com/mainflux/mainflux/twins/api"
 	twapi "github.com/mainflux/mainflux/twins/api/http"
+	"github.com/mainflux/mainflux/twins/filestore"
 	twmongodb "github.com/mainflux/mainflux/twins/mongodb"
+	twthings "github.com/mainflux/mainflux/twins/things"
 	"github.com/mainflux/mainflux/twins/tracing"
-	uuidProvider "github.com/mainflux/mainflux/pkg/uuid"
 	opentracing "github.com/opentracing/opentracing-go"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	jconfig "github.com/uber/jaeger-client-go/config"
@@ -40,6 +46,11 @@ import (
 const (
 	queue = "twins"
 
+	// Nacked messages are redelivered after a backoff that doubles with
+	// each attempt, up to the maximum.
+	redeliveryBackoff    = 100 * time.Millisecond
+	maxRedeliveryBackoff = 10 * time.Second
+
 	defLogLevel        = "error"
 	defHTTPPort        = "8180"
 	defJaegerURL       = ""
@@ -56,6 +67,41 @@ const (
 	defNatsURL         = "nats://localhost:4222"
 	defAuthnURL        = "localhost:8181"
 	defAuthnTimeout    = "1" // in seconds
+	defCaseInsensitive = "false"
+	defMaxPageLimit    = "100"
+	defHeartbeat       = "300" // in seconds
+	defAdminEmail      = ""
+	defContentType     = ""
+	defEventLogSize    = "1000"
+	defUnitAliases     = ""
+	defStrictSenML     = "false"
+	defRejectMismatch  = "false"
+	defAccessGrants    = ""
+	defMonitoringChan  = ""
+	defSummaryInterval = "60" // in seconds
+	defKeySweep        = "60" // in seconds
+	defAsyncWrites     = "false"
+	defWriteQueueSize  = "1000"
+	defStateCodec      = "bson"
+	defArchiveDir      = ""
+	defHealthWeights   = "staleness:1,coverage:1,range:1"
+	defStoreRawSenML   = "false"
+	defCaptureSource   = "false"
+	defHideUnauth      = "false"
+	defThingsURL       = ""
+	defRedeliveries    = "0"
+	defDeadLetterChan  = ""
+	defSaveTimeout     = "0" // in milliseconds
+	defFailOpenReads   = "false"
+	defIdentityTTL     = "900" // in seconds
+	defMaxRecordSize   = "0"   // in bytes
+	defContentEncoding = ""
+	defMaxDecompressed = "10485760" // in bytes
+	defIdentityCache   = "10000"
+	defValidateUnits   = "false"
+	defUnmatchedMetric = "false"
+	defMaxSaves        = "0"
+	defSaveQueueWait   = "0" // in milliseconds
 
 	envLogLevel        = "MF_TWINS_LOG_LEVEL"
 	envHTTPPort        = "MF_TWINS_HTTP_PORT"
@@ -73,6 +119,41 @@ const (
 	envNatsURL         = "MF_NATS_URL"
 	envAuthnURL        = "MF_AUTHN_GRPC_URL"
 	envAuthnTimeout    = "MF_AUTHN_GRPC_TIMEOUT"
+	envCaseInsensitive = "MF_TWINS_CASE_INSENSITIVE_MATCH"
+	envMaxPageLimit    = "MF_TWINS_MAX_PAGE_LIMIT"
+	envHeartbeat       = "MF_TWINS_HEARTBEAT"
+	envAdminEmail      = "MF_TWINS_ADMIN_EMAIL"
+	envContentType     = "MF_TWINS_CONTENT_TYPE"
+	envEventLogSize    = "MF_TWINS_EVENT_LOG_SIZE"
+	envUnitAliases     = "MF_TWINS_UNIT_ALIASES"
+	envStrictSenML     = "MF_TWINS_STRICT_SENML"
+	envRejectMismatch  = "MF_TWINS_REJECT_TYPE_MISMATCH"
+	envAccessGrants    = "MF_TWINS_ACCESS_GRANTS"
+	envMonitoringChan  = "MF_TWINS_MONITORING_CHANNEL"
+	envSummaryInterval = "MF_TWINS_INGESTION_SUMMARY_INTERVAL"
+	envKeySweep        = "MF_TWINS_KEY_SWEEP_INTERVAL"
+	envAsyncWrites     = "MF_TWINS_ASYNC_WRITES"
+	envWriteQueueSize  = "MF_TWINS_WRITE_QUEUE_SIZE"
+	envStateCodec      = "MF_TWINS_STATE_CODEC"
+	envArchiveDir      = "MF_TWINS_ARCHIVE_DIR"
+	envHealthWeights   = "MF_TWINS_HEALTH_WEIGHTS"
+	envStoreRawSenML   = "MF_TWINS_STORE_RAW_SENML"
+	envCaptureSource   = "MF_TWINS_CAPTURE_SOURCE"
+	envHideUnauth      = "MF_TWINS_HIDE_UNAUTHORIZED"
+	envThingsURL       = "MF_TWINS_THINGS_URL"
+	envRedeliveries    = "MF_TWINS_MAX_REDELIVERIES"
+	envDeadLetterChan  = "MF_TWINS_DEAD_LETTER_CHANNEL"
+	envSaveTimeout     = "MF_TWINS_SAVE_TIMEOUT"
+	envFailOpenReads   = "MF_TWINS_FAIL_OPEN_READS"
+	envIdentityTTL     = "MF_TWINS_IDENTITY_TTL"
+	envIdentityCache   = "MF_TWINS_IDENTITY_CACHE_SIZE"
+	envMaxRecordSize   = "MF_TWINS_MAX_RECORD_SIZE"
+	envContentEncoding = "MF_TWINS_CONTENT_ENCODING"
+	envMaxDecompressed = "MF_TWINS_MAX_DECOMPRESSED_SIZE"
+	envValidateUnits   = "MF_TWINS_VALIDATE_UNITS"
+	envUnmatchedMetric = "MF_TWINS_UNMATCHED_METRICS"
+	envMaxSaves        = "MF_TWINS_MAX_CONCURRENT_SAVES"
+	envSaveQueueWait   = "MF_TWINS_SAVE_QUEUE_TIMEOUT"
 )
 
 type config struct {
@@ -82,12 +163,18 @@ type config struct {
 	serverCert      string
 	serverKey       string
 	dbCfg           twmongodb.Config
+	stateCodec      twmongodb.StateCodec
+	archiveDir      string
 	singleUserEmail string
 	singleUserToken string
 	clientTLS       bool
 	caCerts         string
 	channelID       string
 	natsURL         string
+	svcCfg          twins.Config
+	summaryInterval time.Duration
+	keySweep        time.Duration
+	unmatchedMetric bool
 
 	authnURL     string
 	authnTimeout time.Duration
@@ -122,7 +209,13 @@ func main() {
 	}
 	defer pubSub.Close()
 
-	svc := newService(pubSub, cfg.channelID, auth, dbTracer, db, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := newService(ctx, pubSub, cfg.channelID, cfg.svcCfg, auth, dbTracer, db, cfg.stateCodec, cfg.archiveDir, cfg.unmatchedMetric, logger)
+
+	if cfg.svcCfg.MonitoringChannel != "" {
+		go publishIngestionSummaries(svc, cfg.summaryInterval, logger)
+	}
+	go removeExpiredKeys(ctx, svc, cfg.keySweep, logger)
 
 	tracer, closer := initJaeger("twins", cfg.jaegerURL, logger)
 	defer closer.Close()
@@ -136,6 +229,7 @@ func main() {
 	}()
 
 	err = <-errs
+	cancel()
 	logger.Error(fmt.Sprintf("Twins service terminated: %s", err))
 }
 
@@ -150,6 +244,189 @@ func loadConfig() config {
 		log.Fatalf("Invalid %s value: %s", envAuthnTimeout, err.Error())
 	}
 
+	caseInsensitive, err := strconv.ParseBool(mainflux.Env(envCaseInsensitive, defCaseInsensitive))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envCaseInsensitive)
+	}
+
+	maxPageLimit, err := strconv.ParseUint(mainflux.Env(envMaxPageLimit, defMaxPageLimit), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envMaxPageLimit, err.Error())
+	}
+
+	heartbeat, err := strconv.ParseInt(mainflux.Env(envHeartbeat, defHeartbeat), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envHeartbeat, err.Error())
+	}
+
+	eventLogSize, err := strconv.Atoi(mainflux.Env(envEventLogSize, defEventLogSize))
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envEventLogSize, err.Error())
+	}
+
+	unitAliases, err := parseUnitAliases(mainflux.Env(envUnitAliases, defUnitAliases))
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envUnitAliases, err.Error())
+	}
+
+	strictSenML, err := strconv.ParseBool(mainflux.Env(envStrictSenML, defStrictSenML))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envStrictSenML)
+	}
+
+	rejectMismatch, err := strconv.ParseBool(mainflux.Env(envRejectMismatch, defRejectMismatch))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envRejectMismatch)
+	}
+
+	accessGrants, err := parseAccessGrants(mainflux.Env(envAccessGrants, defAccessGrants))
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envAccessGrants, err.Error())
+	}
+
+	summaryInterval, err := strconv.ParseInt(mainflux.Env(envSummaryInterval, defSummaryInterval), 10, 64)
+	if err != nil || summaryInterval <= 0 {
+		log.Fatalf("Invalid value passed for %s\n", envSummaryInterval)
+	}
+
+	keySweep, err := strconv.ParseInt(mainflux.Env(envKeySweep, defKeySweep), 10, 64)
+	if err != nil || keySweep <= 0 {
+		log.Fatalf("Invalid value passed for %s\n", envKeySweep)
+	}
+
+	asyncWrites, err := strconv.ParseBool(mainflux.Env(envAsyncWrites, defAsyncWrites))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envAsyncWrites)
+	}
+
+	writeQueueSize, err := strconv.Atoi(mainflux.Env(envWriteQueueSize, defWriteQueueSize))
+	if err != nil || writeQueueSize < 0 {
+		log.Fatalf("Invalid value passed for %s\n", envWriteQueueSize)
+	}
+
+	stateCodec, err := twmongodb.NewStateCodec(mainflux.Env(envStateCodec, defStateCodec))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envStateCodec)
+	}
+
+	redeliveries, err := strconv.Atoi(mainflux.Env(envRedeliveries, defRedeliveries))
+	if err != nil || redeliveries < 0 {
+		log.Fatalf("Invalid value passed for %s\n", envRedeliveries)
+	}
+
+	saveTimeout, err := strconv.ParseUint(mainflux.Env(envSaveTimeout, defSaveTimeout), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envSaveTimeout, err.Error())
+	}
+
+	failOpenReads, err := strconv.ParseBool(mainflux.Env(envFailOpenReads, defFailOpenReads))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envFailOpenReads)
+	}
+
+	identityTTL, err := strconv.ParseUint(mainflux.Env(envIdentityTTL, defIdentityTTL), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envIdentityTTL, err.Error())
+	}
+
+	identityCache, err := strconv.Atoi(mainflux.Env(envIdentityCache, defIdentityCache))
+	if err != nil || identityCache < 0 {
+		log.Fatalf("Invalid value passed for %s\n", envIdentityCache)
+	}
+
+	maxRecordSize, err := strconv.Atoi(mainflux.Env(envMaxRecordSize, defMaxRecordSize))
+	if err != nil || maxRecordSize < 0 {
+		log.Fatalf("Invalid value passed for %s\n", envMaxRecordSize)
+	}
+
+	contentEncoding := mainflux.Env(envContentEncoding, defContentEncoding)
+	if contentEncoding != "" && contentEncoding != "gzip" && contentEncoding != "identity" {
+		log.Fatalf("Invalid value passed for %s\n", envContentEncoding)
+	}
+
+	maxDecompressed, err := strconv.Atoi(mainflux.Env(envMaxDecompressed, defMaxDecompressed))
+	if err != nil || maxDecompressed < 0 {
+		log.Fatalf("Invalid value passed for %s\n", envMaxDecompressed)
+	}
+
+	validateUnits, err := strconv.ParseBool(mainflux.Env(envValidateUnits, defValidateUnits))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envValidateUnits)
+	}
+
+	unmatchedMetric, err := strconv.ParseBool(mainflux.Env(envUnmatchedMetric, defUnmatchedMetric))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envUnmatchedMetric)
+	}
+
+	maxSaves, err := strconv.Atoi(mainflux.Env(envMaxSaves, defMaxSaves))
+	if err != nil || maxSaves < 0 {
+		log.Fatalf("Invalid value passed for %s\n", envMaxSaves)
+	}
+
+	saveQueueWait, err := strconv.ParseUint(mainflux.Env(envSaveQueueWait, defSaveQueueWait), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envSaveQueueWait, err.Error())
+	}
+
+	storeRawSenML, err := strconv.ParseBool(mainflux.Env(envStoreRawSenML, defStoreRawSenML))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envStoreRawSenML)
+	}
+
+	captureSource, err := strconv.ParseBool(mainflux.Env(envCaptureSource, defCaptureSource))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envCaptureSource)
+	}
+
+	hideUnauth, err := strconv.ParseBool(mainflux.Env(envHideUnauth, defHideUnauth))
+	if err != nil {
+		log.Fatalf("Invalid value passed for %s\n", envHideUnauth)
+	}
+
+	healthWeights, err := parseHealthWeights(mainflux.Env(envHealthWeights, defHealthWeights))
+	if err != nil {
+		log.Fatalf("Invalid %s value: %s", envHealthWeights, err.Error())
+	}
+
+	var thingVerifier twins.ThingVerifier
+	if thingsURL := mainflux.Env(envThingsURL, defThingsURL); thingsURL != "" {
+		thingVerifier = twthings.NewThingVerifier(mfsdk.NewSDK(mfsdk.Config{BaseURL: thingsURL}))
+	}
+
+	svcCfg := twins.Config{
+		CaseInsensitiveMatch: caseInsensitive,
+		MaxPageLimit:         maxPageLimit,
+		Heartbeat:            time.Duration(heartbeat) * time.Second,
+		AdminEmail:           mainflux.Env(envAdminEmail, defAdminEmail),
+		ContentType:          mainflux.Env(envContentType, defContentType),
+		EventLogSize:         eventLogSize,
+		UnitAliases:          unitAliases,
+		StrictSenML:          strictSenML,
+		RejectTypeMismatch:   rejectMismatch,
+		AccessGrants:         accessGrants,
+		MonitoringChannel:    mainflux.Env(envMonitoringChan, defMonitoringChan),
+		AsyncWrites:          asyncWrites,
+		WriteQueueSize:       writeQueueSize,
+		HealthWeights:        healthWeights,
+		StoreRawSenML:        storeRawSenML,
+		CaptureSource:        captureSource,
+		HideUnauthorized:     hideUnauth,
+		Things:               thingVerifier,
+		MaxRedeliveries:      redeliveries,
+		DeadLetterChannel:    mainflux.Env(envDeadLetterChan, defDeadLetterChan),
+		SaveTimeout:          time.Duration(saveTimeout) * time.Millisecond,
+		FailOpenReads:        failOpenReads,
+		IdentityTTL:          time.Duration(identityTTL) * time.Second,
+		IdentityCacheSize:    identityCache,
+		MaxRecordSize:        maxRecordSize,
+		ContentEncoding:      contentEncoding,
+		MaxDecompressedSize:  maxDecompressed,
+		ValidateUnits:        validateUnits,
+		MaxConcurrentSaves:   maxSaves,
+		SaveQueueTimeout:     time.Duration(saveQueueWait) * time.Millisecond,
+	}
+
 	dbCfg := twmongodb.Config{
 		Name: mainflux.Env(envDB, defDB),
 		Host: mainflux.Env(envDBHost, defDBHost),
@@ -163,17 +440,90 @@ func loadConfig() config {
 		serverKey:       mainflux.Env(envServerKey, defServerKey),
 		jaegerURL:       mainflux.Env(envJaegerURL, defJaegerURL),
 		dbCfg:           dbCfg,
+		stateCodec:      stateCodec,
+		archiveDir:      mainflux.Env(envArchiveDir, defArchiveDir),
 		singleUserEmail: mainflux.Env(envSingleUserEmail, defSingleUserEmail),
 		singleUserToken: mainflux.Env(envSingleUserToken, defSingleUserToken),
 		clientTLS:       tls,
 		caCerts:         mainflux.Env(envCACerts, defCACerts),
 		channelID:       mainflux.Env(envChannelID, defChannelID),
 		natsURL:         mainflux.Env(envNatsURL, defNatsURL),
+		svcCfg:          svcCfg,
+		summaryInterval: time.Duration(summaryInterval) * time.Second,
+		keySweep:        time.Duration(keySweep) * time.Second,
+		unmatchedMetric: unmatchedMetric,
 		authnURL:        mainflux.Env(envAuthnURL, defAuthnURL),
 		authnTimeout:    time.Duration(timeout) * time.Second,
 	}
 }
 
+// parseUnitAliases parses comma separated alias:canonical unit pairs.
+func parseUnitAliases(s string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	if s == "" {
+		return aliases, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed unit alias %q", pair)
+		}
+		aliases[parts[0]] = parts[1]
+	}
+
+	return aliases, nil
+}
+
+// parseAccessGrants parses comma separated owner:user:label triples.
+func parseAccessGrants(s string) (map[string]map[string][]string, error) {
+	grants := make(map[string]map[string][]string)
+	if s == "" {
+		return grants, nil
+	}
+
+	for _, grant := range strings.Split(s, ",") {
+		parts := strings.Split(grant, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("malformed access grant %q", grant)
+		}
+		if grants[parts[0]] == nil {
+			grants[parts[0]] = make(map[string][]string)
+		}
+		grants[parts[0]][parts[1]] = append(grants[parts[0]][parts[1]], parts[2])
+	}
+
+	return grants, nil
+}
+
+// parseHealthWeights parses comma separated factor:weight pairs. Factors
+// that aren't listed aren't weighed.
+func parseHealthWeights(s string) (twins.HealthWeights, error) {
+	var weights twins.HealthWeights
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return twins.HealthWeights{}, fmt.Errorf("malformed health weight %q", pair)
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || weight < 0 {
+			return twins.HealthWeights{}, fmt.Errorf("malformed health weight %q", pair)
+		}
+		switch parts[0] {
+		case twins.StalenessFactor:
+			weights.Staleness = weight
+		case twins.CoverageFactor:
+			weights.Coverage = weight
+		case twins.RangeFactor:
+			weights.Range = weight
+		default:
+			return twins.HealthWeights{}, fmt.Errorf("unknown health factor %q", parts[0])
+		}
+	}
+
+	return weights, nil
+}
+
 func initJaeger(svcName, url string, logger logger.Logger) (opentracing.Tracer, io.Closer) {
 	if url == "" {
 		return opentracing.NoopTracer{}, ioutil.NopCloser(nil)
@@ -232,17 +582,32 @@ func connectToAuth(cfg config, logger logger.Logger) *grpc.ClientConn {
 	return conn
 }
 
-func newService(ps messaging.PubSub, chanID string, users mainflux.AuthNServiceClient, dbTracer opentracing.Tracer, db *mongo.Database, logger logger.Logger) twins.Service {
+func newService(ctx context.Context, ps messaging.PubSub, chanID string, svcCfg twins.Config, users mainflux.AuthNServiceClient, dbTracer opentracing.Tracer, db *mongo.Database, codec twmongodb.StateCodec, archiveDir string, unmatchedMetric bool, logger logger.Logger) twins.Service {
 	twinRepo := twmongodb.NewTwinRepository(db)
 	twinRepo = tracing.TwinRepositoryMiddleware(dbTracer, twinRepo)
 
-	stateRepo := twmongodb.NewStateRepository(db)
+	stateRepo := twmongodb.NewStateRepository(db, codec)
 	stateRepo = tracing.StateRepositoryMiddleware(dbTracer, stateRepo)
 
+	if archiveDir != "" {
+		svcCfg.Archive = tracing.ArchiveStoreMiddleware(dbTracer, filestore.NewArchiveStore(archiveDir))
+	}
+
 	up := uuidProvider.New()
 
-	svc := twins.New(ps, users, twinRepo, stateRepo, up, chanID, logger)
+	svc := twins.New(ps, users, twinRepo, stateRepo, up, chanID, svcCfg, logger)
 	svc = api.LoggingMiddleware(svc, logger)
+
+	// Records matching no attribute are counted by channel, whose number is
+	// bounded, to reveal devices that changed their subtopics.
+	var unmatched metrics.Counter
+	if unmatchedMetric {
+		unmatched = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "twins",
+			Name:      "unmatched_records_total",
+			Help:      "Number of records matching no twin attribute.",
+		}, []string{"channel"})
+	}
 	svc = api.MetricsMiddleware(
 		svc,
 		kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
@@ -257,19 +622,39 @@ func newService(ps messaging.PubSub, chanID string, users mainflux.AuthNServiceC
 			Name:      "request_latency_microseconds",
 			Help:      "Total duration of requests in microseconds.",
 		}, []string{"method"}),
+		unmatched,
 	)
 
 	err := ps.Subscribe(nats.SubjectAllChannels, func(msg messaging.Message) error {
-		if msg.Channel == chanID {
+		if msg.Channel == chanID || msg.Channel == svcCfg.MonitoringChannel || msg.Channel == svcCfg.DeadLetterChannel {
 			return nil
 		}
 
-		if err := svc.SaveStates(&msg); err != nil {
-			logger.Error(fmt.Sprintf("State save failed: %s", err))
-			return err
-		}
+		// NATS doesn't redeliver messages, so nacked messages are
+		// redelivered in place, at most MaxRedeliveries times.
+		d := &delivery{msg: &msg}
+		backoff := redeliveryBackoff
+		for {
+			d.attempt++
+			d.nacked = false
+			err := svc.HandleDelivery(d)
+			if !d.nacked || d.attempt > svcCfg.MaxRedeliveries {
+				if err != nil {
+					logger.Error(fmt.Sprintf("State save failed: %s", err))
+				}
+				return err
+			}
 
-		return nil
+			select {
+			case <-ctx.Done():
+				logger.Error(fmt.Sprintf("State save failed: %s", err))
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxRedeliveryBackoff {
+				backoff = maxRedeliveryBackoff
+			}
+		}
 	})
 	if err != nil {
 		logger.Error(err.Error())
@@ -279,6 +664,58 @@ func newService(ps messaging.PubSub, chanID string, users mainflux.AuthNServiceC
 	return svc
 }
 
+// delivery is a message delivered by NATS, which doesn't acknowledge
+// messages.
+type delivery struct {
+	msg     *messaging.Message
+	attempt int
+	nacked  bool
+}
+
+func (d *delivery) Message() *messaging.Message {
+	return d.msg
+}
+
+func (d *delivery) Attempt() int {
+	return d.attempt
+}
+
+func (d *delivery) Ack() error {
+	return nil
+}
+
+func (d *delivery) Nack() error {
+	d.nacked = true
+	return nil
+}
+
+func publishIngestionSummaries(svc twins.Service, interval time.Duration, logger logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := svc.PublishIngestionSummaries(); err != nil {
+			logger.Error(fmt.Sprintf("Failed to publish ingestion summaries: %s", err))
+		}
+	}
+}
+
+func removeExpiredKeys(ctx context.Context, svc twins.Service, interval time.Duration, logger logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := svc.RemoveExpiredKeys(ctx); err != nil {
+				logger.Error(fmt.Sprintf("Failed to remove expired twin keys: %s", err))
+			}
+		}
+	}
+}
+
 func startHTTPServer(handler http.Handler, port string, cfg config, logger logger.Logger, errs chan error) {
 	p := fmt.Sprintf(":%s", port)
 	if cfg.serverCert != "" || cfg.serverKey != "" {
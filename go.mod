@@ -9,6 +9,7 @@ require (
 	github.com/dustin/go-coap v0.0.0-20190908170653-752e0f79981e
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/fatih/color v1.9.0
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/go-kit/kit v0.10.0
 	github.com/go-redis/redis v6.15.8+incompatible
 	github.com/go-zoo/bone v1.3.0
@@ -38,4 +39,5 @@ require (
 	golang.org/x/net v0.0.0-20200602114024-627f9648deb9
 	gonum.org/v1/gonum v0.7.0
 	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.24.0
 )
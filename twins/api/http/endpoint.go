@@ -5,6 +5,7 @@ package http
 
 import (
 	"context"
+	"io"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/mainflux/mainflux/twins"
@@ -19,8 +20,13 @@ func addTwinEndpoint(svc twins.Service) endpoint.Endpoint {
 		}
 
 		twin := twins.Twin{
-			Name:     req.Name,
-			Metadata: req.Metadata,
+			Name:       req.Name,
+			Metadata:   req.Metadata,
+			Heartbeat:  req.Heartbeat,
+			BaseTwinID: req.BaseTwinID,
+			ChannelID:  req.ChannelID,
+			ThingID:    req.ThingID,
+			Features:   req.Features,
 		}
 		saved, err := svc.AddTwin(ctx, req.token, twin, req.Definition)
 		if err != nil {
@@ -44,9 +50,21 @@ func updateTwinEndpoint(svc twins.Service) endpoint.Endpoint {
 		}
 
 		twin := twins.Twin{
-			ID:       req.id,
-			Name:     req.Name,
-			Metadata: req.Metadata,
+			ID:         req.id,
+			Name:       req.Name,
+			Metadata:   req.Metadata,
+			Heartbeat:  req.Heartbeat,
+			BaseTwinID: req.BaseTwinID,
+			ChannelID:  req.ChannelID,
+			ThingID:    req.ThingID,
+			Features:   req.Features,
+		}
+
+		if len(req.IfMetadata) > 0 {
+			if err := svc.ConditionalUpdateTwin(ctx, req.token, twin, req.IfMetadata); err != nil {
+				return nil, err
+			}
+			return twinRes{id: req.id, created: false}, nil
 		}
 
 		if err := svc.UpdateTwin(ctx, req.token, twin, req.Definition); err != nil {
@@ -58,6 +76,188 @@ func updateTwinEndpoint(svc twins.Service) endpoint.Endpoint {
 	}
 }
 
+func setMetadataSchemaEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(setSchemaReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		schema := twins.MetadataSchema{
+			Required: req.Required,
+			Types:    req.Types,
+		}
+		if err := svc.SetMetadataSchema(ctx, req.token, schema); err != nil {
+			return nil, err
+		}
+
+		return schemaRes{}, nil
+	}
+}
+
+func updateTwinsMetadataEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(updateMetadataReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		n, err := svc.UpdateTwinsMetadata(ctx, req.token, req.Filter, req.Patch)
+		if err != nil {
+			return nil, err
+		}
+
+		return updateMetadataRes{Updated: n}, nil
+	}
+}
+
+func migrateDefinitionsEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(migrateReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		mr, err := svc.MigrateDefinitions(ctx, req.token, req.Filter, req.migration())
+		if err != nil {
+			return nil, err
+		}
+
+		res := migrateRes{
+			Migrated: mr.Migrated,
+			Failed:   make(map[string]string, len(mr.Failed)),
+		}
+		for id, err := range mr.Failed {
+			res.Failed[id] = err.Error()
+		}
+
+		return res, nil
+	}
+}
+
+func lockTwinEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(lockReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		lockToken, err := svc.LockTwin(ctx, req.token, req.id, req.TTL)
+		if err != nil {
+			return nil, err
+		}
+
+		return lockRes{Token: lockToken}, nil
+	}
+}
+
+func linkTwinInputEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(twinInputReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.LinkTwinInput(ctx, req.token, req.id, req.Attribute, req.SourceTwinID, req.SourceAttribute, req.SourceField); err != nil {
+			return nil, err
+		}
+
+		return twinInputRes{}, nil
+	}
+}
+
+func issueTwinKeyEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(twinKeyReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		key, err := svc.IssueTwinKey(ctx, req.token, req.id, actions[req.Action], req.TTL)
+		if err != nil {
+			return nil, err
+		}
+
+		res := twinKeyRes{
+			ID:      key.ID,
+			Key:     key.Value,
+			Expires: key.Expires,
+		}
+
+		return res, nil
+	}
+}
+
+func revokeTwinKeyEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(revokeTwinKeyReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.RevokeTwinKey(ctx, req.token, req.id, req.keyID); err != nil {
+			return nil, err
+		}
+
+		return removeRes{}, nil
+	}
+}
+
+func unlockTwinEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.UnlockTwin(ctx, req.token, req.id); err != nil {
+			return nil, err
+		}
+
+		return removeRes{}, nil
+	}
+}
+
+func archiveTwinEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.ArchiveTwin(ctx, req.token, req.id); err != nil {
+			return nil, err
+		}
+
+		return removeRes{}, nil
+	}
+}
+
+func restoreArchivedTwinEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.RestoreArchivedTwin(ctx, req.token, req.id); err != nil {
+			return nil, err
+		}
+
+		return twinRes{id: req.id, created: true}, nil
+	}
+}
+
 func viewTwinEndpoint(svc twins.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(viewTwinReq)
@@ -80,34 +280,36 @@ func viewTwinEndpoint(svc twins.Service) endpoint.Endpoint {
 			Revision:    twin.Revision,
 			Definitions: twin.Definitions,
 			Metadata:    twin.Metadata,
+			Heartbeat:   twin.Heartbeat,
+			BaseTwinID:  twin.BaseTwinID,
+			ChannelID:   twin.ChannelID,
+			ThingID:     twin.ThingID,
+			Features:    twin.Features,
+			LastError:   twin.LastError,
+			LastErrorAt: lastErrorAt(twin),
+			Inputs:      twinInputs(twin),
 		}
 		return res, nil
 	}
 }
 
-func listTwinsEndpoint(svc twins.Service) endpoint.Endpoint {
+func viewTwinsEndpoint(svc twins.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		req := request.(listReq)
+		req := request.(viewTwinsReq)
 
 		if err := req.validate(); err != nil {
 			return nil, err
 		}
 
-		page, err := svc.ListTwins(ctx, req.token, req.offset, req.limit, req.name, req.metadata)
-		if err != nil {
+		tws, err := svc.ViewTwins(ctx, req.token, req.IDs)
+		be, ok := err.(*twins.BatchError)
+		if err != nil && !ok {
 			return nil, err
 		}
 
-		res := twinsPageRes{
-			pageRes: pageRes{
-				Total:  page.Total,
-				Offset: page.Offset,
-				Limit:  page.Limit,
-			},
-			Twins: []viewTwinRes{},
-		}
-		for _, twin := range page.Twins {
-			view := viewTwinRes{
+		res := viewTwinsRes{Twins: []viewTwinRes{}}
+		for _, twin := range tws {
+			res.Twins = append(res.Twins, viewTwinRes{
 				Owner:       twin.Owner,
 				ID:          twin.ID,
 				Name:        twin.Name,
@@ -116,63 +318,824 @@ func listTwinsEndpoint(svc twins.Service) endpoint.Endpoint {
 				Revision:    twin.Revision,
 				Definitions: twin.Definitions,
 				Metadata:    twin.Metadata,
+				Heartbeat:   twin.Heartbeat,
+				BaseTwinID:  twin.BaseTwinID,
+				ChannelID:   twin.ChannelID,
+				ThingID:     twin.ThingID,
+				Features:    twin.Features,
+				LastError:   twin.LastError,
+				LastErrorAt: lastErrorAt(twin),
+				Inputs:      twinInputs(twin),
+			})
+		}
+		if ok {
+			res.Errors = make(map[string]string)
+			for id, err := range be.Errors {
+				res.Errors[id] = err.Error()
 			}
-			res.Twins = append(res.Twins, view)
 		}
 
 		return res, nil
 	}
 }
 
-func removeTwinEndpoint(svc twins.Service) endpoint.Endpoint {
+func latestValuesEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(latestValuesReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		values, err := svc.LatestAttributeValues(ctx, req.token, req.IDs, req.Attribute)
+		be, ok := err.(*twins.BatchError)
+		if err != nil && !ok {
+			return nil, err
+		}
+
+		res := latestValuesRes{
+			Attribute: req.Attribute,
+			Values:    make(map[string]latestValueRes),
+		}
+		for id, v := range values {
+			res.Values[id] = latestValueRes{
+				Value:   v.Value,
+				Updated: v.Updated,
+				Age:     v.Age,
+			}
+		}
+		if ok {
+			res.Errors = make(map[string]string)
+			for id, err := range be.Errors {
+				res.Errors[id] = err.Error()
+			}
+		}
+
+		return res, nil
+	}
+}
+
+func twinStatusEndpoint(svc twins.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(viewTwinReq)
 
-		err := req.validate()
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		online, lastSeen, err := svc.TwinStatus(ctx, req.token, req.id)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := svc.RemoveTwin(ctx, req.token, req.id); err != nil {
+		return twinStatusRes{Online: online, LastSeen: lastSeen}, nil
+	}
+}
+
+func coverageReportEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(coverageReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		report, err := svc.CoverageReport(ctx, req.token, req.id, req.window)
+		if err != nil {
 			return nil, err
 		}
 
-		return removeRes{}, nil
+		return coverageRes{Coverage: report}, nil
 	}
 }
 
-func listStatesEndpoint(svc twins.Service) endpoint.Endpoint {
+func twinHealthEndpoint(svc twins.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		req := request.(listStatesReq)
+		req := request.(viewTwinReq)
 
 		if err := req.validate(); err != nil {
 			return nil, err
 		}
 
-		page, err := svc.ListStates(ctx, req.token, req.offset, req.limit, req.id)
+		hs, err := svc.TwinHealth(ctx, req.token, req.id)
 		if err != nil {
 			return nil, err
 		}
 
-		res := statesPageRes{
-			pageRes: pageRes{
-				Total:  page.Total,
-				Offset: page.Offset,
-				Limit:  page.Limit,
-			},
-			States: []viewStateRes{},
+		res := healthRes{
+			TwinID:  hs.TwinID,
+			Score:   hs.Score,
+			Factors: hs.Factors,
 		}
-		for _, state := range page.States {
-			view := viewStateRes{
-				TwinID:     state.TwinID,
-				ID:         state.ID,
-				Definition: state.Definition,
-				Created:    state.Created,
-				Payload:    state.Payload,
+
+		return res, nil
+	}
+}
+
+func describeTwinEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		desc, err := svc.DescribeTwin(ctx, req.token, req.id)
+		if err != nil {
+			return nil, err
+		}
+
+		res := twinDescriptorRes{
+			TwinID:      desc.TwinID,
+			Name:        desc.Name,
+			Definition:  desc.Definition,
+			ContentType: desc.ContentType,
+			Delta:       desc.Delta,
+			Attributes:  desc.Attributes,
+		}
+
+		return res, nil
+	}
+}
+
+func simulateIngestionEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(simulateIngestionReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		trace, err := svc.SimulateIngestion(ctx, req.token, req.id, req.payload)
+		if err != nil {
+			return nil, err
+		}
+
+		res := ingestionTraceRes{
+			TwinID:   trace.TwinID,
+			Channel:  trace.Channel,
+			Subtopic: trace.Subtopic,
+			Matched:  trace.Matched,
+			Invalid:  trace.Invalid,
+			Rejected: trace.Rejected,
+			Records:  []recordTraceRes{},
+		}
+		for _, rt := range trace.Records {
+			res.Records = append(res.Records, recordTraceRes{
+				Name:      rt.Name,
+				Time:      rt.Time,
+				Unit:      rt.Unit,
+				Value:     rt.Value,
+				Attribute: rt.Attribute,
+				Action:    rt.Action,
+				Reason:    rt.Reason,
+			})
+		}
+		if trace.Matched {
+			res.State = &viewStateRes{
+				TwinID:     trace.State.TwinID,
+				ID:         trace.State.ID,
+				Definition: trace.State.Definition,
+				Created:    trace.State.Created,
+				Payload:    trace.State.Payload,
+				Sums:       trace.State.Sums,
 			}
-			res.States = append(res.States, view)
 		}
 
 		return res, nil
 	}
 }
+
+func viewTwinByMetadataEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewByMetadataReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		twin, err := svc.ViewTwinByMetadata(ctx, req.token, req.key, req.value)
+		if err != nil {
+			return nil, err
+		}
+
+		res := viewTwinRes{
+			Owner:       twin.Owner,
+			ID:          twin.ID,
+			Name:        twin.Name,
+			Created:     twin.Created,
+			Updated:     twin.Updated,
+			Revision:    twin.Revision,
+			Definitions: twin.Definitions,
+			Metadata:    twin.Metadata,
+			Heartbeat:   twin.Heartbeat,
+			BaseTwinID:  twin.BaseTwinID,
+			ChannelID:   twin.ChannelID,
+			ThingID:     twin.ThingID,
+			Features:    twin.Features,
+			LastError:   twin.LastError,
+			LastErrorAt: lastErrorAt(twin),
+			Inputs:      twinInputs(twin),
+		}
+		return res, nil
+	}
+}
+
+func viewTwinByThingEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewByThingReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		twin, err := svc.ViewTwinByThing(ctx, req.token, req.thingID)
+		if err != nil {
+			return nil, err
+		}
+
+		res := viewTwinRes{
+			Owner:       twin.Owner,
+			ID:          twin.ID,
+			Name:        twin.Name,
+			Created:     twin.Created,
+			Updated:     twin.Updated,
+			Revision:    twin.Revision,
+			Definitions: twin.Definitions,
+			Metadata:    twin.Metadata,
+			Heartbeat:   twin.Heartbeat,
+			BaseTwinID:  twin.BaseTwinID,
+			ChannelID:   twin.ChannelID,
+			ThingID:     twin.ThingID,
+			Features:    twin.Features,
+			LastError:   twin.LastError,
+			LastErrorAt: lastErrorAt(twin),
+			Inputs:      twinInputs(twin),
+		}
+		return res, nil
+	}
+}
+
+func replayEventsEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(replayReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		ch, err := svc.ReplayEvents(ctx, req.token, req.fromSeq)
+		if err != nil {
+			return nil, err
+		}
+
+		res := eventsRes{Events: []eventRes{}}
+		for e := range ch {
+			res.Events = append(res.Events, eventRes{
+				Seq:       e.Seq,
+				Operation: e.Operation,
+				Payload:   string(e.Payload),
+				Created:   e.Created,
+			})
+		}
+
+		return res, nil
+	}
+}
+
+func listTwinIDsEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listIDsReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		ids, err := svc.ListAllTwinIDs(ctx, req.token, req.owner)
+		if err != nil {
+			return nil, err
+		}
+
+		return twinIDsRes{IDs: ids}, nil
+	}
+}
+
+func listTwinsEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		var page twins.Page
+		var err error
+		switch {
+		case req.errorWithin > 0:
+			page, err = svc.ListTwinsWithErrors(ctx, req.token, req.offset, req.limit, req.errorWithin)
+		case req.status != "":
+			page, err = svc.ListTwinsByStatus(ctx, req.token, req.offset, req.limit, req.status == online)
+		default:
+			page, err = svc.ListTwins(ctx, req.token, req.offset, req.limit, req.name, req.metadata, !req.definitions)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res := twinsPageRes{
+			pageRes: pageRes{
+				Total:  page.Total,
+				Offset: page.Offset,
+				Limit:  page.Limit,
+			},
+			Twins: []viewTwinRes{},
+		}
+		for _, twin := range page.Twins {
+			view := viewTwinRes{
+				Owner:       twin.Owner,
+				ID:          twin.ID,
+				Name:        twin.Name,
+				Created:     twin.Created,
+				Updated:     twin.Updated,
+				Revision:    twin.Revision,
+				Definitions: twin.Definitions,
+				Metadata:    twin.Metadata,
+				Heartbeat:   twin.Heartbeat,
+				BaseTwinID:  twin.BaseTwinID,
+				ChannelID:   twin.ChannelID,
+				ThingID:     twin.ThingID,
+				Features:    twin.Features,
+				LastError:   twin.LastError,
+				LastErrorAt: lastErrorAt(twin),
+				Inputs:      twinInputs(twin),
+			}
+			res.Twins = append(res.Twins, view)
+		}
+
+		return res, nil
+	}
+}
+
+func removeTwinEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(removeTwinReq)
+
+		err := req.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := svc.RemoveTwin(ctx, req.token, req.id, req.cascade); err != nil {
+			return nil, err
+		}
+
+		return removeRes{}, nil
+	}
+}
+
+func listStatesEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listStatesReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		var page twins.StatesPage
+		var err error
+		switch {
+		case req.group != "":
+			page, err = svc.ListStatesByGroup(ctx, req.token, req.id, req.group, req.offset, req.limit, req.consistency, req.order)
+		case req.source != "":
+			page, err = svc.ListStatesBySource(ctx, req.token, req.id, req.source, req.offset, req.limit, req.order)
+		default:
+			page, err = svc.ListStates(ctx, req.token, req.offset, req.limit, req.id, req.consistency, req.order, req.raw)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res := statesPageRes{
+			pageRes: pageRes{
+				Total:  page.Total,
+				Offset: page.Offset,
+				Limit:  page.Limit,
+			},
+			States: []viewStateRes{},
+		}
+		for _, state := range page.States {
+			view := viewStateRes{
+				TwinID:     state.TwinID,
+				ID:         state.ID,
+				Definition: state.Definition,
+				Created:    state.Created,
+				Payload:    state.Payload,
+				Sums:       state.Sums,
+				Hash:       state.Hash,
+				Note:       state.Note,
+				Backfilled: state.Backfilled,
+				Source:     state.Source,
+				Raw:        state.Raw,
+			}
+			res.States = append(res.States, view)
+		}
+
+		return res, nil
+	}
+}
+
+func listChannelStatesEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listChannelStatesReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		page, err := svc.ListChannelStates(ctx, req.token, req.channelID, req.offset, req.limit)
+		if err != nil {
+			return nil, err
+		}
+
+		res := statesPageRes{
+			pageRes: pageRes{
+				Total:  page.Total,
+				Offset: page.Offset,
+				Limit:  page.Limit,
+			},
+			States: []viewStateRes{},
+		}
+		for _, state := range page.States {
+			view := viewStateRes{
+				TwinID:     state.TwinID,
+				ID:         state.ID,
+				Definition: state.Definition,
+				Created:    state.Created,
+				Payload:    state.Payload,
+				Sums:       state.Sums,
+				Hash:       state.Hash,
+				Note:       state.Note,
+				Backfilled: state.Backfilled,
+				Source:     state.Source,
+			}
+			res.States = append(res.States, view)
+		}
+
+		return res, nil
+	}
+}
+
+func streamExportStatesEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		res := exportStatesRes{
+			export: func(w io.Writer) error {
+				return svc.StreamExportStates(ctx, req.token, req.id, w)
+			},
+		}
+		return res, nil
+	}
+}
+
+func currentStateEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		state, err := svc.CurrentState(ctx, req.token, req.id)
+		if err != nil {
+			return nil, err
+		}
+
+		res := viewStateRes{
+			TwinID:     state.TwinID,
+			ID:         state.ID,
+			Definition: state.Definition,
+			Created:    state.Created,
+			Payload:    state.Payload,
+			Sums:       state.Sums,
+			Hash:       state.Hash,
+			Note:       state.Note,
+			Backfilled: state.Backfilled,
+			Source:     state.Source,
+		}
+
+		return res, nil
+	}
+}
+
+func stateAtEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(stateAtReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		state, err := svc.StateAt(ctx, req.token, req.id, req.at)
+		if err != nil {
+			return nil, err
+		}
+
+		res := viewStateRes{
+			TwinID:     state.TwinID,
+			ID:         state.ID,
+			Definition: state.Definition,
+			Created:    state.Created,
+			Payload:    state.Payload,
+			Sums:       state.Sums,
+			Hash:       state.Hash,
+			Note:       state.Note,
+			Backfilled: state.Backfilled,
+			Source:     state.Source,
+		}
+
+		return res, nil
+	}
+}
+
+func verifyStatesEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		intact, broken, err := svc.VerifyStateChain(ctx, req.token, req.id)
+		if err != nil {
+			return nil, err
+		}
+
+		return verifyStatesRes{Intact: intact, Broken: broken}, nil
+	}
+}
+
+func reindexEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewTwinReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.Reindex(ctx, req.token, req.id); err != nil {
+			return nil, err
+		}
+
+		return reindexRes{}, nil
+	}
+}
+
+func backfillDerivedEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(backfillDerivedReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.BackfillDerived(ctx, req.token, req.id, req.Attribute); err != nil {
+			return nil, err
+		}
+
+		return backfillDerivedRes{}, nil
+	}
+}
+
+func annotateStateEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(annotateStateReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if req.Note == "" {
+			return nil, twins.ErrMalformedEntity
+		}
+
+		if err := svc.AnnotateState(ctx, req.token, req.id, req.stateID, req.Note); err != nil {
+			return nil, err
+		}
+
+		return noteRes{}, nil
+	}
+}
+
+func removeStateNoteEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(annotateStateReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.AnnotateState(ctx, req.token, req.id, req.stateID, ""); err != nil {
+			return nil, err
+		}
+
+		return removeRes{}, nil
+	}
+}
+
+func statesHistogramEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(statesHistogramReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		hist, err := svc.StatesHistogram(ctx, req.token, req.id, req.bucket, req.from, req.to, req.loc)
+		if err != nil {
+			return nil, err
+		}
+
+		res := histogramRes{Buckets: []bucketRes{}}
+		for _, b := range hist {
+			res.Buckets = append(res.Buckets, bucketRes{Start: b.Start, Count: b.Count})
+		}
+
+		return res, nil
+	}
+}
+
+func listStatePartitionsEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(statePartitionsReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		partitions, err := svc.ListStatePartitions(ctx, req.token, req.id, req.granularity, req.loc)
+		if err != nil {
+			return nil, err
+		}
+
+		res := partitionsRes{Partitions: []bucketRes{}}
+		for _, p := range partitions {
+			res.Partitions = append(res.Partitions, bucketRes{Start: p.Start, Count: p.Count})
+		}
+
+		return res, nil
+	}
+}
+
+func findStatesEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(findStatesReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		page, err := svc.FindStates(ctx, req.token, req.id, req.attr, req.op, req.value, req.offset, req.limit)
+		if err != nil {
+			return nil, err
+		}
+
+		res := statesPageRes{
+			pageRes: pageRes{
+				Total:  page.Total,
+				Offset: page.Offset,
+				Limit:  page.Limit,
+			},
+			States: []viewStateRes{},
+		}
+		for _, state := range page.States {
+			view := viewStateRes{
+				TwinID:     state.TwinID,
+				ID:         state.ID,
+				Definition: state.Definition,
+				Created:    state.Created,
+				Payload:    state.Payload,
+				Sums:       state.Sums,
+				Hash:       state.Hash,
+				Note:       state.Note,
+				Backfilled: state.Backfilled,
+				Source:     state.Source,
+			}
+			res.States = append(res.States, view)
+		}
+
+		return res, nil
+	}
+}
+
+func validateDefinitionEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(validateDefinitionReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		err := svc.ValidateDefinition(ctx, req.Definition)
+		if de, ok := err.(*twins.DefinitionError); ok {
+			return validateDefinitionRes{Valid: false, Problems: de.Problems}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return validateDefinitionRes{Valid: true}, nil
+	}
+}
+
+func subscriptionInfoEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(statsReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		infos, err := svc.SubscriptionInfo(ctx, req.token)
+		if err != nil {
+			return nil, err
+		}
+
+		res := subscriptionsRes{
+			Subscriptions: []subscriptionRes{},
+		}
+		for _, info := range infos {
+			res.Subscriptions = append(res.Subscriptions, subscriptionRes{
+				Subject:     info.Subject,
+				Messages:    info.Messages,
+				LastMessage: info.LastMessage,
+			})
+		}
+		return res, nil
+	}
+}
+
+func serviceStatsEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(statsReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		stats, err := svc.ServiceStats(ctx, req.token)
+		if err != nil {
+			return nil, err
+		}
+
+		res := statsRes{
+			Twins:        stats.Twins,
+			States:       stats.States,
+			RecentStates: stats.RecentStates,
+			Channels:     stats.Channels,
+		}
+		return res, nil
+	}
+}
+
+func setOwnerQuotaEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(setQuotaReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.SetOwnerQuota(ctx, req.token, req.owner, req.MaxStates); err != nil {
+			return nil, err
+		}
+
+		return quotaRes{}, nil
+	}
+}
+
+func ownerUsageEndpoint(svc twins.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewUsageReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		usage, err := svc.OwnerUsage(ctx, req.token, req.owner)
+		if err != nil {
+			return nil, err
+		}
+
+		res := usageRes{
+			Owner:     usage.Owner,
+			States:    usage.States,
+			MaxStates: usage.MaxStates,
+		}
+		return res, nil
+	}
+}
@@ -8,8 +8,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mainflux/mainflux/pkg/uuid"
 	"github.com/mainflux/mainflux/twins"
 	"github.com/mainflux/senml"
 	"github.com/stretchr/testify/assert"
@@ -34,6 +37,9 @@ type stateRes struct {
 	ID         int64                  `json:"id"`
 	Definition int                    `json:"definition"`
 	Payload    map[string]interface{} `json:"payload"`
+	Raw        []byte                 `json:"raw"`
+	Source     string                 `json:"source"`
+	Sums       map[string]float64     `json:"sums"`
 }
 
 type statesPageRes struct {
@@ -57,7 +63,7 @@ func TestListStates(t *testing.T) {
 	recs := mocks.CreateSenML(100, attrName1)
 	message, err := mocks.CreateMessage(attr, recs)
 	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
-	err = svc.SaveStates(message)
+	_, err = svc.SaveStates(message)
 	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
 
 	var data []stateRes
@@ -66,6 +72,11 @@ func TestListStates(t *testing.T) {
 		data = append(data, res)
 	}
 
+	var latest []stateRes
+	for i := len(data) - 1; i >= 0; i-- {
+		latest = append(latest, data[i])
+	}
+
 	baseURL := fmt.Sprintf("%s/states/%s", ts.URL, tw.ID)
 	queryFmt := "%s?offset=%d&limit=%d"
 	cases := []struct {
@@ -80,14 +91,14 @@ func TestListStates(t *testing.T) {
 			auth:   token,
 			status: http.StatusOK,
 			url:    baseURL,
-			res:    data[0:10],
+			res:    latest[0:10],
 		},
 		{
 			desc:   "get a list of states with valid offset and limit",
 			auth:   token,
 			status: http.StatusOK,
 			url:    fmt.Sprintf(queryFmt, baseURL, 20, 15),
-			res:    data[20:35],
+			res:    latest[20:35],
 		},
 		{
 			desc:   "get a list of states with invalid token",
@@ -108,7 +119,7 @@ func TestListStates(t *testing.T) {
 			auth:   token,
 			status: http.StatusOK,
 			url:    fmt.Sprintf(queryFmt, baseURL, 91, 20),
-			res:    data[91:],
+			res:    latest[91:],
 		},
 		{
 			desc:   "get a list of states with negative offset",
@@ -157,14 +168,14 @@ func TestListStates(t *testing.T) {
 			auth:   token,
 			status: http.StatusOK,
 			url:    fmt.Sprintf("%s?limit=%d", baseURL, 15),
-			res:    data[0:15],
+			res:    latest[0:15],
 		},
 		{
 			desc:   "get a list of states without limit",
 			auth:   token,
 			status: http.StatusOK,
 			url:    fmt.Sprintf("%s?offset=%d", baseURL, 14),
-			res:    data[14:24],
+			res:    latest[14:24],
 		},
 		{
 			desc:   "get a list of states with invalid number of parameters",
@@ -173,12 +184,68 @@ func TestListStates(t *testing.T) {
 			url:    fmt.Sprintf("%s%s", baseURL, "?offset=4&limit=4&limit=5&offset=5"),
 			res:    nil,
 		},
+		{
+			desc:   "get a list of states with eventual consistency",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&consistency=eventual", baseURL, 0, 5),
+			res:    latest[0:5],
+		},
+		{
+			desc:   "get a list of states with invalid consistency",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&consistency=invalid", baseURL, 0, 5),
+			res:    nil,
+		},
+		{
+			desc:   "get a list of states in ascending order",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&order=asc", baseURL, 0, 5),
+			res:    data[0:5],
+		},
+		{
+			desc:   "get a list of states in ascending order with offset",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&order=asc", baseURL, 95, 10),
+			res:    data[95:],
+		},
+		{
+			desc:   "get a list of states in descending order",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&order=desc", baseURL, 0, 5),
+			res:    latest[0:5],
+		},
+		{
+			desc:   "get a list of states in descending order with offset",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&order=desc", baseURL, 95, 10),
+			res:    latest[95:],
+		},
+		{
+			desc:   "get a list of states in descending order with offset equal to total",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&order=desc", baseURL, 100, 10),
+			res:    []stateRes{},
+		},
+		{
+			desc:   "get a list of states with invalid order",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?offset=%d&limit=%d&order=invalid", baseURL, 0, 5),
+			res:    nil,
+		},
 		{
 			desc:   "get a list of states with redundant query parameters",
 			auth:   token,
 			status: http.StatusOK,
 			url:    fmt.Sprintf("%s?offset=%d&limit=%d&value=something", baseURL, 0, 5),
-			res:    data[0:5],
+			res:    latest[0:5],
 		},
 	}
 
@@ -199,7 +266,1318 @@ func TestListStates(t *testing.T) {
 		}
 
 		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
-		assert.ElementsMatch(t, tc.res, resData.States, fmt.Sprintf("%s: expected body %v got %v", tc.desc, tc.res, resData.States))
+		assert.Equal(t, tc.res, resData.States, fmt.Sprintf("%s: expected body %v got %v", tc.desc, tc.res, resData.States))
+	}
+}
+
+func TestListStatesByGroup(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[0].Group = "engine"
+	def.Attributes[1].Group = "climate"
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, attr := range def.Attributes {
+		recs := mocks.CreateSenML(1, attr.Name)
+		recs[0].BaseTime = 0
+		recs[0].Time = 1600000000
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc   string
+		url    string
+		auth   string
+		status int
+		attrs  int
+	}{
+		{
+			desc:   "get a list of states by group",
+			url:    fmt.Sprintf("%s/states/%s?group=engine", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusOK,
+			attrs:  1,
+		},
+		{
+			desc:   "get a list of states without group",
+			url:    fmt.Sprintf("%s/states/%s", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusOK,
+			attrs:  2,
+		},
+		{
+			desc:   "get a list of states by non-existing group",
+			url:    fmt.Sprintf("%s/states/%s?group=cabin", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "get a list of states by group with invalid token",
+			url:    fmt.Sprintf("%s/states/%s?group=engine", ts.URL, tw.ID),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body statesPageRes
+		json.NewDecoder(res.Body).Decode(&body)
+		var attrs int
+		if len(body.States) > 0 {
+			attrs = len(body.States[0].Payload)
+		}
+		assert.Equal(t, tc.attrs, attrs, fmt.Sprintf("%s: expected %d attributes got %d", tc.desc, tc.attrs, attrs))
+	}
+}
+
+func TestListStatesBySource(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{CaptureSource: true}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for i, src := range []string{"gateway-1", "gateway-2", "gateway-1"} {
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].BaseTime = 0
+		recs[0].Time = float64(1600000000 + i)
+		message, err := mocks.CreateMessage(def.Attributes[0], recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		message.Publisher = src
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc   string
+		url    string
+		auth   string
+		status int
+		size   int
+	}{
+		{
+			desc:   "get a list of states by source",
+			url:    fmt.Sprintf("%s/states/%s?source=gateway-1", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusOK,
+			size:   2,
+		},
+		{
+			desc:   "get a list of states by unknown source",
+			url:    fmt.Sprintf("%s/states/%s?source=gateway-3", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusOK,
+			size:   0,
+		},
+		{
+			desc:   "get a list of states by source and group",
+			url:    fmt.Sprintf("%s/states/%s?source=gateway-1&group=engine", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "get a list of raw states by source",
+			url:    fmt.Sprintf("%s/states/%s?source=gateway-1&raw=true", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "get a list of states by source with invalid token",
+			url:    fmt.Sprintf("%s/states/%s?source=gateway-1", ts.URL, tw.ID),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body statesPageRes
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Len(t, body.States, tc.size, fmt.Sprintf("%s: expected %d states got %d", tc.desc, tc.size, len(body.States)))
+		for _, st := range body.States {
+			assert.Equal(t, "gateway-1", st.Source, fmt.Sprintf("%s: expected source %s got %s", tc.desc, "gateway-1", st.Source))
+		}
+	}
+}
+
+func TestListStatesSums(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	val, sum := 2.5, 120.0
+	message, err := mocks.CreateMessage(def.Attributes[0], []senml.Record{{BaseName: attrName1, Value: &val, Sum: &sum}})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	req := testRequest{
+		client: ts.Client(),
+		method: http.MethodGet,
+		url:    fmt.Sprintf("%s/states/%s", ts.URL, tw.ID),
+		token:  token,
+	}
+	res, err := req.make()
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected status code %d got %d", http.StatusOK, res.StatusCode))
+
+	var body statesPageRes
+	json.NewDecoder(res.Body).Decode(&body)
+	require.Len(t, body.States, 1, fmt.Sprintf("expected single state got %d", len(body.States)))
+	assert.Equal(t, val, body.States[0].Payload[attrName1], fmt.Sprintf("expected value %v got %v", val, body.States[0].Payload[attrName1]))
+	assert.Equal(t, map[string]float64{attrName1: sum}, body.States[0].Sums, fmt.Sprintf("expected sums %v got %v", sum, body.States[0].Sums))
+}
+
+func TestListStatesRaw(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{StoreRawSenML: true}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].Group = "engine"
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		url    string
+		status int
+		raw    []byte
+	}{
+		{
+			desc:   "get a list of states with raw payloads",
+			url:    fmt.Sprintf("%s/states/%s?raw=true", ts.URL, tw.ID),
+			status: http.StatusOK,
+			raw:    message.Payload,
+		},
+		{
+			desc:   "get a list of states without raw payloads",
+			url:    fmt.Sprintf("%s/states/%s", ts.URL, tw.ID),
+			status: http.StatusOK,
+			raw:    nil,
+		},
+		{
+			desc:   "get a list of states with invalid raw flag",
+			url:    fmt.Sprintf("%s/states/%s?raw=yes", ts.URL, tw.ID),
+			status: http.StatusBadRequest,
+			raw:    nil,
+		},
+		{
+			desc:   "get a list of states by group with raw payloads",
+			url:    fmt.Sprintf("%s/states/%s?group=engine&raw=true", ts.URL, tw.ID),
+			status: http.StatusBadRequest,
+			raw:    nil,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  token,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body statesPageRes
+		json.NewDecoder(res.Body).Decode(&body)
+		var raw []byte
+		if len(body.States) > 0 {
+			raw = body.States[0].Raw
+		}
+		assert.Equal(t, tc.raw, raw, fmt.Sprintf("%s: expected raw payload %s got %s", tc.desc, tc.raw, raw))
+	}
+}
+
+func TestListChannelStates(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{ChannelID: attr.Channel}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(attr, mocks.CreateSenML(5, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	baseURL := fmt.Sprintf("%s/channels/%s/states", ts.URL, attr.Channel)
+	cases := []struct {
+		desc   string
+		auth   string
+		status int
+		url    string
+		size   int
+	}{
+		{
+			desc:   "get states of channel",
+			auth:   token,
+			status: http.StatusOK,
+			url:    baseURL,
+			size:   5,
+		},
+		{
+			desc:   "get states of channel with offset and limit",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?offset=1&limit=2", baseURL),
+			size:   2,
+		},
+		{
+			desc:   "get states of channel with invalid limit",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?limit=%d", baseURL, 0),
+		},
+		{
+			desc:   "get states of channel with invalid offset",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?offset=%s", baseURL, wrongValue),
+		},
+		{
+			desc:   "get states of channel with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+			url:    baseURL,
+		},
+		{
+			desc:   "get states of channel with empty token",
+			auth:   "",
+			status: http.StatusForbidden,
+			url:    baseURL,
+		},
+		{
+			desc:   "get states of channel without twins",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s/channels/%s/states", ts.URL, "wrong"),
+			size:   0,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			States []struct {
+				TwinID string `json:"twin_id"`
+			} `json:"states"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.size, len(body.States), fmt.Sprintf("%s: expected %d states got %d", tc.desc, tc.size, len(body.States)))
+	}
+}
+
+func TestVerifyStateChain(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(10, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	url := fmt.Sprintf("%s/states/%s/verify", ts.URL, tw.ID)
+	cases := []struct {
+		desc   string
+		auth   string
+		status int
+		intact bool
+	}{
+		{
+			desc:   "verify state chain",
+			auth:   token,
+			status: http.StatusOK,
+			intact: true,
+		},
+		{
+			desc:   "verify state chain with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "verify state chain with empty token",
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Intact bool `json:"intact"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.intact, body.Intact, fmt.Sprintf("%s: expected intact %t got %t", tc.desc, tc.intact, body.Intact))
+	}
+}
+
+func TestReindex(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(10, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		id     string
+		auth   string
+		status int
+	}{
+		{
+			desc:   "reindex states",
+			id:     tw.ID,
+			auth:   token,
+			status: http.StatusOK,
+		},
+		{
+			desc:   "reindex states of non-existent twin",
+			id:     "missing",
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "reindex states with invalid token",
+			id:     tw.ID,
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "reindex states with empty token",
+			id:     tw.ID,
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodPost,
+			url:    fmt.Sprintf("%s/states/%s/reindex", ts.URL, tc.id),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestBackfillDerived(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes = append(def.Attributes, twins.Attribute{Name: "rate", DerivativeOf: attrName1, PersistState: true})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(10, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		id          string
+		req         string
+		contentType string
+		auth        string
+		status      int
+	}{
+		{
+			desc:        "backfill derived attribute",
+			id:          tw.ID,
+			req:         toJSON(map[string]string{"attribute": "rate"}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "backfill attribute that is not derived",
+			id:          tw.ID,
+			req:         toJSON(map[string]string{"attribute": attrName1}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "backfill without attribute",
+			id:          tw.ID,
+			req:         toJSON(map[string]string{}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "backfill derived attribute of non-existent twin",
+			id:          "missing",
+			req:         toJSON(map[string]string{"attribute": "rate"}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusNotFound,
+		},
+		{
+			desc:        "backfill derived attribute without content type",
+			id:          tw.ID,
+			req:         toJSON(map[string]string{"attribute": "rate"}),
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "backfill derived attribute with invalid token",
+			id:          tw.ID,
+			req:         toJSON(map[string]string{"attribute": "rate"}),
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/states/%s/backfill", ts.URL, tc.id),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestLatestAttributeValues(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		req         string
+		contentType string
+		auth        string
+		status      int
+		ids         []string
+		errors      map[string]string
+	}{
+		{
+			desc:        "retrieve latest values",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}, "attribute": attrName1}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			ids:         []string{tw.ID},
+		},
+		{
+			desc:        "retrieve latest values of attribute without values",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}, "attribute": attrName2}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "retrieve latest values with missing twin",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID, "missing"}, "attribute": attrName1}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			ids:         []string{tw.ID},
+			errors:      map[string]string{"missing": twins.ErrNotFound.Error()},
+		},
+		{
+			desc:        "retrieve latest values without ids",
+			req:         toJSON(map[string]interface{}{"ids": []string{}, "attribute": attrName1}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "retrieve latest values without attribute",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "retrieve latest values without content type",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}, "attribute": attrName1}),
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "retrieve latest values with invalid token",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}, "attribute": attrName1}),
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/states/latest", ts.URL),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Values map[string]struct {
+				Updated time.Time `json:"updated"`
+			} `json:"values"`
+			Errors map[string]string `json:"errors"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		var ids []string
+		for id, v := range body.Values {
+			ids = append(ids, id)
+			assert.False(t, v.Updated.IsZero(), fmt.Sprintf("%s: expected update time of twin %s", tc.desc, id))
+		}
+		assert.Equal(t, tc.ids, ids, fmt.Sprintf("%s: expected twins %v got %v", tc.desc, tc.ids, ids))
+		assert.Equal(t, tc.errors, body.Errors, fmt.Sprintf("%s: expected errors %v got %v", tc.desc, tc.errors, body.Errors))
+	}
+}
+
+func TestCurrentState(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].Smoothing = 0.25
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	empty, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, v := range []float64{10, 50} {
+		val := v
+		message, err := mocks.CreateMessage(def.Attributes[0], []senml.Record{{BaseName: attrName1, Value: &val}})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc   string
+		url    string
+		auth   string
+		status int
+		value  float64
+	}{
+		{
+			desc:   "get smoothed current state",
+			url:    fmt.Sprintf("%s/states/%s/current", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusOK,
+			value:  20,
+		},
+		{
+			desc:   "get current state of twin without states",
+			url:    fmt.Sprintf("%s/states/%s/current", ts.URL, empty.ID),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "get current state with invalid token",
+			url:    fmt.Sprintf("%s/states/%s/current", ts.URL, tw.ID),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "get current state with empty token",
+			url:    fmt.Sprintf("%s/states/%s/current", ts.URL, tw.ID),
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Payload map[string]float64 `json:"payload"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.value, body.Payload[attrName1], fmt.Sprintf("%s: expected value %v got %v", tc.desc, tc.value, body.Payload[attrName1]))
+	}
+}
+
+func TestStateAt(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	now := time.Now()
+	for i, v := range []float64{10, 50} {
+		val := v
+		created := now.Add(time.Duration(i-2) * time.Hour)
+		message, err := mocks.CreateMessage(def.Attributes[0], []senml.Record{{BaseName: attrName1, BaseTime: float64(created.Unix()), Value: &val}})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	url := fmt.Sprintf("%s/states/%s/snapshot", ts.URL, tw.ID)
+	cases := []struct {
+		desc   string
+		url    string
+		auth   string
+		status int
+		value  float64
+	}{
+		{
+			desc:   "get state at current time",
+			url:    fmt.Sprintf("%s?at=%s", url, now.UTC().Format(time.RFC3339)),
+			auth:   token,
+			status: http.StatusOK,
+			value:  50,
+		},
+		{
+			desc:   "get state between states",
+			url:    fmt.Sprintf("%s?at=%s", url, now.Add(-90*time.Minute).UTC().Format(time.RFC3339)),
+			auth:   token,
+			status: http.StatusOK,
+			value:  10,
+		},
+		{
+			desc:   "get state before first state",
+			url:    fmt.Sprintf("%s?at=%s", url, now.Add(-3*time.Hour).UTC().Format(time.RFC3339)),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "get state without time",
+			url:    url,
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "get state with invalid time",
+			url:    fmt.Sprintf("%s?at=%s", url, wrongValue),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "get state with invalid token",
+			url:    fmt.Sprintf("%s?at=%s", url, now.UTC().Format(time.RFC3339)),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Payload map[string]float64 `json:"payload"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.value, body.Payload[attrName1], fmt.Sprintf("%s: expected value %v got %v", tc.desc, tc.value, body.Payload[attrName1]))
+	}
+}
+
+func TestStreamExportStates(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	n := 10
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(n, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		id          string
+		auth        string
+		status      int
+		contentType string
+		lines       int
+	}{
+		{
+			desc:        "export states",
+			id:          tw.ID,
+			auth:        token,
+			status:      http.StatusOK,
+			contentType: "application/x-ndjson",
+			lines:       n,
+		},
+		{
+			desc:        "export states of non-existent twin",
+			id:          "wrong",
+			auth:        token,
+			status:      http.StatusNotFound,
+			contentType: contentType,
+		},
+		{
+			desc:        "export states with invalid token",
+			id:          tw.ID,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+			contentType: contentType,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/states/%s/export", ts.URL, tc.id),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		ct := res.Header.Get("Content-Type")
+		assert.Equal(t, tc.contentType, ct, fmt.Sprintf("%s: expected content type %s got %s", tc.desc, tc.contentType, ct))
+
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		lines := 0
+		dec := json.NewDecoder(res.Body)
+		for dec.More() {
+			var st stateRes
+			require.Nil(t, dec.Decode(&st), fmt.Sprintf("%s: unexpected error decoding state", tc.desc))
+			lines++
+		}
+		assert.Equal(t, tc.lines, lines, fmt.Sprintf("%s: expected %d states got %d", tc.desc, tc.lines, lines))
+	}
+}
+
+func TestAnnotateState(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	note := `{"note": "sensor recalibrated"}`
+	cases := []struct {
+		desc        string
+		method      string
+		url         string
+		req         string
+		contentType string
+		auth        string
+		status      int
+		note        string
+	}{
+		{
+			desc:        "annotate state",
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/states/%s/0/note", ts.URL, tw.ID),
+			req:         note,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			note:        "sensor recalibrated",
+		},
+		{
+			desc:        "annotate state with empty note",
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/states/%s/0/note", ts.URL, tw.ID),
+			req:         `{"note": ""}`,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+			note:        "sensor recalibrated",
+		},
+		{
+			desc:        "annotate state with invalid state id",
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/states/%s/invalid/note", ts.URL, tw.ID),
+			req:         note,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+			note:        "sensor recalibrated",
+		},
+		{
+			desc:        "annotate non-existent state",
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/states/%s/10/note", ts.URL, tw.ID),
+			req:         note,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusNotFound,
+			note:        "sensor recalibrated",
+		},
+		{
+			desc:        "annotate state without content type",
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/states/%s/0/note", ts.URL, tw.ID),
+			req:         note,
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+			note:        "sensor recalibrated",
+		},
+		{
+			desc:        "annotate state with invalid token",
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/states/%s/0/note", ts.URL, tw.ID),
+			req:         note,
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+			note:        "sensor recalibrated",
+		},
+		{
+			desc:   "remove state note",
+			method: http.MethodDelete,
+			url:    fmt.Sprintf("%s/states/%s/0/note", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusNoContent,
+			note:   "",
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      tc.method,
+			url:         tc.url,
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.note, page.States[0].Note, fmt.Sprintf("%s: expected note %q got %q", tc.desc, tc.note, page.States[0].Note))
+	}
+}
+
+func TestStatesHistogram(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	from := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	recs := mocks.CreateSenML(10, attrName1)
+	for i := range recs {
+		recs[i].BaseTime = float64(from.Unix())
+	}
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	baseURL := fmt.Sprintf("%s/states/%s/histogram", ts.URL, tw.ID)
+	start := from.Format(time.RFC3339)
+	end := from.Add(10 * time.Second).Format(time.RFC3339)
+	cases := []struct {
+		desc   string
+		auth   string
+		status int
+		url    string
+		counts []uint64
+	}{
+		{
+			desc:   "get states histogram",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?bucket=5s&from=%s&to=%s", baseURL, start, end),
+			counts: []uint64{5, 5},
+		},
+		{
+			desc:   "get states histogram with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+			url:    fmt.Sprintf("%s?bucket=5s&from=%s&to=%s", baseURL, start, end),
+		},
+		{
+			desc:   "get states histogram without bucket",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?from=%s&to=%s", baseURL, start, end),
+		},
+		{
+			desc:   "get states histogram with invalid bucket",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?bucket=invalid&from=%s&to=%s", baseURL, start, end),
+		},
+		{
+			desc:   "get states histogram without time range",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?bucket=5s", baseURL),
+		},
+		{
+			desc:   "get states histogram with invalid time",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?bucket=5s&from=invalid&to=%s", baseURL, end),
+		},
+		{
+			desc:   "get daily states histogram in time zone",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?bucket=24h&from=%s&to=%s&tz=America/New_York", baseURL, start, end),
+			counts: []uint64{10},
+		},
+		{
+			desc:   "get states histogram with invalid time zone",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?bucket=24h&from=%s&to=%s&tz=invalid", baseURL, start, end),
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Buckets []struct {
+				Count uint64 `json:"count"`
+			} `json:"buckets"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		var counts []uint64
+		for _, b := range body.Buckets {
+			counts = append(counts, b.Count)
+		}
+		assert.Equal(t, tc.counts, counts, fmt.Sprintf("%s: expected counts %v got %v", tc.desc, tc.counts, counts))
+	}
+}
+
+func TestStatePartitions(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	from := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	recs := mocks.CreateSenML(3, attrName1)
+	for i := range recs {
+		recs[i].BaseTime = float64(from.Unix())
+		recs[i].Time = float64(i * 24 * 60 * 60)
+	}
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	baseURL := fmt.Sprintf("%s/states/%s/partitions", ts.URL, tw.ID)
+	cases := []struct {
+		desc   string
+		auth   string
+		status int
+		url    string
+		counts []uint64
+	}{
+		{
+			desc:   "get state partitions",
+			auth:   token,
+			status: http.StatusOK,
+			url:    baseURL,
+			counts: []uint64{1, 1, 1},
+		},
+		{
+			desc:   "get monthly state partitions",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?granularity=month", baseURL),
+			counts: []uint64{3},
+		},
+		{
+			desc:   "get monthly state partitions in time zone",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?granularity=month&tz=America/New_York", baseURL),
+			counts: []uint64{1, 2},
+		},
+		{
+			desc:   "get state partitions with invalid time zone",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?tz=Local", baseURL),
+		},
+		{
+			desc:   "get state partitions with invalid granularity",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?granularity=invalid", baseURL),
+		},
+		{
+			desc:   "get state partitions with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+			url:    baseURL,
+		},
+		{
+			desc:   "get state partitions of non-existent twin",
+			auth:   token,
+			status: http.StatusNotFound,
+			url:    fmt.Sprintf("%s/states/%s/partitions", ts.URL, "wrong"),
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Partitions []struct {
+				Count uint64 `json:"count"`
+			} `json:"partitions"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		var counts []uint64
+		for _, p := range body.Partitions {
+			counts = append(counts, p.Count)
+		}
+		assert.Equal(t, tc.counts, counts, fmt.Sprintf("%s: expected counts %v got %v", tc.desc, tc.counts, counts))
+	}
+}
+
+func TestFindStates(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, v := range []float64{80, 95, 100} {
+		val := v
+		message, err := mocks.CreateMessage(def.Attributes[0], []senml.Record{{BaseName: attrName1, Value: &val}})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	baseURL := fmt.Sprintf("%s/states/%s/search", ts.URL, tw.ID)
+	cases := []struct {
+		desc   string
+		auth   string
+		status int
+		url    string
+		total  uint64
+	}{
+		{
+			desc:   "find states",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?attribute=%s&op=gt&value=90", baseURL, attrName1),
+			total:  2,
+		},
+		{
+			desc:   "find states with equal value",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf("%s?attribute=%s&op=eq&value=80", baseURL, attrName1),
+			total:  1,
+		},
+		{
+			desc:   "find states with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+			url:    fmt.Sprintf("%s?attribute=%s&op=gt&value=90", baseURL, attrName1),
+		},
+		{
+			desc:   "find states without attribute",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?op=gt&value=90", baseURL),
+		},
+		{
+			desc:   "find states with invalid operator",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?attribute=%s&op=ne&value=90", baseURL, attrName1),
+		},
+		{
+			desc:   "find states without value",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?attribute=%s&op=gt", baseURL, attrName1),
+		},
+		{
+			desc:   "find states with invalid limit",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf("%s?attribute=%s&op=gt&value=90&limit=0", baseURL, attrName1),
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body statesPageRes
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.total, body.Total, fmt.Sprintf("%s: expected total %d got %d", tc.desc, tc.total, body.Total))
+		assert.Equal(t, int(tc.total), len(body.States), fmt.Sprintf("%s: expected %d states got %d", tc.desc, tc.total, len(body.States)))
 	}
 }
 
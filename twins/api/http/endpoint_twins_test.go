@@ -4,6 +4,7 @@
 package http_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -13,7 +14,9 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/mainflux/mainflux/pkg/uuid"
 	"github.com/mainflux/mainflux/twins"
 	httpapi "github.com/mainflux/mainflux/twins/api/http"
@@ -67,6 +70,7 @@ type testRequest struct {
 	url         string
 	contentType string
 	token       string
+	lockToken   string
 	body        io.Reader
 }
 
@@ -81,6 +85,9 @@ func (tr testRequest) make() (*http.Response, error) {
 	if tr.contentType != "" {
 		req.Header.Set("Content-Type", tr.contentType)
 	}
+	if tr.lockToken != "" {
+		req.Header.Set("X-Lock-Token", tr.lockToken)
+	}
 	return tr.client.Do(req)
 }
 
@@ -91,7 +98,7 @@ func newService(tokens map[string]string) twins.Service {
 	subs := map[string]string{"chanID": "chanID"}
 	broker := mocks.NewBroker(subs)
 	uuidProvider := uuid.NewMock()
-	return twins.New(broker, auth, twinsRepo, statesRepo, uuidProvider, "chanID", nil)
+	return twins.New(broker, auth, twinsRepo, statesRepo, uuidProvider, "chanID", twins.Config{}, nil)
 }
 
 func newServer(svc twins.Service) *httptest.Server {
@@ -224,6 +231,25 @@ func TestUpdateTwin(t *testing.T) {
 	tw.Name = invalidName
 	invalidData := toJSON(tw)
 
+	ctw, err := svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"state": "idle"}}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	conditionalData := toJSON(map[string]interface{}{
+		"metadata":    map[string]interface{}{"state": "running"},
+		"if_metadata": map[string]interface{}{"state": "idle"},
+	})
+	conditionalDefData := toJSON(map[string]interface{}{
+		"definition":  mocks.CreateDefinition([]string{"temperature"}, []string{"engine"}),
+		"if_metadata": map[string]interface{}{"state": "running"},
+	})
+
+	derivedDef := mocks.CreateDefinition([]string{"temperature", "rate"}, []string{"engine", "engine-rate"})
+	derivedDef.Attributes[1].DerivativeOf = "temperature"
+	dtw, err := svc.AddTwin(context.Background(), token, twins.Twin{}, derivedDef)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	dependentData := toJSON(map[string]interface{}{
+		"definition": twins.Definition{Attributes: derivedDef.Attributes[1:]},
+	})
+
 	cases := []struct {
 		desc        string
 		req         string
@@ -303,6 +329,38 @@ func TestUpdateTwin(t *testing.T) {
 			auth:        token,
 			status:      http.StatusBadRequest,
 		},
+		{
+			desc:        "update twin with met metadata conditions",
+			req:         conditionalData,
+			id:          ctw.ID,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "update twin with unmet metadata conditions",
+			req:         conditionalData,
+			id:          ctw.ID,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusUnprocessableEntity,
+		},
+		{
+			desc:        "update twin definition with metadata conditions",
+			req:         conditionalDefData,
+			id:          ctw.ID,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "update twin definition removing attribute with dependents",
+			req:         dependentData,
+			id:          dtw.ID,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusConflict,
+		},
 	}
 
 	for _, tc := range cases {
@@ -320,6 +378,280 @@ func TestUpdateTwin(t *testing.T) {
 	}
 }
 
+func TestTwinFeatures(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	stw, err := svc.AddTwin(context.Background(), token, twins.Twin{Features: map[string]bool{twins.FeatureSmoothing: false}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc     string
+		req      string
+		status   int
+		features map[string]bool
+	}{
+		{
+			desc:     "update twin features",
+			req:      `{"features":{"rounding":false,"raw_senml":true}}`,
+			status:   http.StatusOK,
+			features: map[string]bool{twins.FeatureRounding: false, twins.FeatureRawSenML: true},
+		},
+		{
+			desc:     "update twin with unknown feature",
+			req:      `{"features":{"unknown":true}}`,
+			status:   http.StatusOK,
+			features: map[string]bool{"unknown": true},
+		},
+		{
+			desc:     "update twin with invalid features",
+			req:      `{"features":{"smoothing":"off"}}`,
+			status:   http.StatusBadRequest,
+			features: map[string]bool{"unknown": true},
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/twins/%s", ts.URL, stw.ID),
+			contentType: contentType,
+			token:       token,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		req = testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/twins/%s", ts.URL, stw.ID),
+			token:  token,
+		}
+		res, err = req.make()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		var body struct {
+			Features map[string]bool `json:"features"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.features, body.Features, fmt.Sprintf("%s: expected features %v got %v", tc.desc, tc.features, body.Features))
+	}
+}
+
+func TestUpdateTwinsMetadata(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	n := 3
+	twin := twins.Twin{Metadata: map[string]interface{}{"model": "sensor"}}
+	for i := 0; i < n; i++ {
+		_, err := svc.AddTwin(context.Background(), token, twin, twins.Definition{})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	data := toJSON(map[string]interface{}{
+		"filter": map[string]interface{}{"model": "sensor"},
+		"patch":  map[string]interface{}{"firmware": "v2"},
+	})
+	emptyFilter := toJSON(map[string]interface{}{
+		"patch": map[string]interface{}{"firmware": "v2"},
+	})
+
+	cases := []struct {
+		desc        string
+		req         string
+		contentType string
+		auth        string
+		status      int
+		updated     uint64
+	}{
+		{
+			desc:        "update metadata of matching twins",
+			req:         data,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			updated:     uint64(n),
+		},
+		{
+			desc:        "update metadata with empty filter",
+			req:         emptyFilter,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "update metadata with invalid user token",
+			req:         data,
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "update metadata with invalid data format",
+			req:         "{",
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "update metadata without content type",
+			req:         data,
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPatch,
+			url:         fmt.Sprintf("%s/twins", ts.URL),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Updated uint64 `json:"updated"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.updated, body.Updated, fmt.Sprintf("%s: expected %d updated twins got %d", tc.desc, tc.updated, body.Updated))
+	}
+}
+
+func TestMigrateDefinitions(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	n := 3
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	twin := twins.Twin{Metadata: map[string]interface{}{"model": "sensor"}}
+	for i := 0; i < n; i++ {
+		_, err := svc.AddTwin(context.Background(), token, twin, def)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	data := toJSON(map[string]interface{}{
+		"filter": map[string]interface{}{"model": "sensor"},
+		"steps": []map[string]interface{}{
+			{"op": "rename", "attribute": "temperature", "to": "temp"},
+			{"op": "change_unit", "attribute": "temp", "to": "F", "scale": 1.8, "offset": 32},
+		},
+	})
+	unknownAttr := toJSON(map[string]interface{}{
+		"filter": map[string]interface{}{"model": "sensor"},
+		"steps": []map[string]interface{}{
+			{"op": "rename", "attribute": "pressure", "to": "p"},
+		},
+	})
+	invalidOp := toJSON(map[string]interface{}{
+		"filter": map[string]interface{}{"model": "sensor"},
+		"steps": []map[string]interface{}{
+			{"op": "drop", "attribute": "temp"},
+		},
+	})
+	emptyFilter := toJSON(map[string]interface{}{
+		"steps": []map[string]interface{}{
+			{"op": "rename", "attribute": "temp", "to": "t"},
+		},
+	})
+
+	cases := []struct {
+		desc        string
+		req         string
+		contentType string
+		auth        string
+		status      int
+		migrated    int
+		failed      int
+	}{
+		{
+			desc:        "migrate definitions of matching twins",
+			req:         data,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			migrated:    n,
+		},
+		{
+			desc:        "migrate definitions with unknown attribute",
+			req:         unknownAttr,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			failed:      n,
+		},
+		{
+			desc:        "migrate definitions with invalid operation",
+			req:         invalidOp,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "migrate definitions with empty filter",
+			req:         emptyFilter,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "migrate definitions with invalid user token",
+			req:         data,
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "migrate definitions with invalid data format",
+			req:         "{",
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "migrate definitions without content type",
+			req:         data,
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/twins/migrate", ts.URL),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Migrated []string          `json:"migrated"`
+			Failed   map[string]string `json:"failed"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.migrated, len(body.Migrated), fmt.Sprintf("%s: expected %d migrated twins got %d", tc.desc, tc.migrated, len(body.Migrated)))
+		assert.Equal(t, tc.failed, len(body.Failed), fmt.Sprintf("%s: expected %d failed twins got %d", tc.desc, tc.failed, len(body.Failed)))
+	}
+}
+
 func TestViewTwin(t *testing.T) {
 	svc := mocks.NewService(map[string]string{token: email})
 	ts := newServer(svc)
@@ -399,85 +731,372 @@ func TestViewTwin(t *testing.T) {
 	}
 }
 
-func TestListTwins(t *testing.T) {
+func TestViewTwinByMetadata(t *testing.T) {
 	svc := mocks.NewService(map[string]string{token: email})
 	ts := newServer(svc)
 	defer ts.Close()
 
-	var data []twinRes
-	for i := 0; i < 100; i++ {
-		name := fmt.Sprintf("%s-%d", twinName, i)
-		twin := twins.Twin{
-			Owner: email,
-			Name:  name,
-		}
-		tw, err := svc.AddTwin(context.Background(), token, twin, twins.Definition{})
-		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
-		twres := twinRes{
-			Owner:    tw.Owner,
-			ID:       tw.ID,
-			Name:     tw.Name,
-			Revision: tw.Revision,
-			Metadata: tw.Metadata,
-		}
-		data = append(data, twres)
-	}
+	stw, err := svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"serial": "SN-1", "rack": 1}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"serial": "SN-2", "line": "a"}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"serial": "SN-3", "line": "a"}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
 
-	baseURL := fmt.Sprintf("%s/twins", ts.URL)
-	queryFmt := "%s?offset=%d&limit=%d"
 	cases := []struct {
 		desc   string
+		query  string
 		auth   string
 		status int
-		url    string
-		res    []twinRes
+		id     string
 	}{
 		{
-			desc:   "get a list of twins",
+			desc:   "view twin by unique metadata value",
+			query:  "key=serial&value=SN-1",
 			auth:   token,
 			status: http.StatusOK,
-			url:    baseURL,
-			res:    data[0:10],
-		},
-		{
-			desc:   "get a list of twins with invalid token",
-			auth:   wrongValue,
-			status: http.StatusForbidden,
-			url:    fmt.Sprintf(queryFmt, baseURL, 0, 1),
-			res:    nil,
-		},
-		{
-			desc:   "get a list of twins with empty token",
-			auth:   "",
-			status: http.StatusForbidden,
-			url:    fmt.Sprintf(queryFmt, baseURL, 0, 1),
-			res:    nil,
+			id:     stw.ID,
 		},
 		{
-			desc:   "get a list of twins with valid offset and limit",
+			desc:   "view twin by metadata value shared by many twins",
+			query:  "key=line&value=a",
 			auth:   token,
-			status: http.StatusOK,
-			url:    fmt.Sprintf(queryFmt, baseURL, 25, 40),
-			res:    data[25:65],
+			status: http.StatusUnprocessableEntity,
 		},
 		{
-			desc:   "get a list of twins with offset + limit > total",
+			desc:   "view twin by non-existent metadata value",
+			query:  "key=serial&value=SN-4",
 			auth:   token,
-			status: http.StatusOK,
-			url:    fmt.Sprintf(queryFmt, baseURL, 91, 20),
-			res:    data[91:],
+			status: http.StatusNotFound,
 		},
 		{
-			desc:   "get a list of twins with negative offset",
+			desc:   "view twin without metadata key",
+			query:  "value=SN-1",
 			auth:   token,
 			status: http.StatusBadRequest,
-			url:    fmt.Sprintf(queryFmt, baseURL, -1, 5),
-			res:    nil,
 		},
 		{
-			desc:   "get a list of twins with negative limit",
-			auth:   token,
-			status: http.StatusBadRequest,
+			desc:   "view twin by metadata with invalid token",
+			query:  "key=serial&value=SN-1",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/twins/search?%s", ts.URL, tc.query),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var resData twinRes
+		json.NewDecoder(res.Body).Decode(&resData)
+		assert.Equal(t, tc.id, resData.ID, fmt.Sprintf("%s: expected twin %s got %s", tc.desc, tc.id, resData.ID))
+	}
+}
+
+func TestViewTwinByThing(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	stw, err := svc.AddTwin(context.Background(), token, twins.Twin{ThingID: "thing-1"}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{ThingID: "thing-2"}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{ThingID: "thing-2"}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc    string
+		thingID string
+		auth    string
+		status  int
+		id      string
+	}{
+		{
+			desc:    "view twin by thing",
+			thingID: "thing-1",
+			auth:    token,
+			status:  http.StatusOK,
+			id:      stw.ID,
+		},
+		{
+			desc:    "view twin by thing linked to many twins",
+			thingID: "thing-2",
+			auth:    token,
+			status:  http.StatusUnprocessableEntity,
+		},
+		{
+			desc:    "view twin by non-linked thing",
+			thingID: "thing-3",
+			auth:    token,
+			status:  http.StatusNotFound,
+		},
+		{
+			desc:    "view twin by thing with invalid token",
+			thingID: "thing-1",
+			auth:    wrongValue,
+			status:  http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/twins/things/%s", ts.URL, tc.thingID),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var resData twinRes
+		json.NewDecoder(res.Body).Decode(&resData)
+		assert.Equal(t, tc.id, resData.ID, fmt.Sprintf("%s: expected twin %s got %s", tc.desc, tc.id, resData.ID))
+	}
+}
+
+func TestTwinStatus(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	stw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	msg, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, "temperature"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(msg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		url    string
+		auth   string
+		status int
+	}{
+		{
+			desc:   "view status of existing twin",
+			url:    fmt.Sprintf("%s/twins/%s/status", ts.URL, stw.ID),
+			auth:   token,
+			status: http.StatusOK,
+		},
+		{
+			desc:   "view status of non-existent twin",
+			url:    fmt.Sprintf("%s/twins/%s/status", ts.URL, strconv.FormatUint(wrongID, 10)),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "view status by passing invalid token",
+			url:    fmt.Sprintf("%s/twins/%s/status", ts.URL, stw.ID),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "list online twins",
+			url:    fmt.Sprintf("%s/twins?status=online", ts.URL),
+			auth:   token,
+			status: http.StatusOK,
+		},
+		{
+			desc:   "list offline twins",
+			url:    fmt.Sprintf("%s/twins?status=offline", ts.URL),
+			auth:   token,
+			status: http.StatusOK,
+		},
+		{
+			desc:   "list twins with invalid status",
+			url:    fmt.Sprintf("%s/twins?status=%s", ts.URL, wrongValue),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestListTwinsWithErrors(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	stw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, mocks.CreateDefinition([]string{"humidity"}, []string{"chassis"}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	msg, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, "temperature"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	msg.Payload = []byte("malformed")
+	_, err = svc.SaveStates(msg)
+	require.NotNil(t, err, "expected error saving malformed message")
+
+	cases := []struct {
+		desc   string
+		url    string
+		auth   string
+		status int
+		ids    []string
+	}{
+		{
+			desc:   "list twins with recent errors",
+			url:    fmt.Sprintf("%s/twins?error_within=1h", ts.URL),
+			auth:   token,
+			status: http.StatusOK,
+			ids:    []string{stw.ID},
+		},
+		{
+			desc:   "list twins with errors and status",
+			url:    fmt.Sprintf("%s/twins?error_within=1h&status=online", ts.URL),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "list twins with invalid error window",
+			url:    fmt.Sprintf("%s/twins?error_within=%s", ts.URL, wrongValue),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "list twins with negative error window",
+			url:    fmt.Sprintf("%s/twins?error_within=-1h", ts.URL),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "list twins with errors by passing invalid token",
+			url:    fmt.Sprintf("%s/twins?error_within=1h", ts.URL),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Twins []struct {
+				ID          string     `json:"id"`
+				LastError   string     `json:"last_error"`
+				LastErrorAt *time.Time `json:"last_error_at"`
+			} `json:"twins"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		var ids []string
+		for _, tw := range body.Twins {
+			assert.NotEmpty(t, tw.LastError, fmt.Sprintf("%s: expected last error of twin %s", tc.desc, tw.ID))
+			assert.NotNil(t, tw.LastErrorAt, fmt.Sprintf("%s: expected last error time of twin %s", tc.desc, tw.ID))
+			ids = append(ids, tw.ID)
+		}
+		assert.Equal(t, tc.ids, ids, fmt.Sprintf("%s: expected twins %v got %v", tc.desc, tc.ids, ids))
+	}
+}
+
+func TestListTwins(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	var data []twinRes
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("%s-%d", twinName, i)
+		twin := twins.Twin{
+			Owner: email,
+			Name:  name,
+		}
+		tw, err := svc.AddTwin(context.Background(), token, twin, twins.Definition{})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		twres := twinRes{
+			Owner:    tw.Owner,
+			ID:       tw.ID,
+			Name:     tw.Name,
+			Revision: tw.Revision,
+			Metadata: tw.Metadata,
+		}
+		data = append(data, twres)
+	}
+
+	baseURL := fmt.Sprintf("%s/twins", ts.URL)
+	queryFmt := "%s?offset=%d&limit=%d"
+	cases := []struct {
+		desc   string
+		auth   string
+		status int
+		url    string
+		res    []twinRes
+	}{
+		{
+			desc:   "get a list of twins",
+			auth:   token,
+			status: http.StatusOK,
+			url:    baseURL,
+			res:    data[0:10],
+		},
+		{
+			desc:   "get a list of twins with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+			url:    fmt.Sprintf(queryFmt, baseURL, 0, 1),
+			res:    nil,
+		},
+		{
+			desc:   "get a list of twins with empty token",
+			auth:   "",
+			status: http.StatusForbidden,
+			url:    fmt.Sprintf(queryFmt, baseURL, 0, 1),
+			res:    nil,
+		},
+		{
+			desc:   "get a list of twins with valid offset and limit",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf(queryFmt, baseURL, 25, 40),
+			res:    data[25:65],
+		},
+		{
+			desc:   "get a list of twins with offset + limit > total",
+			auth:   token,
+			status: http.StatusOK,
+			url:    fmt.Sprintf(queryFmt, baseURL, 91, 20),
+			res:    data[91:],
+		},
+		{
+			desc:   "get a list of twins with negative offset",
+			auth:   token,
+			status: http.StatusBadRequest,
+			url:    fmt.Sprintf(queryFmt, baseURL, -1, 5),
+			res:    nil,
+		},
+		{
+			desc:   "get a list of twins with negative limit",
+			auth:   token,
+			status: http.StatusBadRequest,
 			url:    fmt.Sprintf(queryFmt, baseURL, 1, -5),
 			res:    nil,
 		},
@@ -574,34 +1193,125 @@ func TestListTwins(t *testing.T) {
 	}
 }
 
-func TestRemoveTwin(t *testing.T) {
+func TestListTwinsDefinitions(t *testing.T) {
 	svc := mocks.NewService(map[string]string{token: email})
 	ts := newServer(svc)
 	defer ts.Close()
 
-	def := twins.Definition{}
-	twin := twins.Twin{}
-	stw, err := svc.AddTwin(context.Background(), token, twin, def)
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID}, def)
 	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
 
 	cases := []struct {
-		desc   string
-		id     string
-		auth   string
-		status int
+		desc        string
+		url         string
+		status      int
+		definitions int
 	}{
 		{
-			desc:   "delete existing twin",
-			id:     stw.ID,
-			auth:   token,
-			status: http.StatusNoContent,
+			desc:        "get a list of twins",
+			url:         fmt.Sprintf("%s/twins", ts.URL),
+			status:      http.StatusOK,
+			definitions: 2,
 		},
 		{
-			desc:   "delete non-existent twin",
-			id:     strconv.FormatUint(wrongID, 10),
+			desc:        "get a list of twins with definitions",
+			url:         fmt.Sprintf("%s/twins?definitions=true", ts.URL),
+			status:      http.StatusOK,
+			definitions: 2,
+		},
+		{
+			desc:        "get a list of twins without definitions",
+			url:         fmt.Sprintf("%s/twins?definitions=false", ts.URL),
+			status:      http.StatusOK,
+			definitions: 0,
+		},
+		{
+			desc:   "get a list of twins with invalid definitions flag",
+			url:    fmt.Sprintf("%s/twins?definitions=invalid", ts.URL),
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  token,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Twins []struct {
+				Definitions []twins.Definition `json:"definitions"`
+			} `json:"twins"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		definitions := 0
+		for _, tw := range body.Twins {
+			definitions += len(tw.Definitions)
+		}
+		assert.Equal(t, tc.definitions, definitions, fmt.Sprintf("%s: expected %d definitions got %d", tc.desc, tc.definitions, definitions))
+	}
+}
+
+func TestRemoveTwin(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := twins.Definition{}
+	twin := twins.Twin{}
+	stw, err := svc.AddTwin(context.Background(), token, twin, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	ctw, err := svc.AddTwin(context.Background(), token, twin, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		id     string
+		query  string
+		auth   string
+		status int
+	}{
+		{
+			desc:   "delete existing twin",
+			id:     stw.ID,
+			auth:   token,
+			status: http.StatusNoContent,
+		},
+		{
+			desc:   "delete non-existent twin",
+			id:     strconv.FormatUint(wrongID, 10),
+			auth:   token,
+			status: http.StatusNoContent,
+		},
+		{
+			desc:   "delete twin with invalid cascade",
+			id:     ctw.ID,
+			query:  "?cascade=invalid",
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "delete existing twin with states",
+			id:     ctw.ID,
+			query:  "?cascade=true",
 			auth:   token,
 			status: http.StatusNoContent,
 		},
+		{
+			desc:   "delete non-existent twin with states",
+			id:     strconv.FormatUint(wrongID, 10),
+			query:  "?cascade=true",
+			auth:   token,
+			status: http.StatusNotFound,
+		},
 		{
 			desc:   "delete twin by passing empty id",
 			id:     "",
@@ -626,11 +1336,1727 @@ func TestRemoveTwin(t *testing.T) {
 		req := testRequest{
 			client: ts.Client(),
 			method: http.MethodDelete,
-			url:    fmt.Sprintf("%s/twins/%s", ts.URL, tc.id),
+			url:    fmt.Sprintf("%s/twins/%s%s", ts.URL, tc.id, tc.query),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestArchiveTwin(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{Archive: mocks.NewArchiveStore()}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc     string
+		action   string
+		auth     string
+		status   int
+		location string
+	}{
+		{
+			desc:   "archive twin with invalid token",
+			action: "archive",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "archive twin",
+			action: "archive",
+			auth:   token,
+			status: http.StatusNoContent,
+		},
+		{
+			desc:   "archive archived twin",
+			action: "archive",
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:     "restore archived twin",
+			action:   "restore",
+			auth:     token,
+			status:   http.StatusCreated,
+			location: fmt.Sprintf("/twins/%s", tw.ID),
+		},
+		{
+			desc:   "restore restored twin",
+			action: "restore",
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "restore twin with empty token",
+			action: "restore",
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodPost,
+			url:    fmt.Sprintf("%s/twins/%s/%s", ts.URL, tw.ID, tc.action),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		location := res.Header.Get("Location")
+		assert.Equal(t, tc.location, location, fmt.Sprintf("%s: expected location %s got %s", tc.desc, tc.location, location))
+	}
+
+	svc = newService(map[string]string{token: email})
+	ts = newServer(svc)
+	defer ts.Close()
+
+	req := testRequest{
+		client: ts.Client(),
+		method: http.MethodPost,
+		url:    fmt.Sprintf("%s/twins/%s/archive", ts.URL, tw.ID),
+		token:  token,
+	}
+	res, err := req.make()
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	assert.Equal(t, http.StatusNotImplemented, res.StatusCode, fmt.Sprintf("archive twin without archive store: expected status code %d got %d", http.StatusNotImplemented, res.StatusCode))
+}
+
+func TestServiceStats(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc     string
+		auth     string
+		status   int
+		twins    uint64
+		channels uint64
+	}{
+		{
+			desc:     "retrieve stats as admin",
+			auth:     adminToken,
+			status:   http.StatusOK,
+			twins:    1,
+			channels: 1,
+		},
+		{
+			desc:   "retrieve stats as regular user",
+			auth:   token,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "retrieve stats with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "retrieve stats with empty token",
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/stats", ts.URL),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Twins    uint64 `json:"twins"`
+			Channels uint64 `json:"channels"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.twins, body.Twins, fmt.Sprintf("%s: expected %d twins got %d", tc.desc, tc.twins, body.Twins))
+		assert.Equal(t, tc.channels, body.Channels, fmt.Sprintf("%s: expected %d channels got %d", tc.desc, tc.channels, body.Channels))
+	}
+}
+
+func TestSetOwnerQuota(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	data := toJSON(map[string]uint64{"max_states": 100})
+
+	cases := []struct {
+		desc        string
+		auth        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{
+			desc:        "set quota as admin",
+			auth:        adminToken,
+			contentType: contentType,
+			body:        data,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "set quota as regular user",
+			auth:        token,
+			contentType: contentType,
+			body:        data,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "set quota with invalid token",
+			auth:        wrongValue,
+			contentType: contentType,
+			body:        data,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "set quota with invalid request format",
+			auth:        adminToken,
+			contentType: contentType,
+			body:        "}",
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "set quota without content type",
+			auth:        adminToken,
+			contentType: "",
+			body:        data,
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/quotas/%s", ts.URL, email),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.body),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestOwnerUsage(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	err := svc.SetOwnerQuota(context.Background(), adminToken, email, 100)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		auth   string
+		owner  string
+		status int
+		max    uint64
+	}{
+		{
+			desc:   "retrieve usage as owner",
+			auth:   token,
+			owner:  email,
+			status: http.StatusOK,
+			max:    100,
+		},
+		{
+			desc:   "retrieve usage as admin",
+			auth:   adminToken,
+			owner:  email,
+			status: http.StatusOK,
+			max:    100,
+		},
+		{
+			desc:   "retrieve usage of other owner",
+			auth:   token,
+			owner:  adminEmail,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "retrieve usage with invalid token",
+			auth:   wrongValue,
+			owner:  email,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/quotas/%s", ts.URL, tc.owner),
 			token:  tc.auth,
 		}
 		res, err := req.make()
 		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
 		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			MaxStates uint64 `json:"max_states"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.max, body.MaxStates, fmt.Sprintf("%s: expected quota %d got %d", tc.desc, tc.max, body.MaxStates))
+	}
+}
+
+func TestSubscriptionInfo(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, "temperature"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc          string
+		auth          string
+		status        int
+		subscriptions int
+	}{
+		{
+			desc:          "retrieve subscription info as admin",
+			auth:          adminToken,
+			status:        http.StatusOK,
+			subscriptions: 1,
+		},
+		{
+			desc:   "retrieve subscription info as regular user",
+			auth:   token,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "retrieve subscription info with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "retrieve subscription info with empty token",
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/stats/subscriptions", ts.URL),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Subscriptions []struct {
+				Subject  string `json:"subject"`
+				Messages uint64 `json:"messages"`
+			} `json:"subscriptions"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Len(t, body.Subscriptions, tc.subscriptions, fmt.Sprintf("%s: expected %d subscriptions got %d", tc.desc, tc.subscriptions, len(body.Subscriptions)))
+	}
+}
+
+func TestListAllTwinIDs(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	n := 3
+	for i := 0; i < n; i++ {
+		_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc   string
+		auth   string
+		owner  string
+		status int
+		size   int
+	}{
+		{
+			desc:   "list own twin ids",
+			auth:   token,
+			status: http.StatusOK,
+			size:   n,
+		},
+		{
+			desc:   "list twin ids of other user as admin",
+			auth:   adminToken,
+			owner:  email,
+			status: http.StatusOK,
+			size:   n,
+		},
+		{
+			desc:   "list twin ids of other user as regular user",
+			auth:   token,
+			owner:  adminEmail,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "list twin ids with invalid token",
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "list twin ids with empty token",
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/twins/ids?owner=%s", ts.URL, tc.owner),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			IDs []string `json:"ids"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.size, len(body.IDs), fmt.Sprintf("%s: expected %d ids got %d", tc.desc, tc.size, len(body.IDs)))
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail, EventLogSize: 2}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	ts := newServer(svc)
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc   string
+		auth   string
+		from   string
+		status int
+		size   int
+	}{
+		{
+			desc:   "replay retained events",
+			auth:   adminToken,
+			from:   "2",
+			status: http.StatusOK,
+			size:   2,
+		},
+		{
+			desc:   "replay evicted events",
+			auth:   adminToken,
+			from:   "1",
+			status: http.StatusGone,
+		},
+		{
+			desc:   "replay events with invalid sequence",
+			auth:   adminToken,
+			from:   "invalid",
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "replay events as regular user",
+			auth:   token,
+			from:   "2",
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "replay events with empty token",
+			auth:   "",
+			from:   "2",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/events?from=%s", ts.URL, tc.from),
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Events []interface{} `json:"events"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.size, len(body.Events), fmt.Sprintf("%s: expected %d events got %d", tc.desc, tc.size, len(body.Events)))
+	}
+}
+
+func TestTwinChannelBinding(t *testing.T) {
+	svc := newService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	req := testRequest{
+		client:      ts.Client(),
+		method:      http.MethodPost,
+		url:         fmt.Sprintf("%s/twins", ts.URL),
+		contentType: contentType,
+		token:       token,
+		body:        strings.NewReader(toJSON(map[string]interface{}{"name": twinName, "channel_id": "chanID"})),
+	}
+	res, err := req.make()
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	require.Equal(t, http.StatusCreated, res.StatusCode, fmt.Sprintf("add bound twin: expected status code %d got %d", http.StatusCreated, res.StatusCode))
+
+	req = testRequest{
+		client: ts.Client(),
+		method: http.MethodGet,
+		url:    fmt.Sprintf("%s%s", ts.URL, res.Header.Get("Location")),
+		token:  token,
+	}
+	res, err = req.make()
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+
+	var body struct {
+		ChannelID string `json:"channel_id"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	assert.Equal(t, "chanID", body.ChannelID, fmt.Sprintf("view bound twin: expected channel %s got %s", "chanID", body.ChannelID))
+}
+
+func TestValidationErrors(t *testing.T) {
+	svc := newService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature", ""}, []string{"engine", "chassis"})
+	def.Attributes[0].MinInterval = -1
+
+	cases := []struct {
+		desc   string
+		body   string
+		status int
+		fields []string
+	}{
+		{
+			desc:   "add twin with invalid definition",
+			body:   toJSON(map[string]interface{}{"definition": def}),
+			status: http.StatusBadRequest,
+			fields: []string{"definition.attributes[0].min_interval", "definition.attributes[1].name"},
+		},
+		{
+			desc:   "add twin with too long name and negative heartbeat",
+			body:   toJSON(map[string]interface{}{"name": invalidName, "heartbeat": -1}),
+			status: http.StatusBadRequest,
+			fields: []string{"name", "heartbeat"},
+		},
+		{
+			desc:   "add valid twin",
+			body:   toJSON(map[string]interface{}{"name": twinName}),
+			status: http.StatusCreated,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/twins", ts.URL),
+			contentType: contentType,
+			token:       token,
+			body:        strings.NewReader(tc.body),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if tc.fields == nil {
+			continue
+		}
+
+		var body struct {
+			Fields []struct {
+				Field   string `json:"field"`
+				Message string `json:"message"`
+			} `json:"fields"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&body)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var fields []string
+		for _, f := range body.Fields {
+			fields = append(fields, f.Field)
+		}
+		assert.Equal(t, tc.fields, fields, fmt.Sprintf("%s: expected fields %v got %v", tc.desc, tc.fields, fields))
+	}
+}
+
+func TestAttributeDisplayHints(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	hints := twins.DisplayHints{Label: "Engine temperature", Chart: "line", Color: "#ff0000", Precision: 1}
+	def.Attributes[0].Display = &hints
+	invalid := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	invalid.Attributes[0].Display = &twins.DisplayHints{Precision: -1}
+
+	cases := []struct {
+		desc   string
+		def    twins.Definition
+		status int
+	}{
+		{
+			desc:   "add twin with display hints",
+			def:    def,
+			status: http.StatusCreated,
+		},
+		{
+			desc:   "add twin with negative display precision",
+			def:    invalid,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/twins", ts.URL),
+			contentType: contentType,
+			token:       token,
+			body:        strings.NewReader(toJSON(map[string]interface{}{"definition": tc.def})),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+
+	req := testRequest{
+		client: ts.Client(),
+		method: http.MethodGet,
+		url:    fmt.Sprintf("%s/twins/123e4567-e89b-12d3-a456-000000000001", ts.URL),
+		token:  token,
+	}
+	res, err := req.make()
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+
+	var body struct {
+		Definitions []twins.Definition `json:"definitions"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	require.Equal(t, 1, len(body.Definitions), fmt.Sprintf("view twin: expected %d definitions got %d", 1, len(body.Definitions)))
+	display := body.Definitions[0].Attributes[0].Display
+	assert.Equal(t, &hints, display, fmt.Sprintf("view twin: expected display hints %v got %v", &hints, display))
+}
+
+func TestLockTwin(t *testing.T) {
+	otherToken := "other-token"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: "other@example.com"})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	lock := toJSON(map[string]interface{}{"ttl": time.Minute})
+	zeroTTL := toJSON(map[string]interface{}{"ttl": 0})
+	update := toJSON(map[string]interface{}{"name": "updated"})
+
+	req := testRequest{
+		client:      ts.Client(),
+		method:      http.MethodPost,
+		url:         fmt.Sprintf("%s/twins/%s/lock", ts.URL, tw.ID),
+		contentType: contentType,
+		token:       token,
+		body:        strings.NewReader(lock),
+	}
+	res, err := req.make()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("lock twin: expected status code %d got %d", http.StatusOK, res.StatusCode))
+	var body struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.NotEmpty(t, body.Token, "lock twin: expected lock token")
+
+	cases := []struct {
+		desc        string
+		method      string
+		id          string
+		req         string
+		contentType string
+		auth        string
+		lockToken   string
+		status      int
+	}{
+		{
+			desc:        "extend lock with its token",
+			method:      http.MethodPost,
+			id:          tw.ID,
+			req:         lock,
+			contentType: contentType,
+			auth:        token,
+			lockToken:   body.Token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "lock locked twin without lock token",
+			method:      http.MethodPost,
+			id:          tw.ID,
+			req:         lock,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusLocked,
+		},
+		{
+			desc:        "lock locked twin by user not owning it",
+			method:      http.MethodPost,
+			id:          tw.ID,
+			req:         lock,
+			contentType: contentType,
+			auth:        otherToken,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "update locked twin without lock token",
+			method:      http.MethodPut,
+			id:          tw.ID,
+			req:         update,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusLocked,
+		},
+		{
+			desc:        "update locked twin with lock token",
+			method:      http.MethodPut,
+			id:          tw.ID,
+			req:         update,
+			contentType: contentType,
+			auth:        token,
+			lockToken:   body.Token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "update locked twin by user not owning it",
+			method:      http.MethodPut,
+			id:          tw.ID,
+			req:         update,
+			contentType: contentType,
+			auth:        otherToken,
+			lockToken:   body.Token,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "lock twin with zero ttl",
+			method:      http.MethodPost,
+			id:          tw.ID,
+			req:         zeroTTL,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "lock twin without content type",
+			method:      http.MethodPost,
+			id:          tw.ID,
+			req:         lock,
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "lock non-existent twin",
+			method:      http.MethodPost,
+			id:          strconv.FormatUint(wrongID, 10),
+			req:         lock,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusNotFound,
+		},
+		{
+			desc:        "lock twin with invalid token",
+			method:      http.MethodPost,
+			id:          tw.ID,
+			req:         lock,
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:      "unlock twin by user not owning it",
+			method:    http.MethodDelete,
+			id:        tw.ID,
+			auth:      otherToken,
+			lockToken: body.Token,
+			status:    http.StatusForbidden,
+		},
+		{
+			desc:   "unlock twin without lock token",
+			method: http.MethodDelete,
+			id:     tw.ID,
+			auth:   token,
+			status: http.StatusLocked,
+		},
+		{
+			desc:      "unlock twin with lock token",
+			method:    http.MethodDelete,
+			id:        tw.ID,
+			auth:      token,
+			lockToken: body.Token,
+			status:    http.StatusNoContent,
+		},
+	}
+
+	for _, tc := range cases {
+		url := fmt.Sprintf("%s/twins/%s/lock", ts.URL, tc.id)
+		if tc.method == http.MethodPut {
+			url = fmt.Sprintf("%s/twins/%s", ts.URL, tc.id)
+		}
+		req := testRequest{
+			client:      ts.Client(),
+			method:      tc.method,
+			url:         url,
+			contentType: tc.contentType,
+			token:       tc.auth,
+			lockToken:   tc.lockToken,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestLinkTwinInput(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	src, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, mocks.CreateDefinition([]string{attrName2}, []string{attrSubtopic2}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	input := toJSON(map[string]interface{}{"attribute": attrName2, "source_twin_id": src.ID, "source_attribute": attrName1})
+
+	cases := []struct {
+		desc        string
+		id          string
+		req         string
+		contentType string
+		auth        string
+		status      int
+	}{
+		{
+			desc:        "link twin input",
+			id:          tw.ID,
+			req:         input,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "link twin input introducing cycle",
+			id:          src.ID,
+			req:         toJSON(map[string]interface{}{"attribute": attrName1, "source_twin_id": tw.ID, "source_attribute": attrName2}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "link twin input of unknown attribute",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"attribute": "unknown", "source_twin_id": src.ID, "source_attribute": attrName1}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "link twin input of source sum",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"attribute": attrName2, "source_twin_id": src.ID, "source_attribute": attrName1, "source_field": "sum"}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "link twin input of unknown source field",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"attribute": attrName2, "source_twin_id": src.ID, "source_attribute": attrName1, "source_field": "mean"}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "link twin input without source",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"attribute": attrName2}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "link twin input with invalid JSON",
+			id:          tw.ID,
+			req:         "{",
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "link twin input without content type",
+			id:          tw.ID,
+			req:         input,
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "link input of non-existent twin",
+			id:          strconv.FormatUint(wrongID, 10),
+			req:         input,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusNotFound,
+		},
+		{
+			desc:        "link twin input with invalid token",
+			id:          tw.ID,
+			req:         input,
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/twins/%s/inputs", ts.URL, tc.id),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestIssueTwinKey(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		id          string
+		req         string
+		contentType string
+		auth        string
+		status      int
+	}{
+		{
+			desc:        "issue read key",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"action": "read", "ttl": time.Minute}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusCreated,
+		},
+		{
+			desc:        "issue key with unknown action",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"action": "admin", "ttl": time.Minute}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "issue key with zero ttl",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"action": "read", "ttl": 0}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "issue key without content type",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"action": "read", "ttl": time.Minute}),
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "issue key with invalid token",
+			id:          tw.ID,
+			req:         toJSON(map[string]interface{}{"action": "read", "ttl": time.Minute}),
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "issue key for non-existent twin",
+			id:          strconv.FormatUint(wrongID, 10),
+			req:         toJSON(map[string]interface{}{"action": "read", "ttl": time.Minute}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/twins/%s/keys", ts.URL, tc.id),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+
+	req := testRequest{
+		client:      ts.Client(),
+		method:      http.MethodPost,
+		url:         fmt.Sprintf("%s/twins/%s/keys", ts.URL, tw.ID),
+		contentType: contentType,
+		token:       token,
+		body:        strings.NewReader(toJSON(map[string]interface{}{"action": "read", "ttl": time.Minute})),
+	}
+	res, err := req.make()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	var body struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	keyCases := []struct {
+		desc   string
+		method string
+		url    string
+		auth   string
+		status int
+	}{
+		{
+			desc:   "view twin with read key",
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/twins/%s", ts.URL, tw.ID),
+			auth:   body.Key,
+			status: http.StatusOK,
+		},
+		{
+			desc:   "revoke key with read key",
+			method: http.MethodDelete,
+			url:    fmt.Sprintf("%s/twins/%s/keys/%s", ts.URL, tw.ID, body.ID),
+			auth:   body.Key,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "revoke unknown key",
+			method: http.MethodDelete,
+			url:    fmt.Sprintf("%s/twins/%s/keys/%s", ts.URL, tw.ID, wrongValue),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "revoke key",
+			method: http.MethodDelete,
+			url:    fmt.Sprintf("%s/twins/%s/keys/%s", ts.URL, tw.ID, body.ID),
+			auth:   token,
+			status: http.StatusNoContent,
+		},
+		{
+			desc:   "view twin with revoked key",
+			method: http.MethodGet,
+			url:    fmt.Sprintf("%s/twins/%s", ts.URL, tw.ID),
+			auth:   body.Key,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range keyCases {
+		req := testRequest{
+			client: ts.Client(),
+			method: tc.method,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestViewTwins(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	missing := strconv.FormatUint(wrongID, 10)
+
+	cases := []struct {
+		desc        string
+		req         string
+		contentType string
+		auth        string
+		status      int
+		ids         []string
+		errors      map[string]string
+	}{
+		{
+			desc:        "view twins",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			ids:         []string{tw.ID},
+		},
+		{
+			desc:        "view twins with missing twin",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID, missing}}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+			ids:         []string{tw.ID},
+			errors:      map[string]string{missing: twins.ErrNotFound.Error()},
+		},
+		{
+			desc:        "view twins without ids",
+			req:         toJSON(map[string]interface{}{"ids": []string{}}),
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "view twins without content type",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}}),
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "view twins with invalid token",
+			req:         toJSON(map[string]interface{}{"ids": []string{tw.ID}}),
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/twins/view", ts.URL),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Twins []struct {
+				ID string `json:"id"`
+			} `json:"twins"`
+			Errors map[string]string `json:"errors"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		var ids []string
+		for _, tw := range body.Twins {
+			ids = append(ids, tw.ID)
+		}
+		assert.Equal(t, tc.ids, ids, fmt.Sprintf("%s: expected twins %v got %v", tc.desc, tc.ids, ids))
+		assert.Equal(t, tc.errors, body.Errors, fmt.Sprintf("%s: expected errors %v got %v", tc.desc, tc.errors, body.Errors))
+	}
+}
+
+func TestCoverageReport(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, "temperature"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	baseURL := fmt.Sprintf("%s/twins/%s/coverage", ts.URL, tw.ID)
+	cases := []struct {
+		desc     string
+		url      string
+		auth     string
+		status   int
+		coverage map[string]bool
+	}{
+		{
+			desc:     "get coverage report",
+			url:      fmt.Sprintf("%s?window=1h", baseURL),
+			auth:     token,
+			status:   http.StatusOK,
+			coverage: map[string]bool{"temperature": true},
+		},
+		{
+			desc:   "get coverage report without window",
+			url:    baseURL,
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "get coverage report with invalid window",
+			url:    fmt.Sprintf("%s?window=invalid", baseURL),
+			auth:   token,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "get coverage report with invalid token",
+			url:    fmt.Sprintf("%s?window=1h", baseURL),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "get coverage report of non-existent twin",
+			url:    fmt.Sprintf("%s/twins/%s/coverage?window=1h", ts.URL, strconv.FormatUint(wrongID, 10)),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Coverage map[string]bool `json:"coverage"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.coverage, body.Coverage, fmt.Sprintf("%s: expected coverage %v got %v", tc.desc, tc.coverage, body.Coverage))
+	}
+}
+
+func TestTwinHealth(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, "temperature"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		url    string
+		auth   string
+		status int
+		score  int
+	}{
+		{
+			desc:   "get twin health",
+			url:    fmt.Sprintf("%s/twins/%s/health", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusOK,
+			score:  100,
+		},
+		{
+			desc:   "get twin health with invalid token",
+			url:    fmt.Sprintf("%s/twins/%s/health", ts.URL, tw.ID),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "get twin health with empty token",
+			url:    fmt.Sprintf("%s/twins/%s/health", ts.URL, tw.ID),
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "get health of non-existent twin",
+			url:    fmt.Sprintf("%s/twins/%s/health", ts.URL, strconv.FormatUint(wrongID, 10)),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Score int `json:"score"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.score, body.Score, fmt.Sprintf("%s: expected score %d got %d", tc.desc, tc.score, body.Score))
+	}
+}
+
+func TestDescribeTwin(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"{room}/engine"})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Metadata: twins.Metadata{"room": "garage"}}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc       string
+		url        string
+		auth       string
+		status     int
+		attributes []twins.AttributeDescriptor
+	}{
+		{
+			desc:   "describe twin",
+			url:    fmt.Sprintf("%s/twins/%s/descriptor", ts.URL, tw.ID),
+			auth:   token,
+			status: http.StatusOK,
+			attributes: []twins.AttributeDescriptor{
+				{
+					Name:      "temperature",
+					Channel:   def.Attributes[0].Channel,
+					Subtopics: []string{"garage/engine"},
+				},
+			},
+		},
+		{
+			desc:   "describe twin with invalid token",
+			url:    fmt.Sprintf("%s/twins/%s/descriptor", ts.URL, tw.ID),
+			auth:   wrongValue,
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "describe twin with empty token",
+			url:    fmt.Sprintf("%s/twins/%s/descriptor", ts.URL, tw.ID),
+			auth:   "",
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "describe non-existent twin",
+			url:    fmt.Sprintf("%s/twins/%s/descriptor", ts.URL, strconv.FormatUint(wrongID, 10)),
+			auth:   token,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client: ts.Client(),
+			method: http.MethodGet,
+			url:    tc.url,
+			token:  tc.auth,
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Attributes []twins.AttributeDescriptor `json:"attributes"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.attributes, body.Attributes, fmt.Sprintf("%s: expected attributes %v got %v", tc.desc, tc.attributes, body.Attributes))
+	}
+}
+
+func TestSimulateIngestion(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	def := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	msg, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, "temperature"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	payload, err := proto.Marshal(msg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		url         string
+		payload     []byte
+		contentType string
+		auth        string
+		status      int
+		action      string
+	}{
+		{
+			desc:        "simulate ingestion",
+			url:         fmt.Sprintf("%s/twins/%s/simulate", ts.URL, tw.ID),
+			payload:     payload,
+			contentType: "application/octet-stream",
+			auth:        token,
+			status:      http.StatusOK,
+			action:      "saved",
+		},
+		{
+			desc:        "simulate ingestion of malformed message",
+			url:         fmt.Sprintf("%s/twins/%s/simulate", ts.URL, tw.ID),
+			payload:     []byte("malformed"),
+			contentType: "application/octet-stream",
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "simulate ingestion of empty message",
+			url:         fmt.Sprintf("%s/twins/%s/simulate", ts.URL, tw.ID),
+			payload:     []byte{},
+			contentType: "application/octet-stream",
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "simulate ingestion with invalid content type",
+			url:         fmt.Sprintf("%s/twins/%s/simulate", ts.URL, tw.ID),
+			payload:     payload,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "simulate ingestion with invalid token",
+			url:         fmt.Sprintf("%s/twins/%s/simulate", ts.URL, tw.ID),
+			payload:     payload,
+			contentType: "application/octet-stream",
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+		{
+			desc:        "simulate ingestion for non-existent twin",
+			url:         fmt.Sprintf("%s/twins/%s/simulate", ts.URL, strconv.FormatUint(wrongID, 10)),
+			payload:     payload,
+			contentType: "application/octet-stream",
+			auth:        token,
+			status:      http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         tc.url,
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        bytes.NewReader(tc.payload),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Records []struct {
+				Action string `json:"action"`
+			} `json:"records"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		var action string
+		if len(body.Records) > 0 {
+			action = body.Records[0].Action
+		}
+		assert.Equal(t, tc.action, action, fmt.Sprintf("%s: expected action %s got %s", tc.desc, tc.action, action))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc      string
+		url       string
+		requestID string
+		generated bool
+	}{
+		{
+			desc:      "propagate request ID",
+			url:       fmt.Sprintf("%s/twins/%s", ts.URL, tw.ID),
+			requestID: "request",
+		},
+		{
+			desc:      "generate request ID",
+			url:       fmt.Sprintf("%s/twins/%s", ts.URL, tw.ID),
+			generated: true,
+		},
+		{
+			desc:      "propagate request ID of failed request",
+			url:       fmt.Sprintf("%s/twins/%s", ts.URL, strconv.FormatUint(wrongID, 10)),
+			requestID: "request",
+		},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		req.Header.Set("Authorization", token)
+		if tc.requestID != "" {
+			req.Header.Set("X-Request-ID", tc.requestID)
+		}
+		res, err := ts.Client().Do(req)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		id := res.Header.Get("X-Request-ID")
+		if tc.generated {
+			assert.NotEmpty(t, id, fmt.Sprintf("%s: expected generated request ID", tc.desc))
+			continue
+		}
+		assert.Equal(t, tc.requestID, id, fmt.Sprintf("%s: expected request ID %s got %s", tc.desc, tc.requestID, id))
+	}
+}
+
+func TestSetMetadataSchema(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	valid := toJSON(map[string]interface{}{
+		"required": []string{"serial"},
+		"types":    map[string]string{"serial": "string"},
+	})
+	invalid := toJSON(map[string]interface{}{
+		"types": map[string]string{"serial": "text"},
+	})
+
+	cases := []struct {
+		desc        string
+		req         string
+		contentType string
+		auth        string
+		status      int
+	}{
+		{
+			desc:        "set valid schema",
+			req:         valid,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "set schema with unknown type",
+			req:         invalid,
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "set schema with invalid request format",
+			req:         "}",
+			contentType: contentType,
+			auth:        token,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "set schema without content type",
+			req:         valid,
+			contentType: "",
+			auth:        token,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "set schema with invalid auth token",
+			req:         valid,
+			contentType: contentType,
+			auth:        wrongValue,
+			status:      http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPut,
+			url:         fmt.Sprintf("%s/twins/schema", ts.URL),
+			contentType: tc.contentType,
+			token:       tc.auth,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+
+	req := testRequest{
+		client:      ts.Client(),
+		method:      http.MethodPost,
+		url:         fmt.Sprintf("%s/twins", ts.URL),
+		contentType: contentType,
+		token:       token,
+		body:        strings.NewReader("{}"),
+	}
+	res, err := req.make()
+	assert.Nil(t, err, fmt.Sprintf("add twin violating schema: unexpected error %s", err))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, fmt.Sprintf("add twin violating schema: expected status code %d got %d", http.StatusBadRequest, res.StatusCode))
+}
+
+func TestValidateDefinition(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	ts := newServer(svc)
+	defer ts.Close()
+
+	valid := mocks.CreateDefinition([]string{"temperature"}, []string{"engine"})
+	invalid := mocks.CreateDefinition([]string{"temperature", "temperature"}, []string{"engine", "chassis"})
+	invalid.Delta = -1
+
+	cases := []struct {
+		desc        string
+		req         string
+		contentType string
+		status      int
+		valid       bool
+		problems    int
+	}{
+		{
+			desc:        "validate valid definition",
+			req:         toJSON(map[string]interface{}{"definition": valid}),
+			contentType: contentType,
+			status:      http.StatusOK,
+			valid:       true,
+			problems:    0,
+		},
+		{
+			desc:        "validate invalid definition",
+			req:         toJSON(map[string]interface{}{"definition": invalid}),
+			contentType: contentType,
+			status:      http.StatusOK,
+			valid:       false,
+			problems:    2,
+		},
+		{
+			desc:        "validate definition with invalid request format",
+			req:         "}",
+			contentType: contentType,
+			status:      http.StatusBadRequest,
+		},
+		{
+			desc:        "validate definition without content type",
+			req:         toJSON(map[string]interface{}{"definition": valid}),
+			contentType: "",
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range cases {
+		req := testRequest{
+			client:      ts.Client(),
+			method:      http.MethodPost,
+			url:         fmt.Sprintf("%s/definitions/validate", ts.URL),
+			contentType: tc.contentType,
+			body:        strings.NewReader(tc.req),
+		}
+		res, err := req.make()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		var body struct {
+			Valid    bool     `json:"valid"`
+			Problems []string `json:"problems"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		assert.Equal(t, tc.valid, body.Valid, fmt.Sprintf("%s: expected valid %t got %t", tc.desc, tc.valid, body.Valid))
+		assert.Len(t, body.Problems, tc.problems, fmt.Sprintf("%s: expected %d problems got %v", tc.desc, tc.problems, body.Problems))
 	}
 }
@@ -4,11 +4,16 @@
 package http
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/mainflux/mainflux/twins"
 )
 
 const maxNameSize = 1024
 const maxLimitSize = 100
+const maxNoteSize = 1024
+const maxMessageSize = 1 << 20
 
 type apiReq interface {
 	validate() error
@@ -19,6 +24,11 @@ type addTwinReq struct {
 	Name       string                 `json:"name,omitempty"`
 	Definition twins.Definition       `json:"definition,omitempty"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	Heartbeat  time.Duration          `json:"heartbeat,omitempty"`
+	BaseTwinID string                 `json:"base_twin_id,omitempty"`
+	ChannelID  string                 `json:"channel_id,omitempty"`
+	ThingID    string                 `json:"thing_id,omitempty"`
+	Features   map[string]bool        `json:"features,omitempty"`
 }
 
 func (req addTwinReq) validate() error {
@@ -26,11 +36,7 @@ func (req addTwinReq) validate() error {
 		return twins.ErrUnauthorizedAccess
 	}
 
-	if len(req.Name) > maxNameSize {
-		return twins.ErrMalformedEntity
-	}
-
-	return nil
+	return validateTwin(req.Name, req.Heartbeat)
 }
 
 type updateTwinReq struct {
@@ -39,6 +45,12 @@ type updateTwinReq struct {
 	Name       string                 `json:"name,omitempty"`
 	Definition twins.Definition       `json:"definition,omitempty"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	Heartbeat  time.Duration          `json:"heartbeat,omitempty"`
+	BaseTwinID string                 `json:"base_twin_id,omitempty"`
+	ChannelID  string                 `json:"channel_id,omitempty"`
+	ThingID    string                 `json:"thing_id,omitempty"`
+	Features   map[string]bool        `json:"features,omitempty"`
+	IfMetadata map[string]interface{} `json:"if_metadata,omitempty"`
 }
 
 func (req updateTwinReq) validate() error {
@@ -50,7 +62,308 @@ func (req updateTwinReq) validate() error {
 		return twins.ErrMalformedEntity
 	}
 
-	if len(req.Name) > maxNameSize {
+	// Conditional updates leave the definition as it is.
+	if len(req.IfMetadata) > 0 && len(req.Definition.Attributes) > 0 {
+		return &twins.ValidationError{Fields: []twins.FieldError{{
+			Field:   "definition",
+			Message: "must not be set along with if_metadata",
+		}}}
+	}
+
+	return validateTwin(req.Name, req.Heartbeat)
+}
+
+// validateTwin returns ValidationError listing the invalid twin fields.
+func validateTwin(name string, heartbeat time.Duration) error {
+	ve := &twins.ValidationError{}
+	if len(name) > maxNameSize {
+		ve.Fields = append(ve.Fields, twins.FieldError{
+			Field:   "name",
+			Message: fmt.Sprintf("must be at most %d characters long", maxNameSize),
+		})
+	}
+	if heartbeat < 0 {
+		ve.Fields = append(ve.Fields, twins.FieldError{
+			Field:   "heartbeat",
+			Message: "must not be negative",
+		})
+	}
+
+	if len(ve.Fields) > 0 {
+		return ve
+	}
+	return nil
+}
+
+type lockReq struct {
+	token string
+	id    string
+	TTL   time.Duration `json:"ttl"`
+}
+
+func (req lockReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.TTL <= 0 {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type twinInputReq struct {
+	token           string
+	id              string
+	Attribute       string      `json:"attribute"`
+	SourceTwinID    string      `json:"source_twin_id"`
+	SourceAttribute string      `json:"source_attribute"`
+	SourceField     twins.Field `json:"source_field,omitempty"`
+}
+
+func (req twinInputReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.Attribute == "" || req.SourceTwinID == "" || req.SourceAttribute == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type twinKeyReq struct {
+	token  string
+	id     string
+	Action string        `json:"action"`
+	TTL    time.Duration `json:"ttl"`
+}
+
+func (req twinKeyReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if _, ok := actions[req.Action]; !ok {
+		return twins.ErrMalformedEntity
+	}
+
+	if req.id == "" || req.TTL <= 0 {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type revokeTwinKeyReq struct {
+	token string
+	id    string
+	keyID string
+}
+
+func (req revokeTwinKeyReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.keyID == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type setSchemaReq struct {
+	token    string
+	Required []string          `json:"required,omitempty"`
+	Types    map[string]string `json:"types,omitempty"`
+}
+
+func (req setSchemaReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	return nil
+}
+
+type updateMetadataReq struct {
+	token  string
+	Filter map[string]interface{} `json:"filter"`
+	Patch  map[string]interface{} `json:"patch"`
+}
+
+func (req updateMetadataReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if len(req.Filter) == 0 || len(req.Patch) == 0 {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type migrationStepReq struct {
+	Op        string  `json:"op"`
+	Attribute string  `json:"attribute"`
+	To        string  `json:"to,omitempty"`
+	Scale     float64 `json:"scale,omitempty"`
+	Offset    float64 `json:"offset,omitempty"`
+}
+
+type migrateReq struct {
+	token  string
+	Filter map[string]interface{} `json:"filter"`
+	Steps  []migrationStepReq     `json:"steps"`
+}
+
+func (req migrateReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if len(req.Filter) == 0 || len(req.Steps) == 0 {
+		return twins.ErrMalformedEntity
+	}
+
+	for _, step := range req.Steps {
+		if _, ok := migrationOps[step.Op]; !ok {
+			return twins.ErrMalformedEntity
+		}
+	}
+
+	return nil
+}
+
+func (req migrateReq) migration() twins.Migration {
+	m := twins.Migration{Steps: make([]twins.MigrationStep, len(req.Steps))}
+	for i, step := range req.Steps {
+		m.Steps[i] = twins.MigrationStep{
+			Op:        migrationOps[step.Op],
+			Attribute: step.Attribute,
+			To:        step.To,
+			Scale:     step.Scale,
+			Offset:    step.Offset,
+		}
+	}
+
+	return m
+}
+
+type validateDefinitionReq struct {
+	Definition twins.Definition `json:"definition"`
+}
+
+func (req validateDefinitionReq) validate() error {
+	return nil
+}
+
+type statsReq struct {
+	token string
+}
+
+func (req statsReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	return nil
+}
+
+type setQuotaReq struct {
+	token     string
+	owner     string
+	MaxStates uint64 `json:"max_states"`
+}
+
+func (req setQuotaReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.owner == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type viewUsageReq struct {
+	token string
+	owner string
+}
+
+func (req viewUsageReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.owner == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type replayReq struct {
+	token   string
+	fromSeq uint64
+}
+
+func (req replayReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	return nil
+}
+
+type listIDsReq struct {
+	token string
+	owner string
+}
+
+func (req listIDsReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	return nil
+}
+
+type viewTwinsReq struct {
+	token string
+	IDs   []string `json:"ids"`
+}
+
+func (req viewTwinsReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if len(req.IDs) == 0 {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type latestValuesReq struct {
+	token     string
+	IDs       []string `json:"ids"`
+	Attribute string   `json:"attribute"`
+}
+
+func (req latestValuesReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if len(req.IDs) == 0 || req.Attribute == "" {
 		return twins.ErrMalformedEntity
 	}
 
@@ -74,12 +387,68 @@ func (req viewTwinReq) validate() error {
 	return nil
 }
 
+type removeTwinReq struct {
+	token   string
+	id      string
+	cascade bool
+}
+
+func (req removeTwinReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type viewByMetadataReq struct {
+	token string
+	key   string
+	value interface{}
+}
+
+func (req viewByMetadataReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.key == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type viewByThingReq struct {
+	token   string
+	thingID string
+}
+
+func (req viewByThingReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.thingID == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
 type listReq struct {
-	token    string
-	offset   uint64
-	limit    uint64
-	name     string
-	metadata map[string]interface{}
+	token       string
+	offset      uint64
+	limit       uint64
+	name        string
+	metadata    map[string]interface{}
+	status      string
+	errorWithin time.Duration
+	definitions bool
 }
 
 func (req *listReq) validate() error {
@@ -91,6 +460,14 @@ func (req *listReq) validate() error {
 		return twins.ErrMalformedEntity
 	}
 
+	if req.status != "" && req.status != online && req.status != offline {
+		return twins.ErrMalformedEntity
+	}
+
+	if req.errorWithin < 0 || (req.errorWithin > 0 && req.status != "") {
+		return twins.ErrMalformedEntity
+	}
+
 	if len(req.name) > maxNameSize {
 		return twins.ErrMalformedEntity
 	}
@@ -98,11 +475,196 @@ func (req *listReq) validate() error {
 	return nil
 }
 
-type listStatesReq struct {
+type coverageReq struct {
+	token  string
+	id     string
+	window time.Duration
+}
+
+func (req coverageReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.window <= 0 {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type backfillDerivedReq struct {
+	token     string
+	id        string
+	Attribute string `json:"attribute"`
+}
+
+func (req backfillDerivedReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.Attribute == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type annotateStateReq struct {
+	token   string
+	id      string
+	stateID int64
+	Note    string `json:"note"`
+}
+
+func (req annotateStateReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.stateID < 0 || len(req.Note) > maxNoteSize {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type simulateIngestionReq struct {
+	token   string
+	id      string
+	payload []byte
+}
+
+func (req simulateIngestionReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || len(req.payload) == 0 || len(req.payload) > maxMessageSize {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type statesHistogramReq struct {
 	token  string
+	id     string
+	bucket time.Duration
+	from   time.Time
+	to     time.Time
+	loc    *time.Location
+}
+
+func (req statesHistogramReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.bucket <= 0 || req.from.IsZero() || req.to.IsZero() {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type statePartitionsReq struct {
+	token       string
+	id          string
+	granularity twins.Granularity
+	loc         *time.Location
+}
+
+func (req statePartitionsReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type stateAtReq struct {
+	token string
+	id    string
+	at    time.Time
+}
+
+func (req stateAtReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.at.IsZero() {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type findStatesReq struct {
+	token  string
+	id     string
+	attr   string
+	op     twins.Operator
+	value  float64
 	offset uint64
 	limit  uint64
-	id     string
+}
+
+func (req findStatesReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.id == "" || req.attr == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	if req.limit == 0 || req.limit > maxLimitSize {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type listChannelStatesReq struct {
+	token     string
+	channelID string
+	offset    uint64
+	limit     uint64
+}
+
+func (req *listChannelStatesReq) validate() error {
+	if req.token == "" {
+		return twins.ErrUnauthorizedAccess
+	}
+
+	if req.channelID == "" {
+		return twins.ErrMalformedEntity
+	}
+
+	if req.limit == 0 || req.limit > maxLimitSize {
+		return twins.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type listStatesReq struct {
+	token       string
+	offset      uint64
+	limit       uint64
+	id          string
+	group       string
+	source      string
+	consistency twins.Consistency
+	order       twins.Order
+	raw         bool
 }
 
 func (req *listStatesReq) validate() error {
@@ -114,6 +676,17 @@ func (req *listStatesReq) validate() error {
 		return twins.ErrMalformedEntity
 	}
 
+	// Raw payloads aren't limited to the attributes of a group.
+	if req.raw && req.group != "" {
+		return twins.ErrMalformedEntity
+	}
+
+	// States filtered by source are listed without raw payloads, and
+	// aren't limited to a group.
+	if req.source != "" && (req.raw || req.group != "") {
+		return twins.ErrMalformedEntity
+	}
+
 	if req.limit == 0 || req.limit > maxLimitSize {
 		return twins.ErrMalformedEntity
 	}
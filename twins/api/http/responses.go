@@ -5,6 +5,7 @@ package http
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
@@ -15,10 +16,33 @@ import (
 var (
 	_ mainflux.Response = (*twinRes)(nil)
 	_ mainflux.Response = (*viewTwinRes)(nil)
+	_ mainflux.Response = (*viewTwinsRes)(nil)
+	_ mainflux.Response = (*latestValuesRes)(nil)
 	_ mainflux.Response = (*viewStateRes)(nil)
 	_ mainflux.Response = (*twinsPageRes)(nil)
 	_ mainflux.Response = (*statesPageRes)(nil)
 	_ mainflux.Response = (*removeRes)(nil)
+	_ mainflux.Response = (*updateMetadataRes)(nil)
+	_ mainflux.Response = (*migrateRes)(nil)
+	_ mainflux.Response = (*verifyStatesRes)(nil)
+	_ mainflux.Response = (*reindexRes)(nil)
+	_ mainflux.Response = (*backfillDerivedRes)(nil)
+	_ mainflux.Response = (*twinStatusRes)(nil)
+	_ mainflux.Response = (*coverageRes)(nil)
+	_ mainflux.Response = (*twinDescriptorRes)(nil)
+	_ mainflux.Response = (*healthRes)(nil)
+	_ mainflux.Response = (*statsRes)(nil)
+	_ mainflux.Response = (*twinIDsRes)(nil)
+	_ mainflux.Response = (*eventsRes)(nil)
+	_ mainflux.Response = (*schemaRes)(nil)
+	_ mainflux.Response = (*lockRes)(nil)
+	_ mainflux.Response = (*noteRes)(nil)
+	_ mainflux.Response = (*twinKeyRes)(nil)
+	_ mainflux.Response = (*validateDefinitionRes)(nil)
+	_ mainflux.Response = (*histogramRes)(nil)
+	_ mainflux.Response = (*partitionsRes)(nil)
+	_ mainflux.Response = (*quotaRes)(nil)
+	_ mainflux.Response = (*usageRes)(nil)
 )
 
 type twinRes struct {
@@ -48,6 +72,39 @@ func (res twinRes) Empty() bool {
 	return true
 }
 
+type updateMetadataRes struct {
+	Updated uint64 `json:"updated"`
+}
+
+func (res updateMetadataRes) Code() int {
+	return http.StatusOK
+}
+
+func (res updateMetadataRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res updateMetadataRes) Empty() bool {
+	return false
+}
+
+type migrateRes struct {
+	Migrated []string          `json:"migrated"`
+	Failed   map[string]string `json:"failed"`
+}
+
+func (res migrateRes) Code() int {
+	return http.StatusOK
+}
+
+func (res migrateRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res migrateRes) Empty() bool {
+	return false
+}
+
 type viewTwinRes struct {
 	Owner       string                 `json:"owner,omitempty"`
 	ID          string                 `json:"id"`
@@ -57,6 +114,14 @@ type viewTwinRes struct {
 	Updated     time.Time              `json:"updated"`
 	Definitions []twins.Definition     `json:"definitions,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Heartbeat   time.Duration          `json:"heartbeat,omitempty"`
+	BaseTwinID  string                 `json:"base_twin_id,omitempty"`
+	ChannelID   string                 `json:"channel_id,omitempty"`
+	ThingID     string                 `json:"thing_id,omitempty"`
+	Features    map[string]bool        `json:"features,omitempty"`
+	LastError   string                 `json:"last_error,omitempty"`
+	LastErrorAt *time.Time             `json:"last_error_at,omitempty"`
+	Inputs      []twinInputView        `json:"inputs,omitempty"`
 }
 
 func (res viewTwinRes) Code() int {
@@ -71,12 +136,157 @@ func (res viewTwinRes) Empty() bool {
 	return false
 }
 
+// lastErrorAt returns the time of the last twin error, or nil if the twin
+// hasn't encountered one.
+func lastErrorAt(tw twins.Twin) *time.Time {
+	if tw.LastErrorAt.IsZero() {
+		return nil
+	}
+	return &tw.LastErrorAt
+}
+
+type twinInputView struct {
+	Attribute       string      `json:"attribute"`
+	SourceTwinID    string      `json:"source_twin_id"`
+	SourceAttribute string      `json:"source_attribute"`
+	SourceField     twins.Field `json:"source_field,omitempty"`
+}
+
+func twinInputs(tw twins.Twin) []twinInputView {
+	var views []twinInputView
+	for _, in := range tw.Inputs {
+		views = append(views, twinInputView{
+			Attribute:       in.Attribute,
+			SourceTwinID:    in.SourceTwinID,
+			SourceAttribute: in.SourceAttribute,
+			SourceField:     in.SourceField,
+		})
+	}
+	return views
+}
+
+type twinStatusRes struct {
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (res twinStatusRes) Code() int {
+	return http.StatusOK
+}
+
+func (res twinStatusRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res twinStatusRes) Empty() bool {
+	return false
+}
+
+type coverageRes struct {
+	Coverage map[string]bool `json:"coverage"`
+}
+
+func (res coverageRes) Code() int {
+	return http.StatusOK
+}
+
+func (res coverageRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res coverageRes) Empty() bool {
+	return false
+}
+
+type twinDescriptorRes struct {
+	TwinID      string                      `json:"twin_id"`
+	Name        string                      `json:"name"`
+	Definition  int                         `json:"definition"`
+	ContentType string                      `json:"content_type"`
+	Delta       int64                       `json:"delta"`
+	Attributes  []twins.AttributeDescriptor `json:"attributes"`
+}
+
+func (res twinDescriptorRes) Code() int {
+	return http.StatusOK
+}
+
+func (res twinDescriptorRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res twinDescriptorRes) Empty() bool {
+	return false
+}
+
+type healthRes struct {
+	TwinID  string               `json:"twin_id"`
+	Score   int                  `json:"score"`
+	Factors []twins.HealthFactor `json:"factors"`
+}
+
+func (res healthRes) Code() int {
+	return http.StatusOK
+}
+
+func (res healthRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res healthRes) Empty() bool {
+	return false
+}
+
+type recordTraceRes struct {
+	Name      string      `json:"name,omitempty"`
+	Time      time.Time   `json:"time"`
+	Unit      string      `json:"unit,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+	Attribute string      `json:"attribute,omitempty"`
+	Action    string      `json:"action"`
+	Reason    string      `json:"reason,omitempty"`
+}
+
+type ingestionTraceRes struct {
+	TwinID   string           `json:"twin_id"`
+	Channel  string           `json:"channel"`
+	Subtopic string           `json:"subtopic,omitempty"`
+	Matched  bool             `json:"matched"`
+	Invalid  uint64           `json:"invalid"`
+	Rejected bool             `json:"rejected"`
+	Records  []recordTraceRes `json:"records"`
+	State    *viewStateRes    `json:"state,omitempty"`
+}
+
+func (res ingestionTraceRes) Code() int {
+	return http.StatusOK
+}
+
+func (res ingestionTraceRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res ingestionTraceRes) Empty() bool {
+	return false
+}
+
+// exportStatesRes streams the export when encoded.
+type exportStatesRes struct {
+	export func(io.Writer) error
+}
+
 type viewStateRes struct {
 	TwinID     string                 `json:"twin_id"`
 	ID         int64                  `json:"id"`
 	Definition int                    `json:"definition"`
 	Created    time.Time              `json:"created"`
 	Payload    map[string]interface{} `json:"payload"`
+	Sums       map[string]float64     `json:"sums,omitempty"`
+	Hash       string                 `json:"hash,omitempty"`
+	Note       string                 `json:"note,omitempty"`
+	Backfilled bool                   `json:"backfilled,omitempty"`
+	Raw        []byte                 `json:"raw,omitempty"`
+	Source     string                 `json:"source,omitempty"`
 }
 
 func (res viewStateRes) Code() int {
@@ -91,12 +301,264 @@ func (res viewStateRes) Empty() bool {
 	return false
 }
 
+type verifyStatesRes struct {
+	Intact bool  `json:"intact"`
+	Broken int64 `json:"broken"`
+}
+
+func (res verifyStatesRes) Code() int {
+	return http.StatusOK
+}
+
+func (res verifyStatesRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res verifyStatesRes) Empty() bool {
+	return false
+}
+
+type reindexRes struct{}
+
+func (res reindexRes) Code() int {
+	return http.StatusOK
+}
+
+func (res reindexRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res reindexRes) Empty() bool {
+	return true
+}
+
+type backfillDerivedRes struct{}
+
+func (res backfillDerivedRes) Code() int {
+	return http.StatusOK
+}
+
+func (res backfillDerivedRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res backfillDerivedRes) Empty() bool {
+	return true
+}
+
+type bucketRes struct {
+	Start time.Time `json:"start"`
+	Count uint64    `json:"count"`
+}
+
+type histogramRes struct {
+	Buckets []bucketRes `json:"buckets"`
+}
+
+func (res histogramRes) Code() int {
+	return http.StatusOK
+}
+
+func (res histogramRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res histogramRes) Empty() bool {
+	return false
+}
+
+type partitionsRes struct {
+	Partitions []bucketRes `json:"partitions"`
+}
+
+func (res partitionsRes) Code() int {
+	return http.StatusOK
+}
+
+func (res partitionsRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res partitionsRes) Empty() bool {
+	return false
+}
+
+type validateDefinitionRes struct {
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+func (res validateDefinitionRes) Code() int {
+	return http.StatusOK
+}
+
+func (res validateDefinitionRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res validateDefinitionRes) Empty() bool {
+	return false
+}
+
+type statsRes struct {
+	Twins        uint64 `json:"twins"`
+	States       uint64 `json:"states"`
+	RecentStates uint64 `json:"recent_states"`
+	Channels     uint64 `json:"channels"`
+}
+
+func (res statsRes) Code() int {
+	return http.StatusOK
+}
+
+func (res statsRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res statsRes) Empty() bool {
+	return false
+}
+
+type quotaRes struct{}
+
+func (res quotaRes) Code() int {
+	return http.StatusOK
+}
+
+func (res quotaRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res quotaRes) Empty() bool {
+	return true
+}
+
+type usageRes struct {
+	Owner     string `json:"owner"`
+	States    uint64 `json:"states"`
+	MaxStates uint64 `json:"max_states"`
+}
+
+func (res usageRes) Code() int {
+	return http.StatusOK
+}
+
+func (res usageRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res usageRes) Empty() bool {
+	return false
+}
+
+type subscriptionRes struct {
+	Subject     string    `json:"subject"`
+	Messages    uint64    `json:"messages"`
+	LastMessage time.Time `json:"last_message"`
+}
+
+type subscriptionsRes struct {
+	Subscriptions []subscriptionRes `json:"subscriptions"`
+}
+
+func (res subscriptionsRes) Code() int {
+	return http.StatusOK
+}
+
+func (res subscriptionsRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res subscriptionsRes) Empty() bool {
+	return false
+}
+
+type twinIDsRes struct {
+	IDs []string `json:"ids"`
+}
+
+func (res twinIDsRes) Code() int {
+	return http.StatusOK
+}
+
+func (res twinIDsRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res twinIDsRes) Empty() bool {
+	return false
+}
+
+type eventRes struct {
+	Seq       uint64    `json:"seq"`
+	Operation string    `json:"operation"`
+	Payload   string    `json:"payload"`
+	Created   time.Time `json:"created"`
+}
+
+type eventsRes struct {
+	Events []eventRes `json:"events"`
+}
+
+func (res eventsRes) Code() int {
+	return http.StatusOK
+}
+
+func (res eventsRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res eventsRes) Empty() bool {
+	return false
+}
+
 type pageRes struct {
 	Total  uint64 `json:"total"`
 	Offset uint64 `json:"offset"`
 	Limit  uint64 `json:"limit"`
 }
 
+type viewTwinsRes struct {
+	Twins  []viewTwinRes     `json:"twins"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+func (res viewTwinsRes) Code() int {
+	return http.StatusOK
+}
+
+func (res viewTwinsRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res viewTwinsRes) Empty() bool {
+	return false
+}
+
+type latestValueRes struct {
+	Value   interface{}   `json:"value"`
+	Updated time.Time     `json:"updated"`
+	Age     time.Duration `json:"age"`
+}
+
+type latestValuesRes struct {
+	Attribute string                    `json:"attribute"`
+	Values    map[string]latestValueRes `json:"values"`
+	Errors    map[string]string         `json:"errors,omitempty"`
+}
+
+func (res latestValuesRes) Code() int {
+	return http.StatusOK
+}
+
+func (res latestValuesRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res latestValuesRes) Empty() bool {
+	return false
+}
+
 type twinsPageRes struct {
 	pageRes
 	Twins []viewTwinRes `json:"twins"`
@@ -131,6 +593,82 @@ func (res statesPageRes) Empty() bool {
 	return false
 }
 
+type lockRes struct {
+	Token string `json:"token"`
+}
+
+func (res lockRes) Code() int {
+	return http.StatusOK
+}
+
+func (res lockRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res lockRes) Empty() bool {
+	return false
+}
+
+type twinInputRes struct{}
+
+func (res twinInputRes) Code() int {
+	return http.StatusOK
+}
+
+func (res twinInputRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res twinInputRes) Empty() bool {
+	return true
+}
+
+type twinKeyRes struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+func (res twinKeyRes) Code() int {
+	return http.StatusCreated
+}
+
+func (res twinKeyRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res twinKeyRes) Empty() bool {
+	return false
+}
+
+type noteRes struct{}
+
+func (res noteRes) Code() int {
+	return http.StatusOK
+}
+
+func (res noteRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res noteRes) Empty() bool {
+	return true
+}
+
+type schemaRes struct{}
+
+func (res schemaRes) Code() int {
+	return http.StatusOK
+}
+
+func (res schemaRes) Headers() map[string]string {
+	return map[string]string{}
+}
+
+func (res schemaRes) Empty() bool {
+	return true
+}
+
 type removeRes struct{}
 
 func (res removeRes) Code() int {
@@ -144,3 +682,30 @@ func (res removeRes) Headers() map[string]string {
 func (res removeRes) Empty() bool {
 	return true
 }
+
+type fieldErrorRes struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validationErrorRes struct {
+	Error  string          `json:"error"`
+	Fields []fieldErrorRes `json:"fields"`
+}
+
+func newValidationErrorRes(ve *twins.ValidationError) validationErrorRes {
+	res := validationErrorRes{
+		Error:  twins.ErrMalformedEntity.Error(),
+		Fields: []fieldErrorRes{},
+	}
+	for _, fe := range ve.Fields {
+		res.Fields = append(res.Fields, fieldErrorRes{Field: fe.Field, Message: fe.Message})
+	}
+
+	return res
+}
+
+type dependencyErrorRes struct {
+	Error      string              `json:"error"`
+	Dependents map[string][]string `json:"dependents"`
+}
@@ -8,9 +8,11 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	kitot "github.com/go-kit/kit/tracing/opentracing"
 	kithttp "github.com/go-kit/kit/transport/http"
@@ -22,17 +24,81 @@ import (
 )
 
 const (
-	contentType = "application/json"
+	contentType        = "application/json"
+	ndjsonContentType  = "application/x-ndjson"
+	messageContentType = "application/octet-stream"
 
-	offset   = "offset"
-	limit    = "limit"
-	name     = "name"
-	metadata = "metadata"
+	requestIDHeader = "X-Request-ID"
+	lockTokenHeader = "X-Lock-Token"
+
+	offset      = "offset"
+	limit       = "limit"
+	name        = "name"
+	metadata    = "metadata"
+	consistency = "consistency"
+	order       = "order"
+	key         = "key"
+	value       = "value"
+	status      = "status"
+	owner       = "owner"
+	from        = "from"
+	to          = "to"
+	bucket      = "bucket"
+	window      = "window"
+	cascade     = "cascade"
+	definitions = "definitions"
+	group       = "group"
+	raw         = "raw"
+	attribute   = "attribute"
+	operator    = "op"
+	errorWithin = "error_within"
+	granularity = "granularity"
+	at          = "at"
+	source      = "source"
+	timezone    = "tz"
+
+	online  = "online"
+	offline = "offline"
 
 	defLimit  = 10
 	defOffset = 0
 )
 
+var consistencies = map[string]twins.Consistency{
+	"strong":   twins.Strong,
+	"eventual": twins.Eventual,
+}
+
+var orders = map[string]twins.Order{
+	"asc":  twins.Asc,
+	"desc": twins.Desc,
+}
+
+var operators = map[string]twins.Operator{
+	"gt": twins.Gt,
+	"ge": twins.Ge,
+	"lt": twins.Lt,
+	"le": twins.Le,
+	"eq": twins.Eq,
+}
+
+var migrationOps = map[string]twins.MigrationOp{
+	"rename":      twins.RenameAttribute,
+	"change_unit": twins.ChangeUnit,
+}
+
+var granularities = map[string]twins.Granularity{
+	"day":   twins.Daily,
+	"month": twins.Monthly,
+	"year":  twins.Yearly,
+}
+
+var actions = map[string]twins.Action{
+	"read":   twins.Read,
+	"write":  twins.Write,
+	"delete": twins.Delete,
+}
+
 var (
 	errUnsupportedContentType = errors.New("unsupported content type")
 	errInvalidQueryParams     = errors.New("invalid query params")
@@ -42,6 +108,8 @@ var (
 func MakeHandler(tracer opentracing.Tracer, svc twins.Service) http.Handler {
 	opts := []kithttp.ServerOption{
 		kithttp.ServerErrorEncoder(encodeError),
+		kithttp.ServerBefore(readRequestID, readLockToken),
+		kithttp.ServerAfter(writeRequestID),
 	}
 
 	r := bone.New()
@@ -53,6 +121,13 @@ func MakeHandler(tracer opentracing.Tracer, svc twins.Service) http.Handler {
 		opts...,
 	))
 
+	r.Put("/twins/schema", kithttp.NewServer(
+		kitot.TraceServer(tracer, "set_metadata_schema")(setMetadataSchemaEndpoint(svc)),
+		decodeMetadataSchema,
+		encodeResponse,
+		opts...,
+	))
+
 	r.Put("/twins/:id", kithttp.NewServer(
 		kitot.TraceServer(tracer, "update_twin")(updateTwinEndpoint(svc)),
 		decodeTwinUpdate,
@@ -60,6 +135,41 @@ func MakeHandler(tracer opentracing.Tracer, svc twins.Service) http.Handler {
 		opts...,
 	))
 
+	r.Get("/twins/search", kithttp.NewServer(
+		kitot.TraceServer(tracer, "view_twin_by_metadata")(viewTwinByMetadataEndpoint(svc)),
+		decodeViewByMetadata,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/twins/things/:thingID", kithttp.NewServer(
+		kitot.TraceServer(tracer, "view_twin_by_thing")(viewTwinByThingEndpoint(svc)),
+		decodeViewByThing,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/twins/ids", kithttp.NewServer(
+		kitot.TraceServer(tracer, "list_all_twin_ids")(listTwinIDsEndpoint(svc)),
+		decodeListIDs,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/view", kithttp.NewServer(
+		kitot.TraceServer(tracer, "view_twins")(viewTwinsEndpoint(svc)),
+		decodeViewTwins,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/migrate", kithttp.NewServer(
+		kitot.TraceServer(tracer, "migrate_definitions")(migrateDefinitionsEndpoint(svc)),
+		decodeMigration,
+		encodeResponse,
+		opts...,
+	))
+
 	r.Get("/twins/:id", kithttp.NewServer(
 		kitot.TraceServer(tracer, "view_twin")(viewTwinEndpoint(svc)),
 		decodeView,
@@ -69,11 +179,102 @@ func MakeHandler(tracer opentracing.Tracer, svc twins.Service) http.Handler {
 
 	r.Delete("/twins/:id", kithttp.NewServer(
 		kitot.TraceServer(tracer, "remove_twin")(removeTwinEndpoint(svc)),
+		decodeRemoveTwin,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Patch("/twins", kithttp.NewServer(
+		kitot.TraceServer(tracer, "update_twins_metadata")(updateTwinsMetadataEndpoint(svc)),
+		decodeMetadataUpdate,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/twins/:id/status", kithttp.NewServer(
+		kitot.TraceServer(tracer, "twin_status")(twinStatusEndpoint(svc)),
 		decodeView,
 		encodeResponse,
 		opts...,
 	))
 
+	r.Get("/twins/:id/coverage", kithttp.NewServer(
+		kitot.TraceServer(tracer, "coverage_report")(coverageReportEndpoint(svc)),
+		decodeCoverage,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/twins/:id/health", kithttp.NewServer(
+		kitot.TraceServer(tracer, "twin_health")(twinHealthEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/twins/:id/descriptor", kithttp.NewServer(
+		kitot.TraceServer(tracer, "describe_twin")(describeTwinEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/:id/simulate", kithttp.NewServer(
+		kitot.TraceServer(tracer, "simulate_ingestion")(simulateIngestionEndpoint(svc)),
+		decodeSimulateIngestion,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/:id/lock", kithttp.NewServer(
+		kitot.TraceServer(tracer, "lock_twin")(lockTwinEndpoint(svc)),
+		decodeLock,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/:id/inputs", kithttp.NewServer(
+		kitot.TraceServer(tracer, "link_twin_input")(linkTwinInputEndpoint(svc)),
+		decodeTwinInput,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Delete("/twins/:id/lock", kithttp.NewServer(
+		kitot.TraceServer(tracer, "unlock_twin")(unlockTwinEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/:id/archive", kithttp.NewServer(
+		kitot.TraceServer(tracer, "archive_twin")(archiveTwinEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/:id/restore", kithttp.NewServer(
+		kitot.TraceServer(tracer, "restore_archived_twin")(restoreArchivedTwinEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/twins/:id/keys", kithttp.NewServer(
+		kitot.TraceServer(tracer, "issue_twin_key")(issueTwinKeyEndpoint(svc)),
+		decodeTwinKey,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Delete("/twins/:id/keys/:key", kithttp.NewServer(
+		kitot.TraceServer(tracer, "revoke_twin_key")(revokeTwinKeyEndpoint(svc)),
+		decodeRevokeTwinKey,
+		encodeResponse,
+		opts...,
+	))
+
 	r.Get("/twins", kithttp.NewServer(
 		kitot.TraceServer(tracer, "list_twins")(listTwinsEndpoint(svc)),
 		decodeList,
@@ -81,6 +282,13 @@ func MakeHandler(tracer opentracing.Tracer, svc twins.Service) http.Handler {
 		opts...,
 	))
 
+	r.Post("/states/latest", kithttp.NewServer(
+		kitot.TraceServer(tracer, "latest_attribute_values")(latestValuesEndpoint(svc)),
+		decodeLatestValues,
+		encodeResponse,
+		opts...,
+	))
+
 	r.Get("/states/:id", kithttp.NewServer(
 		kitot.TraceServer(tracer, "list_states")(listStatesEndpoint(svc)),
 		decodeListStates,
@@ -88,6 +296,132 @@ func MakeHandler(tracer opentracing.Tracer, svc twins.Service) http.Handler {
 		opts...,
 	))
 
+	r.Get("/states/:id/verify", kithttp.NewServer(
+		kitot.TraceServer(tracer, "verify_state_chain")(verifyStatesEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/states/:id/reindex", kithttp.NewServer(
+		kitot.TraceServer(tracer, "reindex")(reindexEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/states/:id/backfill", kithttp.NewServer(
+		kitot.TraceServer(tracer, "backfill_derived")(backfillDerivedEndpoint(svc)),
+		decodeBackfillDerived,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/states/:id/export", kithttp.NewServer(
+		kitot.TraceServer(tracer, "stream_export_states")(streamExportStatesEndpoint(svc)),
+		decodeView,
+		encodeExport,
+		opts...,
+	))
+
+	r.Get("/states/:id/current", kithttp.NewServer(
+		kitot.TraceServer(tracer, "current_state")(currentStateEndpoint(svc)),
+		decodeView,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/states/:id/snapshot", kithttp.NewServer(
+		kitot.TraceServer(tracer, "state_at")(stateAtEndpoint(svc)),
+		decodeStateAt,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Put("/states/:id/:state/note", kithttp.NewServer(
+		kitot.TraceServer(tracer, "annotate_state")(annotateStateEndpoint(svc)),
+		decodeAnnotateState,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Delete("/states/:id/:state/note", kithttp.NewServer(
+		kitot.TraceServer(tracer, "remove_state_note")(removeStateNoteEndpoint(svc)),
+		decodeRemoveStateNote,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/states/:id/histogram", kithttp.NewServer(
+		kitot.TraceServer(tracer, "states_histogram")(statesHistogramEndpoint(svc)),
+		decodeStatesHistogram,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/states/:id/partitions", kithttp.NewServer(
+		kitot.TraceServer(tracer, "list_state_partitions")(listStatePartitionsEndpoint(svc)),
+		decodeStatePartitions,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/states/:id/search", kithttp.NewServer(
+		kitot.TraceServer(tracer, "find_states")(findStatesEndpoint(svc)),
+		decodeFindStates,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/channels/:id/states", kithttp.NewServer(
+		kitot.TraceServer(tracer, "list_channel_states")(listChannelStatesEndpoint(svc)),
+		decodeListChannelStates,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Post("/definitions/validate", kithttp.NewServer(
+		kitot.TraceServer(tracer, "validate_definition")(validateDefinitionEndpoint(svc)),
+		decodeDefinitionValidation,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/stats", kithttp.NewServer(
+		kitot.TraceServer(tracer, "service_stats")(serviceStatsEndpoint(svc)),
+		decodeStats,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/stats/subscriptions", kithttp.NewServer(
+		kitot.TraceServer(tracer, "subscription_info")(subscriptionInfoEndpoint(svc)),
+		decodeStats,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Put("/quotas/:owner", kithttp.NewServer(
+		kitot.TraceServer(tracer, "set_owner_quota")(setOwnerQuotaEndpoint(svc)),
+		decodeSetQuota,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/quotas/:owner", kithttp.NewServer(
+		kitot.TraceServer(tracer, "owner_usage")(ownerUsageEndpoint(svc)),
+		decodeViewUsage,
+		encodeResponse,
+		opts...,
+	))
+
+	r.Get("/events", kithttp.NewServer(
+		kitot.TraceServer(tracer, "replay_events")(replayEventsEndpoint(svc)),
+		decodeReplay,
+		encodeResponse,
+		opts...,
+	))
+
 	r.GetFunc("/version", mainflux.Version("twins"))
 	r.Handle("/metrics", promhttp.Handler())
 
@@ -123,16 +457,347 @@ func decodeTwinUpdate(_ context.Context, r *http.Request) (interface{}, error) {
 	return req, nil
 }
 
-func decodeView(_ context.Context, r *http.Request) (interface{}, error) {
-	req := viewTwinReq{
-		token: r.Header.Get("Authorization"),
-		id:    bone.GetValue(r, "id"),
+func decodeLock(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := lockReq{
+		token: r.Header.Get("Authorization"),
+		id:    bone.GetValue(r, "id"),
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeTwinInput(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := twinInputReq{
+		token: r.Header.Get("Authorization"),
+		id:    bone.GetValue(r, "id"),
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeTwinKey(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := twinKeyReq{
+		token: r.Header.Get("Authorization"),
+		id:    bone.GetValue(r, "id"),
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeRevokeTwinKey(_ context.Context, r *http.Request) (interface{}, error) {
+	req := revokeTwinKeyReq{
+		token: r.Header.Get("Authorization"),
+		id:    bone.GetValue(r, "id"),
+		keyID: bone.GetValue(r, "key"),
+	}
+
+	return req, nil
+}
+
+func decodeMetadataSchema(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := setSchemaReq{token: r.Header.Get("Authorization")}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeMetadataUpdate(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := updateMetadataReq{token: r.Header.Get("Authorization")}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeMigration(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := migrateReq{token: r.Header.Get("Authorization")}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeDefinitionValidation(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := validateDefinitionReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeViewTwins(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := viewTwinsReq{token: r.Header.Get("Authorization")}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeLatestValues(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := latestValuesReq{token: r.Header.Get("Authorization")}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeBackfillDerived(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := backfillDerivedReq{
+		token: r.Header.Get("Authorization"),
+		id:    bone.GetValue(r, "id"),
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeView(_ context.Context, r *http.Request) (interface{}, error) {
+	req := viewTwinReq{
+		token: r.Header.Get("Authorization"),
+		id:    bone.GetValue(r, "id"),
+	}
+
+	return req, nil
+}
+
+func decodeSimulateIngestion(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), messageContentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	req := simulateIngestionReq{
+		token:   r.Header.Get("Authorization"),
+		id:      bone.GetValue(r, "id"),
+		payload: payload,
+	}
+
+	return req, nil
+}
+
+func decodeRemoveTwin(_ context.Context, r *http.Request) (interface{}, error) {
+	c, err := readBoolQuery(r, cascade, false)
+	if err != nil {
+		return nil, err
+	}
+
+	req := removeTwinReq{
+		token:   r.Header.Get("Authorization"),
+		id:      bone.GetValue(r, "id"),
+		cascade: c,
+	}
+
+	return req, nil
+}
+
+func decodeStats(_ context.Context, r *http.Request) (interface{}, error) {
+	req := statsReq{token: r.Header.Get("Authorization")}
+
+	return req, nil
+}
+
+func decodeSetQuota(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req := setQuotaReq{
+		token: r.Header.Get("Authorization"),
+		owner: bone.GetValue(r, "owner"),
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeViewUsage(_ context.Context, r *http.Request) (interface{}, error) {
+	req := viewUsageReq{
+		token: r.Header.Get("Authorization"),
+		owner: bone.GetValue(r, "owner"),
+	}
+
+	return req, nil
+}
+
+func decodeReplay(_ context.Context, r *http.Request) (interface{}, error) {
+	f, err := readUintQuery(r, from, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	req := replayReq{
+		token:   r.Header.Get("Authorization"),
+		fromSeq: f,
+	}
+
+	return req, nil
+}
+
+func decodeListIDs(_ context.Context, r *http.Request) (interface{}, error) {
+	o, err := readStringQuery(r, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	req := listIDsReq{
+		token: r.Header.Get("Authorization"),
+		owner: o,
+	}
+
+	return req, nil
+}
+
+func decodeViewByMetadata(_ context.Context, r *http.Request) (interface{}, error) {
+	k, err := readStringQuery(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := readStringQuery(r, value)
+	if err != nil {
+		return nil, err
+	}
+
+	req := viewByMetadataReq{
+		token: r.Header.Get("Authorization"),
+		key:   k,
+		value: v,
+	}
+
+	// Values that are valid JSON, such as numbers and booleans, are matched
+	// by their decoded type.
+	var val interface{}
+	if err := json.Unmarshal([]byte(v), &val); err == nil {
+		req.value = val
+	}
+
+	return req, nil
+}
+
+func decodeViewByThing(_ context.Context, r *http.Request) (interface{}, error) {
+	req := viewByThingReq{
+		token:   r.Header.Get("Authorization"),
+		thingID: bone.GetValue(r, "thingID"),
+	}
+
+	return req, nil
+}
+
+func decodeList(_ context.Context, r *http.Request) (interface{}, error) {
+	l, err := readUintQuery(r, limit, defLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := readUintQuery(r, offset, defOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := readStringQuery(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readMetadataQuery(r, "metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := readStringQuery(r, status)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := readDurationQuery(r, errorWithin)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := readBoolQuery(r, definitions, true)
+	if err != nil {
+		return nil, err
+	}
+
+	req := listReq{
+		token:       r.Header.Get("Authorization"),
+		limit:       l,
+		offset:      o,
+		name:        n,
+		metadata:    m,
+		status:      s,
+		errorWithin: e,
+		definitions: d,
 	}
 
 	return req, nil
 }
 
-func decodeList(_ context.Context, r *http.Request) (interface{}, error) {
+func decodeListStates(_ context.Context, r *http.Request) (interface{}, error) {
 	l, err := readUintQuery(r, limit, defLimit)
 	if err != nil {
 		return nil, err
@@ -143,28 +808,47 @@ func decodeList(_ context.Context, r *http.Request) (interface{}, error) {
 		return nil, err
 	}
 
-	n, err := readStringQuery(r, name)
+	c, err := readConsistencyQuery(r, consistency)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := readMetadataQuery(r, "metadata")
+	ord, err := readOrderQuery(r, order)
 	if err != nil {
 		return nil, err
 	}
 
-	req := listReq{
-		token:    r.Header.Get("Authorization"),
-		limit:    l,
-		offset:   o,
-		name:     n,
-		metadata: m,
+	g, err := readStringQuery(r, group)
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := readBoolQuery(r, raw, false)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := readStringQuery(r, source)
+	if err != nil {
+		return nil, err
+	}
+
+	req := listStatesReq{
+		token:       r.Header.Get("Authorization"),
+		limit:       l,
+		offset:      o,
+		id:          bone.GetValue(r, "id"),
+		group:       g,
+		source:      src,
+		consistency: c,
+		order:       ord,
+		raw:         rw,
 	}
 
 	return req, nil
 }
 
-func decodeListStates(_ context.Context, r *http.Request) (interface{}, error) {
+func decodeListChannelStates(_ context.Context, r *http.Request) (interface{}, error) {
 	l, err := readUintQuery(r, limit, defLimit)
 	if err != nil {
 		return nil, err
@@ -175,16 +859,44 @@ func decodeListStates(_ context.Context, r *http.Request) (interface{}, error) {
 		return nil, err
 	}
 
-	req := listStatesReq{
-		token:  r.Header.Get("Authorization"),
-		limit:  l,
-		offset: o,
-		id:     bone.GetValue(r, "id"),
+	req := listChannelStatesReq{
+		token:     r.Header.Get("Authorization"),
+		channelID: bone.GetValue(r, "id"),
+		offset:    o,
+		limit:     l,
 	}
 
 	return req, nil
 }
 
+// readRequestID propagates the request ID passed in the request header, or
+// generates one if there is none.
+func readRequestID(ctx context.Context, r *http.Request) context.Context {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		ctx = twins.WithRequestID(ctx, id)
+	}
+
+	return twins.EnsureRequestID(ctx)
+}
+
+// readLockToken propagates the token of the twin lock passed in the request
+// header, which updates of locked twins must present.
+func readLockToken(ctx context.Context, r *http.Request) context.Context {
+	if token := r.Header.Get(lockTokenHeader); token != "" {
+		ctx = twins.WithLockToken(ctx, token)
+	}
+
+	return ctx
+}
+
+func writeRequestID(ctx context.Context, w http.ResponseWriter) context.Context {
+	if id := twins.RequestID(ctx); id != "" {
+		w.Header().Set(requestIDHeader, id)
+	}
+
+	return ctx
+}
+
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Set("Content-Type", contentType)
 
@@ -203,8 +915,50 @@ func encodeResponse(_ context.Context, w http.ResponseWriter, response interface
 	return json.NewEncoder(w).Encode(response)
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+// encodeExport streams the export to the response. Errors are encoded as
+// usual until the first state is written, after which the stream is cut
+// short.
+func encodeExport(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(exportStatesRes)
+	w.Header().Set("Content-Type", ndjsonContentType)
+
+	ew := &exportWriter{w: w}
+	if err := res.export(ew); err != nil && !ew.started {
+		return err
+	}
+
+	return nil
+}
+
+// exportWriter records whether the response has been started.
+type exportWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (ew *exportWriter) Write(p []byte) (int, error) {
+	ew.started = true
+	return ew.w.Write(p)
+}
+
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", contentType)
+	writeRequestID(ctx, w)
+
+	if ve, ok := err.(*twins.ValidationError); ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(newValidationErrorRes(ve))
+		return
+	}
+
+	if de, ok := err.(*twins.DependencyError); ok {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(dependencyErrorRes{
+			Error:      twins.ErrDependencyExists.Error(),
+			Dependents: de.Dependents,
+		})
+		return
+	}
 
 	switch err {
 	case twins.ErrMalformedEntity:
@@ -215,6 +969,16 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 		w.WriteHeader(http.StatusNotFound)
 	case twins.ErrConflict:
 		w.WriteHeader(http.StatusUnprocessableEntity)
+	case twins.ErrLimitExceeded:
+		w.WriteHeader(http.StatusBadRequest)
+	case twins.ErrSchemaViolation:
+		w.WriteHeader(http.StatusBadRequest)
+	case twins.ErrLocked:
+		w.WriteHeader(http.StatusLocked)
+	case twins.ErrEventsEvicted:
+		w.WriteHeader(http.StatusGone)
+	case twins.ErrArchiveUnavailable:
+		w.WriteHeader(http.StatusNotImplemented)
 	case errUnsupportedContentType:
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 	case errInvalidQueryParams:
@@ -235,6 +999,165 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	}
 }
 
+func decodeCoverage(_ context.Context, r *http.Request) (interface{}, error) {
+	w, err := readDurationQuery(r, window)
+	if err != nil {
+		return nil, err
+	}
+
+	req := coverageReq{
+		token:  r.Header.Get("Authorization"),
+		id:     bone.GetValue(r, "id"),
+		window: w,
+	}
+
+	return req, nil
+}
+
+func decodeAnnotateState(_ context.Context, r *http.Request) (interface{}, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentType) {
+		return nil, errUnsupportedContentType
+	}
+
+	req, err := readStateNoteReq(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeRemoveStateNote(_ context.Context, r *http.Request) (interface{}, error) {
+	return readStateNoteReq(r)
+}
+
+func readStateNoteReq(r *http.Request) (annotateStateReq, error) {
+	stateID, err := strconv.ParseInt(bone.GetValue(r, "state"), 10, 64)
+	if err != nil {
+		return annotateStateReq{}, twins.ErrMalformedEntity
+	}
+
+	req := annotateStateReq{
+		token:   r.Header.Get("Authorization"),
+		id:      bone.GetValue(r, "id"),
+		stateID: stateID,
+	}
+
+	return req, nil
+}
+
+func decodeStatesHistogram(_ context.Context, r *http.Request) (interface{}, error) {
+	b, err := readDurationQuery(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := readTimeQuery(r, from)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := readTimeQuery(r, to)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := readLocationQuery(r, timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	req := statesHistogramReq{
+		token:  r.Header.Get("Authorization"),
+		id:     bone.GetValue(r, "id"),
+		bucket: b,
+		from:   f,
+		to:     t,
+		loc:    loc,
+	}
+
+	return req, nil
+}
+
+func decodeStatePartitions(_ context.Context, r *http.Request) (interface{}, error) {
+	g, err := readGranularityQuery(r, granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := readLocationQuery(r, timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	req := statePartitionsReq{
+		token:       r.Header.Get("Authorization"),
+		id:          bone.GetValue(r, "id"),
+		granularity: g,
+		loc:         loc,
+	}
+
+	return req, nil
+}
+
+func decodeStateAt(_ context.Context, r *http.Request) (interface{}, error) {
+	t, err := readTimeQuery(r, at)
+	if err != nil {
+		return nil, err
+	}
+
+	req := stateAtReq{
+		token: r.Header.Get("Authorization"),
+		id:    bone.GetValue(r, "id"),
+		at:    t,
+	}
+
+	return req, nil
+}
+
+func decodeFindStates(_ context.Context, r *http.Request) (interface{}, error) {
+	l, err := readUintQuery(r, limit, defLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := readUintQuery(r, offset, defOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := readStringQuery(r, attribute)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := readOperatorQuery(r, operator)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := readFloatQuery(r, value)
+	if err != nil {
+		return nil, err
+	}
+
+	req := findStatesReq{
+		token:  r.Header.Get("Authorization"),
+		id:     bone.GetValue(r, "id"),
+		attr:   a,
+		op:     op,
+		value:  v,
+		offset: o,
+		limit:  l,
+	}
+
+	return req, nil
+}
+
 func readUintQuery(r *http.Request, key string, def uint64) (uint64, error) {
 	vals := bone.GetQuery(r, key)
 	if len(vals) > 1 {
@@ -254,6 +1177,24 @@ func readUintQuery(r *http.Request, key string, def uint64) (uint64, error) {
 	return val, nil
 }
 
+func readBoolQuery(r *http.Request, key string, def bool) (bool, error) {
+	vals := bone.GetQuery(r, key)
+	if len(vals) > 1 {
+		return false, errInvalidQueryParams
+	}
+
+	if len(vals) == 0 {
+		return def, nil
+	}
+
+	val, err := strconv.ParseBool(vals[0])
+	if err != nil {
+		return false, errInvalidQueryParams
+	}
+
+	return val, nil
+}
+
 func readStringQuery(r *http.Request, key string) (string, error) {
 	vals := bone.GetQuery(r, key)
 	if len(vals) > 1 {
@@ -267,6 +1208,75 @@ func readStringQuery(r *http.Request, key string) (string, error) {
 	return vals[0], nil
 }
 
+// readTimeQuery reads RFC3339 formatted time. Zero time is returned if the
+// query parameter is missing.
+func readTimeQuery(r *http.Request, key string) (time.Time, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil || val == "" {
+		return time.Time{}, err
+	}
+
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, errInvalidQueryParams
+	}
+
+	return t, nil
+}
+
+// readLocationQuery reads the IANA time zone name, e.g. "Europe/Belgrade".
+// It returns nil if the time zone isn't set.
+func readLocationQuery(r *http.Request, key string) (*time.Location, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil || val == "" {
+		return nil, err
+	}
+
+	// The server local time zone isn't accepted, as it isn't known to
+	// clients.
+	if val == "Local" {
+		return nil, errInvalidQueryParams
+	}
+
+	loc, err := time.LoadLocation(val)
+	if err != nil {
+		return nil, errInvalidQueryParams
+	}
+
+	return loc, nil
+}
+
+// readDurationQuery reads duration formatted as accepted by
+// time.ParseDuration, e.g. "15m".
+func readDurationQuery(r *http.Request, key string) (time.Duration, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil || val == "" {
+		return 0, err
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, errInvalidQueryParams
+	}
+
+	return d, nil
+}
+
+// readFloatQuery reads the required floating point number.
+func readFloatQuery(r *http.Request, key string) (float64, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, errInvalidQueryParams
+	}
+
+	return f, nil
+}
+
 func readMetadataQuery(r *http.Request, key string) (map[string]interface{}, error) {
 	vals := bone.GetQuery(r, key)
 	if len(vals) > 1 {
@@ -285,3 +1295,74 @@ func readMetadataQuery(r *http.Request, key string) (map[string]interface{}, err
 
 	return m, nil
 }
+
+func readConsistencyQuery(r *http.Request, key string) (twins.Consistency, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil {
+		return twins.Strong, err
+	}
+
+	if val == "" {
+		return twins.Strong, nil
+	}
+
+	c, ok := consistencies[val]
+	if !ok {
+		return twins.Strong, errInvalidQueryParams
+	}
+
+	return c, nil
+}
+
+// readOrderQuery reads the states order. Newest states are retrieved first
+// by default.
+func readOrderQuery(r *http.Request, key string) (twins.Order, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil {
+		return twins.Desc, err
+	}
+
+	if val == "" {
+		return twins.Desc, nil
+	}
+
+	o, ok := orders[val]
+	if !ok {
+		return twins.Desc, errInvalidQueryParams
+	}
+
+	return o, nil
+}
+
+// readOperatorQuery reads the required comparison operator.
+func readOperatorQuery(r *http.Request, key string) (twins.Operator, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil {
+		return twins.Eq, err
+	}
+
+	op, ok := operators[val]
+	if !ok {
+		return twins.Eq, errInvalidQueryParams
+	}
+
+	return op, nil
+}
+
+// readGranularityQuery reads the partition granularity, defaulting to days.
+func readGranularityQuery(r *http.Request, key string) (twins.Granularity, error) {
+	val, err := readStringQuery(r, key)
+	if err != nil {
+		return twins.Daily, err
+	}
+	if val == "" {
+		return twins.Daily, nil
+	}
+
+	g, ok := granularities[val]
+	if !ok {
+		return twins.Daily, errInvalidQueryParams
+	}
+
+	return g, nil
+}
@@ -8,6 +8,7 @@ package api
 import (
 	"context"
 	"fmt"
+	"io"
 	"time"
 
 	log "github.com/mainflux/mainflux/logger"
@@ -28,8 +29,10 @@ func LoggingMiddleware(svc twins.Service, logger log.Logger) twins.Service {
 }
 
 func (lm *loggingMiddleware) AddTwin(ctx context.Context, token string, twin twins.Twin, def twins.Definition) (saved twins.Twin, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
 	defer func(begin time.Time) {
-		message := fmt.Sprintf("Method add_twin for token %s and twin %s took %s to complete", token, twin.ID, time.Since(begin))
+		message := fmt.Sprintf("Method add_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twin.ID, time.Since(begin))
 		if err != nil {
 			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
 			return
@@ -41,8 +44,10 @@ func (lm *loggingMiddleware) AddTwin(ctx context.Context, token string, twin twi
 }
 
 func (lm *loggingMiddleware) UpdateTwin(ctx context.Context, token string, twin twins.Twin, def twins.Definition) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
 	defer func(begin time.Time) {
-		message := fmt.Sprintf("Method update_twin for token %s and twin %s took %s to complete", token, twin.ID, time.Since(begin))
+		message := fmt.Sprintf("Method update_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twin.ID, time.Since(begin))
 		if err != nil {
 			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
 			return
@@ -53,9 +58,71 @@ func (lm *loggingMiddleware) UpdateTwin(ctx context.Context, token string, twin
 	return lm.svc.UpdateTwin(ctx, token, twin, def)
 }
 
+func (lm *loggingMiddleware) ConditionalUpdateTwin(ctx context.Context, token string, twin twins.Twin, conditions map[string]interface{}) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method conditional_update_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twin.ID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ConditionalUpdateTwin(ctx, token, twin, conditions)
+}
+
+func (lm *loggingMiddleware) LinkTwinInput(ctx context.Context, token, targetTwinID, targetAttr, sourceTwinID, sourceAttr string, sourceField twins.Field) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method link_twin_input with request %s for token %s, twin %s and source twin %s took %s to complete", twins.RequestID(ctx), token, targetTwinID, sourceTwinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.LinkTwinInput(ctx, token, targetTwinID, targetAttr, sourceTwinID, sourceAttr, sourceField)
+}
+
+func (lm *loggingMiddleware) LockTwin(ctx context.Context, token, id string, ttl time.Duration) (lockToken string, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method lock_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.LockTwin(ctx, token, id, ttl)
+}
+
+func (lm *loggingMiddleware) UnlockTwin(ctx context.Context, token, id string) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method unlock_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.UnlockTwin(ctx, token, id)
+}
+
 func (lm *loggingMiddleware) ViewTwin(ctx context.Context, token, id string) (viewed twins.Twin, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
 	defer func(begin time.Time) {
-		message := fmt.Sprintf("Method view_twin for token %s and twin %s took %s to complete", token, id, time.Since(begin))
+		message := fmt.Sprintf("Method view_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
 		if err != nil {
 			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
 			return
@@ -66,9 +133,26 @@ func (lm *loggingMiddleware) ViewTwin(ctx context.Context, token, id string) (vi
 	return lm.svc.ViewTwin(ctx, token, id)
 }
 
-func (lm *loggingMiddleware) ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata twins.Metadata) (tw twins.Page, err error) {
+func (lm *loggingMiddleware) ViewTwins(ctx context.Context, token string, ids []string) (tws []twins.Twin, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method view_twins with request %s for token %s and %d twins took %s to complete", twins.RequestID(ctx), token, len(ids), time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ViewTwins(ctx, token, ids)
+}
+
+func (lm *loggingMiddleware) ViewTwinByMetadata(ctx context.Context, token, key string, value interface{}) (viewed twins.Twin, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
 	defer func(begin time.Time) {
-		message := fmt.Sprintf("Method list_twins for token %s took %s to complete", token, time.Since(begin))
+		message := fmt.Sprintf("Method view_twin_by_metadata with request %s for token %s and key %s took %s to complete", twins.RequestID(ctx), token, key, time.Since(begin))
 		if err != nil {
 			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
 			return
@@ -76,12 +160,14 @@ func (lm *loggingMiddleware) ListTwins(ctx context.Context, token string, offset
 		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
 	}(time.Now())
 
-	return lm.svc.ListTwins(ctx, token, offset, limit, name, metadata)
+	return lm.svc.ViewTwinByMetadata(ctx, token, key, value)
 }
 
-func (lm *loggingMiddleware) SaveStates(msg *messaging.Message) (err error) {
+func (lm *loggingMiddleware) ViewTwinByThing(ctx context.Context, token, thingID string) (viewed twins.Twin, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
 	defer func(begin time.Time) {
-		message := fmt.Sprintf("Method save_states took %s to complete", time.Since(begin))
+		message := fmt.Sprintf("Method view_twin_by_thing with request %s for token %s and thing %s took %s to complete", twins.RequestID(ctx), token, thingID, time.Since(begin))
 		if err != nil {
 			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
 			return
@@ -89,12 +175,267 @@ func (lm *loggingMiddleware) SaveStates(msg *messaging.Message) (err error) {
 		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
 	}(time.Now())
 
-	return lm.svc.SaveStates(msg)
+	return lm.svc.ViewTwinByThing(ctx, token, thingID)
+}
+
+func (lm *loggingMiddleware) UpdateTwinsMetadata(ctx context.Context, token string, filter, patch twins.Metadata) (n uint64, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method update_twins_metadata with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.UpdateTwinsMetadata(ctx, token, filter, patch)
+}
+
+func (lm *loggingMiddleware) MigrateDefinitions(ctx context.Context, token string, filter twins.Metadata, migration twins.Migration) (mr twins.MigrationResult, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method migrate_definitions with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.MigrateDefinitions(ctx, token, filter, migration)
+}
+
+func (lm *loggingMiddleware) SetMetadataSchema(ctx context.Context, token string, schema twins.MetadataSchema) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method set_metadata_schema with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.SetMetadataSchema(ctx, token, schema)
+}
+
+func (lm *loggingMiddleware) ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata twins.Metadata, omitDefinitions bool) (tw twins.Page, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_twins with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListTwins(ctx, token, offset, limit, name, metadata, omitDefinitions)
+}
+
+func (lm *loggingMiddleware) ListAllTwinIDs(ctx context.Context, token, owner string) (ids []string, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_all_twin_ids with request %s for token %s and owner %s took %s to complete", twins.RequestID(ctx), token, owner, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListAllTwinIDs(ctx, token, owner)
+}
+
+func (lm *loggingMiddleware) TwinStatus(ctx context.Context, token, id string) (online bool, lastSeen time.Time, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method twin_status with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.TwinStatus(ctx, token, id)
+}
+
+func (lm *loggingMiddleware) CoverageReport(ctx context.Context, token, twinID string, window time.Duration) (report map[string]bool, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method coverage_report with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.CoverageReport(ctx, token, twinID, window)
+}
+
+func (lm *loggingMiddleware) LatestAttributeValues(ctx context.Context, token string, twinIDs []string, attr string) (values map[string]twins.AttrValueAge, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method latest_attribute_values with request %s for token %s, attribute %s and %d twins took %s to complete", twins.RequestID(ctx), token, attr, len(twinIDs), time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.LatestAttributeValues(ctx, token, twinIDs, attr)
+}
+
+func (lm *loggingMiddleware) TwinHealth(ctx context.Context, token, twinID string) (hs twins.HealthScore, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method twin_health with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.TwinHealth(ctx, token, twinID)
+}
+
+func (lm *loggingMiddleware) DescribeTwin(ctx context.Context, token, twinID string) (desc twins.TwinDescriptor, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method describe_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.DescribeTwin(ctx, token, twinID)
+}
+
+func (lm *loggingMiddleware) ListTwinsByStatus(ctx context.Context, token string, offset uint64, limit uint64, online bool) (tw twins.Page, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_twins_by_status with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListTwinsByStatus(ctx, token, offset, limit, online)
+}
+
+func (lm *loggingMiddleware) ListTwinsWithErrors(ctx context.Context, token string, offset uint64, limit uint64, window time.Duration) (tw twins.Page, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_twins_with_errors with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListTwinsWithErrors(ctx, token, offset, limit, window)
+}
+
+func (lm *loggingMiddleware) ValidateDefinition(ctx context.Context, def twins.Definition) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method validate_definition with request %s took %s to complete", twins.RequestID(ctx), time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ValidateDefinition(ctx, def)
+}
+
+func (lm *loggingMiddleware) Authorize(ctx context.Context, token, id string, action twins.Action) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method authorize with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.Authorize(ctx, token, id, action)
+}
+
+func (lm *loggingMiddleware) IssueTwinKey(ctx context.Context, token, twinID string, action twins.Action, ttl time.Duration) (key twins.TwinKey, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method issue_twin_key with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.IssueTwinKey(ctx, token, twinID, action, ttl)
+}
+
+func (lm *loggingMiddleware) RevokeTwinKey(ctx context.Context, token, twinID, keyID string) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method revoke_twin_key with request %s for token %s, twin %s and key %s took %s to complete", twins.RequestID(ctx), token, twinID, keyID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.RevokeTwinKey(ctx, token, twinID, keyID)
+}
+
+func (lm *loggingMiddleware) RemoveExpiredKeys(ctx context.Context) (removed uint64, err error) {
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method remove_expired_keys removed %d keys and took %s to complete", removed, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.RemoveExpiredKeys(ctx)
 }
 
-func (lm *loggingMiddleware) ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string) (st twins.StatesPage, err error) {
+func (lm *loggingMiddleware) SubscriptionInfo(ctx context.Context, token string) (infos []twins.SubInfo, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
 	defer func(begin time.Time) {
-		message := fmt.Sprintf("Method list_states for token %s took %s to complete", token, time.Since(begin))
+		message := fmt.Sprintf("Method subscription_info with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
 		if err != nil {
 			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
 			return
@@ -102,12 +443,402 @@ func (lm *loggingMiddleware) ListStates(ctx context.Context, token string, offse
 		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
 	}(time.Now())
 
-	return lm.svc.ListStates(ctx, token, offset, limit, id)
+	return lm.svc.SubscriptionInfo(ctx, token)
 }
 
-func (lm *loggingMiddleware) RemoveTwin(ctx context.Context, token, id string) (err error) {
+func (lm *loggingMiddleware) ServiceStats(ctx context.Context, token string) (stats twins.ServiceStats, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method service_stats with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ServiceStats(ctx, token)
+}
+
+func (lm *loggingMiddleware) SetOwnerQuota(ctx context.Context, token, owner string, maxStates uint64) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method set_owner_quota with request %s for token %s, owner %s and max states %d took %s to complete", twins.RequestID(ctx), token, owner, maxStates, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.SetOwnerQuota(ctx, token, owner, maxStates)
+}
+
+func (lm *loggingMiddleware) OwnerUsage(ctx context.Context, token, owner string) (usage twins.Usage, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method owner_usage with request %s for token %s and owner %s took %s to complete", twins.RequestID(ctx), token, owner, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.OwnerUsage(ctx, token, owner)
+}
+
+func (lm *loggingMiddleware) ReplayEvents(ctx context.Context, token string, fromSeq uint64) (ch <-chan twins.Event, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method replay_events with request %s for token %s from sequence %d took %s to complete", twins.RequestID(ctx), token, fromSeq, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ReplayEvents(ctx, token, fromSeq)
+}
+
+func (lm *loggingMiddleware) StreamExportStates(ctx context.Context, token, twinID string, w io.Writer) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method stream_export_states with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.StreamExportStates(ctx, token, twinID, w)
+}
+
+func (lm *loggingMiddleware) CurrentState(ctx context.Context, token, id string) (st twins.State, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method current_state with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.CurrentState(ctx, token, id)
+}
+
+func (lm *loggingMiddleware) StateAt(ctx context.Context, token, id string, at time.Time) (st twins.State, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method state_at with request %s for token %s, twin %s and time %s took %s to complete", twins.RequestID(ctx), token, id, at.Format(time.RFC3339), time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.StateAt(ctx, token, id, at)
+}
+
+func (lm *loggingMiddleware) AnnotateState(ctx context.Context, token, twinID string, stateID int64, note string) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method annotate_state with request %s for token %s, twin %s and state %d took %s to complete", twins.RequestID(ctx), token, twinID, stateID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.AnnotateState(ctx, token, twinID, stateID, note)
+}
+
+func (lm *loggingMiddleware) SaveStates(msg *messaging.Message) (res twins.SaveResult, err error) {
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method save_states with request %s saved %d, dropped %d and skipped %d invalid and %d oversized records and took %s to complete", res.RequestID, res.Saved, res.Dropped, res.Invalid, res.Oversized, time.Since(begin))
+		if res.Queued {
+			message = fmt.Sprintf("Method save_states with request %s queued records for asynchronous write and skipped %d invalid and %d oversized records and took %s to complete", res.RequestID, res.Invalid, res.Oversized, time.Since(begin))
+		}
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.SaveStates(msg)
+}
+
+func (lm *loggingMiddleware) HandleDelivery(d twins.Delivery) (err error) {
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method handle_delivery for message from channel %s delivered %d times took %s to complete", d.Message().Channel, d.Attempt(), time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.HandleDelivery(d)
+}
+
+func (lm *loggingMiddleware) SaveStatesBatch(ctx context.Context, msgs []*messaging.Message) (res []twins.SaveResult, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		var saved, dropped, invalid, oversized uint64
+		for _, r := range res {
+			saved += r.Saved
+			dropped += r.Dropped
+			invalid += r.Invalid
+			oversized += r.Oversized
+		}
+		message := fmt.Sprintf("Method save_states_batch with request %s for %d messages saved %d, dropped %d and skipped %d invalid and %d oversized records and took %s to complete", twins.RequestID(ctx), len(msgs), saved, dropped, invalid, oversized, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.SaveStatesBatch(ctx, msgs)
+}
+
+func (lm *loggingMiddleware) SimulateIngestion(ctx context.Context, token, twinID string, payload []byte) (trace twins.IngestionTrace, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method simulate_ingestion with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.SimulateIngestion(ctx, token, twinID, payload)
+}
+
+func (lm *loggingMiddleware) PublishIngestionSummaries() (summaries []twins.IngestionSummary, err error) {
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method publish_ingestion_summaries published %d summaries and took %s to complete", len(summaries), time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.PublishIngestionSummaries()
+}
+
+func (lm *loggingMiddleware) ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string, consistency twins.Consistency, order twins.Order, includeRaw bool) (st twins.StatesPage, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_states with request %s for token %s took %s to complete", twins.RequestID(ctx), token, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListStates(ctx, token, offset, limit, id, consistency, order, includeRaw)
+}
+
+func (lm *loggingMiddleware) ListStatesByGroup(ctx context.Context, token, twinID, group string, offset uint64, limit uint64, consistency twins.Consistency, order twins.Order) (st twins.StatesPage, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_states_by_group with request %s for token %s, twin %s and group %s took %s to complete", twins.RequestID(ctx), token, twinID, group, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListStatesByGroup(ctx, token, twinID, group, offset, limit, consistency, order)
+}
+
+func (lm *loggingMiddleware) ListStatesBySource(ctx context.Context, token, twinID, source string, offset uint64, limit uint64, order twins.Order) (st twins.StatesPage, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_states_by_source with request %s for token %s, twin %s and source %s took %s to complete", twins.RequestID(ctx), token, twinID, source, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListStatesBySource(ctx, token, twinID, source, offset, limit, order)
+}
+
+func (lm *loggingMiddleware) ListChannelStates(ctx context.Context, token, channelID string, offset, limit uint64) (st twins.StatesPage, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_channel_states with request %s for token %s and channel %s took %s to complete", twins.RequestID(ctx), token, channelID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListChannelStates(ctx, token, channelID, offset, limit)
+}
+
+func (lm *loggingMiddleware) VerifyStateChain(ctx context.Context, token, id string) (intact bool, broken int64, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method verify_state_chain with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.VerifyStateChain(ctx, token, id)
+}
+
+func (lm *loggingMiddleware) Reindex(ctx context.Context, token, twinID string) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method reindex with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.Reindex(ctx, token, twinID)
+}
+
+func (lm *loggingMiddleware) BackfillDerived(ctx context.Context, token, twinID, derivedAttr string) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method backfill_derived with request %s for token %s, twin %s and attribute %s took %s to complete", twins.RequestID(ctx), token, twinID, derivedAttr, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.BackfillDerived(ctx, token, twinID, derivedAttr)
+}
+
+func (lm *loggingMiddleware) StatesHistogram(ctx context.Context, token, twinID string, bucket time.Duration, from, to time.Time, loc *time.Location) (hist []twins.BucketCount, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method states_histogram with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.StatesHistogram(ctx, token, twinID, bucket, from, to, loc)
+}
+
+func (lm *loggingMiddleware) ListStatePartitions(ctx context.Context, token, twinID string, granularity twins.Granularity, loc *time.Location) (partitions []twins.Partition, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method list_state_partitions with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ListStatePartitions(ctx, token, twinID, granularity, loc)
+}
+
+func (lm *loggingMiddleware) FindStates(ctx context.Context, token, twinID, attr string, op twins.Operator, value float64, offset, limit uint64) (page twins.StatesPage, err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method find_states with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, twinID, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.FindStates(ctx, token, twinID, attr, op, value, offset, limit)
+}
+
+func (lm *loggingMiddleware) RegisterUnitAlias(alias, canonical string) {
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method register_unit_alias for alias %s and unit %s took %s to complete", alias, canonical, time.Since(begin))
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	lm.svc.RegisterUnitAlias(alias, canonical)
+}
+
+func (lm *loggingMiddleware) RemoveTwin(ctx context.Context, token, id string, cascade bool) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method remove_twin with request %s for token %s and twin %s with cascade %t took %s to complete", twins.RequestID(ctx), token, id, cascade, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.RemoveTwin(ctx, token, id, cascade)
+}
+
+func (lm *loggingMiddleware) ArchiveTwin(ctx context.Context, token, id string) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method archive_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.svc.ArchiveTwin(ctx, token, id)
+}
+
+func (lm *loggingMiddleware) RestoreArchivedTwin(ctx context.Context, token, id string) (err error) {
+	ctx = twins.EnsureRequestID(ctx)
+
 	defer func(begin time.Time) {
-		message := fmt.Sprintf("Method remove_twin for token %s and twin %s took %s to complete", token, id, time.Since(begin))
+		message := fmt.Sprintf("Method restore_archived_twin with request %s for token %s and twin %s took %s to complete", twins.RequestID(ctx), token, id, time.Since(begin))
 		if err != nil {
 			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
 			return
@@ -115,5 +846,5 @@ func (lm *loggingMiddleware) RemoveTwin(ctx context.Context, token, id string) (
 		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
 	}(time.Now())
 
-	return lm.svc.RemoveTwin(ctx, token, id)
+	return lm.svc.RestoreArchivedTwin(ctx, token, id)
 }
@@ -7,6 +7,7 @@ package api
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/go-kit/kit/metrics"
@@ -17,18 +18,21 @@ import (
 var _ twins.Service = (*metricsMiddleware)(nil)
 
 type metricsMiddleware struct {
-	counter metrics.Counter
-	latency metrics.Histogram
-	svc     twins.Service
+	counter   metrics.Counter
+	latency   metrics.Histogram
+	unmatched metrics.Counter
+	svc       twins.Service
 }
 
 // MetricsMiddleware instruments core service by tracking request count and
-// latency.
-func MetricsMiddleware(svc twins.Service, counter metrics.Counter, latency metrics.Histogram) twins.Service {
+// latency. If the unmatched counter is set, it counts the saved records that
+// match no twin attribute, labeled by channel.
+func MetricsMiddleware(svc twins.Service, counter metrics.Counter, latency metrics.Histogram, unmatched metrics.Counter) twins.Service {
 	return &metricsMiddleware{
-		counter: counter,
-		latency: latency,
-		svc:     svc,
+		counter:   counter,
+		latency:   latency,
+		unmatched: unmatched,
+		svc:       svc,
 	}
 }
 
@@ -50,6 +54,42 @@ func (ms *metricsMiddleware) UpdateTwin(ctx context.Context, token string, twin
 	return ms.svc.UpdateTwin(ctx, token, twin, def)
 }
 
+func (ms *metricsMiddleware) ConditionalUpdateTwin(ctx context.Context, token string, twin twins.Twin, conditions map[string]interface{}) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "conditional_update_twin").Add(1)
+		ms.latency.With("method", "conditional_update_twin").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ConditionalUpdateTwin(ctx, token, twin, conditions)
+}
+
+func (ms *metricsMiddleware) LinkTwinInput(ctx context.Context, token, targetTwinID, targetAttr, sourceTwinID, sourceAttr string, sourceField twins.Field) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "link_twin_input").Add(1)
+		ms.latency.With("method", "link_twin_input").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.LinkTwinInput(ctx, token, targetTwinID, targetAttr, sourceTwinID, sourceAttr, sourceField)
+}
+
+func (ms *metricsMiddleware) LockTwin(ctx context.Context, token, id string, ttl time.Duration) (string, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "lock_twin").Add(1)
+		ms.latency.With("method", "lock_twin").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.LockTwin(ctx, token, id, ttl)
+}
+
+func (ms *metricsMiddleware) UnlockTwin(ctx context.Context, token, id string) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "unlock_twin").Add(1)
+		ms.latency.With("method", "unlock_twin").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.UnlockTwin(ctx, token, id)
+}
+
 func (ms *metricsMiddleware) ViewTwin(ctx context.Context, token, id string) (viewed twins.Twin, err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "view_twin").Add(1)
@@ -59,38 +99,449 @@ func (ms *metricsMiddleware) ViewTwin(ctx context.Context, token, id string) (vi
 	return ms.svc.ViewTwin(ctx, token, id)
 }
 
-func (ms *metricsMiddleware) ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata twins.Metadata) (tw twins.Page, err error) {
+func (ms *metricsMiddleware) ViewTwins(ctx context.Context, token string, ids []string) ([]twins.Twin, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "view_twins").Add(1)
+		ms.latency.With("method", "view_twins").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ViewTwins(ctx, token, ids)
+}
+
+func (ms *metricsMiddleware) ViewTwinByMetadata(ctx context.Context, token, key string, value interface{}) (viewed twins.Twin, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "view_twin_by_metadata").Add(1)
+		ms.latency.With("method", "view_twin_by_metadata").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ViewTwinByMetadata(ctx, token, key, value)
+}
+
+func (ms *metricsMiddleware) ViewTwinByThing(ctx context.Context, token, thingID string) (viewed twins.Twin, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "view_twin_by_thing").Add(1)
+		ms.latency.With("method", "view_twin_by_thing").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ViewTwinByThing(ctx, token, thingID)
+}
+
+func (ms *metricsMiddleware) UpdateTwinsMetadata(ctx context.Context, token string, filter, patch twins.Metadata) (n uint64, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "update_twins_metadata").Add(1)
+		ms.latency.With("method", "update_twins_metadata").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.UpdateTwinsMetadata(ctx, token, filter, patch)
+}
+
+func (ms *metricsMiddleware) MigrateDefinitions(ctx context.Context, token string, filter twins.Metadata, migration twins.Migration) (twins.MigrationResult, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "migrate_definitions").Add(1)
+		ms.latency.With("method", "migrate_definitions").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.MigrateDefinitions(ctx, token, filter, migration)
+}
+
+func (ms *metricsMiddleware) SetMetadataSchema(ctx context.Context, token string, schema twins.MetadataSchema) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "set_metadata_schema").Add(1)
+		ms.latency.With("method", "set_metadata_schema").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.SetMetadataSchema(ctx, token, schema)
+}
+
+func (ms *metricsMiddleware) ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata twins.Metadata, omitDefinitions bool) (tw twins.Page, err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "list_twins").Add(1)
 		ms.latency.With("method", "list_twins").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return ms.svc.ListTwins(ctx, token, offset, limit, name, metadata)
+	return ms.svc.ListTwins(ctx, token, offset, limit, name, metadata, omitDefinitions)
+}
+
+func (ms *metricsMiddleware) ListAllTwinIDs(ctx context.Context, token, owner string) ([]string, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "list_all_twin_ids").Add(1)
+		ms.latency.With("method", "list_all_twin_ids").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ListAllTwinIDs(ctx, token, owner)
+}
+
+func (ms *metricsMiddleware) TwinStatus(ctx context.Context, token, id string) (bool, time.Time, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "twin_status").Add(1)
+		ms.latency.With("method", "twin_status").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.TwinStatus(ctx, token, id)
+}
+
+func (ms *metricsMiddleware) CoverageReport(ctx context.Context, token, twinID string, window time.Duration) (map[string]bool, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "coverage_report").Add(1)
+		ms.latency.With("method", "coverage_report").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.CoverageReport(ctx, token, twinID, window)
+}
+
+func (ms *metricsMiddleware) LatestAttributeValues(ctx context.Context, token string, twinIDs []string, attr string) (map[string]twins.AttrValueAge, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "latest_attribute_values").Add(1)
+		ms.latency.With("method", "latest_attribute_values").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.LatestAttributeValues(ctx, token, twinIDs, attr)
+}
+
+func (ms *metricsMiddleware) TwinHealth(ctx context.Context, token, twinID string) (twins.HealthScore, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "twin_health").Add(1)
+		ms.latency.With("method", "twin_health").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.TwinHealth(ctx, token, twinID)
+}
+
+func (ms *metricsMiddleware) DescribeTwin(ctx context.Context, token, twinID string) (twins.TwinDescriptor, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "describe_twin").Add(1)
+		ms.latency.With("method", "describe_twin").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.DescribeTwin(ctx, token, twinID)
+}
+
+func (ms *metricsMiddleware) ListTwinsByStatus(ctx context.Context, token string, offset uint64, limit uint64, online bool) (twins.Page, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "list_twins_by_status").Add(1)
+		ms.latency.With("method", "list_twins_by_status").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ListTwinsByStatus(ctx, token, offset, limit, online)
+}
+
+func (ms *metricsMiddleware) ListTwinsWithErrors(ctx context.Context, token string, offset uint64, limit uint64, window time.Duration) (twins.Page, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "list_twins_with_errors").Add(1)
+		ms.latency.With("method", "list_twins_with_errors").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ListTwinsWithErrors(ctx, token, offset, limit, window)
+}
+
+func (ms *metricsMiddleware) ValidateDefinition(ctx context.Context, def twins.Definition) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "validate_definition").Add(1)
+		ms.latency.With("method", "validate_definition").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ValidateDefinition(ctx, def)
+}
+
+func (ms *metricsMiddleware) Authorize(ctx context.Context, token, id string, action twins.Action) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "authorize").Add(1)
+		ms.latency.With("method", "authorize").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.Authorize(ctx, token, id, action)
+}
+
+func (ms *metricsMiddleware) IssueTwinKey(ctx context.Context, token, twinID string, action twins.Action, ttl time.Duration) (twins.TwinKey, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "issue_twin_key").Add(1)
+		ms.latency.With("method", "issue_twin_key").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.IssueTwinKey(ctx, token, twinID, action, ttl)
+}
+
+func (ms *metricsMiddleware) RevokeTwinKey(ctx context.Context, token, twinID, keyID string) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "revoke_twin_key").Add(1)
+		ms.latency.With("method", "revoke_twin_key").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.RevokeTwinKey(ctx, token, twinID, keyID)
+}
+
+func (ms *metricsMiddleware) RemoveExpiredKeys(ctx context.Context) (uint64, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "remove_expired_keys").Add(1)
+		ms.latency.With("method", "remove_expired_keys").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.RemoveExpiredKeys(ctx)
+}
+
+func (ms *metricsMiddleware) SubscriptionInfo(ctx context.Context, token string) ([]twins.SubInfo, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "subscription_info").Add(1)
+		ms.latency.With("method", "subscription_info").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.SubscriptionInfo(ctx, token)
+}
+
+func (ms *metricsMiddleware) ServiceStats(ctx context.Context, token string) (twins.ServiceStats, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "service_stats").Add(1)
+		ms.latency.With("method", "service_stats").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ServiceStats(ctx, token)
+}
+
+func (ms *metricsMiddleware) SetOwnerQuota(ctx context.Context, token, owner string, maxStates uint64) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "set_owner_quota").Add(1)
+		ms.latency.With("method", "set_owner_quota").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.SetOwnerQuota(ctx, token, owner, maxStates)
 }
 
-func (ms *metricsMiddleware) SaveStates(msg *messaging.Message) error {
+func (ms *metricsMiddleware) OwnerUsage(ctx context.Context, token, owner string) (twins.Usage, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "owner_usage").Add(1)
+		ms.latency.With("method", "owner_usage").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.OwnerUsage(ctx, token, owner)
+}
+
+func (ms *metricsMiddleware) ReplayEvents(ctx context.Context, token string, fromSeq uint64) (<-chan twins.Event, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "replay_events").Add(1)
+		ms.latency.With("method", "replay_events").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ReplayEvents(ctx, token, fromSeq)
+}
+
+func (ms *metricsMiddleware) StreamExportStates(ctx context.Context, token, twinID string, w io.Writer) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "stream_export_states").Add(1)
+		ms.latency.With("method", "stream_export_states").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.StreamExportStates(ctx, token, twinID, w)
+}
+
+func (ms *metricsMiddleware) CurrentState(ctx context.Context, token, id string) (twins.State, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "current_state").Add(1)
+		ms.latency.With("method", "current_state").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.CurrentState(ctx, token, id)
+}
+
+func (ms *metricsMiddleware) StateAt(ctx context.Context, token, id string, at time.Time) (twins.State, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "state_at").Add(1)
+		ms.latency.With("method", "state_at").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.StateAt(ctx, token, id, at)
+}
+
+func (ms *metricsMiddleware) AnnotateState(ctx context.Context, token, twinID string, stateID int64, note string) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "annotate_state").Add(1)
+		ms.latency.With("method", "annotate_state").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.AnnotateState(ctx, token, twinID, stateID, note)
+}
+
+func (ms *metricsMiddleware) SaveStates(msg *messaging.Message) (res twins.SaveResult, err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "save_states").Add(1)
 		ms.latency.With("method", "save_states").Observe(time.Since(begin).Seconds())
+		ms.countUnmatched(msg, res)
 	}(time.Now())
 
 	return ms.svc.SaveStates(msg)
 }
 
-func (ms *metricsMiddleware) ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string) (st twins.StatesPage, err error) {
+func (ms *metricsMiddleware) HandleDelivery(d twins.Delivery) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "handle_delivery").Add(1)
+		ms.latency.With("method", "handle_delivery").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.HandleDelivery(d)
+}
+
+func (ms *metricsMiddleware) SaveStatesBatch(ctx context.Context, msgs []*messaging.Message) (res []twins.SaveResult, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "save_states_batch").Add(1)
+		ms.latency.With("method", "save_states_batch").Observe(time.Since(begin).Seconds())
+		for i := range res {
+			ms.countUnmatched(msgs[i], res[i])
+		}
+	}(time.Now())
+
+	return ms.svc.SaveStatesBatch(ctx, msgs)
+}
+
+// countUnmatched counts the records of the message that matched no twin
+// attribute. Records are labeled by channel only, since subtopics would make
+// the number of series unbounded.
+func (ms *metricsMiddleware) countUnmatched(msg *messaging.Message, res twins.SaveResult) {
+	if ms.unmatched == nil || res.Unmatched == 0 {
+		return
+	}
+
+	ms.unmatched.With("channel", msg.Channel).Add(float64(res.Unmatched))
+}
+
+func (ms *metricsMiddleware) SimulateIngestion(ctx context.Context, token, twinID string, payload []byte) (twins.IngestionTrace, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "simulate_ingestion").Add(1)
+		ms.latency.With("method", "simulate_ingestion").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.SimulateIngestion(ctx, token, twinID, payload)
+}
+
+func (ms *metricsMiddleware) PublishIngestionSummaries() ([]twins.IngestionSummary, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "publish_ingestion_summaries").Add(1)
+		ms.latency.With("method", "publish_ingestion_summaries").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.PublishIngestionSummaries()
+}
+
+func (ms *metricsMiddleware) ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string, consistency twins.Consistency, order twins.Order, includeRaw bool) (st twins.StatesPage, err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "list_states").Add(1)
 		ms.latency.With("method", "list_states").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return ms.svc.ListStates(ctx, token, offset, limit, id)
+	return ms.svc.ListStates(ctx, token, offset, limit, id, consistency, order, includeRaw)
+}
+
+func (ms *metricsMiddleware) ListStatesByGroup(ctx context.Context, token, twinID, group string, offset uint64, limit uint64, consistency twins.Consistency, order twins.Order) (st twins.StatesPage, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "list_states_by_group").Add(1)
+		ms.latency.With("method", "list_states_by_group").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ListStatesByGroup(ctx, token, twinID, group, offset, limit, consistency, order)
+}
+
+func (ms *metricsMiddleware) ListStatesBySource(ctx context.Context, token, twinID, source string, offset uint64, limit uint64, order twins.Order) (st twins.StatesPage, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "list_states_by_source").Add(1)
+		ms.latency.With("method", "list_states_by_source").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ListStatesBySource(ctx, token, twinID, source, offset, limit, order)
+}
+
+func (ms *metricsMiddleware) ListChannelStates(ctx context.Context, token, channelID string, offset, limit uint64) (st twins.StatesPage, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "list_channel_states").Add(1)
+		ms.latency.With("method", "list_channel_states").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ListChannelStates(ctx, token, channelID, offset, limit)
+}
+
+func (ms *metricsMiddleware) VerifyStateChain(ctx context.Context, token, id string) (intact bool, broken int64, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "verify_state_chain").Add(1)
+		ms.latency.With("method", "verify_state_chain").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.VerifyStateChain(ctx, token, id)
+}
+
+func (ms *metricsMiddleware) Reindex(ctx context.Context, token, twinID string) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "reindex").Add(1)
+		ms.latency.With("method", "reindex").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.Reindex(ctx, token, twinID)
+}
+
+func (ms *metricsMiddleware) BackfillDerived(ctx context.Context, token, twinID, derivedAttr string) error {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "backfill_derived").Add(1)
+		ms.latency.With("method", "backfill_derived").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.BackfillDerived(ctx, token, twinID, derivedAttr)
 }
 
-func (ms *metricsMiddleware) RemoveTwin(ctx context.Context, token, id string) (err error) {
+func (ms *metricsMiddleware) StatesHistogram(ctx context.Context, token, twinID string, bucket time.Duration, from, to time.Time, loc *time.Location) ([]twins.BucketCount, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "states_histogram").Add(1)
+		ms.latency.With("method", "states_histogram").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.StatesHistogram(ctx, token, twinID, bucket, from, to, loc)
+}
+
+func (ms *metricsMiddleware) ListStatePartitions(ctx context.Context, token, twinID string, granularity twins.Granularity, loc *time.Location) ([]twins.Partition, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "list_state_partitions").Add(1)
+		ms.latency.With("method", "list_state_partitions").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ListStatePartitions(ctx, token, twinID, granularity, loc)
+}
+
+func (ms *metricsMiddleware) FindStates(ctx context.Context, token, twinID, attr string, op twins.Operator, value float64, offset, limit uint64) (twins.StatesPage, error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "find_states").Add(1)
+		ms.latency.With("method", "find_states").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.FindStates(ctx, token, twinID, attr, op, value, offset, limit)
+}
+
+func (ms *metricsMiddleware) RegisterUnitAlias(alias, canonical string) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "register_unit_alias").Add(1)
+		ms.latency.With("method", "register_unit_alias").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	ms.svc.RegisterUnitAlias(alias, canonical)
+}
+
+func (ms *metricsMiddleware) RemoveTwin(ctx context.Context, token, id string, cascade bool) (err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "remove_twin").Add(1)
 		ms.latency.With("method", "remove_twin").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return ms.svc.RemoveTwin(ctx, token, id)
+	return ms.svc.RemoveTwin(ctx, token, id, cascade)
+}
+
+func (ms *metricsMiddleware) ArchiveTwin(ctx context.Context, token, id string) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "archive_twin").Add(1)
+		ms.latency.With("method", "archive_twin").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ArchiveTwin(ctx, token, id)
+}
+
+func (ms *metricsMiddleware) RestoreArchivedTwin(ctx context.Context, token, id string) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "restore_archived_twin").Add(1)
+		ms.latency.With("method", "restore_archived_twin").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.RestoreArchivedTwin(ctx, token, id)
 }
@@ -0,0 +1,27 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import "context"
+
+// Archive holds a retired twin along with all of its states.
+type Archive struct {
+	Twin   Twin
+	States []State
+}
+
+// ArchiveStore specifies a cold storage API for archived twins.
+type ArchiveStore interface {
+	// Save stores the archive, replacing an existing archive of the same
+	// twin.
+	Save(context.Context, Archive) error
+
+	// Retrieve retrieves the archive of the twin having the provided
+	// identifier.
+	Retrieve(ctx context.Context, id string) (Archive, error)
+
+	// Remove removes the archive of the twin having the provided
+	// identifier.
+	Remove(ctx context.Context, id string) error
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"context"
+
+	"github.com/mainflux/mainflux/pkg/messaging"
+	"github.com/mainflux/senml"
+)
+
+// Delivery is a message received from a broker that delivers messages at
+// least once. The message is redelivered until it's acknowledged.
+type Delivery interface {
+	// Message returns the delivered message.
+	Message() *messaging.Message
+
+	// Attempt returns the number of times the message was delivered,
+	// including the current delivery.
+	Attempt() int
+
+	// Ack acknowledges the message, so it's not redelivered.
+	Ack() error
+
+	// Nack rejects the message, so it's redelivered.
+	Nack() error
+}
+
+// permanent reports whether saving the message failed for a reason that
+// redelivering it can't fix.
+func permanent(err error) bool {
+	if _, ok := err.(*ValidationError); ok {
+		return true
+	}
+
+	return err == ErrMalformedEntity || err == ErrUnsupportedContentType || err == ErrTypeMismatch || err == ErrInvalidValue || err == ErrQuotaExceeded || err == ErrPayloadTooLarge
+}
+
+type redeliveryKey struct{}
+
+// withRedelivery returns a copy of the context marking the message being
+// saved as redelivered.
+func withRedelivery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, redeliveryKey{}, true)
+}
+
+// redelivered reports whether the message being saved was redelivered.
+func redelivered(ctx context.Context) bool {
+	r, _ := ctx.Value(redeliveryKey{}).(bool)
+	return r
+}
+
+// persisted reports whether the record of a redelivered message was already
+// persisted by an earlier delivery, i.e. whether it's timed no later than the
+// last stored value of the attribute. Records without absolute time can't be
+// told apart from new ones, so they're saved again.
+func persisted(st State, attr Attribute, rec senml.Record) bool {
+	sec := rec.BaseTime + rec.Time
+	if sec < relativeTime {
+		return false
+	}
+
+	last, ok := st.AttributeTimes[attr.Name]
+	if !ok {
+		return false
+	}
+	t, _ := resolveTime(sec)
+
+	return !t.After(last)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a notification published by the twins service, sequenced in
+// order of publishing.
+type Event struct {
+	Seq       uint64
+	Operation string
+	Payload   []byte
+	Created   time.Time
+}
+
+// eventLog retains a bounded number of the most recent events.
+type eventLog struct {
+	mu     sync.Mutex
+	size   int
+	seq    uint64
+	events []Event
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		size:   size,
+		events: make([]Event, 0, size),
+	}
+}
+
+// append sequences the event and retains it, evicting the oldest event if
+// the log is full.
+func (el *eventLog) append(op string, payload []byte, created time.Time) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	el.seq++
+	if el.size <= 0 {
+		return
+	}
+
+	if len(el.events) == el.size {
+		copy(el.events, el.events[1:])
+		el.events = el.events[:len(el.events)-1]
+	}
+	el.events = append(el.events, Event{
+		Seq:       el.seq,
+		Operation: op,
+		Payload:   payload,
+		Created:   created,
+	})
+}
+
+// since returns retained events having sequence number greater than or
+// equal to seq. Sequence numbers start from 1. ErrEventsEvicted is returned
+// if some of the requested events are no longer retained.
+func (el *eventLog) since(seq uint64) ([]Event, error) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if seq == 0 {
+		seq = 1
+	}
+
+	first := el.seq + 1
+	if len(el.events) > 0 {
+		first = el.events[0].Seq
+	}
+	if seq < first {
+		return nil, ErrEventsEvicted
+	}
+
+	var events []Event
+	for _, e := range el.events {
+		if e.Seq >= seq {
+			events = append(events, e)
+		}
+	}
+
+	return events, nil
+}
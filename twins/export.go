@@ -0,0 +1,38 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import "time"
+
+// exportBatchSize is the number of states retrieved at once while streaming
+// an export.
+const exportBatchSize = 1000
+
+// exportedState is the representation of a state written by state exports,
+// one per line.
+type exportedState struct {
+	TwinID     string                 `json:"twin_id"`
+	ID         int64                  `json:"id"`
+	Definition int                    `json:"definition"`
+	Created    time.Time              `json:"created"`
+	Payload    map[string]interface{} `json:"payload"`
+	Sums       map[string]float64     `json:"sums,omitempty"`
+	Hash       string                 `json:"hash,omitempty"`
+	Note       string                 `json:"note,omitempty"`
+	Backfilled bool                   `json:"backfilled,omitempty"`
+}
+
+func newExportedState(st State) exportedState {
+	return exportedState{
+		TwinID:     st.TwinID,
+		ID:         st.ID,
+		Definition: st.Definition,
+		Created:    st.Created,
+		Payload:    st.Payload,
+		Sums:       st.Sums,
+		Hash:       st.Hash,
+		Note:       st.Note,
+		Backfilled: st.Backfilled,
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+// Ingestion behaviors that can be toggled per twin with Twin.Features. Twins
+// that don't set a feature get its default: smoothing and rounding are
+// enabled, while raw SenML storage and source capture follow the service
+// configuration.
+const (
+	// FeatureSmoothing computes moving averages of the attributes declaring
+	// a smoothing factor.
+	FeatureSmoothing = "smoothing"
+	// FeatureRounding rounds values of the attributes declaring a precision.
+	FeatureRounding = "rounding"
+	// FeatureRawSenML stores the SenML payload of the message a state was
+	// last saved or updated from.
+	FeatureRawSenML = "raw_senml"
+	// FeatureSourceCapture records the publisher of the message a state was
+	// last saved or updated from.
+	FeatureSourceCapture = "source_capture"
+)
+
+// Enabled reports whether the feature is enabled for the twin, falling back
+// to the default if the twin doesn't set it.
+func (tw Twin) Enabled(feature string, def bool) bool {
+	if enabled, ok := tw.Features[feature]; ok {
+		return enabled
+	}
+	return def
+}
+
+// ingestionDefinition returns the current definition of the twin with the
+// attribute settings of the disabled features cleared. The twin definitions
+// are left intact.
+func (tw Twin) ingestionDefinition() Definition {
+	def := tw.Definitions[len(tw.Definitions)-1]
+	smoothing, rounding := tw.Enabled(FeatureSmoothing, true), tw.Enabled(FeatureRounding, true)
+	if smoothing && rounding {
+		return def
+	}
+
+	attrs := make([]Attribute, len(def.Attributes))
+	copy(attrs, def.Attributes)
+	for i := range attrs {
+		if !smoothing {
+			attrs[i].Smoothing = 0
+		}
+		if !rounding {
+			attrs[i].Precision = nil
+		}
+	}
+	def.Attributes = attrs
+
+	return def
+}
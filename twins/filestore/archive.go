@@ -0,0 +1,86 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mainflux/mainflux/twins"
+)
+
+const archiveExt = ".json"
+
+var _ twins.ArchiveStore = (*archiveStore)(nil)
+
+type archiveStore struct {
+	dir string
+}
+
+// NewArchiveStore instantiates archive store keeping each archive as a JSON
+// file in the directory.
+func NewArchiveStore(dir string) twins.ArchiveStore {
+	return &archiveStore{
+		dir: dir,
+	}
+}
+
+func (as *archiveStore) Save(_ context.Context, arch twins.Archive) error {
+	data, err := json.Marshal(arch)
+	if err != nil {
+		return err
+	}
+
+	// The archive is written to a temporary file first, so an interrupted
+	// write doesn't replace an existing archive with a partial one.
+	tmp, err := ioutil.TempFile(as.dir, arch.Twin.ID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), as.path(arch.Twin.ID))
+}
+
+func (as *archiveStore) Retrieve(_ context.Context, id string) (twins.Archive, error) {
+	data, err := ioutil.ReadFile(as.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return twins.Archive{}, twins.ErrNotFound
+		}
+		return twins.Archive{}, err
+	}
+
+	var arch twins.Archive
+	if err := json.Unmarshal(data, &arch); err != nil {
+		return twins.Archive{}, err
+	}
+
+	return arch, nil
+}
+
+func (as *archiveStore) Remove(_ context.Context, id string) error {
+	if err := os.Remove(as.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// path returns the file of the twin archive. The base name guards against
+// ids escaping the directory.
+func (as *archiveStore) path(id string) string {
+	return filepath.Join(as.dir, filepath.Base(id)+archiveExt)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mainflux/mainflux/twins"
+	"github.com/mainflux/mainflux/twins/filestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "twins-archive")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	defer os.RemoveAll(dir)
+
+	store := filestore.NewArchiveStore(dir)
+
+	arch := twins.Archive{
+		Twin: twins.Twin{ID: "id", Owner: "user@example.com", Name: "name"},
+		States: []twins.State{
+			{TwinID: "id", ID: 0, Created: time.Now().Round(0).UTC(), Payload: map[string]interface{}{"temperature": 21.5}},
+		},
+	}
+
+	err = store.Save(context.Background(), arch)
+	require.Nil(t, err, fmt.Sprintf("save archive: unexpected error: %s", err))
+
+	cases := []struct {
+		desc string
+		id   string
+		arch twins.Archive
+		err  error
+	}{
+		{
+			desc: "retrieve existing archive",
+			id:   arch.Twin.ID,
+			arch: arch,
+			err:  nil,
+		},
+		{
+			desc: "retrieve non-existent archive",
+			id:   "wrong",
+			arch: twins.Archive{},
+			err:  twins.ErrNotFound,
+		},
+		{
+			desc: "retrieve archive by id containing parent directory",
+			id:   "../id",
+			arch: arch,
+			err:  nil,
+		},
+	}
+
+	for _, tc := range cases {
+		res, err := store.Retrieve(context.Background(), tc.id)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.arch, res, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.arch, res))
+	}
+
+	err = store.Remove(context.Background(), arch.Twin.ID)
+	require.Nil(t, err, fmt.Sprintf("remove archive: unexpected error: %s", err))
+	_, err = store.Retrieve(context.Background(), arch.Twin.ID)
+	assert.Equal(t, twins.ErrNotFound, err, fmt.Sprintf("retrieve removed archive: expected %s got %s\n", twins.ErrNotFound, err))
+}
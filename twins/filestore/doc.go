@@ -0,0 +1,6 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package filestore contains archive store implementation keeping archives
+// as files, e.g. on a mounted object storage bucket.
+package filestore
@@ -0,0 +1,134 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"math"
+	"time"
+)
+
+// healthSampleSize is the number of the most recent states checked for
+// values out of attribute ranges.
+const healthSampleSize = 100
+
+// Health factor names.
+const (
+	StalenessFactor = "staleness"
+	CoverageFactor  = "coverage"
+	RangeFactor     = "range"
+)
+
+// HealthWeights are the relative weights of the factors the twin health
+// score is combined from. Zero value weighs all the factors equally.
+// Weights must not be negative.
+type HealthWeights struct {
+	Staleness float64
+	Coverage  float64
+	Range     float64
+}
+
+var defHealthWeights = HealthWeights{Staleness: 1, Coverage: 1, Range: 1}
+
+// HealthScore rates the twin health from 0 to 100, combined from the
+// scores of the contributing factors.
+type HealthScore struct {
+	TwinID  string         `json:"twin_id"`
+	Score   int            `json:"score"`
+	Factors []HealthFactor `json:"factors"`
+}
+
+// HealthFactor is the score, from 0 to 100, of a factor contributing to the
+// twin health score with the given weight.
+type HealthFactor struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+	Score  int     `json:"score"`
+}
+
+// stalenessScore is full while the last state is within the heartbeat window
+// and decreases linearly to zero within the following window.
+func stalenessScore(last time.Time, window time.Duration) float64 {
+	if last.IsZero() {
+		return 0
+	}
+
+	late := time.Since(last) - window
+	if late <= 0 {
+		return 1
+	}
+
+	return math.Max(0, 1-float64(late)/float64(window))
+}
+
+// coverageScore is the share of the persisted attributes whose values were
+// stored since the given time.
+func coverageScore(st State, attrs []Attribute, since time.Time) float64 {
+	var total, covered int
+	for _, attr := range attrs {
+		if !attr.PersistState {
+			continue
+		}
+		total++
+		if t, ok := st.AttributeTimes[attr.Name]; ok && !t.Before(since) {
+			covered++
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+
+	return float64(covered) / float64(total)
+}
+
+// rangeScore is the share of the numeric values of the ranged attributes
+// within their ranges.
+func rangeScore(states []State, attrs []Attribute) float64 {
+	var checked, within int
+	for _, st := range states {
+		for _, attr := range attrs {
+			if attr.Range == nil {
+				continue
+			}
+			v, ok := toFloat(st.Payload[attr.Name])
+			if !ok {
+				continue
+			}
+			checked++
+			if attr.Range.contains(v) {
+				within++
+			}
+		}
+	}
+	if checked == 0 {
+		return 1
+	}
+
+	return float64(within) / float64(checked)
+}
+
+// healthScore combines the factor scores, weighted by the given weights.
+func healthScore(twinID string, weights HealthWeights, staleness, coverage, ranged float64) HealthScore {
+	if weights.Staleness+weights.Coverage+weights.Range <= 0 {
+		weights = defHealthWeights
+	}
+
+	hs := HealthScore{
+		TwinID: twinID,
+		Factors: []HealthFactor{
+			{Name: StalenessFactor, Weight: weights.Staleness, Score: percent(staleness)},
+			{Name: CoverageFactor, Weight: weights.Coverage, Score: percent(coverage)},
+			{Name: RangeFactor, Weight: weights.Range, Score: percent(ranged)},
+		},
+	}
+
+	total := weights.Staleness + weights.Coverage + weights.Range
+	score := (weights.Staleness*staleness + weights.Coverage*coverage + weights.Range*ranged) / total
+	hs.Score = percent(score)
+
+	return hs
+}
+
+func percent(share float64) int {
+	return int(math.Round(share * 100))
+}
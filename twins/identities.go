@@ -0,0 +1,101 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type identity struct {
+	token string
+	user  string
+	seen  time.Time
+}
+
+// identities keeps the users tokens were last successfully identified as, so
+// reads can be served while the auth service is unavailable. Saving an
+// identity evicts the least recently used identities that are older than the
+// ttl or exceed the size. Identities older than the ttl are also removed when
+// looked up.
+type identities struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	order *list.List
+	users map[string]*list.Element
+}
+
+func newIdentities(ttl time.Duration, size int) *identities {
+	return &identities{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		users: make(map[string]*list.Element),
+	}
+}
+
+func (ids *identities) save(token, user string) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := ids.users[token]; ok {
+		el.Value = identity{token: token, user: user, seen: now}
+		ids.order.MoveToFront(el)
+		return
+	}
+	ids.users[token] = ids.order.PushFront(identity{token: token, user: user, seen: now})
+
+	for el := ids.order.Back(); el != nil; el = ids.order.Back() {
+		if !ids.expired(el.Value.(identity), now) && (ids.size <= 0 || ids.order.Len() <= ids.size) {
+			break
+		}
+		ids.remove(el)
+	}
+}
+
+// lookup returns the user the token was last identified as, if it was
+// identified within the ttl.
+func (ids *identities) lookup(token string) (string, bool) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	el, ok := ids.users[token]
+	if !ok {
+		return "", false
+	}
+	id := el.Value.(identity)
+	if ids.expired(id, time.Now()) {
+		ids.remove(el)
+		return "", false
+	}
+	ids.order.MoveToFront(el)
+
+	return id.user, true
+}
+
+func (ids *identities) expired(id identity, now time.Time) bool {
+	return ids.ttl > 0 && now.Sub(id.seen) > ids.ttl
+}
+
+func (ids *identities) remove(el *list.Element) {
+	ids.order.Remove(el)
+	delete(ids.users, el.Value.(identity).token)
+}
+
+// unavailable reports whether the auth call failed because the auth service
+// couldn't be reached, rather than because the token was rejected.
+func unavailable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
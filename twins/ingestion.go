@@ -0,0 +1,66 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"sync"
+	"time"
+)
+
+// IngestionSummary reports the number of records stored for each attribute
+// of the twin within the interval starting at From and ending at To.
+type IngestionSummary struct {
+	TwinID     string            `json:"twin_id"`
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Attributes map[string]uint64 `json:"attributes"`
+}
+
+// ingestion counts records stored per twin attribute since the last drain.
+type ingestion struct {
+	mu     sync.Mutex
+	since  time.Time
+	counts map[string]map[string]uint64
+}
+
+func newIngestion() *ingestion {
+	return &ingestion{
+		since:  time.Now(),
+		counts: make(map[string]map[string]uint64),
+	}
+}
+
+func (in *ingestion) record(twinID, attr string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	counts, ok := in.counts[twinID]
+	if !ok {
+		counts = make(map[string]uint64)
+		in.counts[twinID] = counts
+	}
+	counts[attr]++
+}
+
+// drain returns the summaries of the interval since the last drain and
+// starts a new interval.
+func (in *ingestion) drain() []IngestionSummary {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	now := time.Now()
+	var summaries []IngestionSummary
+	for twinID, counts := range in.counts {
+		summaries = append(summaries, IngestionSummary{
+			TwinID:     twinID,
+			From:       in.since,
+			To:         now,
+			Attributes: counts,
+		})
+	}
+	in.since = now
+	in.counts = make(map[string]map[string]uint64)
+
+	return summaries
+}
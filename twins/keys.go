@@ -0,0 +1,72 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// keyPrefix marks values of twin keys, telling them apart from the tokens
+// issued by the auth service.
+const keyPrefix = "twk_"
+
+// keyIDLen is the number of leading hash characters identifying a key.
+const keyIDLen = 16
+
+// TwinKey is a key scoped to a single twin and action, issued by the twin
+// owner. Only the hash of the key value is stored, so the value is known
+// only to whoever the key was issued to.
+type TwinKey struct {
+	// ID identifies the key when it's revoked.
+	ID string
+
+	// Value is the key itself. It's set only on the key returned when the
+	// key is issued.
+	Value string
+
+	// Hash is the SHA-256 hash of the value the key is looked up by.
+	Hash string
+
+	Issuer  string
+	TwinID  string
+	Action  Action
+	Expires time.Time
+}
+
+// isTwinKey reports whether the token is a twin key.
+func isTwinKey(token string) bool {
+	return strings.HasPrefix(token, keyPrefix)
+}
+
+// hashKey returns the hex encoded SHA-256 hash of the key value.
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyKey returns the issuer of the key if the key is valid for the twin
+// and the action. Unknown, revoked and expired keys, and keys issued for
+// another twin or action, fail with ErrUnauthorizedAccess.
+func (ts *twinsService) verifyKey(ctx context.Context, value, twinID string, action Action) (string, error) {
+	key, err := ts.twins.RetrieveKey(ctx, hashKey(value))
+	if err == ErrNotFound {
+		return "", ErrUnauthorizedAccess
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !time.Now().Before(key.Expires) {
+		return "", ErrUnauthorizedAccess
+	}
+	if key.TwinID != twinID || key.Action != action {
+		return "", ErrUnauthorizedAccess
+	}
+
+	return key.Issuer, nil
+}
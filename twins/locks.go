@@ -0,0 +1,51 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"context"
+	"time"
+)
+
+// TwinLock is an advisory lock on a twin. The lock is held by whoever
+// presents its token, so two sessions of the same user, or two writers
+// sharing a twin, conflict with each other.
+type TwinLock struct {
+	TwinID  string
+	Token   string
+	Holder  string
+	Expires time.Time
+}
+
+type lockTokenKey struct{}
+
+// WithLockToken returns a copy of the context carrying the lock token.
+func WithLockToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, lockTokenKey{}, token)
+}
+
+// LockToken returns the lock token carried by the context, or an empty
+// string if there is none.
+func LockToken(ctx context.Context) string {
+	token, _ := ctx.Value(lockTokenKey{}).(string)
+	return token
+}
+
+// checkLock returns ErrLocked if the twin is locked and the context doesn't
+// carry the lock token. Expired locks are treated as released.
+func (ts *twinsService) checkLock(ctx context.Context, id string) error {
+	lk, err := ts.twins.RetrieveLock(ctx, id)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !time.Now().Before(lk.Expires) || lk.Token == LockToken(ctx) {
+		return nil
+	}
+
+	return ErrLocked
+}
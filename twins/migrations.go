@@ -0,0 +1,132 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import "fmt"
+
+// MigrationOp represents the change a migration step makes to an attribute.
+type MigrationOp int
+
+const (
+	// RenameAttribute renames the attribute.
+	RenameAttribute MigrationOp = iota
+	// ChangeUnit changes the attribute unit, converting its values.
+	ChangeUnit
+)
+
+// MigrationStep changes a single attribute of the twin definition. To is
+// the new name of the renamed attribute, or the new unit. Values of the
+// attribute whose unit is changed are converted to value*Scale+Offset.
+type MigrationStep struct {
+	Op        MigrationOp
+	Attribute string
+	To        string
+	Scale     float64
+	Offset    float64
+}
+
+// Migration is a sequence of steps applied to twin definitions, in order.
+type Migration struct {
+	Steps []MigrationStep
+}
+
+// MigrationResult reports the outcome of the migration of each twin. Twins
+// that failed to migrate are left unchanged.
+type MigrationResult struct {
+	Migrated []string
+	Failed   map[string]error
+}
+
+// apply applies the migration to the definition and the last state of the
+// twin. The state may be empty if the twin has no states.
+func (m Migration) apply(def Definition, st State) (Definition, State, error) {
+	attrs := make([]Attribute, len(def.Attributes))
+	copy(attrs, def.Attributes)
+	def.Attributes = attrs
+	st = st.clone()
+
+	for i, step := range m.Steps {
+		idx := findAttribute(step.Attribute, def.Attributes)
+		if idx < 0 {
+			return Definition{}, State{}, invalidField(fmt.Sprintf("steps[%d].attribute", i), "unknown attribute %q", step.Attribute)
+		}
+
+		switch step.Op {
+		case RenameAttribute:
+			if step.To == "" || findAttribute(step.To, def.Attributes) >= 0 {
+				return Definition{}, State{}, invalidField(fmt.Sprintf("steps[%d].to", i), "invalid attribute name %q", step.To)
+			}
+			def.Attributes[idx].Name = step.To
+			for j := range def.Attributes {
+				if def.Attributes[j].DerivativeOf == step.Attribute {
+					def.Attributes[j].DerivativeOf = step.To
+				}
+			}
+			st.rename(step.Attribute, step.To)
+		case ChangeUnit:
+			if step.Scale == 0 {
+				return Definition{}, State{}, invalidField(fmt.Sprintf("steps[%d].scale", i), "scale must not be zero")
+			}
+			def.Attributes[idx] = step.convert(def.Attributes[idx])
+			st.convert(step.Attribute, step.value)
+		default:
+			return Definition{}, State{}, invalidField(fmt.Sprintf("steps[%d].op", i), "unknown operation")
+		}
+	}
+
+	return def, st, nil
+}
+
+func (step MigrationStep) value(v float64) float64 {
+	return v*step.Scale + step.Offset
+}
+
+// convert sets the unit of the attribute and converts its default value and
+// expected range.
+func (step MigrationStep) convert(attr Attribute) Attribute {
+	attr.Unit = step.To
+	if v, ok := attr.Default.(float64); ok {
+		attr.Default = step.value(v)
+	}
+	if attr.Range != nil {
+		min, max := step.value(attr.Range.Min), step.value(attr.Range.Max)
+		if min > max {
+			min, max = max, min
+		}
+		attr.Range = &ValueRange{Min: min, Max: max}
+	}
+
+	return attr
+}
+
+func (st *State) rename(from, to string) {
+	if v, ok := st.Payload[from]; ok {
+		delete(st.Payload, from)
+		st.Payload[to] = v
+	}
+	if v, ok := st.Smoothed[from]; ok {
+		delete(st.Smoothed, from)
+		st.Smoothed[to] = v
+	}
+	if v, ok := st.Sums[from]; ok {
+		delete(st.Sums, from)
+		st.Sums[to] = v
+	}
+	if v, ok := st.AttributeTimes[from]; ok {
+		delete(st.AttributeTimes, from)
+		st.AttributeTimes[to] = v
+	}
+}
+
+func (st *State) convert(attr string, conv func(float64) float64) {
+	if v, ok := toFloat(st.Payload[attr]); ok {
+		st.Payload[attr] = conv(v)
+	}
+	if v, ok := st.Smoothed[attr]; ok {
+		st.Smoothed[attr] = conv(v)
+	}
+	if v, ok := st.Sums[attr]; ok {
+		st.Sums[attr] = conv(v)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mainflux/mainflux/twins"
+)
+
+var _ twins.ArchiveStore = (*archiveStoreMock)(nil)
+
+type archiveStoreMock struct {
+	mu       sync.Mutex
+	archives map[string]twins.Archive
+}
+
+// NewArchiveStore creates in-memory archive store.
+func NewArchiveStore() twins.ArchiveStore {
+	return &archiveStoreMock{
+		archives: make(map[string]twins.Archive),
+	}
+}
+
+func (asm *archiveStoreMock) Save(_ context.Context, arch twins.Archive) error {
+	asm.mu.Lock()
+	defer asm.mu.Unlock()
+
+	asm.archives[arch.Twin.ID] = arch
+
+	return nil
+}
+
+func (asm *archiveStoreMock) Retrieve(_ context.Context, id string) (twins.Archive, error) {
+	asm.mu.Lock()
+	defer asm.mu.Unlock()
+
+	arch, ok := asm.archives[id]
+	if !ok {
+		return twins.Archive{}, twins.ErrNotFound
+	}
+
+	return arch, nil
+}
+
+func (asm *archiveStoreMock) Remove(_ context.Context, id string) error {
+	asm.mu.Lock()
+	defer asm.mu.Unlock()
+
+	delete(asm.archives, id)
+
+	return nil
+}
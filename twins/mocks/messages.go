@@ -4,8 +4,11 @@
 package mocks
 
 import (
+	"sync"
+
 	"github.com/mainflux/mainflux/pkg/errors"
 	"github.com/mainflux/mainflux/pkg/messaging"
+	"github.com/mainflux/mainflux/twins"
 )
 
 var _ messaging.Publisher = (*mockBroker)(nil)
@@ -27,3 +30,97 @@ func (mb mockBroker) Publish(topic string, msg messaging.Message) error {
 	}
 	return nil
 }
+
+var _ messaging.Publisher = (*RedeliveringBroker)(nil)
+
+// RedeliveringBroker is a mock broker that redelivers nacked messages, the
+// way brokers delivering messages at least once do, and records the
+// messages published to it.
+type RedeliveringBroker struct {
+	mu        sync.Mutex
+	published map[string][]messaging.Message
+	failing   bool
+}
+
+// NewRedeliveringBroker returns mock broker redelivering nacked messages.
+func NewRedeliveringBroker() *RedeliveringBroker {
+	return &RedeliveringBroker{
+		published: make(map[string][]messaging.Message),
+	}
+}
+
+// Publish records the message published to the topic.
+func (rb *RedeliveringBroker) Publish(topic string, msg messaging.Message) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.failing {
+		return errors.New("failed to publish")
+	}
+	rb.published[topic] = append(rb.published[topic], msg)
+
+	return nil
+}
+
+// SetFailing makes publishing fail until it's reset.
+func (rb *RedeliveringBroker) SetFailing(failing bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.failing = failing
+}
+
+// Published returns the messages published to the topic.
+func (rb *RedeliveringBroker) Published(topic string) []messaging.Message {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return rb.published[topic]
+}
+
+// Deliver delivers the message to the handler, and redelivers it as long as
+// it's nacked, at most maxDeliveries times. It returns the number of
+// deliveries and whether the message was acked.
+func (rb *RedeliveringBroker) Deliver(msg *messaging.Message, handler func(twins.Delivery) error, maxDeliveries int) (int, bool) {
+	d := &delivery{msg: msg}
+	for d.attempt < maxDeliveries {
+		d.attempt++
+		d.nacked = false
+		handler(d)
+		if d.acked {
+			return d.attempt, true
+		}
+		if !d.nacked {
+			break
+		}
+	}
+
+	return d.attempt, false
+}
+
+var _ twins.Delivery = (*delivery)(nil)
+
+type delivery struct {
+	msg     *messaging.Message
+	attempt int
+	acked   bool
+	nacked  bool
+}
+
+func (d *delivery) Message() *messaging.Message {
+	return d.msg
+}
+
+func (d *delivery) Attempt() int {
+	return d.attempt
+}
+
+func (d *delivery) Ack() error {
+	d.acked = true
+	return nil
+}
+
+func (d *delivery) Nack() error {
+	d.nacked = true
+	return nil
+}
@@ -22,7 +22,7 @@ func NewService(tokens map[string]string) twins.Service {
 	uuidProvider := uuid.NewMock()
 	subs := map[string]string{"chanID": "chanID"}
 	broker := NewBroker(subs)
-	return twins.New(broker, auth, twinsRepo, statesRepo, uuidProvider, "chanID", nil)
+	return twins.New(broker, auth, twinsRepo, statesRepo, uuidProvider, "chanID", twins.Config{}, nil)
 }
 
 // CreateDefinition creates twin definition
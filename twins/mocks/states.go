@@ -6,8 +6,10 @@ package mocks
 import (
 	"context"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mainflux/mainflux/twins"
 )
@@ -15,14 +17,31 @@ import (
 var _ twins.StateRepository = (*stateRepositoryMock)(nil)
 
 type stateRepositoryMock struct {
-	mu     sync.Mutex
-	states map[string]twins.State
+	mu      sync.Mutex
+	states  map[string]twins.State
+	replica map[string]twins.State
+	pending []twins.State
+	lag     int
+
+	// index maps twin attribute to the keys of states containing it,
+	// sorted by state creation time.
+	index map[string][]string
 }
 
 // NewStateRepository creates in-memory twin repository.
 func NewStateRepository() twins.StateRepository {
+	return NewReplicatedStateRepository(0)
+}
+
+// NewReplicatedStateRepository creates in-memory twin repository whose
+// replica, used for eventually consistent reads, lags behind the primary
+// by the given number of writes.
+func NewReplicatedStateRepository(lag int) twins.StateRepository {
 	return &stateRepositoryMock{
-		states: make(map[string]twins.State),
+		states:  make(map[string]twins.State),
+		replica: make(map[string]twins.State),
+		lag:     lag,
+		index:   make(map[string][]string),
 	}
 }
 
@@ -31,7 +50,14 @@ func (srm *stateRepositoryMock) Save(ctx context.Context, st twins.State) error
 	srm.mu.Lock()
 	defer srm.mu.Unlock()
 
-	srm.states[key(st.TwinID, string(st.ID))] = st
+	// States are stored detached from the payload the service keeps
+	// updating, as if they were serialized.
+	st.Payload = copyPayload(st.Payload)
+	st.AttributeTimes = copyTimes(st.AttributeTimes)
+	st.Sums = copySums(st.Sums)
+	srm.reindex(st)
+	srm.states[stateKey(st)] = st
+	srm.replicate(st)
 
 	return nil
 }
@@ -41,7 +67,144 @@ func (srm *stateRepositoryMock) Update(ctx context.Context, st twins.State) erro
 	srm.mu.Lock()
 	defer srm.mu.Unlock()
 
-	srm.states[key(st.TwinID, string(st.ID))] = st
+	st.Payload = copyPayload(st.Payload)
+	st.AttributeTimes = copyTimes(st.AttributeTimes)
+	st.Sums = copySums(st.Sums)
+	srm.reindex(st)
+	srm.states[stateKey(st)] = st
+	srm.replicate(st)
+
+	return nil
+}
+
+func copyPayload(payload map[string]interface{}) map[string]interface{} {
+	if payload == nil {
+		return nil
+	}
+
+	cp := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyTimes(times map[string]time.Time) map[string]time.Time {
+	if times == nil {
+		return nil
+	}
+
+	cp := make(map[string]time.Time, len(times))
+	for k, v := range times {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copySums(sums map[string]float64) map[string]float64 {
+	if sums == nil {
+		return nil
+	}
+
+	cp := make(map[string]float64, len(sums))
+	for k, v := range sums {
+		cp[k] = v
+	}
+	return cp
+}
+
+// floatValue returns the numeric payload value, stored either as a value or
+// as the pointer SenML records carry it as.
+func floatValue(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case *float64:
+		if v == nil {
+			return 0, false
+		}
+		return *v, true
+	default:
+		return 0, false
+	}
+}
+
+// Annotate sets the note of the state
+func (srm *stateRepositoryMock) Annotate(ctx context.Context, twinID string, id int64, note string) error {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	k := stateKey(twins.State{TwinID: twinID, ID: id})
+	st, ok := srm.states[k]
+	if !ok {
+		return twins.ErrNotFound
+	}
+
+	st.Note = note
+	srm.states[k] = st
+	srm.replicate(st)
+
+	return nil
+}
+
+// RemoveAll removes all the states of the twin
+func (srm *stateRepositoryMock) RemoveAll(ctx context.Context, twinID string) error {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	for k, st := range srm.states {
+		if st.TwinID != twinID {
+			continue
+		}
+		for attr := range st.Payload {
+			delete(srm.index, key(twinID, attr))
+		}
+		delete(srm.states, k)
+		delete(srm.replica, k)
+	}
+
+	pending := srm.pending[:0]
+	for _, st := range srm.pending {
+		if st.TwinID != twinID {
+			pending = append(pending, st)
+		}
+	}
+	srm.pending = pending
+
+	return nil
+}
+
+// Reindex rebuilds the attribute index entries of the twin states
+func (srm *stateRepositoryMock) Reindex(ctx context.Context, twinID string) error {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	prefix := key(twinID, "")
+	for ik := range srm.index {
+		if strings.HasPrefix(ik, prefix) {
+			delete(srm.index, ik)
+		}
+	}
+
+	var items []twins.State
+	for _, st := range srm.states {
+		if st.TwinID == twinID {
+			items = append(items, st)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Created.Equal(items[j].Created) {
+			return items[i].ID < items[j].ID
+		}
+		return items[i].Created.Before(items[j].Created)
+	})
+
+	for _, st := range items {
+		for attr := range st.Payload {
+			ik := key(twinID, attr)
+			srm.index[ik] = append(srm.index[ik], stateKey(st))
+		}
+	}
 
 	return nil
 }
@@ -51,7 +214,42 @@ func (srm *stateRepositoryMock) Count(ctx context.Context, tw twins.Twin) (int64
 	return int64(len(srm.states)), nil
 }
 
-func (srm *stateRepositoryMock) RetrieveAll(ctx context.Context, offset uint64, limit uint64, twinID string) (twins.StatesPage, error) {
+// CountSince returns the number of states created at or after since
+func (srm *stateRepositoryMock) CountSince(ctx context.Context, since time.Time) (int64, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	var n int64
+	for _, st := range srm.states {
+		if !st.Created.Before(since) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// CountByTwins returns the number of states of the twins
+func (srm *stateRepositoryMock) CountByTwins(ctx context.Context, ids []string) (int64, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	var n int64
+	for _, st := range srm.states {
+		if set[st.TwinID] {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (srm *stateRepositoryMock) RetrieveAll(ctx context.Context, offset uint64, limit uint64, twinID string, consistency twins.Consistency, order twins.Order) (twins.StatesPage, error) {
 	srm.mu.Lock()
 	defer srm.mu.Unlock()
 
@@ -61,24 +259,34 @@ func (srm *stateRepositoryMock) RetrieveAll(ctx context.Context, offset uint64,
 		return twins.StatesPage{}, nil
 	}
 
-	for k, v := range srm.states {
-		if (uint64)(len(items)) >= limit {
-			break
-		}
-		if !strings.HasPrefix(k, twinID) {
-			continue
-		}
-		id := uint64(v.ID)
-		if id >= offset && id < offset+limit {
+	states := srm.states
+	if consistency == twins.Eventual {
+		states = srm.replica
+	}
+
+	for k, v := range states {
+		if strings.HasPrefix(k, twinID) {
 			items = append(items, v)
 		}
 	}
 
 	sort.SliceStable(items, func(i, j int) bool {
+		if order == twins.Desc {
+			return items[i].ID > items[j].ID
+		}
 		return items[i].ID < items[j].ID
 	})
 
-	total := uint64(len(srm.states))
+	if offset > uint64(len(items)) {
+		offset = uint64(len(items))
+	}
+	end := offset + limit
+	if end > uint64(len(items)) {
+		end = uint64(len(items))
+	}
+	items = items[offset:end]
+
+	total := uint64(len(states))
 	page := twins.StatesPage{
 		States: items,
 		PageMetadata: twins.PageMetadata{
@@ -91,6 +299,227 @@ func (srm *stateRepositoryMock) RetrieveAll(ctx context.Context, offset uint64,
 	return page, nil
 }
 
+// RetrieveByTwins returns the states of the twins, newest first.
+func (srm *stateRepositoryMock) RetrieveByTwins(ctx context.Context, ids []string, offset, limit uint64) (twins.StatesPage, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	var items []twins.State
+	for _, st := range srm.states {
+		if set[st.TwinID] {
+			items = append(items, st)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Created.Equal(items[j].Created) {
+			return items[i].Created.After(items[j].Created)
+		}
+		if items[i].TwinID != items[j].TwinID {
+			return items[i].TwinID < items[j].TwinID
+		}
+		return items[i].ID > items[j].ID
+	})
+
+	page := twins.StatesPage{
+		States: []twins.State{},
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(len(items)),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	for i := offset; i < uint64(len(items)) && i-offset < limit; i++ {
+		page.States = append(page.States, items[i])
+	}
+
+	return page, nil
+}
+
+// ListUntil returns the states of twin created at or before until, newest
+// first.
+func (srm *stateRepositoryMock) ListUntil(ctx context.Context, id string, until time.Time, offset, limit uint64) (twins.StatesPage, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	var items []twins.State
+	for _, st := range srm.states {
+		if st.TwinID == id && !st.Created.After(until) {
+			items = append(items, st)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Created.Equal(items[j].Created) {
+			return items[i].Created.After(items[j].Created)
+		}
+		return items[i].ID > items[j].ID
+	})
+
+	page := twins.StatesPage{
+		States: []twins.State{},
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(len(items)),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	for i := offset; i < uint64(len(items)) && i-offset < limit; i++ {
+		page.States = append(page.States, items[i])
+	}
+
+	return page, nil
+}
+
+// ListByAttribute returns the states of twin containing the attribute,
+// created within the time range, using the attribute index
+func (srm *stateRepositoryMock) ListByAttribute(ctx context.Context, twinID, attr string, from, to time.Time, offset, limit uint64) (twins.StatesPage, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	keys := srm.index[key(twinID, attr)]
+	start := sort.Search(len(keys), func(i int) bool {
+		return !srm.states[keys[i]].Created.Before(from)
+	})
+	end := len(keys)
+	if !to.IsZero() {
+		end = sort.Search(len(keys), func(i int) bool {
+			return srm.states[keys[i]].Created.After(to)
+		})
+	}
+	if end < start {
+		end = start
+	}
+	keys = keys[start:end]
+
+	page := twins.StatesPage{
+		States: []twins.State{},
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(len(keys)),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	for i := offset; i < uint64(len(keys)) && i-offset < limit; i++ {
+		page.States = append(page.States, srm.states[keys[i]])
+	}
+
+	return page, nil
+}
+
+// ListByValue returns the states of twin whose numeric value of the
+// attribute matches the operator, scanning the attribute index
+func (srm *stateRepositoryMock) ListByValue(ctx context.Context, twinID, attr string, op twins.Operator, value float64, offset, limit uint64) (twins.StatesPage, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	var keys []string
+	for _, k := range srm.index[key(twinID, attr)] {
+		if v, ok := floatValue(srm.states[k].Payload[attr]); ok && op.Match(v, value) {
+			keys = append(keys, k)
+		}
+	}
+
+	page := twins.StatesPage{
+		States: []twins.State{},
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(len(keys)),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	for i := offset; i < uint64(len(keys)) && i-offset < limit; i++ {
+		page.States = append(page.States, srm.states[keys[i]])
+	}
+
+	return page, nil
+}
+
+// ListBySource returns the states of twin saved from messages of the
+// source, in the provided order
+func (srm *stateRepositoryMock) ListBySource(ctx context.Context, twinID, source string, offset, limit uint64, order twins.Order) (twins.StatesPage, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	var items []twins.State
+	for _, st := range srm.states {
+		if st.TwinID == twinID && st.Source == source {
+			items = append(items, st)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if order == twins.Desc {
+			return items[i].ID > items[j].ID
+		}
+		return items[i].ID < items[j].ID
+	})
+
+	page := twins.StatesPage{
+		States: []twins.State{},
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(len(items)),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	for i := offset; i < uint64(len(items)) && i-offset < limit; i++ {
+		page.States = append(page.States, items[i])
+	}
+
+	return page, nil
+}
+
+// CountByBucket returns the number of states of twin created within each
+// time bucket
+func (srm *stateRepositoryMock) CountByBucket(ctx context.Context, twinID string, from, to time.Time, bucket time.Duration) ([]twins.BucketCount, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	counts := make(map[int64]uint64)
+	for _, st := range srm.states {
+		if st.TwinID != twinID || st.Created.Before(from) || !st.Created.Before(to) {
+			continue
+		}
+		counts[int64(st.Created.Sub(from)/bucket)]++
+	}
+
+	var buckets []twins.BucketCount
+	for i, n := range counts {
+		buckets = append(buckets, twins.BucketCount{
+			Start: from.Add(time.Duration(i) * bucket),
+			Count: n,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+
+	return buckets, nil
+}
+
+// CountByPartition returns the number of states of twin created within each
+// calendar period
+func (srm *stateRepositoryMock) CountByPartition(ctx context.Context, twinID string, granularity twins.Granularity, loc *time.Location) ([]twins.Partition, error) {
+	srm.mu.Lock()
+	defer srm.mu.Unlock()
+
+	counts := make(map[time.Time]uint64)
+	for _, st := range srm.states {
+		if st.TwinID == twinID {
+			counts[granularity.Truncate(st.Created, loc)]++
+		}
+	}
+
+	var partitions []twins.Partition
+	for start, n := range counts {
+		partitions = append(partitions, twins.Partition{Start: start, Count: n})
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Start.Before(partitions[j].Start) })
+
+	return partitions, nil
+}
+
 // RetrieveLast returns the last state related to twin spec by id
 func (srm *stateRepositoryMock) RetrieveLast(ctx context.Context, id string) (twins.State, error) {
 	srm.mu.Lock()
@@ -107,7 +536,57 @@ func (srm *stateRepositoryMock) RetrieveLast(ctx context.Context, id string) (tw
 	})
 
 	if len(items) > 0 {
-		return items[len(items)-1], nil
+		// The service updates the last state payload in place.
+		st := items[len(items)-1]
+		st.Payload = copyPayload(st.Payload)
+		st.AttributeTimes = copyTimes(st.AttributeTimes)
+		st.Sums = copySums(st.Sums)
+		return st, nil
 	}
 	return twins.State{}, nil
 }
+
+// replicate queues the write for the replica and applies the writes
+// exceeding the configured lag.
+func (srm *stateRepositoryMock) replicate(st twins.State) {
+	srm.pending = append(srm.pending, st)
+	for len(srm.pending) > srm.lag {
+		st := srm.pending[0]
+		srm.replica[stateKey(st)] = st
+		srm.pending = srm.pending[1:]
+	}
+}
+
+// reindex removes the previous version of the state from the attribute
+// index and inserts the new one, keeping the index sorted by creation time.
+func (srm *stateRepositoryMock) reindex(st twins.State) {
+	k := stateKey(st)
+	if old, ok := srm.states[k]; ok {
+		for attr := range old.Payload {
+			ik := key(old.TwinID, attr)
+			keys := srm.index[ik]
+			for i, v := range keys {
+				if v == k {
+					srm.index[ik] = append(keys[:i], keys[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	for attr := range st.Payload {
+		ik := key(st.TwinID, attr)
+		keys := srm.index[ik]
+		i := sort.Search(len(keys), func(i int) bool {
+			return srm.states[keys[i]].Created.After(st.Created)
+		})
+		keys = append(keys, "")
+		copy(keys[i+1:], keys[i:])
+		keys[i] = k
+		srm.index[ik] = keys
+	}
+}
+
+func stateKey(st twins.State) string {
+	return key(st.TwinID, strconv.FormatInt(st.ID, 10))
+}
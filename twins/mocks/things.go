@@ -0,0 +1,36 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+
+	"github.com/mainflux/mainflux/twins"
+)
+
+var _ twins.ThingVerifier = (*thingVerifierMock)(nil)
+
+type thingVerifierMock struct {
+	things map[string]string
+}
+
+// NewThingVerifier creates thing verifier mock. Things and channels are
+// mapped to the tokens they can be accessed with.
+func NewThingVerifier(things map[string]string) twins.ThingVerifier {
+	return &thingVerifierMock{
+		things: things,
+	}
+}
+
+func (tvm *thingVerifierMock) Verify(_ context.Context, token, thingID string) error {
+	if t, ok := tvm.things[thingID]; !ok || t != token {
+		return twins.ErrNotFound
+	}
+
+	return nil
+}
+
+func (tvm *thingVerifierMock) VerifyChannel(ctx context.Context, token, chanID string) error {
+	return tvm.Verify(ctx, token, chanID)
+}
@@ -5,10 +5,12 @@ package mocks
 
 import (
 	"context"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mainflux/mainflux/pkg/uuid"
 	"github.com/mainflux/mainflux/twins"
@@ -17,14 +19,22 @@ import (
 var _ twins.TwinRepository = (*twinRepositoryMock)(nil)
 
 type twinRepositoryMock struct {
-	mu    sync.Mutex
-	twins map[string]twins.Twin
+	mu      sync.Mutex
+	twins   map[string]twins.Twin
+	schemas map[string]twins.MetadataSchema
+	quotas  map[string]uint64
+	keys    map[string]twins.TwinKey
+	locks   map[string]twins.TwinLock
 }
 
 // NewTwinRepository creates in-memory twin repository.
 func NewTwinRepository() twins.TwinRepository {
 	return &twinRepositoryMock{
-		twins: make(map[string]twins.Twin),
+		twins:   make(map[string]twins.Twin),
+		schemas: make(map[string]twins.MetadataSchema),
+		quotas:  make(map[string]uint64),
+		keys:    make(map[string]twins.TwinKey),
+		locks:   make(map[string]twins.TwinLock),
 	}
 }
 
@@ -57,6 +67,25 @@ func (trm *twinRepositoryMock) Update(ctx context.Context, twin twins.Twin) erro
 	return nil
 }
 
+func (trm *twinRepositoryMock) UpdateIf(ctx context.Context, twin twins.Twin, conditions twins.Metadata) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	dbKey := key(twin.Owner, twin.ID)
+	tw, ok := trm.twins[dbKey]
+	if !ok {
+		return twins.ErrNotFound
+	}
+
+	if !matchMetadata(tw.Metadata, conditions) {
+		return twins.ErrConflict
+	}
+
+	trm.twins[dbKey] = twin
+
+	return nil
+}
+
 func (trm *twinRepositoryMock) RetrieveByID(_ context.Context, id string) (twins.Twin, error) {
 	trm.mu.Lock()
 	defer trm.mu.Unlock()
@@ -70,12 +99,12 @@ func (trm *twinRepositoryMock) RetrieveByID(_ context.Context, id string) (twins
 	return twins.Twin{}, twins.ErrNotFound
 }
 
-func (trm *twinRepositoryMock) RetrieveByAttribute(ctx context.Context, channel, subtopic string) ([]string, error) {
+func (trm *twinRepositoryMock) RetrieveByAttribute(ctx context.Context, channel, subtopic string, caseInsensitive bool) ([]string, error) {
 	var ids []string
 	for _, twin := range trm.twins {
 		def := twin.Definitions[len(twin.Definitions)-1]
 		for _, attr := range def.Attributes {
-			if attr.Channel == channel && attr.Subtopic == subtopic {
+			if attr.Channel == channel && matchSubtopics(attr.Subtopics(), subtopic, caseInsensitive) {
 				ids = append(ids, twin.ID)
 				break
 			}
@@ -88,6 +117,37 @@ func (trm *twinRepositoryMock) RetrieveByAttribute(ctx context.Context, channel,
 	return ids, twins.ErrNotFound
 }
 
+func (trm *twinRepositoryMock) Count(ctx context.Context) (int64, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	return int64(len(trm.twins)), nil
+}
+
+func (trm *twinRepositoryMock) CountChannels(ctx context.Context) (int64, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	channels := make(map[string]bool)
+	for _, tw := range trm.twins {
+		def := tw.Definitions[len(tw.Definitions)-1]
+		for _, attr := range def.Attributes {
+			channels[attr.Channel] = true
+		}
+	}
+
+	return int64(len(channels)), nil
+}
+
+func matchSubtopics(subtopics []string, subtopic string, caseInsensitive bool) bool {
+	for _, s := range subtopics {
+		if s == subtopic || (caseInsensitive && strings.EqualFold(s, subtopic)) || strings.Contains(s, "{") {
+			return true
+		}
+	}
+	return false
+}
+
 func (trm *twinRepositoryMock) RetrieveAll(_ context.Context, owner string, offset uint64, limit uint64, name string, metadata twins.Metadata) (twins.Page, error) {
 	trm.mu.Lock()
 	defer trm.mu.Unlock()
@@ -132,6 +192,141 @@ func (trm *twinRepositoryMock) RetrieveAll(_ context.Context, owner string, offs
 	return page, nil
 }
 
+func (trm *twinRepositoryMock) RetrieveByBase(ctx context.Context, baseID string) ([]string, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	var ids []string
+	for _, tw := range trm.twins {
+		if tw.BaseTwinID == baseID {
+			ids = append(ids, tw.ID)
+		}
+	}
+
+	return ids, nil
+}
+
+func (trm *twinRepositoryMock) RetrieveIDs(ctx context.Context, owner string) ([]string, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	ids := []string{}
+	for _, tw := range trm.twins {
+		if tw.Owner == owner {
+			ids = append(ids, tw.ID)
+		}
+	}
+
+	return ids, nil
+}
+
+func (trm *twinRepositoryMock) RetrieveByMetadata(ctx context.Context, owner string, filter twins.Metadata, limit uint64) ([]twins.Twin, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	var items []twins.Twin
+	for _, tw := range trm.twins {
+		if uint64(len(items)) >= limit {
+			break
+		}
+		if tw.Owner == owner && matchMetadata(tw.Metadata, filter) {
+			items = append(items, tw)
+		}
+	}
+
+	return items, nil
+}
+
+func (trm *twinRepositoryMock) RetrieveByThing(ctx context.Context, owner, thingID string, limit uint64) ([]twins.Twin, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	var items []twins.Twin
+	for _, tw := range trm.twins {
+		if uint64(len(items)) >= limit {
+			break
+		}
+		if tw.Owner == owner && tw.ThingID == thingID {
+			items = append(items, tw)
+		}
+	}
+
+	return items, nil
+}
+
+func (trm *twinRepositoryMock) RetrieveByChannel(ctx context.Context, channelID string) ([]twins.Twin, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	var items []twins.Twin
+	for _, tw := range trm.twins {
+		if tw.ChannelID == channelID {
+			items = append(items, tw)
+		}
+	}
+
+	return items, nil
+}
+
+func (trm *twinRepositoryMock) RetrieveByInput(ctx context.Context, sourceID string) ([]twins.Twin, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	var items []twins.Twin
+	for _, tw := range trm.twins {
+		for _, in := range tw.Inputs {
+			if in.SourceTwinID == sourceID {
+				items = append(items, tw)
+				break
+			}
+		}
+	}
+
+	return items, nil
+}
+
+func (trm *twinRepositoryMock) UpdateMetadata(ctx context.Context, owner string, filter, patch twins.Metadata) (uint64, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	var n uint64
+	for k, v := range trm.twins {
+		if v.Owner != owner || !matchMetadata(v.Metadata, filter) {
+			continue
+		}
+		md := twins.Metadata{}
+		for mk, mv := range v.Metadata {
+			md[mk] = mv
+		}
+		for mk, mv := range patch {
+			md[mk] = mv
+		}
+		v.Metadata = md
+		v.Updated = time.Now()
+		v.Revision++
+		trm.twins[k] = v
+		n++
+	}
+
+	return n, nil
+}
+
+func (trm *twinRepositoryMock) SaveLastError(ctx context.Context, id, msg string, at time.Time) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	for k, v := range trm.twins {
+		if v.ID == id {
+			v.LastError = msg
+			v.LastErrorAt = at
+			trm.twins[k] = v
+			return nil
+		}
+	}
+
+	return twins.ErrNotFound
+}
+
 func (trm *twinRepositoryMock) Remove(ctx context.Context, id string) error {
 	trm.mu.Lock()
 	defer trm.mu.Unlock()
@@ -145,3 +340,139 @@ func (trm *twinRepositoryMock) Remove(ctx context.Context, id string) error {
 
 	return nil
 }
+
+func (trm *twinRepositoryMock) SaveMetadataSchema(ctx context.Context, owner string, schema twins.MetadataSchema) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	trm.schemas[owner] = schema
+
+	return nil
+}
+
+func (trm *twinRepositoryMock) RetrieveMetadataSchema(ctx context.Context, owner string) (twins.MetadataSchema, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	return trm.schemas[owner], nil
+}
+
+func (trm *twinRepositoryMock) SaveOwnerQuota(ctx context.Context, owner string, maxStates uint64) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	if maxStates == 0 {
+		delete(trm.quotas, owner)
+		return nil
+	}
+	trm.quotas[owner] = maxStates
+
+	return nil
+}
+
+func (trm *twinRepositoryMock) RetrieveOwnerQuota(ctx context.Context, owner string) (uint64, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	return trm.quotas[owner], nil
+}
+
+func (trm *twinRepositoryMock) SaveKey(ctx context.Context, key twins.TwinKey) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	key.Value = ""
+	trm.keys[key.Hash] = key
+
+	return nil
+}
+
+func (trm *twinRepositoryMock) RetrieveKey(ctx context.Context, hash string) (twins.TwinKey, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	key, ok := trm.keys[hash]
+	if !ok {
+		return twins.TwinKey{}, twins.ErrNotFound
+	}
+
+	return key, nil
+}
+
+func (trm *twinRepositoryMock) RemoveKey(ctx context.Context, twinID, id string) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	for hash, key := range trm.keys {
+		if key.TwinID == twinID && key.ID == id {
+			delete(trm.keys, hash)
+			return nil
+		}
+	}
+
+	return twins.ErrNotFound
+}
+
+func (trm *twinRepositoryMock) RemoveExpiredKeys(ctx context.Context, before time.Time) (uint64, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	var removed uint64
+	for hash, key := range trm.keys {
+		if key.Expires.Before(before) {
+			delete(trm.keys, hash)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func (trm *twinRepositoryMock) SaveLock(ctx context.Context, lk twins.TwinLock) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	if cur, ok := trm.locks[lk.TwinID]; ok && cur.Token != lk.Token && time.Now().Before(cur.Expires) {
+		return twins.ErrLocked
+	}
+	trm.locks[lk.TwinID] = lk
+
+	return nil
+}
+
+func (trm *twinRepositoryMock) RetrieveLock(ctx context.Context, twinID string) (twins.TwinLock, error) {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	lk, ok := trm.locks[twinID]
+	if !ok {
+		return twins.TwinLock{}, twins.ErrNotFound
+	}
+
+	return lk, nil
+}
+
+func (trm *twinRepositoryMock) RemoveLock(ctx context.Context, twinID, token string) error {
+	trm.mu.Lock()
+	defer trm.mu.Unlock()
+
+	lk, ok := trm.locks[twinID]
+	if !ok {
+		return nil
+	}
+	if lk.Token != token && time.Now().Before(lk.Expires) {
+		return twins.ErrLocked
+	}
+	delete(trm.locks, twinID)
+
+	return nil
+}
+
+func matchMetadata(metadata, filter twins.Metadata) bool {
+	for k, v := range filter {
+		if !reflect.DeepEqual(metadata[k], v) {
+			return false
+		}
+	}
+	return true
+}
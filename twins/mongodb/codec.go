@@ -0,0 +1,198 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mongodb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/mainflux/mainflux/twins"
+)
+
+// ErrUnknownCodec indicates that the requested state serialization format
+// isn't supported.
+var ErrUnknownCodec = errors.New("unknown state codec")
+
+// StateCodec serializes states stored by the state repository.
+type StateCodec interface {
+	// Marshal encodes the state.
+	Marshal(twins.State) ([]byte, error)
+
+	// Unmarshal decodes the data into the state.
+	Unmarshal([]byte, *twins.State) error
+}
+
+// NewStateCodec returns the codec of the named serialization format. The
+// "bson" format stores states as native documents and is represented by a
+// nil codec.
+func NewStateCodec(format string) (StateCodec, error) {
+	switch format {
+	case "", "bson":
+		return nil, nil
+	case "json":
+		return jsonCodec{}, nil
+	case "cbor":
+		em, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+		if err != nil {
+			return nil, err
+		}
+		return cborCodec{em: em}, nil
+	case "msgpack":
+		return msgpackCodec{}, nil
+	case "protobuf":
+		return protobufCodec{}, nil
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(st twins.State) ([]byte, error) {
+	return json.Marshal(st)
+}
+
+func (jsonCodec) Unmarshal(data []byte, st *twins.State) error {
+	return json.Unmarshal(data, st)
+}
+
+type cborCodec struct {
+	em cbor.EncMode
+}
+
+func (c cborCodec) Marshal(st twins.State) ([]byte, error) {
+	return c.em.Marshal(st)
+}
+
+func (cborCodec) Unmarshal(data []byte, st *twins.State) error {
+	return cbor.Unmarshal(data, st)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(st twins.State) ([]byte, error) {
+	v, err := toGeneric(st)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendMsgpack(nil, v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, st *twins.State) error {
+	v, n, err := consumeMsgpack(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return errMalformedMsgpack
+	}
+
+	return fromGeneric(v, st)
+}
+
+// protobufCodec encodes states as the google.protobuf.Struct well-known type.
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(st twins.State) ([]byte, error) {
+	v, err := toGeneric(st)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMalformedProtobuf
+	}
+
+	return appendStruct(nil, obj)
+}
+
+func (protobufCodec) Unmarshal(data []byte, st *twins.State) error {
+	obj, err := consumeStruct(data)
+	if err != nil {
+		return err
+	}
+
+	return fromGeneric(obj, st)
+}
+
+// toGeneric converts the state into the generic JSON model, the msgpack and
+// protobuf codecs encode, keeping numbers as json.Number.
+func toGeneric(st twins.State) (interface{}, error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// fromGeneric converts the value of the generic JSON model into the state.
+func fromGeneric(v interface{}, st *twins.State) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, st)
+}
+
+// encodedState is the document of a state serialized by a codec. The fields
+// the repository queries on are kept alongside the serialized state.
+type encodedState struct {
+	TwinID     string    `bson:"twinid"`
+	ID         int64     `bson:"id"`
+	Definition int       `bson:"definition"`
+	Created    time.Time `bson:"created"`
+	Note       string    `bson:"note"`
+	Source     string    `bson:"source"`
+	Attributes []string  `bson:"attributes"`
+	Data       []byte    `bson:"data"`
+}
+
+func encodeState(codec StateCodec, st twins.State) (encodedState, error) {
+	data, err := codec.Marshal(st)
+	if err != nil {
+		return encodedState{}, err
+	}
+
+	attrs := make([]string, 0, len(st.Payload))
+	for attr := range st.Payload {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+
+	return encodedState{
+		TwinID:     st.TwinID,
+		ID:         st.ID,
+		Definition: st.Definition,
+		Created:    st.Created,
+		Note:       st.Note,
+		Source:     st.Source,
+		Attributes: attrs,
+		Data:       data,
+	}, nil
+}
+
+func decodeState(codec StateCodec, es encodedState) (twins.State, error) {
+	var st twins.State
+	if err := codec.Unmarshal(es.Data, &st); err != nil {
+		return twins.State{}, err
+	}
+	// The note is annotated in place, so the document holds its latest value.
+	st.Note = es.Note
+
+	return st, nil
+}
@@ -0,0 +1,243 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mongodb
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var errMalformedMsgpack = errors.New("malformed msgpack data")
+
+// appendMsgpack appends the MessagePack encoding of the value of the generic
+// JSON model, i.e. decoded with numbers kept as json.Number.
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendUint(append(b, 0xcb), math.Float64bits(f), 8), nil
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = appendUint(append(b, 0xda), uint64(n), 2)
+		default:
+			b = appendUint(append(b, 0xdb), uint64(n), 4)
+		}
+		return append(b, v...), nil
+	case []interface{}:
+		switch n := len(v); {
+		case n < 16:
+			b = append(b, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			b = appendUint(append(b, 0xdc), uint64(n), 2)
+		default:
+			b = appendUint(append(b, 0xdd), uint64(n), 4)
+		}
+		for _, el := range v {
+			var err error
+			if b, err = appendMsgpack(b, el); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		switch n := len(v); {
+		case n < 16:
+			b = append(b, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			b = appendUint(append(b, 0xde), uint64(n), 2)
+		default:
+			b = appendUint(append(b, 0xdf), uint64(n), 4)
+		}
+		// Keys are sorted, so equal states are encoded the same way.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var err error
+			if b, err = appendMsgpack(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, errMalformedMsgpack
+	}
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= -32 && i <= math.MaxInt8:
+		return append(b, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return appendUint(append(b, 0xd1), uint64(i), 2)
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return appendUint(append(b, 0xd2), uint64(i), 4)
+	default:
+		return appendUint(append(b, 0xd3), uint64(i), 8)
+	}
+}
+
+// appendUint appends the lowest size bytes of u in big endian order.
+func appendUint(b []byte, u uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(u>>(8*uint(i))))
+	}
+	return b
+}
+
+// consumeMsgpack decodes the first MessagePack value of the data into the
+// generic JSON model, and returns the number of bytes the value takes.
+// Binary data is decoded as strings, and extension types aren't supported.
+func consumeMsgpack(data []byte) (interface{}, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errMalformedMsgpack
+	}
+
+	switch c := data[0]; {
+	case c <= 0x7f || c >= 0xe0:
+		return json.Number(strconv.FormatInt(int64(int8(c)), 10)), 1, nil
+	case c >= 0xa0 && c <= 0xbf:
+		return consumeMsgpackString(data, 1, uint64(c&0x1f))
+	case c >= 0x90 && c <= 0x9f:
+		return consumeMsgpackArray(data, 1, uint64(c&0x0f))
+	case c >= 0x80 && c <= 0x8f:
+		return consumeMsgpackMap(data, 1, uint64(c&0x0f))
+	case c == 0xc0:
+		return nil, 1, nil
+	case c == 0xc2:
+		return false, 1, nil
+	case c == 0xc3:
+		return true, 1, nil
+	}
+
+	size, ok := msgpackSizes[data[0]]
+	if !ok {
+		return nil, 0, errMalformedMsgpack
+	}
+	if len(data) < 1+size {
+		return nil, 0, errMalformedMsgpack
+	}
+	var u uint64
+	for _, c := range data[1 : 1+size] {
+		u = u<<8 | uint64(c)
+	}
+
+	switch c := data[0]; {
+	case c == 0xca:
+		f := float64(math.Float32frombits(uint32(u)))
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), 1 + size, nil
+	case c == 0xcb:
+		f := math.Float64frombits(u)
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), 1 + size, nil
+	case c >= 0xcc && c <= 0xcf:
+		return json.Number(strconv.FormatUint(u, 10)), 1 + size, nil
+	case c >= 0xd0 && c <= 0xd3:
+		// Sign extend the integer to 64 bits.
+		shift := uint(64 - 8*size)
+		return json.Number(strconv.FormatInt(int64(u<<shift)>>shift, 10)), 1 + size, nil
+	case c >= 0xc4 && c <= 0xc6, c >= 0xd9 && c <= 0xdb:
+		return consumeMsgpackString(data, 1+size, u)
+	case c == 0xdc || c == 0xdd:
+		return consumeMsgpackArray(data, 1+size, u)
+	default:
+		return consumeMsgpackMap(data, 1+size, u)
+	}
+}
+
+// msgpackSizes maps the types that aren't fixed formats to the size of the
+// value or of the length that follows the type byte.
+var msgpackSizes = map[byte]int{
+	0xc4: 1, 0xc5: 2, 0xc6: 4, // bin
+	0xca: 4, 0xcb: 8, // float
+	0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, // uint
+	0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, // int
+	0xd9: 1, 0xda: 2, 0xdb: 4, // str
+	0xdc: 2, 0xdd: 4, // array
+	0xde: 2, 0xdf: 4, // map
+}
+
+func consumeMsgpackString(data []byte, off int, n uint64) (interface{}, int, error) {
+	if uint64(len(data)-off) < n {
+		return nil, 0, errMalformedMsgpack
+	}
+	end := off + int(n)
+
+	return string(data[off:end]), end, nil
+}
+
+func consumeMsgpackArray(data []byte, off int, n uint64) (interface{}, int, error) {
+	// Every element takes at least a byte.
+	if uint64(len(data)-off) < n {
+		return nil, 0, errMalformedMsgpack
+	}
+
+	arr := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		el, size, err := consumeMsgpack(data[off:])
+		if err != nil {
+			return nil, 0, err
+		}
+		arr = append(arr, el)
+		off += size
+	}
+
+	return arr, off, nil
+}
+
+func consumeMsgpackMap(data []byte, off int, n uint64) (interface{}, int, error) {
+	// Every key and value takes at least a byte.
+	if uint64(len(data)-off)/2 < n {
+		return nil, 0, errMalformedMsgpack
+	}
+
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, size, err := consumeMsgpack(data[off:])
+		if err != nil {
+			return nil, 0, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, 0, errMalformedMsgpack
+		}
+		off += size
+
+		v, size, err := consumeMsgpack(data[off:])
+		if err != nil {
+			return nil, 0, err
+		}
+		m[key] = v
+		off += size
+	}
+
+	return m, off, nil
+}
@@ -0,0 +1,220 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mongodb
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the google.protobuf.Struct well-known type, states are
+// encoded as, and of the messages it's built of.
+const (
+	structFields = 1
+
+	entryKey   = 1
+	entryValue = 2
+
+	valueNull   = 1
+	valueNumber = 2
+	valueString = 3
+	valueBool   = 4
+	valueStruct = 5
+	valueList   = 6
+
+	listValues = 1
+)
+
+var errMalformedProtobuf = errors.New("malformed protobuf data")
+
+// appendStruct appends the google.protobuf.Struct encoding of the object of
+// the generic JSON model, i.e. decoded with numbers kept as json.Number.
+func appendStruct(b []byte, obj map[string]interface{}) ([]byte, error) {
+	// Keys are sorted, so equal states are encoded the same way.
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		entry := protowire.AppendTag(nil, entryKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		val, err := appendValue(nil, obj[k])
+		if err != nil {
+			return nil, err
+		}
+		entry = protowire.AppendTag(entry, entryValue, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, val)
+
+		b = protowire.AppendTag(b, structFields, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return b, nil
+}
+
+// appendValue appends the google.protobuf.Value encoding of the value.
+// Numbers are encoded as doubles.
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		b = protowire.AppendTag(b, valueNull, protowire.VarintType)
+		return protowire.AppendVarint(b, 0), nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, valueNumber, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(f)), nil
+	case string:
+		b = protowire.AppendTag(b, valueString, protowire.BytesType)
+		return protowire.AppendString(b, v), nil
+	case bool:
+		b = protowire.AppendTag(b, valueBool, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(v)), nil
+	case map[string]interface{}:
+		obj, err := appendStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, valueStruct, protowire.BytesType)
+		return protowire.AppendBytes(b, obj), nil
+	case []interface{}:
+		var list []byte
+		for _, el := range v {
+			val, err := appendValue(nil, el)
+			if err != nil {
+				return nil, err
+			}
+			list = protowire.AppendTag(list, listValues, protowire.BytesType)
+			list = protowire.AppendBytes(list, val)
+		}
+		b = protowire.AppendTag(b, valueList, protowire.BytesType)
+		return protowire.AppendBytes(b, list), nil
+	default:
+		return nil, errMalformedProtobuf
+	}
+}
+
+// consumeStruct decodes the google.protobuf.Struct into an object of the
+// generic JSON model. Unknown fields are skipped.
+func consumeStruct(b []byte) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		if num != structFields || typ != protowire.BytesType {
+			return nil
+		}
+
+		var key string
+		var val interface{}
+		err := consumeFields(field, func(num protowire.Number, typ protowire.Type, field []byte) error {
+			if typ != protowire.BytesType {
+				return nil
+			}
+			switch num {
+			case entryKey:
+				key = string(field)
+			case entryValue:
+				v, err := consumeValue(field)
+				if err != nil {
+					return err
+				}
+				val = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		obj[key] = val
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// consumeValue decodes the google.protobuf.Value into a value of the generic
+// JSON model.
+func consumeValue(b []byte) (interface{}, error) {
+	var val interface{}
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		switch {
+		case num == valueNull && typ == protowire.VarintType:
+			val = nil
+		case num == valueNumber && typ == protowire.Fixed64Type:
+			u, _ := protowire.ConsumeFixed64(field)
+			val = json.Number(strconv.FormatFloat(math.Float64frombits(u), 'g', -1, 64))
+		case num == valueString && typ == protowire.BytesType:
+			val = string(field)
+		case num == valueBool && typ == protowire.VarintType:
+			u, _ := protowire.ConsumeVarint(field)
+			val = protowire.DecodeBool(u)
+		case num == valueStruct && typ == protowire.BytesType:
+			obj, err := consumeStruct(field)
+			if err != nil {
+				return err
+			}
+			val = obj
+		case num == valueList && typ == protowire.BytesType:
+			list := []interface{}{}
+			err := consumeFields(field, func(num protowire.Number, typ protowire.Type, field []byte) error {
+				if num != listValues || typ != protowire.BytesType {
+					return nil
+				}
+				el, err := consumeValue(field)
+				if err != nil {
+					return err
+				}
+				list = append(list, el)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			val = list
+		}
+		return nil
+	})
+
+	return val, err
+}
+
+// consumeFields calls the function for each field of the message, passing
+// the contents of the length delimited fields, and the raw value of the
+// others.
+func consumeFields(b []byte, fn func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errMalformedProtobuf
+		}
+		b = b[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return errMalformedProtobuf
+		}
+		field := b[:n]
+		if typ == protowire.BytesType {
+			field, _ = protowire.ConsumeBytes(field)
+		}
+		if err := fn(num, typ, field); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
@@ -5,26 +5,34 @@ package mongodb
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/mainflux/mainflux/twins"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 const statesCollection string = "states"
 
 type stateRepository struct {
-	db *mongo.Database
+	db    *mongo.Database
+	codec StateCodec
 }
 
 var _ twins.StateRepository = (*stateRepository)(nil)
 
 // NewStateRepository instantiates a MongoDB implementation of state
-// repository.
-func NewStateRepository(db *mongo.Database) twins.StateRepository {
+// repository. States are serialized by the codec, or stored as native
+// documents if the codec is nil.
+func NewStateRepository(db *mongo.Database, codec StateCodec) twins.StateRepository {
 	return &stateRepository{
-		db: db,
+		db:    db,
+		codec: codec,
 	}
 }
 
@@ -32,7 +40,12 @@ func NewStateRepository(db *mongo.Database) twins.StateRepository {
 func (sr *stateRepository) Save(ctx context.Context, st twins.State) error {
 	coll := sr.db.Collection(statesCollection)
 
-	if _, err := coll.InsertOne(context.Background(), st); err != nil {
+	doc, err := sr.document(st)
+	if err != nil {
+		return err
+	}
+
+	if _, err := coll.InsertOne(context.Background(), doc); err != nil {
 		return err
 	}
 
@@ -43,8 +56,13 @@ func (sr *stateRepository) Save(ctx context.Context, st twins.State) error {
 func (sr *stateRepository) Update(ctx context.Context, st twins.State) error {
 	coll := sr.db.Collection(statesCollection)
 
+	doc, err := sr.document(st)
+	if err != nil {
+		return err
+	}
+
 	filter := bson.M{"id": st.ID, "twinid": st.TwinID}
-	update := bson.M{"$set": st}
+	update := bson.M{"$set": doc}
 	if _, err := coll.UpdateOne(context.Background(), filter, update); err != nil {
 		return err
 	}
@@ -52,6 +70,54 @@ func (sr *stateRepository) Update(ctx context.Context, st twins.State) error {
 	return nil
 }
 
+// Annotate sets the note of the state
+func (sr *stateRepository) Annotate(ctx context.Context, twinID string, id int64, note string) error {
+	coll := sr.db.Collection(statesCollection)
+
+	filter := bson.M{"id": id, "twinid": twinID}
+	update := bson.M{"$set": bson.M{"note": note}}
+	res, err := coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount < 1 {
+		return twins.ErrNotFound
+	}
+
+	return nil
+}
+
+// RemoveAll removes all the states of the twin
+func (sr *stateRepository) RemoveAll(ctx context.Context, twinID string) error {
+	coll := sr.db.Collection(statesCollection)
+
+	if _, err := coll.DeleteMany(ctx, bson.M{"twinid": twinID}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reindex ensures the indexes states are queried by exist. MongoDB indexes
+// span the whole collection and are maintained on every write, so the
+// states of the twin are covered once the indexes are in place.
+func (sr *stateRepository) Reindex(ctx context.Context, twinID string) error {
+	coll := sr.db.Collection(statesCollection)
+
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{"twinid", 1}, {"id", 1}}},
+		{Keys: bson.D{{"twinid", 1}, {"created", 1}}},
+		{Keys: bson.D{{"twinid", 1}, {"attributes", 1}, {"created", 1}}},
+		{Keys: bson.D{{"twinid", 1}, {"source", 1}}},
+	}
+	if _, err := coll.Indexes().CreateMany(ctx, models); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // CountStates returns the number of states related to twin
 func (sr *stateRepository) Count(ctx context.Context, tw twins.Twin) (int64, error) {
 	coll := sr.db.Collection(statesCollection)
@@ -65,11 +131,24 @@ func (sr *stateRepository) Count(ctx context.Context, tw twins.Twin) (int64, err
 	return total, nil
 }
 
-// RetrieveAll retrieves the subset of states related to twin specified by id
-func (sr *stateRepository) RetrieveAll(ctx context.Context, offset uint64, limit uint64, id string) (twins.StatesPage, error) {
+func (sr *stateRepository) CountByTwins(ctx context.Context, ids []string) (int64, error) {
 	coll := sr.db.Collection(statesCollection)
 
+	filter := bson.M{"twinid": bson.M{"$in": ids}}
+	return coll.CountDocuments(ctx, filter)
+}
+
+// RetrieveAll retrieves the subset of states related to twin specified by id
+func (sr *stateRepository) RetrieveAll(ctx context.Context, offset uint64, limit uint64, id string, consistency twins.Consistency, order twins.Order) (twins.StatesPage, error) {
+	coll := sr.readCollection(consistency)
+
+	sort := 1
+	if order == twins.Desc {
+		sort = -1
+	}
+
 	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{"id", sort}})
 	findOptions.SetSkip(int64(offset))
 	findOptions.SetLimit(int64(limit))
 
@@ -80,7 +159,419 @@ func (sr *stateRepository) RetrieveAll(ctx context.Context, offset uint64, limit
 		return twins.StatesPage{}, err
 	}
 
-	results, err := decodeStates(ctx, cur)
+	results, err := sr.decodeStates(ctx, cur)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	return twins.StatesPage{
+		States: results,
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(total),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}, nil
+}
+
+// CountSince returns the number of states created at or after since
+func (sr *stateRepository) CountSince(ctx context.Context, since time.Time) (int64, error) {
+	coll := sr.db.Collection(statesCollection)
+
+	filter := bson.D{}
+	if !since.IsZero() {
+		filter = append(filter, bson.E{"created", bson.M{"$gte": since}})
+	}
+
+	return coll.CountDocuments(ctx, filter)
+}
+
+func (sr *stateRepository) ListBySource(ctx context.Context, id, source string, offset, limit uint64, order twins.Order) (twins.StatesPage, error) {
+	coll := sr.db.Collection(statesCollection)
+
+	sort := 1
+	if order == twins.Desc {
+		sort = -1
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{"id", sort}})
+	findOptions.SetSkip(int64(offset))
+	findOptions.SetLimit(int64(limit))
+
+	filter := bson.D{{"twinid", id}, {"source", source}}
+
+	cur, err := coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	results, err := sr.decodeStates(ctx, cur)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	return twins.StatesPage{
+		States: results,
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(total),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}, nil
+}
+
+// ListByAttribute returns the states of twin containing the attribute,
+// created within the time range
+func (sr *stateRepository) ListByAttribute(ctx context.Context, id, attr string, from, to time.Time, offset, limit uint64) (twins.StatesPage, error) {
+	coll := sr.db.Collection(statesCollection)
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{"created", 1}})
+	findOptions.SetSkip(int64(offset))
+	findOptions.SetLimit(int64(limit))
+
+	created := bson.M{"$gte": from}
+	if !to.IsZero() {
+		created["$lte"] = to
+	}
+	filter := bson.D{
+		{"twinid", id},
+		{fmt.Sprintf("payload.%s", attr), bson.M{"$exists": true}},
+		{"created", created},
+	}
+	if sr.codec != nil {
+		filter[1] = bson.E{"attributes", attr}
+	}
+
+	cur, err := coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	results, err := sr.decodeStates(ctx, cur)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	return twins.StatesPage{
+		States: results,
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(total),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}, nil
+}
+
+var operators = map[twins.Operator]string{
+	twins.Gt: "$gt",
+	twins.Ge: "$gte",
+	twins.Lt: "$lt",
+	twins.Le: "$lte",
+	twins.Eq: "$eq",
+}
+
+// ListByValue returns the states of twin whose numeric value of the
+// attribute matches the operator. Serialized payloads can't be queried, so
+// such states are matched after decoding.
+func (sr *stateRepository) ListByValue(ctx context.Context, id, attr string, op twins.Operator, value float64, offset, limit uint64) (twins.StatesPage, error) {
+	if sr.codec != nil {
+		return sr.scanByValue(ctx, id, attr, op, value, offset, limit)
+	}
+
+	coll := sr.db.Collection(statesCollection)
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{"created", 1}})
+	findOptions.SetSkip(int64(offset))
+	findOptions.SetLimit(int64(limit))
+
+	filter := bson.D{
+		{"twinid", id},
+		{fmt.Sprintf("payload.%s", attr), bson.M{operators[op]: value}},
+	}
+
+	cur, err := coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	results, err := sr.decodeStates(ctx, cur)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	return twins.StatesPage{
+		States: results,
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(total),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}, nil
+}
+
+func (sr *stateRepository) scanByValue(ctx context.Context, id, attr string, op twins.Operator, value float64, offset, limit uint64) (twins.StatesPage, error) {
+	coll := sr.db.Collection(statesCollection)
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{"created", 1}})
+
+	cur, err := coll.Find(ctx, bson.D{{"twinid", id}, {"attributes", attr}}, findOptions)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	states, err := sr.decodeStates(ctx, cur)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	page := twins.StatesPage{
+		States: []twins.State{},
+		PageMetadata: twins.PageMetadata{
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	for _, st := range states {
+		v, ok := st.Payload[attr].(float64)
+		if !ok || !op.Match(v, value) {
+			continue
+		}
+		if page.Total >= offset && page.Total-offset < limit {
+			page.States = append(page.States, st)
+		}
+		page.Total++
+	}
+
+	return page, nil
+}
+
+// CountByBucket returns the number of states of twin created within each
+// time bucket
+func (sr *stateRepository) CountByBucket(ctx context.Context, id string, from, to time.Time, bucket time.Duration) ([]twins.BucketCount, error) {
+	coll := sr.db.Collection(statesCollection)
+
+	// Subtracting dates yields the difference in milliseconds.
+	index := bson.M{"$floor": bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{"$created", from}},
+		int64(bucket / time.Millisecond),
+	}}}
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{
+			{"twinid", id},
+			{"created", bson.M{"$gte": from, "$lt": to}},
+		}}},
+		{{"$group", bson.D{
+			{"_id", index},
+			{"count", bson.M{"$sum": 1}},
+		}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+	}
+
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var buckets []twins.BucketCount
+	for cur.Next(ctx) {
+		var res struct {
+			Index int64 `bson:"_id"`
+			Count int64 `bson:"count"`
+		}
+		if err := cur.Decode(&res); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, twins.BucketCount{
+			Start: from.Add(time.Duration(res.Index) * bucket),
+			Count: uint64(res.Count),
+		})
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// partitionLayouts map granularities to the MongoDB date format and the
+// matching Go layout of the partition keys.
+var partitionLayouts = map[twins.Granularity][2]string{
+	twins.Daily:   {"%Y-%m-%d", "2006-01-02"},
+	twins.Monthly: {"%Y-%m", "2006-01"},
+	twins.Yearly:  {"%Y", "2006"},
+}
+
+// CountByPartition returns the number of states of twin created within each
+// calendar period
+func (sr *stateRepository) CountByPartition(ctx context.Context, id string, granularity twins.Granularity, loc *time.Location) ([]twins.Partition, error) {
+	layout, ok := partitionLayouts[granularity]
+	if !ok {
+		return nil, twins.ErrMalformedEntity
+	}
+
+	coll := sr.db.Collection(statesCollection)
+
+	key := bson.M{"$dateToString": bson.M{"format": layout[0], "date": "$created", "timezone": timezone(loc)}}
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"twinid", id}}}},
+		{{"$group", bson.D{
+			{"_id", key},
+			{"count", bson.M{"$sum": 1}},
+		}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+	}
+
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var partitions []twins.Partition
+	for cur.Next(ctx) {
+		var res struct {
+			Key   string `bson:"_id"`
+			Count int64  `bson:"count"`
+		}
+		if err := cur.Decode(&res); err != nil {
+			return nil, err
+		}
+		start, err := time.ParseInLocation(layout[1], res.Key, loc)
+		if err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, twins.Partition{
+			Start: start,
+			Count: uint64(res.Count),
+		})
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return partitions, nil
+}
+
+// timezone returns the name of the location MongoDB understands. The local
+// location is named "Local", so it's resolved to the IANA name of the system
+// time zone. Locations without a known name fall back to their current UTC
+// offset.
+func timezone(loc *time.Location) string {
+	name := loc.String()
+	if loc == time.Local {
+		name = localZone()
+	}
+	if name != "" && name != "Local" {
+		if _, err := time.LoadLocation(name); err == nil {
+			return name
+		}
+	}
+
+	_, offset := time.Now().In(loc).Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+
+	return fmt.Sprintf("%c%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// localZone returns the name of the system time zone, the same way the local
+// location is loaded: from the TZ variable or the /etc/localtime link.
+func localZone() string {
+	name, ok := os.LookupEnv("TZ")
+	if !ok {
+		var err error
+		if name, err = os.Readlink("/etc/localtime"); err != nil {
+			return ""
+		}
+	}
+	name = strings.TrimPrefix(name, ":")
+	if i := strings.LastIndex(name, "zoneinfo/"); i >= 0 {
+		name = name[i+len("zoneinfo/"):]
+	}
+
+	return name
+}
+
+// RetrieveByTwins retrieves the subset of states related to twins specified
+// by ids, newest first
+func (sr *stateRepository) RetrieveByTwins(ctx context.Context, ids []string, offset, limit uint64) (twins.StatesPage, error) {
+	coll := sr.db.Collection(statesCollection)
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{"created", -1}, {"id", -1}})
+	findOptions.SetSkip(int64(offset))
+	findOptions.SetLimit(int64(limit))
+
+	filter := bson.M{"twinid": bson.M{"$in": ids}}
+	cur, err := coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	results, err := sr.decodeStates(ctx, cur)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	return twins.StatesPage{
+		States: results,
+		PageMetadata: twins.PageMetadata{
+			Total:  uint64(total),
+			Offset: offset,
+			Limit:  limit,
+		},
+	}, nil
+}
+
+func (sr *stateRepository) ListUntil(ctx context.Context, id string, until time.Time, offset, limit uint64) (twins.StatesPage, error) {
+	coll := sr.db.Collection(statesCollection)
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{"created", -1}, {"id", -1}})
+	findOptions.SetSkip(int64(offset))
+	findOptions.SetLimit(int64(limit))
+
+	filter := bson.M{"twinid": id, "created": bson.M{"$lte": until}}
+	cur, err := coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return twins.StatesPage{}, err
+	}
+
+	results, err := sr.decodeStates(ctx, cur)
 	if err != nil {
 		return twins.StatesPage{}, err
 	}
@@ -123,7 +614,7 @@ func (sr *stateRepository) RetrieveLast(ctx context.Context, id string) (twins.S
 		return twins.State{}, err
 	}
 
-	results, err := decodeStates(ctx, cur)
+	results, err := sr.decodeStates(ctx, cur)
 	if err != nil {
 		return twins.State{}, err
 	}
@@ -134,13 +625,32 @@ func (sr *stateRepository) RetrieveLast(ctx context.Context, id string) (twins.S
 	return results[0], nil
 }
 
-func decodeStates(ctx context.Context, cur *mongo.Cursor) ([]twins.State, error) {
+// readCollection returns states collection that reads from secondary
+// members of replica set, if available, when eventual consistency is
+// acceptable.
+func (sr *stateRepository) readCollection(consistency twins.Consistency) *mongo.Collection {
+	if consistency == twins.Eventual {
+		opts := options.Collection().SetReadPreference(readpref.SecondaryPreferred())
+		return sr.db.Collection(statesCollection, opts)
+	}
+	return sr.db.Collection(statesCollection)
+}
+
+// document returns the document the state is stored as.
+func (sr *stateRepository) document(st twins.State) (interface{}, error) {
+	if sr.codec == nil {
+		return st, nil
+	}
+	return encodeState(sr.codec, st)
+}
+
+func (sr *stateRepository) decodeStates(ctx context.Context, cur *mongo.Cursor) ([]twins.State, error) {
 	defer cur.Close(ctx)
 
 	var results []twins.State
 	for cur.Next(ctx) {
-		var elem twins.State
-		if err := cur.Decode(&elem); err != nil {
+		elem, err := sr.decode(cur)
+		if err != nil {
 			return []twins.State{}, nil
 		}
 		results = append(results, elem)
@@ -151,3 +661,17 @@ func decodeStates(ctx context.Context, cur *mongo.Cursor) ([]twins.State, error)
 	}
 	return results, nil
 }
+
+func (sr *stateRepository) decode(cur *mongo.Cursor) (twins.State, error) {
+	if sr.codec == nil {
+		var st twins.State
+		err := cur.Decode(&st)
+		return st, err
+	}
+
+	var es encodedState
+	if err := cur.Decode(&es); err != nil {
+		return twins.State{}, err
+	}
+	return decodeState(sr.codec, es)
+}
@@ -24,7 +24,7 @@ func TestStateSave(t *testing.T) {
 	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
 
 	db := client.Database(testDB)
-	repo := mongodb.NewStateRepository(db)
+	repo := mongodb.NewStateRepository(db, nil)
 
 	twid, err := uuidProvider.New().ID()
 	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
@@ -61,7 +61,7 @@ func TestStatesRetrieveAll(t *testing.T) {
 	db := client.Database(testDB)
 	db.Collection("states").DeleteMany(context.Background(), bson.D{})
 
-	repo := mongodb.NewStateRepository(db)
+	repo := mongodb.NewStateRepository(db, nil)
 
 	twid, err := uuidProvider.New().ID()
 	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
@@ -108,7 +108,7 @@ func TestStatesRetrieveAll(t *testing.T) {
 	}
 
 	for desc, tc := range cases {
-		page, err := repo.RetrieveAll(context.Background(), tc.offset, tc.limit, tc.twid)
+		page, err := repo.RetrieveAll(context.Background(), tc.offset, tc.limit, tc.twid, twins.Strong, twins.Asc)
 		size := uint64(len(page.States))
 		assert.Equal(t, tc.size, size, fmt.Sprintf("%s: expected %d got %d\n", desc, tc.size, size))
 		assert.Equal(t, tc.total, page.Total, fmt.Sprintf("%s: expected %d got %d\n", desc, tc.total, page.Total))
@@ -123,7 +123,7 @@ func TestStatesRetrieveLast(t *testing.T) {
 	db := client.Database(testDB)
 	db.Collection("states").DeleteMany(context.Background(), bson.D{})
 
-	repo := mongodb.NewStateRepository(db)
+	repo := mongodb.NewStateRepository(db, nil)
 
 	twid, err := uuidProvider.New().ID()
 	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
@@ -159,3 +159,284 @@ func TestStatesRetrieveLast(t *testing.T) {
 		assert.Nil(t, err, fmt.Sprintf("%s: expected no error got %d\n", desc, err))
 	}
 }
+
+func TestStatesListByAttribute(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(addr))
+	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
+
+	db := client.Database(testDB)
+	db.Collection("states").DeleteMany(context.Background(), bson.D{})
+
+	repo := mongodb.NewStateRepository(db, nil)
+
+	twid, err := uuidProvider.New().ID()
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+	n := int64(10)
+	start := time.Now().Round(time.Millisecond)
+	for i := int64(0); i < n; i++ {
+		payload := map[string]interface{}{"temperature": i}
+		if i%2 == 0 {
+			payload["humidity"] = i
+		}
+		st := twins.State{
+			TwinID:  twid,
+			ID:      i,
+			Created: start.Add(time.Duration(i) * time.Second),
+			Payload: payload,
+		}
+
+		repo.Save(context.Background(), st)
+	}
+
+	cases := map[string]struct {
+		twid   string
+		attr   string
+		from   time.Time
+		to     time.Time
+		offset uint64
+		limit  uint64
+		size   uint64
+		total  uint64
+	}{
+		"list states by attribute present in all states": {
+			twid:  twid,
+			attr:  "temperature",
+			limit: uint64(n),
+			size:  uint64(n),
+			total: uint64(n),
+		},
+		"list states by attribute present in every other state": {
+			twid:  twid,
+			attr:  "humidity",
+			limit: uint64(n),
+			size:  uint64(n / 2),
+			total: uint64(n / 2),
+		},
+		"list states by attribute within time range": {
+			twid:  twid,
+			attr:  "temperature",
+			from:  start.Add(2 * time.Second),
+			to:    start.Add(5 * time.Second),
+			limit: uint64(n),
+			size:  4,
+			total: 4,
+		},
+		"list subset of states by attribute": {
+			twid:   twid,
+			attr:   "temperature",
+			offset: 2,
+			limit:  3,
+			size:   3,
+			total:  uint64(n),
+		},
+		"list states by non-existing attribute": {
+			twid:  twid,
+			attr:  "speed",
+			limit: uint64(n),
+			size:  0,
+			total: 0,
+		},
+	}
+
+	for desc, tc := range cases {
+		page, err := repo.ListByAttribute(context.Background(), tc.twid, tc.attr, tc.from, tc.to, tc.offset, tc.limit)
+		size := uint64(len(page.States))
+		assert.Equal(t, tc.size, size, fmt.Sprintf("%s: expected %d got %d\n", desc, tc.size, size))
+		assert.Equal(t, tc.total, page.Total, fmt.Sprintf("%s: expected %d got %d\n", desc, tc.total, page.Total))
+		assert.Nil(t, err, fmt.Sprintf("%s: expected no error got %d\n", desc, err))
+	}
+}
+
+func TestStatesListByValue(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(addr))
+	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
+
+	db := client.Database(testDB)
+	db.Collection("states").DeleteMany(context.Background(), bson.D{})
+
+	repo := mongodb.NewStateRepository(db, nil)
+
+	twid, err := uuidProvider.New().ID()
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+	n := int64(10)
+	start := time.Now().Round(time.Millisecond)
+	for i := int64(0); i < n; i++ {
+		st := twins.State{
+			TwinID:  twid,
+			ID:      i,
+			Created: start.Add(time.Duration(i) * time.Second),
+			Payload: map[string]interface{}{"temperature": float64(i * 10)},
+		}
+
+		repo.Save(context.Background(), st)
+	}
+
+	cases := map[string]struct {
+		attr   string
+		op     twins.Operator
+		value  float64
+		offset uint64
+		limit  uint64
+		size   uint64
+		total  uint64
+	}{
+		"list states with values greater than": {
+			attr:  "temperature",
+			op:    twins.Gt,
+			value: 60,
+			limit: uint64(n),
+			size:  3,
+			total: 3,
+		},
+		"list states with values less than or equal to": {
+			attr:  "temperature",
+			op:    twins.Le,
+			value: 20,
+			limit: uint64(n),
+			size:  3,
+			total: 3,
+		},
+		"list states with values equal to": {
+			attr:  "temperature",
+			op:    twins.Eq,
+			value: 50,
+			limit: uint64(n),
+			size:  1,
+			total: 1,
+		},
+		"list subset of states by value": {
+			attr:   "temperature",
+			op:     twins.Ge,
+			value:  0,
+			offset: 2,
+			limit:  3,
+			size:   3,
+			total:  uint64(n),
+		},
+		"list states by value of non-existing attribute": {
+			attr:  "speed",
+			op:    twins.Ge,
+			value: 0,
+			limit: uint64(n),
+			size:  0,
+			total: 0,
+		},
+	}
+
+	for desc, tc := range cases {
+		page, err := repo.ListByValue(context.Background(), twid, tc.attr, tc.op, tc.value, tc.offset, tc.limit)
+		size := uint64(len(page.States))
+		assert.Equal(t, tc.size, size, fmt.Sprintf("%s: expected %d got %d\n", desc, tc.size, size))
+		assert.Equal(t, tc.total, page.Total, fmt.Sprintf("%s: expected %d got %d\n", desc, tc.total, page.Total))
+		assert.Nil(t, err, fmt.Sprintf("%s: expected no error got %d\n", desc, err))
+	}
+}
+
+func TestStatesCountByPartition(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(addr))
+	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
+
+	db := client.Database(testDB)
+	db.Collection("states").DeleteMany(context.Background(), bson.D{})
+
+	repo := mongodb.NewStateRepository(db, nil)
+
+	twid, err := uuidProvider.New().ID()
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+	// States are created around midnight UTC, so partitions depend on the
+	// time zone.
+	midnight := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	created := []time.Time{
+		midnight.Add(-3 * time.Hour),
+		midnight.Add(-time.Hour),
+		midnight.Add(time.Hour),
+		midnight.Add(3 * time.Hour),
+		midnight.Add(13 * time.Hour),
+	}
+	for i, c := range created {
+		st := twins.State{
+			TwinID:  twid,
+			ID:      int64(i),
+			Created: c,
+		}
+		err := repo.Save(context.Background(), st)
+		require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+	}
+
+	cases := map[string]*time.Location{
+		"count states by day in UTC":          time.UTC,
+		"count states by day in local time":   time.Local,
+		"count states by day in fixed offset": time.FixedZone("", -2*60*60),
+	}
+
+	for desc, loc := range cases {
+		counts := make(map[string]uint64)
+		var days []string
+		for _, c := range created {
+			day := c.In(loc).Format("2006-01-02")
+			if counts[day] == 0 {
+				days = append(days, day)
+			}
+			counts[day]++
+		}
+		var expected []twins.Partition
+		for _, day := range days {
+			start, err := time.ParseInLocation("2006-01-02", day, loc)
+			require.Nil(t, err, fmt.Sprintf("%s: got unexpected error: %s", desc, err))
+			expected = append(expected, twins.Partition{Start: start, Count: counts[day]})
+		}
+
+		partitions, err := repo.CountByPartition(context.Background(), twid, twins.Daily, loc)
+		assert.Nil(t, err, fmt.Sprintf("%s: expected no error got %s\n", desc, err))
+		assert.Equal(t, expected, partitions, fmt.Sprintf("%s: expected %v got %v\n", desc, expected, partitions))
+	}
+}
+
+func TestStatesCodecs(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(addr))
+	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
+
+	db := client.Database(testDB)
+
+	for _, format := range []string{"bson", "json", "cbor", "msgpack", "protobuf"} {
+		db.Collection("states").DeleteMany(context.Background(), bson.D{})
+
+		codec, err := mongodb.NewStateCodec(format)
+		require.Nil(t, err, fmt.Sprintf("%s: got unexpected error: %s", format, err))
+		repo := mongodb.NewStateRepository(db, codec)
+
+		twid, err := uuidProvider.New().ID()
+		require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+		state := twins.State{
+			TwinID:  twid,
+			Created: time.Now().Round(time.Millisecond).UTC(),
+			Payload: map[string]interface{}{"temperature": 21.5},
+		}
+		err = repo.Save(context.Background(), state)
+		require.Nil(t, err, fmt.Sprintf("%s: got unexpected error: %s", format, err))
+
+		err = repo.Annotate(context.Background(), twid, state.ID, "calibrated")
+		require.Nil(t, err, fmt.Sprintf("%s: got unexpected error: %s", format, err))
+
+		last, err := repo.RetrieveLast(context.Background(), twid)
+		require.Nil(t, err, fmt.Sprintf("%s: got unexpected error: %s", format, err))
+		assert.Equal(t, state.Payload, last.Payload, fmt.Sprintf("%s: expected payload %v got %v\n", format, state.Payload, last.Payload))
+		assert.True(t, state.Created.Equal(last.Created), fmt.Sprintf("%s: expected created %s got %s\n", format, state.Created, last.Created))
+		assert.Equal(t, "calibrated", last.Note, fmt.Sprintf("%s: expected note %s got %s\n", format, "calibrated", last.Note))
+
+		page, err := repo.ListByAttribute(context.Background(), twid, "temperature", time.Time{}, time.Time{}, 0, 10)
+		require.Nil(t, err, fmt.Sprintf("%s: got unexpected error: %s", format, err))
+		assert.Equal(t, uint64(1), page.Total, fmt.Sprintf("%s: expected total %d got %d\n", format, 1, page.Total))
+
+		page, err = repo.ListByValue(context.Background(), twid, "temperature", twins.Gt, 20, 0, 10)
+		require.Nil(t, err, fmt.Sprintf("%s: got unexpected error: %s", format, err))
+		assert.Equal(t, uint64(1), page.Total, fmt.Sprintf("%s: expected total %d got %d\n", format, 1, page.Total))
+	}
+
+	_, err = mongodb.NewStateCodec("xml")
+	assert.Equal(t, mongodb.ErrUnknownCodec, err, fmt.Sprintf("expected %s got %s\n", mongodb.ErrUnknownCodec, err))
+}
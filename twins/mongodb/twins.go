@@ -5,6 +5,8 @@ package mongodb
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/mainflux/mainflux/twins"
 	"go.mongodb.org/mongo-driver/bson"
@@ -13,8 +15,14 @@ import (
 )
 
 const (
-	maxNameSize            = 1024
-	twinsCollection string = "twins"
+	maxNameSize              = 1024
+	twinsCollection   string = "twins"
+	schemasCollection string = "schemas"
+	quotasCollection  string = "quotas"
+	keysCollection    string = "keys"
+	locksCollection   string = "locks"
+
+	duplicateKeyCode = 11000
 )
 
 type twinRepository struct {
@@ -65,6 +73,40 @@ func (tr *twinRepository) Update(ctx context.Context, tw twins.Twin) error {
 	return nil
 }
 
+func (tr *twinRepository) UpdateIf(ctx context.Context, tw twins.Twin, conditions twins.Metadata) error {
+	if len(tw.Name) > maxNameSize {
+		return twins.ErrMalformedEntity
+	}
+
+	coll := tr.db.Collection(twinsCollection)
+
+	filter := bson.M{"id": tw.ID}
+	for k, v := range conditions {
+		filter[fmt.Sprintf("metadata.%s", k)] = v
+	}
+	update := bson.D{{"$set", tw}}
+	res, err := coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount > 0 {
+		return nil
+	}
+
+	// Conditions are matched along with the id, so the twin is looked up
+	// to tell a missing twin from a failed condition.
+	n, err := coll.CountDocuments(ctx, bson.D{{"id", tw.ID}})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return twins.ErrNotFound
+	}
+
+	return twins.ErrConflict
+}
+
 func (tr *twinRepository) RetrieveByID(_ context.Context, id string) (twins.Twin, error) {
 	coll := tr.db.Collection(twinsCollection)
 	var tw twins.Twin
@@ -77,10 +119,15 @@ func (tr *twinRepository) RetrieveByID(_ context.Context, id string) (twins.Twin
 	return tw, nil
 }
 
-func (tr *twinRepository) RetrieveByAttribute(ctx context.Context, channel, subtopic string) ([]string, error) {
+func (tr *twinRepository) RetrieveByAttribute(ctx context.Context, channel, subtopic string, caseInsensitive bool) ([]string, error) {
 	coll := tr.db.Collection(twinsCollection)
 
 	findOptions := options.Aggregate()
+	if caseInsensitive {
+		// Collation strength 2 compares base characters and diacritics,
+		// but ignores case.
+		findOptions.SetCollation(&options.Collation{Locale: "en", Strength: 2})
+	}
 	prj1 := bson.M{
 		"$project": bson.M{
 			"definition": bson.M{
@@ -92,8 +139,18 @@ func (tr *twinRepository) RetrieveByAttribute(ctx context.Context, channel, subt
 	}
 	match := bson.M{
 		"$match": bson.M{
-			"definition.channel":  channel,
-			"definition.subtopic": subtopic,
+			"definition": bson.M{
+				"$elemMatch": bson.M{
+					"channel": channel,
+					"$or": []bson.M{
+						{"subtopic": subtopic},
+						{"aliases": subtopic},
+						// Placeholders are resolved by the service.
+						{"subtopic": bson.M{"$regex": `\{`}},
+						{"aliases": bson.M{"$regex": `\{`}},
+					},
+				},
+			},
 		},
 	}
 	prj2 := bson.M{
@@ -171,6 +228,153 @@ func (tr *twinRepository) RetrieveAll(ctx context.Context, owner string, offset
 	}, nil
 }
 
+func (tr *twinRepository) RetrieveByBase(ctx context.Context, baseID string) ([]string, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	cur, err := coll.Find(ctx, bson.M{"basetwinid": baseID})
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := decodeTwins(ctx, cur)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, tw := range results {
+		ids = append(ids, tw.ID)
+	}
+
+	return ids, nil
+}
+
+func (tr *twinRepository) RetrieveIDs(ctx context.Context, owner string) ([]string, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	findOptions := options.Find()
+	findOptions.SetProjection(bson.M{"id": true, "_id": 0})
+
+	cur, err := coll.Find(ctx, bson.M{"owner": owner}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	ids := []string{}
+	for cur.Next(ctx) {
+		var elem struct {
+			ID string `bson:"id"`
+		}
+		if err := cur.Decode(&elem); err != nil {
+			return nil, err
+		}
+		ids = append(ids, elem.ID)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (tr *twinRepository) RetrieveByMetadata(ctx context.Context, owner string, filter twins.Metadata, limit uint64) ([]twins.Twin, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	f := bson.M{"owner": owner}
+	for k, v := range filter {
+		f[fmt.Sprintf("metadata.%s", k)] = v
+	}
+
+	findOptions := options.Find()
+	findOptions.SetLimit(int64(limit))
+
+	cur, err := coll.Find(ctx, f, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTwins(ctx, cur)
+}
+
+func (tr *twinRepository) RetrieveByThing(ctx context.Context, owner, thingID string, limit uint64) ([]twins.Twin, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	findOptions := options.Find()
+	findOptions.SetLimit(int64(limit))
+
+	cur, err := coll.Find(ctx, bson.M{"owner": owner, "thingid": thingID}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTwins(ctx, cur)
+}
+
+func (tr *twinRepository) RetrieveByChannel(ctx context.Context, channelID string) ([]twins.Twin, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	cur, err := coll.Find(ctx, bson.M{"channelid": channelID})
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTwins(ctx, cur)
+}
+
+func (tr *twinRepository) RetrieveByInput(ctx context.Context, sourceID string) ([]twins.Twin, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	cur, err := coll.Find(ctx, bson.M{"inputs.sourcetwinid": sourceID})
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTwins(ctx, cur)
+}
+
+func (tr *twinRepository) UpdateMetadata(ctx context.Context, owner string, filter, patch twins.Metadata) (uint64, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	f := bson.M{"owner": owner}
+	for k, v := range filter {
+		f[fmt.Sprintf("metadata.%s", k)] = v
+	}
+
+	set := bson.M{"updated": time.Now()}
+	for k, v := range patch {
+		set[fmt.Sprintf("metadata.%s", k)] = v
+	}
+	update := bson.M{
+		"$set": set,
+		"$inc": bson.M{"revision": 1},
+	}
+
+	res, err := coll.UpdateMany(ctx, f, update)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(res.ModifiedCount), nil
+}
+
+func (tr *twinRepository) SaveLastError(ctx context.Context, id, msg string, at time.Time) error {
+	coll := tr.db.Collection(twinsCollection)
+
+	update := bson.M{"$set": bson.M{"lasterror": msg, "lasterrorat": at}}
+	res, err := coll.UpdateOne(ctx, bson.M{"id": id}, update)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount < 1 {
+		return twins.ErrNotFound
+	}
+
+	return nil
+}
+
 func (tr *twinRepository) Remove(ctx context.Context, id string) error {
 	coll := tr.db.Collection(twinsCollection)
 
@@ -187,6 +391,295 @@ func (tr *twinRepository) Remove(ctx context.Context, id string) error {
 	return nil
 }
 
+type schemaRecord struct {
+	Owner    string            `bson:"owner"`
+	Required []string          `bson:"required"`
+	Types    map[string]string `bson:"types"`
+}
+
+func (tr *twinRepository) SaveMetadataSchema(ctx context.Context, owner string, schema twins.MetadataSchema) error {
+	coll := tr.db.Collection(schemasCollection)
+
+	rec := schemaRecord{
+		Owner:    owner,
+		Required: schema.Required,
+		Types:    schema.Types,
+	}
+
+	filter := bson.M{"owner": owner}
+	_, err := coll.ReplaceOne(ctx, filter, rec, options.Replace().SetUpsert(true))
+
+	return err
+}
+
+func (tr *twinRepository) RetrieveMetadataSchema(ctx context.Context, owner string) (twins.MetadataSchema, error) {
+	coll := tr.db.Collection(schemasCollection)
+
+	var rec schemaRecord
+	if err := coll.FindOne(ctx, bson.M{"owner": owner}).Decode(&rec); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return twins.MetadataSchema{}, nil
+		}
+		return twins.MetadataSchema{}, err
+	}
+
+	schema := twins.MetadataSchema{
+		Required: rec.Required,
+		Types:    rec.Types,
+	}
+
+	return schema, nil
+}
+
+type quotaRecord struct {
+	Owner     string `bson:"owner"`
+	MaxStates uint64 `bson:"maxstates"`
+}
+
+func (tr *twinRepository) SaveOwnerQuota(ctx context.Context, owner string, maxStates uint64) error {
+	coll := tr.db.Collection(quotasCollection)
+
+	filter := bson.M{"owner": owner}
+	if maxStates == 0 {
+		_, err := coll.DeleteOne(ctx, filter)
+		return err
+	}
+
+	rec := quotaRecord{
+		Owner:     owner,
+		MaxStates: maxStates,
+	}
+	_, err := coll.ReplaceOne(ctx, filter, rec, options.Replace().SetUpsert(true))
+
+	return err
+}
+
+func (tr *twinRepository) RetrieveOwnerQuota(ctx context.Context, owner string) (uint64, error) {
+	coll := tr.db.Collection(quotasCollection)
+
+	var rec quotaRecord
+	if err := coll.FindOne(ctx, bson.M{"owner": owner}).Decode(&rec); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return rec.MaxStates, nil
+}
+
+type keyRecord struct {
+	Hash    string       `bson:"_id"`
+	ID      string       `bson:"id"`
+	Issuer  string       `bson:"issuer"`
+	TwinID  string       `bson:"twinid"`
+	Action  twins.Action `bson:"action"`
+	Expires time.Time    `bson:"expires"`
+}
+
+func (tr *twinRepository) SaveKey(ctx context.Context, key twins.TwinKey) error {
+	coll := tr.db.Collection(keysCollection)
+
+	rec := keyRecord{
+		Hash:    key.Hash,
+		ID:      key.ID,
+		Issuer:  key.Issuer,
+		TwinID:  key.TwinID,
+		Action:  key.Action,
+		Expires: key.Expires,
+	}
+	_, err := coll.InsertOne(ctx, rec)
+
+	return err
+}
+
+func (tr *twinRepository) RetrieveKey(ctx context.Context, hash string) (twins.TwinKey, error) {
+	coll := tr.db.Collection(keysCollection)
+
+	var rec keyRecord
+	if err := coll.FindOne(ctx, bson.M{"_id": hash}).Decode(&rec); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return twins.TwinKey{}, twins.ErrNotFound
+		}
+		return twins.TwinKey{}, err
+	}
+
+	key := twins.TwinKey{
+		ID:      rec.ID,
+		Hash:    rec.Hash,
+		Issuer:  rec.Issuer,
+		TwinID:  rec.TwinID,
+		Action:  rec.Action,
+		Expires: rec.Expires,
+	}
+
+	return key, nil
+}
+
+func (tr *twinRepository) RemoveKey(ctx context.Context, twinID, id string) error {
+	coll := tr.db.Collection(keysCollection)
+
+	res, err := coll.DeleteOne(ctx, bson.M{"twinid": twinID, "id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return twins.ErrNotFound
+	}
+
+	return nil
+}
+
+func (tr *twinRepository) RemoveExpiredKeys(ctx context.Context, before time.Time) (uint64, error) {
+	coll := tr.db.Collection(keysCollection)
+
+	res, err := coll.DeleteMany(ctx, bson.M{"expires": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(res.DeletedCount), nil
+}
+
+type lockRecord struct {
+	TwinID  string    `bson:"_id"`
+	Token   string    `bson:"token"`
+	Holder  string    `bson:"holder"`
+	Expires time.Time `bson:"expires"`
+}
+
+func (tr *twinRepository) SaveLock(ctx context.Context, lk twins.TwinLock) error {
+	coll := tr.db.Collection(locksCollection)
+
+	// Locks held with another token that haven't expired don't match the
+	// filter, so the upsert fails on the twin id being taken.
+	filter := bson.M{
+		"_id": lk.TwinID,
+		"$or": []bson.M{
+			{"token": lk.Token},
+			{"expires": bson.M{"$lte": time.Now()}},
+		},
+	}
+	rec := lockRecord{
+		TwinID:  lk.TwinID,
+		Token:   lk.Token,
+		Holder:  lk.Holder,
+		Expires: lk.Expires,
+	}
+	_, err := coll.ReplaceOne(ctx, filter, rec, options.Replace().SetUpsert(true))
+	if isDuplicateKey(err) {
+		return twins.ErrLocked
+	}
+
+	return err
+}
+
+func (tr *twinRepository) RetrieveLock(ctx context.Context, twinID string) (twins.TwinLock, error) {
+	coll := tr.db.Collection(locksCollection)
+
+	var rec lockRecord
+	if err := coll.FindOne(ctx, bson.M{"_id": twinID}).Decode(&rec); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return twins.TwinLock{}, twins.ErrNotFound
+		}
+		return twins.TwinLock{}, err
+	}
+
+	lk := twins.TwinLock{
+		TwinID:  rec.TwinID,
+		Token:   rec.Token,
+		Holder:  rec.Holder,
+		Expires: rec.Expires,
+	}
+
+	return lk, nil
+}
+
+func (tr *twinRepository) RemoveLock(ctx context.Context, twinID, token string) error {
+	coll := tr.db.Collection(locksCollection)
+
+	filter := bson.M{
+		"_id": twinID,
+		"$or": []bson.M{
+			{"token": token},
+			{"expires": bson.M{"$lte": time.Now()}},
+		},
+	}
+	res, err := coll.DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount > 0 {
+		return nil
+	}
+
+	// Nothing is removed either if the twin isn't locked, or if it's locked
+	// with another token.
+	n, err := coll.CountDocuments(ctx, bson.M{"_id": twinID})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return twins.ErrLocked
+	}
+
+	return nil
+}
+
+// isDuplicateKey reports whether the write failed because of a duplicate
+// key.
+func isDuplicateKey(err error) bool {
+	we, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+	for _, e := range we.WriteErrors {
+		if e.Code == duplicateKeyCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (tr *twinRepository) Count(ctx context.Context) (int64, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	return coll.CountDocuments(ctx, bson.D{})
+}
+
+func (tr *twinRepository) CountChannels(ctx context.Context) (int64, error) {
+	coll := tr.db.Collection(twinsCollection)
+
+	prj := bson.M{
+		"$project": bson.M{
+			"attributes": bson.M{
+				"$arrayElemAt": []interface{}{"$definitions.attributes", -1},
+			},
+		},
+	}
+	unwind := bson.M{"$unwind": "$attributes"}
+	group := bson.M{"$group": bson.M{"_id": "$attributes.channel"}}
+	count := bson.M{"$count": "count"}
+
+	cur, err := coll.Aggregate(ctx, []bson.M{prj, unwind, group, count})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var res struct {
+		Count int64 `bson:"count"`
+	}
+	if cur.Next(ctx) {
+		if err := cur.Decode(&res); err != nil {
+			return 0, err
+		}
+	}
+
+	return res.Count, cur.Err()
+}
+
 func decodeTwins(ctx context.Context, cur *mongo.Cursor) ([]twins.Twin, error) {
 	defer cur.Close(ctx)
 	var results []twins.Twin
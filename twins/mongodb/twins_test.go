@@ -141,6 +141,64 @@ func TestTwinsUpdate(t *testing.T) {
 	}
 }
 
+func TestTwinsUpdateIf(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(addr))
+	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
+
+	db := client.Database(testDB)
+	repo := mongodb.NewTwinRepository(db)
+
+	twid, err := uuid.ID()
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+	nonexistentTwinID, err := uuid.ID()
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+	twin := twins.Twin{
+		ID:       twid,
+		Name:     validName,
+		Metadata: twins.Metadata{"state": "idle"},
+	}
+
+	if _, err := repo.Save(context.Background(), twin); err != nil {
+		testLog.Error(err.Error())
+	}
+
+	twin.Metadata = twins.Metadata{"state": "running"}
+	cases := []struct {
+		desc       string
+		twin       twins.Twin
+		conditions twins.Metadata
+		err        error
+	}{
+		{
+			desc:       "update twin matching conditions",
+			twin:       twin,
+			conditions: twins.Metadata{"state": "idle"},
+			err:        nil,
+		},
+		{
+			desc:       "update twin not matching conditions",
+			twin:       twin,
+			conditions: twins.Metadata{"state": "idle"},
+			err:        twins.ErrConflict,
+		},
+		{
+			desc: "update non-existing twin",
+			twin: twins.Twin{
+				ID: nonexistentTwinID,
+			},
+			conditions: twins.Metadata{"state": "idle"},
+			err:        twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		err := repo.UpdateIf(context.Background(), tc.twin, tc.conditions)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+}
+
 func TestTwinsRetrieveByID(t *testing.T) {
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(addr))
 	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
@@ -185,6 +243,40 @@ func TestTwinsRetrieveByID(t *testing.T) {
 	}
 }
 
+func TestTwinsAttributeOrder(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(addr))
+	require.Nil(t, err, fmt.Sprintf("Creating new MongoDB client expected to succeed: %s.\n", err))
+
+	db := client.Database(testDB)
+	repo := mongodb.NewTwinRepository(db)
+
+	twid, err := uuid.ID()
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+	names := []string{"zeta", "alpha", "mu", "beta"}
+	var attrs []twins.Attribute
+	for _, name := range names {
+		attrs = append(attrs, twins.Attribute{Name: name, Channel: name, Subtopic: name, PersistState: true})
+	}
+	twin := twins.Twin{
+		ID:          twid,
+		Owner:       email,
+		Definitions: []twins.Definition{{Attributes: attrs}},
+	}
+	_, err = repo.Save(context.Background(), twin)
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+
+	saved, err := repo.RetrieveByID(context.Background(), twid)
+	require.Nil(t, err, fmt.Sprintf("got unexpected error: %s", err))
+	require.Len(t, saved.Definitions, 1, fmt.Sprintf("expected single definition got %d", len(saved.Definitions)))
+
+	var got []string
+	for _, attr := range saved.Definitions[0].Attributes {
+		got = append(got, attr.Name)
+	}
+	assert.Equal(t, names, got, fmt.Sprintf("expected attributes %v got %v\n", names, got))
+}
+
 func TestTwinsRetrieveAll(t *testing.T) {
 	email := "twin-multi-retrieval@example.com"
 	name := "mainflux"
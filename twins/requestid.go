@@ -0,0 +1,39 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"context"
+
+	"github.com/mainflux/mainflux/pkg/uuid"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of the context carrying the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, or an empty
+// string if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// EnsureRequestID returns the context as it is if it carries a request ID.
+// Otherwise, it returns a copy of the context carrying a generated one.
+func EnsureRequestID(ctx context.Context) context.Context {
+	if RequestID(ctx) != "" {
+		return ctx
+	}
+
+	id, err := uuid.New().ID()
+	if err != nil {
+		return ctx
+	}
+
+	return WithRequestID(ctx, id)
+}
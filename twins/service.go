@@ -4,24 +4,48 @@
 package twins
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/pkg/errors"
 	"github.com/mainflux/mainflux/pkg/messaging"
 
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gogo/protobuf/proto"
 	"github.com/mainflux/mainflux"
 	"github.com/mainflux/senml"
 )
 
 const (
 	publisher = "twins"
+
+	senmlJSON = "application/senml+json"
+	senmlXML  = "application/senml+xml"
+	senmlCBOR = "application/senml+cbor"
+
+	gzipEncoding     = "gzip"
+	identityEncoding = "identity"
 )
 
+var formats = map[string]senml.Format{
+	senmlJSON: senml.JSON,
+	senmlXML:  senml.XML,
+	senmlCBOR: senml.CBOR,
+}
+
 var (
 	// ErrMalformedEntity indicates malformed entity specification (e.g.
 	// invalid username or password).
@@ -36,44 +60,404 @@ var (
 
 	// ErrConflict indicates that entity already exists.
 	ErrConflict = errors.New("entity already exists")
+
+	// ErrUnsupportedContentType indicates that configured message content
+	// type is not supported.
+	ErrUnsupportedContentType = errors.New("unsupported content type")
+
+	// ErrLimitExceeded indicates that requested page size exceeds the
+	// configured maximum.
+	ErrLimitExceeded = errors.New("page limit exceeded")
+
+	// ErrSchemaViolation indicates that twin metadata doesn't conform to the
+	// metadata schema of its owner.
+	ErrSchemaViolation = errors.New("metadata schema violation")
+
+	// ErrLocked indicates that the twin is locked and the lock token wasn't
+	// presented.
+	ErrLocked = errors.New("twin is locked")
+
+	// ErrEventsEvicted indicates that requested events are no longer
+	// retained in the event log.
+	ErrEventsEvicted = errors.New("events evicted from event log")
+
+	// ErrBackpressure indicates that the asynchronous state write queue is
+	// full.
+	ErrBackpressure = errors.New("state write queue is full")
+
+	// ErrOverloaded indicates that the message wasn't processed because
+	// the limit of concurrently processed messages was reached.
+	ErrOverloaded = errors.New("too many messages being processed")
+
+	// ErrArchiveUnavailable indicates that no archive store is configured.
+	ErrArchiveUnavailable = errors.New("archive store is not configured")
+
+	// ErrDependencyExists indicates that an attribute can't be removed
+	// because other attributes are derived from it.
+	ErrDependencyExists = errors.New("attribute has dependent attributes")
+
+	// ErrTypeMismatch indicates that a record value is of a type other than
+	// the value type of its attribute.
+	ErrTypeMismatch = errors.New("value type mismatch")
+
+	// ErrInvalidValue indicates that a record value isn't one of the values
+	// the attribute allows.
+	ErrInvalidValue = errors.New("value not allowed")
+
+	// ErrPartialWrite indicates that persisting states from a message timed
+	// out after some of its records were persisted.
+	ErrPartialWrite = errors.New("states partially written")
+
+	// ErrQuotaExceeded indicates that saving a state would exceed the state
+	// quota of the twin owner.
+	ErrQuotaExceeded = errors.New("state quota exceeded")
+
+	// ErrPayloadTooLarge indicates that a record value, or a decompressed
+	// message payload, exceeds its size limit.
+	ErrPayloadTooLarge = errors.New("payload too large")
 )
 
 // Service specifies an API that must be fullfiled by the domain service
 // implementation, and all of its decorators (e.g. logging & metrics).
 type Service interface {
 	// AddTwin adds new twin related to user identified by the provided key.
+	// ValidationError listing the invalid fields is returned if the
+	// definition is not valid. Attributes without subtopic default to
+	// their name.
 	AddTwin(ctx context.Context, token string, twin Twin, def Definition) (tw Twin, err error)
 
 	// UpdateTwin updates twin identified by the provided Twin that
-	// belongs to the user identified by the provided key.
+	// belongs to the user identified by the provided key. Updates that
+	// don't change the twin, e.g. saving its current definition again,
+	// neither bump its revision nor emit an event.
 	UpdateTwin(ctx context.Context, token string, twin Twin, def Definition) (err error)
 
+	// ConditionalUpdateTwin updates twin like UpdateTwin, leaving its
+	// definition as it is, only if the twin metadata matches the conditions
+	// on top level keys at the time of the update. ErrConflict is returned
+	// if it doesn't.
+	ConditionalUpdateTwin(ctx context.Context, token string, twin Twin, conditions map[string]interface{}) (err error)
+
+	// LinkTwinInput links the attribute of the target twin to the attribute
+	// of the source twin, so that the target attribute is recomputed
+	// whenever the source twin saves a state. An attribute linked to many
+	// source attributes holds the mean of their numeric values, or of their
+	// sums if the source field is SumField. Links that would introduce a
+	// cycle are rejected with ErrMalformedEntity.
+	LinkTwinInput(ctx context.Context, token, targetTwinID, targetAttr, sourceTwinID, sourceAttr string, sourceField Field) (err error)
+
+	// LockTwin acquires an advisory lock on the twin identified by the id and
+	// returns the lock token. The lock expires after ttl. Acquiring the lock
+	// with the context carrying its token extends it. While the twin is
+	// locked, updates whose context doesn't carry the token fail with
+	// ErrLocked, even if they are made by the lock holder.
+	LockTwin(ctx context.Context, token, id string, ttl time.Duration) (string, error)
+
+	// UnlockTwin releases the lock on the twin identified by the id. The
+	// context must carry the lock token, unless the lock has expired.
+	UnlockTwin(ctx context.Context, token, id string) error
+
 	// ViewTwin retrieves data about twin with the provided
 	// ID belonging to the user identified by the provided key.
 	ViewTwin(ctx context.Context, token, id string) (tw Twin, err error)
 
+	// ViewTwins retrieves data about twins with the provided IDs belonging
+	// to the user identified by the provided key. If some of the twins are
+	// missing or not owned by the user, the rest is returned along with
+	// BatchError.
+	ViewTwins(ctx context.Context, token string, ids []string) ([]Twin, error)
+
+	// ViewTwinByMetadata retrieves data about the single twin belonging to
+	// the user identified by the provided key whose metadata key has the
+	// given value. ErrConflict is returned if more than one twin matches.
+	ViewTwinByMetadata(ctx context.Context, token, key string, value interface{}) (tw Twin, err error)
+
+	// ViewTwinByThing retrieves data about the single twin belonging to the
+	// user identified by the provided key that is linked to the thing.
+	// ErrConflict is returned if more than one twin is linked to it.
+	ViewTwinByThing(ctx context.Context, token, thingID string) (tw Twin, err error)
+
 	// RemoveTwin removes the twin identified with the provided ID, that
-	// belongs to the user identified by the provided key.
-	RemoveTwin(ctx context.Context, token, id string) (err error)
+	// belongs to the user identified by the provided key. With cascade, the
+	// twin states and their notes are removed before the twin, so a removal
+	// failing midway leaves the twin in place to be removed again, and the
+	// retry removes whatever the failed removal left. Without cascade, the
+	// states are retained for later archival.
+	RemoveTwin(ctx context.Context, token, id string, cascade bool) (err error)
+
+	// ArchiveTwin exports the twin identified with the provided ID, along
+	// with all of its states, to the archive store and removes them from
+	// the service. Archived twins are neither listed nor updated by
+	// incoming messages until they are restored.
+	ArchiveTwin(ctx context.Context, token, id string) (err error)
+
+	// RestoreArchivedTwin restores the archived twin identified with the
+	// provided ID, along with its states, and removes it from the archive
+	// store. ErrConflict is returned if a twin with the same ID exists.
+	RestoreArchivedTwin(ctx context.Context, token, id string) (err error)
+
+	// UpdateTwinsMetadata merges the patch into metadata of all the twins that
+	// belong to the user identified by the provided key and whose metadata
+	// matches the filter. It returns the number of updated twins.
+	UpdateTwinsMetadata(ctx context.Context, token string, filter, patch Metadata) (uint64, error)
+
+	// MigrateDefinitions applies the migration to the definitions of all the
+	// twins that belong to the user identified by the provided key and whose
+	// metadata matches the filter. Each twin gets a new definition, and its
+	// last state is converted to it; older states are left as they were.
+	// Twins are migrated one by one, and a twin that fails to migrate is
+	// left unchanged. A rehash event is published for each converted state.
+	MigrateDefinitions(ctx context.Context, token string, filter Metadata, migration Migration) (MigrationResult, error)
+
+	// SetMetadataSchema sets the schema that metadata of all the twins that
+	// belong to the user identified by the provided key must conform to.
+	SetMetadataSchema(ctx context.Context, token string, schema MetadataSchema) error
 
 	// ListTwins retrieves data about subset of twins that belongs to the
-	// user identified by the provided key.
-	ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata Metadata) (Page, error)
+	// user identified by the provided key, along with their definition
+	// history. Definitions are omitted if omitDefinitions is set.
+	ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata Metadata, omitDefinitions bool) (Page, error)
+
+	// ListAllTwinIDs retrieves ids of all the twins that belong to the owner,
+	// without pagination. If owner is empty, the user identified by the
+	// provided key is used. Only the service admin is allowed to list ids of
+	// twins owned by other users.
+	ListAllTwinIDs(ctx context.Context, token, owner string) ([]string, error)
+
+	// TwinStatus retrieves online status of the twin identified by the id,
+	// derived from the time its last state was received.
+	TwinStatus(ctx context.Context, token, id string) (online bool, lastSeen time.Time, err error)
+
+	// CoverageReport maps each attribute of the twin identified by the id to
+	// whether a value of the attribute was stored within the window.
+	CoverageReport(ctx context.Context, token, twinID string, window time.Duration) (map[string]bool, error)
+
+	// LatestAttributeValues maps the twins with the provided IDs belonging
+	// to the user identified by the provided key to the last value of the
+	// attribute and its age. Twins that have no value of the attribute, or
+	// whose attribute is hidden from the user, are left out. If some of the
+	// twins are missing or not owned by the user, the rest is returned along
+	// with BatchError.
+	LatestAttributeValues(ctx context.Context, token string, twinIDs []string, attr string) (map[string]AttrValueAge, error)
+
+	// TwinHealth rates health of the twin identified by the id from 0 to
+	// 100, combining the staleness of its last state, the coverage of its
+	// persisted attributes within the heartbeat window and the share of the
+	// recent values within attribute ranges, weighted as configured.
+	TwinHealth(ctx context.Context, token, twinID string) (HealthScore, error)
+
+	// DescribeTwin describes the messages the twin identified by the id
+	// expects. Attributes that aren't persisted or are derived by the
+	// service aren't described.
+	DescribeTwin(ctx context.Context, token, twinID string) (TwinDescriptor, error)
+
+	// ListTwinsByStatus retrieves data about subset of twins that belongs to
+	// the user identified by the provided key and have the given online
+	// status.
+	ListTwinsByStatus(ctx context.Context, token string, offset uint64, limit uint64, online bool) (Page, error)
+
+	// ListTwinsWithErrors retrieves data about subset of twins that belongs
+	// to the user identified by the provided key and have encountered an
+	// error while saving states within the given window.
+	ListTwinsWithErrors(ctx context.Context, token string, offset uint64, limit uint64, window time.Duration) (Page, error)
 
 	// ListStates retrieves data about subset of states that belongs to the
-	// twin identified by the id.
-	ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string) (StatesPage, error)
+	// twin identified by the id. Eventual consistency trades freshness of the
+	// retrieved states for read throughput. Desc order retrieves the newest
+	// states first. Values of the attributes the user isn't granted access
+	// to are omitted. Raw SenML payloads the states were derived from are
+	// included if includeRaw is set and the user can read all the
+	// attributes.
+	ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string, consistency Consistency, order Order, includeRaw bool) (StatesPage, error)
+
+	// ListStatesByGroup retrieves data about subset of states that belongs
+	// to the twin identified by twinID, with payloads limited to the values
+	// of the attributes in the group.
+	ListStatesByGroup(ctx context.Context, token, twinID, group string, offset uint64, limit uint64, consistency Consistency, order Order) (StatesPage, error)
+
+	// ListStatesBySource retrieves the subset of states that belongs to the
+	// twin identified by twinID, last saved or updated from messages of the
+	// given publisher. Sources are recorded only if source capture is
+	// enabled.
+	ListStatesBySource(ctx context.Context, token, twinID, source string, offset uint64, limit uint64, order Order) (StatesPage, error)
+
+	// ListChannelStates retrieves the subset of states of all the twins
+	// bound to the channel, newest first. The channel must be accessible
+	// with the token. If thing verification is disabled, only states of the
+	// twins owned by the user are retrieved. Raw payloads are omitted.
+	ListChannelStates(ctx context.Context, token, channelID string, offset, limit uint64) (StatesPage, error)
+
+	// StreamExportStates writes all the states of the twin identified by
+	// twinID to the writer as newline-delimited JSON, oldest first. States
+	// are retrieved in batches, so the whole history is never held in
+	// memory. Values of the attributes the user isn't granted access to are
+	// omitted.
+	StreamExportStates(ctx context.Context, token, twinID string, w io.Writer) error
+
+	// CurrentState retrieves the last state of the twin identified by the
+	// id, with values of the attributes that declare a smoothing factor
+	// replaced by their moving averages, and the attributes that haven't
+	// reported yet set to their default values. Values of the attributes
+	// the user isn't granted access to are omitted, as is the raw SenML
+	// payload.
+	CurrentState(ctx context.Context, token, id string) (State, error)
+
+	// StateAt retrieves the state of the twin identified by the id as it
+	// was at the given time. The last state created at or before the time
+	// is returned, with each attribute set to its latest value reported at
+	// or before the time. Values of the attributes the user isn't granted
+	// access to are omitted, as is the raw SenML payload.
+	StateAt(ctx context.Context, token, id string, at time.Time) (State, error)
+
+	// AnnotateState attaches the note to the state with given id of the twin
+	// identified by twinID, replacing the existing one. Empty note removes
+	// the annotation.
+	AnnotateState(ctx context.Context, token, twinID string, stateID int64, note string) error
+
+	// SaveStates persists states into database. ValidationError is returned
+	// if the payload is malformed, listing the invalid records in strict
+	// SenML mode. ErrOverloaded is returned if the message can't be
+	// processed within the concurrency limit.
+	SaveStates(msg *messaging.Message) (SaveResult, error)
+
+	// SaveStatesBatch persists states from the messages in order, sharing
+	// the resolution of the twins the messages are matched against. The
+	// results are returned in the order of the messages. If saving some of
+	// them fails, the rest are still saved and BatchError mapping indices
+	// of the failed messages to their errors is returned.
+	SaveStatesBatch(ctx context.Context, msgs []*messaging.Message) ([]SaveResult, error)
+
+	// HandleDelivery saves states from the delivered message and acks it
+	// once they're saved. If saving fails, the message is nacked for
+	// redelivery until it has been redelivered the configured number of
+	// times, and is dead-lettered after that. Messages that fail for a
+	// reason redelivery can't fix are dead-lettered right away.
+	HandleDelivery(d Delivery) error
+
+	// PublishIngestionSummaries publishes a summary of records stored for
+	// each twin attribute since the previous call to the monitoring
+	// channel, one message per twin, and returns the published summaries.
+	PublishIngestionSummaries() ([]IngestionSummary, error)
+
+	// SimulateIngestion reports how the twin identified by twinID would
+	// interpret the protobuf encoded message without persisting any state.
+	SimulateIngestion(ctx context.Context, token, twinID string, payload []byte) (IngestionTrace, error)
+
+	// ValidateDefinition checks the definition without saving it. If the
+	// definition is not valid, DefinitionError listing all the problems is
+	// returned.
+	ValidateDefinition(ctx context.Context, def Definition) error
+
+	// Authorize checks whether the user identified by the provided key is
+	// allowed to perform the action on the twin identified by the id.
+	Authorize(ctx context.Context, token, id string, action Action) error
+
+	// IssueTwinKey issues a key that authorizes only the given action on the
+	// twin identified by the id. The key expires after ttl. Only the twin
+	// owner is allowed to issue keys. The returned key is the only one
+	// carrying the key value.
+	IssueTwinKey(ctx context.Context, token, twinID string, action Action, ttl time.Duration) (TwinKey, error)
+
+	// RevokeTwinKey revokes the key of the twin identified by the key id.
+	// Only the twin owner is allowed to revoke keys.
+	RevokeTwinKey(ctx context.Context, token, twinID, keyID string) error
+
+	// RemoveExpiredKeys removes the expired twin keys and returns the number
+	// of removed keys.
+	RemoveExpiredKeys(ctx context.Context) (uint64, error)
+
+	// ServiceStats retrieves platform-level statistics. Only the service
+	// admin is allowed to retrieve them.
+	ServiceStats(ctx context.Context, token string) (ServiceStats, error)
+
+	// SetOwnerQuota limits the total number of states the twins of the
+	// owner can have. Saving states beyond the quota fails with
+	// ErrQuotaExceeded. Zero removes the quota. Only the service admin is
+	// allowed to set quotas.
+	SetOwnerQuota(ctx context.Context, token, owner string, maxStates uint64) error
+
+	// OwnerUsage retrieves the number of states of the twins of the owner,
+	// along with the owner's quota. Only the owner and the service admin
+	// are allowed to retrieve it.
+	OwnerUsage(ctx context.Context, token, owner string) (Usage, error)
+
+	// SubscriptionInfo retrieves the subjects messages were received on,
+	// with their message counts and the time of the last message. Only the
+	// service admin is allowed to retrieve them.
+	SubscriptionInfo(ctx context.Context, token string) ([]SubInfo, error)
+
+	// ReplayEvents streams the retained events starting from the one with
+	// the given sequence number. The channel is closed once all the retained
+	// events are sent. Only the service admin is allowed to replay events.
+	ReplayEvents(ctx context.Context, token string, fromSeq uint64) (<-chan Event, error)
+
+	// VerifyStateChain verifies integrity of the hash chain of states that
+	// belong to the twin identified by the id. It returns whether the chain
+	// is intact and, if not, the id of the first state that breaks it.
+	VerifyStateChain(ctx context.Context, token, id string) (bool, int64, error)
+
+	// Reindex rebuilds the indexes of states that belong to the twin
+	// identified by the provided id. It's meant to be run after large
+	// imports that may leave the indexes stale.
+	Reindex(ctx context.Context, token, twinID string) error
+
+	// BackfillDerived recomputes the derived attribute over all the stored
+	// states of the twin identified by the id, from the values of its source
+	// attribute, and rehashes the state chain. The changed states are
+	// reported by a rehash event, along with the hashes they had before. It's
+	// meant to be run after a derived attribute is added to a twin that
+	// already has states.
+	BackfillDerived(ctx context.Context, token, twinID, derivedAttr string) error
+
+	// StatesHistogram returns the number of states of the twin identified by
+	// the id created within each bucket of the given size, starting at from
+	// and ending before to. Buckets without states are included. If the
+	// location is set and the bucket is a whole number of days, buckets
+	// start at local midnight of the day from falls within and span whole
+	// local days, which are shorter or longer across DST transitions.
+	StatesHistogram(ctx context.Context, token, twinID string, bucket time.Duration, from, to time.Time, loc *time.Location) ([]BucketCount, error)
 
-	// SaveStates persists states into database
-	SaveStates(msg *messaging.Message) error
+	// ListStatePartitions returns the number of states of the twin
+	// identified by the provided id within each calendar period of the
+	// given granularity, in the location or in UTC if it's nil. Only
+	// periods containing states are returned.
+	ListStatePartitions(ctx context.Context, token, twinID string, granularity Granularity, loc *time.Location) ([]Partition, error)
+
+	// FindStates retrieves the subset of states of the twin identified by
+	// the twinID whose numeric value of the attribute matches the operator
+	// applied to the value, oldest first. Searching by an attribute the
+	// user isn't granted access to fails with ErrUnauthorizedAccess.
+	FindStates(ctx context.Context, token, twinID, attr string, op Operator, value float64, offset, limit uint64) (StatesPage, error)
+
+	// RegisterUnitAlias registers the alias of the canonical unit. Units of
+	// incoming records are normalized before they are checked against the
+	// attribute unit.
+	RegisterUnitAlias(alias, canonical string)
 }
 
 const (
 	noop = iota
 	update
 	save
+	drop
 	millisec = 1e6
 	nanosec  = 1e9
+
+	// relativeTime is the SenML time in seconds below which time is
+	// relative to the current time.
+	relativeTime = 1 << 28
+
+	verifyPageSize = 100
+	statusPageSize = 100
+
+	day = 24 * time.Hour
+
+	defHeartbeat = 5 * time.Minute
+	statsWindow  = time.Hour
+
+	maxAttributes = 100
+	maxBuckets    = 1000
+	maxPrecision  = 15
 )
 
 var crudOp = map[string]string{
@@ -85,10 +469,282 @@ var crudOp = map[string]string{
 	"getFail":    "get.failure",
 	"removeSucc": "remove.success",
 	"removeFail": "remove.failure",
+	"archSucc":   "archive.success",
+	"archFail":   "archive.failure",
+	"restSucc":   "restore.success",
+	"restFail":   "restore.failure",
 	"stateSucc":  "save.success",
 	"stateFail":  "save.failure",
 }
 
+// actionNames names state save actions in ingestion traces.
+var actionNames = map[int]string{
+	noop:   "ignored",
+	update: "updated",
+	save:   "saved",
+	drop:   "dropped",
+}
+
+// ingestionSummaryOp is the subtopic ingestion summaries are published to.
+const ingestionSummaryOp = "ingestion.summary"
+
+// archivePageSize is the number of states retrieved at once while archiving
+// a twin.
+const archivePageSize = 100
+
+// backfillOp is the operation of the event notifying that states were
+// inserted into the past of the twin.
+const backfillOp = "backfill"
+
+// rehashOp is the operation of the event notifying that stored states of the
+// twin were changed, and their hashes recomputed.
+const rehashOp = "rehash"
+
+// Reasons of stored states being rehashed.
+const (
+	rehashDerived   = "backfill_derived"
+	rehashMigration = "migration"
+)
+
+// Config defines the options that are used to tune twins service behavior.
+type Config struct {
+	// CaseInsensitiveMatch makes resolution of attributes by message
+	// subtopic case-insensitive.
+	CaseInsensitiveMatch bool
+
+	// MaxPageLimit is the maximum number of twins or states that can be
+	// retrieved in a single page. Zero value means no limit.
+	MaxPageLimit uint64
+
+	// Heartbeat is the default time window within which a state must be
+	// received for twin to be considered online. It is used for twins that
+	// don't specify their own heartbeat.
+	Heartbeat time.Duration
+
+	// AdminEmail is the email of the user allowed to retrieve service stats
+	// and to enumerate twins of other users.
+	AdminEmail string
+
+	// ContentType is the SenML content type of the message payloads. If
+	// it's not set, the content type of each payload is detected from its
+	// first byte.
+	ContentType string
+
+	// EventLogSize is the number of the most recent events retained for
+	// replay. Zero value disables retention.
+	EventLogSize int
+
+	// MonitoringChannel is the channel ingestion summaries are published
+	// to. Records aren't counted if it's not set.
+	MonitoringChannel string
+
+	// UnitAliases maps unit aliases reported by devices to canonical units.
+	UnitAliases map[string]string
+
+	// AccessGrants maps twin owners to the users they grant attribute access
+	// labels to, and the granted labels. Users granted any label by an owner
+	// are allowed to read the twins of that owner only.
+	AccessGrants map[string]map[string][]string
+
+	// StrictSenML makes SaveStates reject the whole message if any of its
+	// records fails to decode. By default, the valid records are processed
+	// and the invalid ones are reported.
+	StrictSenML bool
+
+	// RejectTypeMismatch makes SaveStates reject the message with
+	// ErrTypeMismatch if any of its records has a value of a type other
+	// than the value type of the attribute. By default, such records are
+	// dropped and reported as the last error of the twin.
+	RejectTypeMismatch bool
+
+	// AsyncWrites makes SaveStates queue state writes and return before
+	// they are persisted. Messages are rejected with ErrBackpressure while
+	// the queue is full.
+	AsyncWrites bool
+
+	// WriteQueueSize is the number of messages that can be queued for
+	// asynchronous state writes.
+	WriteQueueSize int
+
+	// MaxConcurrentSaves is the number of messages SaveStates processes
+	// concurrently. Excess messages wait for a message to be processed.
+	// Zero value means no limit.
+	MaxConcurrentSaves int
+
+	// SaveQueueTimeout is how long a message exceeding MaxConcurrentSaves
+	// waits to be processed before it's rejected with ErrOverloaded. Zero
+	// value means it waits until it's processed.
+	SaveQueueTimeout time.Duration
+
+	// Archive is the cold store retired twins are archived to. Archival is
+	// disabled if it's not set.
+	Archive ArchiveStore
+
+	// HealthWeights weigh the factors twin health scores are combined
+	// from.
+	HealthWeights HealthWeights
+
+	// StoreRawSenML makes states keep the SenML payload of the message
+	// they were last saved or updated from.
+	StoreRawSenML bool
+
+	// CaptureSource makes states record the publisher of the message they
+	// were last saved or updated from.
+	CaptureSource bool
+
+	// HideUnauthorized makes operations on twins owned by another user
+	// fail with ErrNotFound rather than ErrUnauthorizedAccess, so callers
+	// can't tell whether a twin they don't own exists. The tradeoff is that
+	// a legitimate caller using the wrong account gets no hint the twin is
+	// there. Invalid tokens still fail with ErrUnauthorizedAccess.
+	HideUnauthorized bool
+
+	// Things verifies the things twins are linked to. If it's nil, thing
+	// IDs are stored without verification.
+	Things ThingVerifier
+
+	// MaxRedeliveries is the number of times a delivered message whose
+	// states failed to save is redelivered before it's dead-lettered. With
+	// AsyncWrites, messages are acked once their writes are queued.
+	MaxRedeliveries int
+
+	// DeadLetterChannel is the channel the messages that can't be saved are
+	// published to, with the subtopic set to their original channel and
+	// subtopic. Such messages are dropped if it's not set.
+	DeadLetterChannel string
+
+	// SaveTimeout bounds the time persisting states from a single message
+	// takes. Once it elapses, the remaining records are skipped, the ones
+	// already persisted are kept, and SaveStates fails with
+	// ErrPartialWrite. Zero means no timeout.
+	SaveTimeout time.Duration
+
+	// FailOpenReads makes reads of twins and their states fall back to the
+	// users tokens were last identified as while the auth service is
+	// unavailable. Writes fail regardless.
+	FailOpenReads bool
+
+	// IdentityTTL is the time identities are kept for fail-open reads
+	// after the token was last identified. Zero keeps them indefinitely.
+	IdentityTTL time.Duration
+
+	// IdentityCacheSize is the maximum number of identities kept for
+	// fail-open reads. The least recently used identities are evicted once
+	// it's reached. Zero doesn't limit the number of identities.
+	IdentityCacheSize int
+
+	// ValidateUnits makes definitions whose attribute units aren't among
+	// the vetted UCUM units invalid, e.g. "degC" rather than "Cel".
+	ValidateUnits bool
+
+	// MaxRecordSize is the maximal size in bytes of a string or data value
+	// of a single record. Larger records are skipped and SaveStates fails
+	// with ErrPayloadTooLarge once the rest are saved. Zero means no limit.
+	MaxRecordSize int
+
+	// ContentEncoding is the encoding of message payloads, either "gzip"
+	// or "identity". If it's not set, gzip payloads are recognized by their
+	// magic number.
+	ContentEncoding string
+
+	// MaxDecompressedSize is the maximal size in bytes of a decompressed
+	// message payload. Larger payloads fail with ErrPayloadTooLarge. Zero
+	// means no limit.
+	MaxDecompressedSize int
+}
+
+// SaveResult summarizes the outcome of saving states from a message.
+type SaveResult struct {
+	// Saved is the number of records stored as new or updated states. It
+	// is the number of records persisted before ErrPartialWrite, too.
+	Saved uint64
+	// Dropped is the number of records dropped because they arrived within
+	// the attribute minimal interval, were reported in a unit other than
+	// the attribute unit or with a value of a type other than the attribute
+	// value type, or were persisted by an earlier delivery of the message.
+	Dropped uint64
+	// Invalid is the number of records skipped because they failed to
+	// decode.
+	Invalid uint64
+	// Oversized is the number of records skipped because their value
+	// exceeds the record size limit.
+	Oversized uint64
+	// Unmatched is the number of records skipped because the message
+	// matches no attribute of any twin.
+	Unmatched uint64
+	// States are the states saved or updated, in the order they were
+	// persisted. A state updated by several records is listed once.
+	States []StateRef
+	// Queued reports that the records were queued for asynchronous write,
+	// in which case Saved, Dropped, Unmatched and States are not known yet.
+	Queued bool
+	// RequestID is the ID the message was processed with.
+	RequestID string
+}
+
+// StateRef identifies the state with the given id of the twin identified by
+// TwinID.
+type StateRef struct {
+	TwinID string
+	ID     int64
+}
+
+// AttrValueAge is the last value of an attribute, along with the time it
+// was stored at and the time elapsed since.
+type AttrValueAge struct {
+	Value   interface{}
+	Updated time.Time
+	Age     time.Duration
+}
+
+// RecordTrace describes how a single SenML record would be processed.
+type RecordTrace struct {
+	Name      string
+	Time      time.Time
+	Unit      string
+	Value     interface{}
+	Attribute string
+	// Action is one of "saved", "updated", "dropped" or "ignored".
+	Action string
+	// Reason explains why the record would be dropped or ignored.
+	Reason string
+}
+
+// IngestionTrace describes how a message would be interpreted by a twin.
+type IngestionTrace struct {
+	TwinID   string
+	Channel  string
+	Subtopic string
+	// Matched reports whether the message matches any twin attribute.
+	Matched bool
+	// Invalid is the number of records that failed to decode.
+	Invalid uint64
+	// Rejected reports whether the whole message would be rejected because
+	// of invalid records in strict SenML mode.
+	Rejected bool
+	Records  []RecordTrace
+	// State is the state the twin would have after the message is saved.
+	State State
+}
+
+// ServiceStats contains platform-level twins service statistics.
+type ServiceStats struct {
+	Twins        uint64
+	States       uint64
+	RecentStates uint64
+	// Channels is the number of distinct channels twin attributes are
+	// defined on.
+	Channels uint64
+}
+
+// Usage contains the number of states of the twins of the owner, and the
+// maximum number allowed. Zero MaxStates means no quota.
+type Usage struct {
+	Owner     string
+	States    uint64
+	MaxStates uint64
+}
+
 type twinsService struct {
 	publisher    messaging.Publisher
 	auth         mainflux.AuthNServiceClient
@@ -96,22 +752,44 @@ type twinsService struct {
 	states       StateRepository
 	uuidProvider mainflux.UUIDProvider
 	channelID    string
+	cfg          Config
+	events       *eventLog
+	identities   *identities
+	units        *unitAliases
+	ingestion    *ingestion
+	writes       *writeQueue
+	saves        *slots
+	subs         *subscriptions
 	logger       logger.Logger
 }
 
 var _ Service = (*twinsService)(nil)
 
 // New instantiates the twins service implementation.
-func New(publisher messaging.Publisher, auth mainflux.AuthNServiceClient, twins TwinRepository, sr StateRepository, up mainflux.UUIDProvider, chann string, logger logger.Logger) Service {
-	return &twinsService{
+func New(publisher messaging.Publisher, auth mainflux.AuthNServiceClient, twins TwinRepository, sr StateRepository, up mainflux.UUIDProvider, chann string, cfg Config, logger logger.Logger) Service {
+	ts := &twinsService{
 		publisher:    publisher,
 		auth:         auth,
 		twins:        twins,
 		states:       sr,
 		uuidProvider: up,
 		channelID:    chann,
+		cfg:          cfg,
+		events:       newEventLog(cfg.EventLogSize),
+		identities:   newIdentities(cfg.IdentityTTL, cfg.IdentityCacheSize),
+		units:        newUnitAliases(cfg.UnitAliases),
+		ingestion:    newIngestion(),
+		subs:         newSubscriptions(),
 		logger:       logger,
 	}
+	if cfg.AsyncWrites {
+		ts.writes = newWriteQueue(cfg.WriteQueueSize, ts.logWriteError)
+	}
+	if cfg.MaxConcurrentSaves > 0 {
+		ts.saves = newSlots(cfg.MaxConcurrentSaves, cfg.SaveQueueTimeout)
+	}
+
+	return ts
 }
 
 func (ts *twinsService) AddTwin(ctx context.Context, token string, twin Twin, def Definition) (tw Twin, err error) {
@@ -131,6 +809,23 @@ func (ts *twinsService) AddTwin(ctx context.Context, token string, twin Twin, de
 
 	twin.Owner = res.GetValue()
 
+	def = def.withDefaultSubtopics()
+	if err := ts.validateDefinition(def); err != nil {
+		return Twin{}, err.(*DefinitionError).validationError("definition")
+	}
+
+	if err := ts.checkBase(ctx, twin.ID, twin.BaseTwinID); err != nil {
+		return Twin{}, err
+	}
+
+	if err := ts.checkMetadata(ctx, twin.Owner, twin.Metadata); err != nil {
+		return Twin{}, err
+	}
+
+	if err := ts.checkThing(ctx, token, twin.ThingID); err != nil {
+		return Twin{}, err
+	}
+
 	t := time.Now()
 	twin.Created = t
 	twin.Updated = t
@@ -157,48 +852,134 @@ func (ts *twinsService) AddTwin(ctx context.Context, token string, twin Twin, de
 	return twin, nil
 }
 
-func (ts *twinsService) UpdateTwin(ctx context.Context, token string, twin Twin, def Definition) (err error) {
+func (ts *twinsService) UpdateTwin(ctx context.Context, token string, twin Twin, def Definition) error {
+	return ts.updateTwin(ctx, token, twin, def, nil)
+}
+
+func (ts *twinsService) ConditionalUpdateTwin(ctx context.Context, token string, twin Twin, conditions map[string]interface{}) error {
+	if len(conditions) == 0 {
+		return ErrMalformedEntity
+	}
+
+	return ts.updateTwin(ctx, token, twin, Definition{}, conditions)
+}
+
+// updateTwin applies the update to the twin. If there are conditions, the
+// twin is updated only if its stored metadata matches them.
+func (ts *twinsService) updateTwin(ctx context.Context, token string, twin Twin, def Definition, conditions Metadata) (err error) {
 	var b []byte
 	var id string
-	defer ts.publish(&id, &err, crudOp["updateSucc"], crudOp["updateFail"], &b)
+	skip := false
+	defer func() {
+		if !skip {
+			ts.publish(&id, &err, crudOp["updateSucc"], crudOp["updateFail"], &b)
+		}
+	}()
 
-	_, err = ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	_, tw, err := ts.identifyTwin(ctx, token, twin.ID, Write)
 	if err != nil {
-		return ErrUnauthorizedAccess
+		return err
 	}
 
-	tw, err := ts.twins.RetrieveByID(ctx, twin.ID)
-	if err != nil {
+	if err := ts.checkLock(ctx, tw.ID); err != nil {
 		return err
 	}
 
+	// Revision is set if the update carries any field, and changed only if
+	// any of them differs from the stored one.
 	revision := false
+	changed := false
 
 	if twin.Name != "" {
 		revision = true
+		changed = changed || twin.Name != tw.Name
 		tw.Name = twin.Name
 	}
 
+	if twin.Heartbeat > 0 {
+		revision = true
+		changed = changed || twin.Heartbeat != tw.Heartbeat
+		tw.Heartbeat = twin.Heartbeat
+	}
+
+	if twin.BaseTwinID != "" {
+		if err := ts.checkBase(ctx, tw.ID, twin.BaseTwinID); err != nil {
+			return err
+		}
+		revision = true
+		changed = changed || twin.BaseTwinID != tw.BaseTwinID
+		tw.BaseTwinID = twin.BaseTwinID
+	}
+
+	if twin.ChannelID != "" {
+		revision = true
+		changed = changed || twin.ChannelID != tw.ChannelID
+		tw.ChannelID = twin.ChannelID
+	}
+
+	if twin.ThingID != "" {
+		if err := ts.checkThing(ctx, token, twin.ThingID); err != nil {
+			return err
+		}
+		revision = true
+		changed = changed || twin.ThingID != tw.ThingID
+		tw.ThingID = twin.ThingID
+	}
+
 	if len(def.Attributes) > 0 {
+		def = def.withDefaultSubtopics()
+		cur := tw.Definitions[len(tw.Definitions)-1]
+		if err := checkDependencies(cur, def); err != nil {
+			return err
+		}
+		if err := ts.validateDefinition(def); err != nil {
+			return err.(*DefinitionError).validationError("definition")
+		}
 		revision = true
-		def.Created = time.Now()
-		def.ID = tw.Definitions[len(tw.Definitions)-1].ID + 1
-		tw.Definitions = append(tw.Definitions, def)
+		// Saving the current definition again doesn't create a new one.
+		if !def.Equal(cur) {
+			changed = true
+			def.Created = time.Now()
+			def.ID = cur.ID + 1
+			tw.Definitions = append(tw.Definitions, def)
+		}
 	}
 
 	if len(twin.Metadata) > 0 {
+		if err := ts.checkMetadata(ctx, tw.Owner, twin.Metadata); err != nil {
+			return err
+		}
 		revision = true
+		changed = changed || !reflect.DeepEqual(twin.Metadata, tw.Metadata)
 		tw.Metadata = twin.Metadata
 	}
 
+	if len(twin.Features) > 0 {
+		revision = true
+		changed = changed || !reflect.DeepEqual(twin.Features, tw.Features)
+		tw.Features = twin.Features
+	}
+
 	if !revision {
 		return ErrMalformedEntity
 	}
 
+	// Conditional updates are applied regardless, so their conditions are
+	// checked.
+	if !changed && conditions == nil {
+		skip = true
+		return nil
+	}
+
 	tw.Updated = time.Now()
 	tw.Revision++
 
-	if err := ts.twins.Update(ctx, tw); err != nil {
+	if conditions != nil {
+		err = ts.twins.UpdateIf(ctx, tw, conditions)
+	} else {
+		err = ts.twins.Update(ctx, tw)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -208,118 +989,2644 @@ func (ts *twinsService) UpdateTwin(ctx context.Context, token string, twin Twin,
 	return nil
 }
 
-func (ts *twinsService) ViewTwin(ctx context.Context, token, id string) (tw Twin, err error) {
+func (ts *twinsService) LinkTwinInput(ctx context.Context, token, targetTwinID, targetAttr, sourceTwinID, sourceAttr string, sourceField Field) (err error) {
 	var b []byte
-	defer ts.publish(&id, &err, crudOp["getSucc"], crudOp["getFail"], &b)
+	var id string
+	defer ts.publish(&id, &err, crudOp["updateSucc"], crudOp["updateFail"], &b)
 
-	_, err = ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	user, tw, err := ts.identifyTwin(ctx, token, targetTwinID, Write)
 	if err != nil {
-		return Twin{}, ErrUnauthorizedAccess
+		return err
 	}
 
-	twin, err := ts.twins.RetrieveByID(ctx, id)
-	if err != nil {
-		return Twin{}, err
+	if targetAttr == "" || sourceTwinID == "" || sourceAttr == "" {
+		return ErrMalformedEntity
+	}
+	if !sourceField.valid() {
+		return invalidField("source_field", "unknown field %q", sourceField)
+	}
+	// Values are linked by default, so linking them explicitly is the same
+	// link.
+	if sourceField == ValueField {
+		sourceField = ""
 	}
 
-	b, err = json.Marshal(twin)
-
-	return twin, nil
-}
+	if err := ts.checkLock(ctx, tw.ID); err != nil {
+		return err
+	}
 
-func (ts *twinsService) RemoveTwin(ctx context.Context, token, id string) (err error) {
-	var b []byte
-	defer ts.publish(&id, &err, crudOp["removeSucc"], crudOp["removeFail"], &b)
+	target, err := ts.resolveDefinition(ctx, tw)
+	if err != nil {
+		return err
+	}
+	if idx := latestAttribute(target, targetAttr); idx < 0 || !target.Definitions[len(target.Definitions)-1].Attributes[idx].PersistState {
+		return invalidField("attribute", "unknown persisted attribute %q", targetAttr)
+	}
 
-	_, err = ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	src, err := ts.twins.RetrieveByID(ctx, sourceTwinID)
+	if err == ErrNotFound {
+		return invalidField("source_twin_id", "unknown twin %q", sourceTwinID)
+	}
 	if err != nil {
+		return err
+	}
+	if src, err = ts.resolveDefinition(ctx, src); err != nil {
+		return err
+	}
+	if latestAttribute(src, sourceAttr) < 0 {
+		return invalidField("source_attribute", "unknown attribute %q", sourceAttr)
+	}
+	if ts.hiddenAttributes(user, src)[sourceAttr] {
 		return ErrUnauthorizedAccess
 	}
 
-	if err := ts.twins.Remove(ctx, id); err != nil {
+	if err := ts.checkInputs(ctx, tw.ID, src.ID); err != nil {
+		return err
+	}
+
+	input := TwinInput{Attribute: targetAttr, SourceTwinID: sourceTwinID, SourceAttribute: sourceAttr, SourceField: sourceField}
+	for _, in := range tw.Inputs {
+		if in == input {
+			return nil
+		}
+	}
+	tw.Inputs = append(tw.Inputs, input)
+	tw.Updated = time.Now()
+	tw.Revision++
+
+	if err = ts.twins.Update(ctx, tw); err != nil {
 		return err
 	}
 
+	id = tw.ID
+	b, err = json.Marshal(tw)
+
 	return nil
 }
 
-func (ts *twinsService) ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata Metadata) (Page, error) {
-	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
-	if err != nil {
-		return Page{}, ErrUnauthorizedAccess
+// checkInputs verifies that linking the twin with given id to the source
+// twin doesn't introduce a cycle of inputs, including the twin being linked
+// to itself.
+func (ts *twinsService) checkInputs(ctx context.Context, id, sourceID string) error {
+	visited := map[string]bool{}
+	for queue := []string{sourceID}; len(queue) > 0; queue = queue[1:] {
+		cur := queue[0]
+		if cur == id {
+			return ErrMalformedEntity
+		}
+		if visited[cur] {
+			continue
+		}
+		visited[cur] = true
+
+		tw, err := ts.twins.RetrieveByID(ctx, cur)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, in := range tw.Inputs {
+			queue = append(queue, in.SourceTwinID)
+		}
 	}
 
-	return ts.twins.RetrieveAll(ctx, res.GetValue(), offset, limit, name, metadata)
+	return nil
 }
 
-func (ts *twinsService) ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string) (StatesPage, error) {
-	_, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
-	if err != nil {
-		return StatesPage{}, ErrUnauthorizedAccess
+// latestAttribute returns the index of the attribute in the latest twin
+// definition, or -1 if it isn't there.
+func latestAttribute(tw Twin, name string) int {
+	if len(tw.Definitions) == 0 {
+		return -1
 	}
 
-	return ts.states.RetrieveAll(ctx, offset, limit, id)
+	return findAttribute(name, tw.Definitions[len(tw.Definitions)-1].Attributes)
 }
 
-func (ts *twinsService) SaveStates(msg *messaging.Message) error {
-	ids, err := ts.twins.RetrieveByAttribute(context.TODO(), msg.Channel, msg.Subtopic)
+func (ts *twinsService) LockTwin(ctx context.Context, token, id string, ttl time.Duration) (string, error) {
+	user, err := ts.identify(ctx, token, id, Write)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	for _, id := range ids {
-		if err := ts.saveState(msg, id); err != nil {
-			return err
+	if ttl <= 0 {
+		return "", ErrMalformedEntity
+	}
+
+	lockToken := LockToken(ctx)
+	if lockToken == "" {
+		if lockToken, err = ts.uuidProvider.ID(); err != nil {
+			return "", err
 		}
 	}
 
-	return nil
+	lk := TwinLock{
+		TwinID:  id,
+		Token:   lockToken,
+		Holder:  user,
+		Expires: time.Now().Add(ttl),
+	}
+	if err := ts.twins.SaveLock(ctx, lk); err != nil {
+		return "", err
+	}
+
+	return lockToken, nil
+}
+
+func (ts *twinsService) UnlockTwin(ctx context.Context, token, id string) error {
+	if _, err := ts.identify(ctx, token, id, Write); err != nil {
+		return err
+	}
+
+	return ts.twins.RemoveLock(ctx, id, LockToken(ctx))
 }
 
-func (ts *twinsService) saveState(msg *messaging.Message, id string) error {
+func (ts *twinsService) ViewTwin(ctx context.Context, token, id string) (tw Twin, err error) {
 	var b []byte
-	var err error
-	defer ts.publish(&id, &err, crudOp["stateSucc"], crudOp["stateFail"], &b)
+	defer ts.publish(&id, &err, crudOp["getSucc"], crudOp["getFail"], &b)
 
-	tw, err := ts.twins.RetrieveByID(context.TODO(), id)
+	_, twin, err := ts.identifyTwin(ctx, token, id, Read)
 	if err != nil {
-		return fmt.Errorf("Retrieving twin for %s failed: %s", msg.Publisher, err)
+		return Twin{}, err
 	}
 
-	var recs []senml.Record
-	if err := json.Unmarshal(msg.Payload, &recs); err != nil {
-		return fmt.Errorf("Unmarshal payload for %s failed: %s", msg.Publisher, err)
+	if twin, err = ts.resolveDefinition(ctx, twin); err != nil {
+		return Twin{}, err
+	}
+
+	b, err = json.Marshal(twin)
+
+	return twin, nil
+}
+
+func (ts *twinsService) ViewTwins(ctx context.Context, token string, ids []string) ([]Twin, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return nil, ErrUnauthorizedAccess
+	}
+
+	if err := ts.checkLimit(uint64(len(ids))); err != nil {
+		return nil, err
+	}
+
+	tws := []Twin{}
+	failed := make(map[string]error)
+	for _, id := range ids {
+		tw, err := ts.checkOwner(ctx, res.GetValue(), id, Read)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+			failed[id] = err
+			continue
+		}
+		tws = append(tws, tw)
+	}
+
+	if len(failed) > 0 {
+		return tws, &BatchError{Errors: failed}
+	}
+
+	return tws, nil
+}
+
+func (ts *twinsService) ViewTwinByMetadata(ctx context.Context, token, key string, value interface{}) (tw Twin, err error) {
+	var id string
+	var b []byte
+	defer ts.publish(&id, &err, crudOp["getSucc"], crudOp["getFail"], &b)
+
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return Twin{}, ErrUnauthorizedAccess
+	}
+
+	if key == "" {
+		return Twin{}, ErrMalformedEntity
+	}
+
+	// Two twins are enough to tell that the key is not unique.
+	tws, err := ts.twins.RetrieveByMetadata(ctx, res.GetValue(), Metadata{key: value}, 2)
+	if err != nil {
+		return Twin{}, err
+	}
+
+	switch len(tws) {
+	case 0:
+		return Twin{}, ErrNotFound
+	case 1:
+	default:
+		return Twin{}, ErrConflict
+	}
+
+	if _, err := ts.checkOwner(ctx, res.GetValue(), tws[0].ID, Read); err != nil {
+		return Twin{}, err
+	}
+
+	id = tws[0].ID
+	twin, err := ts.resolveDefinition(ctx, tws[0])
+	if err != nil {
+		return Twin{}, err
+	}
+
+	b, err = json.Marshal(twin)
+
+	return twin, nil
+}
+
+func (ts *twinsService) ViewTwinByThing(ctx context.Context, token, thingID string) (tw Twin, err error) {
+	var id string
+	var b []byte
+	defer ts.publish(&id, &err, crudOp["getSucc"], crudOp["getFail"], &b)
+
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return Twin{}, ErrUnauthorizedAccess
+	}
+
+	if thingID == "" {
+		return Twin{}, ErrMalformedEntity
+	}
+
+	tws, err := ts.twins.RetrieveByThing(ctx, res.GetValue(), thingID, 2)
+	if err != nil {
+		return Twin{}, err
+	}
+
+	switch len(tws) {
+	case 0:
+		return Twin{}, ErrNotFound
+	case 1:
+	default:
+		return Twin{}, ErrConflict
+	}
+
+	if _, err := ts.checkOwner(ctx, res.GetValue(), tws[0].ID, Read); err != nil {
+		return Twin{}, err
+	}
+
+	id = tws[0].ID
+	twin, err := ts.resolveDefinition(ctx, tws[0])
+	if err != nil {
+		return Twin{}, err
+	}
+
+	b, err = json.Marshal(twin)
+
+	return twin, nil
+}
+
+func (ts *twinsService) RemoveTwin(ctx context.Context, token, id string, cascade bool) (err error) {
+	var b []byte
+	defer ts.publish(&id, &err, crudOp["removeSucc"], crudOp["removeFail"], &b)
+
+	user, err := ts.authenticate(ctx, token, id, Delete)
+	if err != nil {
+		return err
+	}
+
+	// Removing a missing twin succeeds, so that removals can be retried,
+	// unless its states are to be removed as well.
+	if _, err = ts.twins.RetrieveByID(ctx, id); err == ErrNotFound && !cascade {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = ts.checkOwner(ctx, user, id, Delete); err != nil {
+		return err
+	}
+
+	// The twin is removed last, so that a removal failing midway leaves it
+	// in place, and retrying the removal repeats the steps that completed.
+	// Both steps succeed if there is nothing left to remove.
+	if cascade {
+		if err = ts.states.RemoveAll(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	// The twin may be removed by a concurrent removal in the meantime.
+	if err = ts.twins.Remove(ctx, id); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func (ts *twinsService) ArchiveTwin(ctx context.Context, token, id string) (err error) {
+	var b []byte
+	defer ts.publish(&id, &err, crudOp["archSucc"], crudOp["archFail"], &b)
+
+	if ts.cfg.Archive == nil {
+		return ErrArchiveUnavailable
+	}
+
+	_, tw, err := ts.identifyTwin(ctx, token, id, Delete)
+	if err != nil {
+		return err
+	}
+
+	sts, err := ts.allStates(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// The twin is removed only once it's archived, so a failed removal
+	// leaves the twin in place to be archived again.
+	if err = ts.cfg.Archive.Save(ctx, Archive{Twin: tw, States: sts}); err != nil {
+		return err
+	}
+
+	if err = ts.states.RemoveAll(ctx, id); err != nil {
+		return err
+	}
+
+	return ts.twins.Remove(ctx, id)
+}
+
+func (ts *twinsService) RestoreArchivedTwin(ctx context.Context, token, id string) (err error) {
+	var b []byte
+	defer ts.publish(&id, &err, crudOp["restSucc"], crudOp["restFail"], &b)
+
+	if ts.cfg.Archive == nil {
+		return ErrArchiveUnavailable
+	}
+
+	// Archived twins are removed, so the owner is checked against the
+	// archive rather than the twin repository.
+	user, err := ts.authenticate(ctx, token, id, Write)
+	if err != nil {
+		return err
+	}
+
+	arch, err := ts.cfg.Archive.Retrieve(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if arch.Twin.Owner != user {
+		return ts.errNotOwned()
+	}
+
+	switch _, err = ts.twins.RetrieveByID(ctx, id); err {
+	case nil:
+		return ErrConflict
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	// States left behind by a failed restoration are removed, so the twin
+	// can be restored again.
+	if err = ts.states.RemoveAll(ctx, id); err != nil {
+		return err
+	}
+
+	for _, st := range arch.States {
+		if err = ts.states.Save(ctx, st); err != nil {
+			return err
+		}
+	}
+
+	if _, err = ts.twins.Save(ctx, arch.Twin); err != nil {
+		return err
+	}
+
+	return ts.cfg.Archive.Remove(ctx, id)
+}
+
+// allStates retrieves all the states of the twin, oldest first.
+func (ts *twinsService) allStates(ctx context.Context, id string) ([]State, error) {
+	var sts []State
+	for {
+		page, err := ts.states.RetrieveAll(ctx, uint64(len(sts)), archivePageSize, id, Strong, Asc)
+		if err != nil {
+			return nil, err
+		}
+		sts = append(sts, page.States...)
+
+		if len(page.States) == 0 || uint64(len(sts)) >= page.Total {
+			return sts, nil
+		}
+	}
+}
+
+func (ts *twinsService) UpdateTwinsMetadata(ctx context.Context, token string, filter, patch Metadata) (n uint64, err error) {
+	var b []byte
+	var id string
+	defer ts.publish(&id, &err, crudOp["updateSucc"], crudOp["updateFail"], &b)
+
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return 0, ErrUnauthorizedAccess
+	}
+
+	if len(filter) == 0 || len(patch) == 0 {
+		return 0, ErrMalformedEntity
+	}
+
+	n, err = ts.twins.UpdateMetadata(ctx, res.GetValue(), filter, patch)
+	if err != nil {
+		return 0, err
+	}
+
+	b, err = json.Marshal(map[string]interface{}{
+		"filter":  filter,
+		"patch":   patch,
+		"updated": n,
+	})
+
+	return n, nil
+}
+
+func (ts *twinsService) MigrateDefinitions(ctx context.Context, token string, filter Metadata, migration Migration) (mr MigrationResult, err error) {
+	var b []byte
+	var id string
+	defer ts.publish(&id, &err, crudOp["updateSucc"], crudOp["updateFail"], &b)
+
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return MigrationResult{}, ErrUnauthorizedAccess
+	}
+
+	if len(filter) == 0 || len(migration.Steps) == 0 {
+		return MigrationResult{}, ErrMalformedEntity
+	}
+
+	mr = MigrationResult{
+		Migrated: []string{},
+		Failed:   make(map[string]error),
+	}
+	tws, err := ts.twins.RetrieveByMetadata(ctx, res.GetValue(), filter, math.MaxInt64)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+
+	for _, tw := range tws {
+		if err := ts.migrateTwin(ctx, tw.ID, migration); err != nil {
+			mr.Failed[tw.ID] = err
+			continue
+		}
+		mr.Migrated = append(mr.Migrated, tw.ID)
+	}
+
+	b, err = json.Marshal(map[string]interface{}{
+		"filter":   filter,
+		"migrated": mr.Migrated,
+	})
+
+	return mr, nil
+}
+
+// migrateTwin applies the migration to the twin definition and its last
+// state. The state is converted first, and restored if the twin update
+// fails.
+func (ts *twinsService) migrateTwin(ctx context.Context, id string, migration Migration) error {
+	if err := ts.checkLock(ctx, id); err != nil {
+		return err
+	}
+
+	tw, err := ts.twins.RetrieveByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(tw.Definitions) == 0 {
+		return ErrMalformedEntity
+	}
+
+	last, err := ts.states.RetrieveLast(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	cur := tw.Definitions[len(tw.Definitions)-1]
+	def, st, err := migration.apply(cur, last)
+	if err != nil {
+		return err
+	}
+	if err := ts.validateDefinition(def); err != nil {
+		return err.(*DefinitionError).validationError("definition")
+	}
+	def.ID = cur.ID + 1
+	def.Created = time.Now()
+
+	migrated := last.Payload != nil
+	if migrated {
+		st.Definition = def.ID
+		if st.Hash, err = st.checksum(); err != nil {
+			return err
+		}
+		if err := ts.states.Update(ctx, st); err != nil {
+			return err
+		}
+	}
+
+	tw.Definitions = append(tw.Definitions, def)
+	tw.Updated = time.Now()
+	tw.Revision++
+	if err := ts.twins.Update(ctx, tw); err != nil {
+		if migrated {
+			if rerr := ts.states.Update(ctx, last); rerr != nil {
+				return rerr
+			}
+		}
+		return err
+	}
+
+	if migrated {
+		var rh rehash
+		rh.add(tw.ID, rehashMigration, last.ID, last.Hash)
+		ts.publishRehash(rh)
+	}
+
+	return nil
+}
+
+func (ts *twinsService) ListTwins(ctx context.Context, token string, offset uint64, limit uint64, name string, metadata Metadata, omitDefinitions bool) (Page, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return Page{}, ErrUnauthorizedAccess
+	}
+
+	if err := ts.checkLimit(limit); err != nil {
+		return Page{}, err
+	}
+
+	page, err := ts.twins.RetrieveAll(ctx, res.GetValue(), offset, limit, name, metadata)
+	if err != nil {
+		return Page{}, err
+	}
+
+	for i, tw := range page.Twins {
+		if omitDefinitions {
+			page.Twins[i].Definitions = nil
+			continue
+		}
+		if page.Twins[i], err = ts.resolveDefinition(ctx, tw); err != nil {
+			return Page{}, err
+		}
+	}
+
+	return page, nil
+}
+
+func (ts *twinsService) TwinStatus(ctx context.Context, token, id string) (bool, time.Time, error) {
+	_, tw, err := ts.identifyTwin(ctx, token, id, Read)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	return ts.status(ctx, tw)
+}
+
+func (ts *twinsService) CoverageReport(ctx context.Context, token, twinID string, window time.Duration) (map[string]bool, error) {
+	_, tw, err := ts.identifyTwin(ctx, token, twinID, Read)
+	if err != nil {
+		return nil, err
+	}
+
+	if window <= 0 {
+		return nil, ErrMalformedEntity
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return nil, err
+	}
+
+	st, err := ts.states.RetrieveLast(ctx, tw.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	since := time.Now().Add(-window)
+	report := make(map[string]bool)
+	for _, attr := range tw.Definitions[len(tw.Definitions)-1].Attributes {
+		t, ok := st.AttributeTimes[attr.Name]
+		report[attr.Name] = ok && !t.Before(since)
+	}
+
+	return report, nil
+}
+
+func (ts *twinsService) LatestAttributeValues(ctx context.Context, token string, twinIDs []string, attr string) (map[string]AttrValueAge, error) {
+	// Twin keys are scoped to a single twin, so they aren't accepted here.
+	user, err := ts.authenticate(ctx, token, "", Read)
+	if err != nil {
+		return nil, err
+	}
+
+	if attr == "" {
+		return nil, ErrMalformedEntity
+	}
+
+	if err := ts.checkLimit(uint64(len(twinIDs))); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	values := make(map[string]AttrValueAge)
+	failed := make(map[string]error)
+	for _, id := range twinIDs {
+		tw, err := ts.twins.RetrieveByID(ctx, id)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		if !ts.allowed(user, tw, Read) {
+			failed[id] = ts.errNotOwned()
+			continue
+		}
+		if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+			failed[id] = err
+			continue
+		}
+		if ts.hiddenAttributes(user, tw)[attr] {
+			continue
+		}
+
+		st, err := ts.states.RetrieveLast(ctx, tw.ID)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		val, ok := st.Payload[attr]
+		if !ok {
+			continue
+		}
+
+		// States saved before attribute times were tracked only have the
+		// time they were created at.
+		updated, ok := st.AttributeTimes[attr]
+		if !ok {
+			updated = st.Created
+		}
+		values[id] = AttrValueAge{Value: val, Updated: updated, Age: now.Sub(updated)}
+	}
+
+	if len(failed) > 0 {
+		return values, &BatchError{Errors: failed}
+	}
+
+	return values, nil
+}
+
+func (ts *twinsService) TwinHealth(ctx context.Context, token, twinID string) (HealthScore, error) {
+	_, tw, err := ts.identifyTwin(ctx, token, twinID, Read)
+	if err != nil {
+		return HealthScore{}, err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return HealthScore{}, err
+	}
+
+	st, err := ts.states.RetrieveLast(ctx, tw.ID)
+	if err != nil {
+		return HealthScore{}, err
+	}
+
+	page, err := ts.states.RetrieveAll(ctx, 0, healthSampleSize, tw.ID, Strong, Desc)
+	if err != nil {
+		return HealthScore{}, err
+	}
+
+	window := ts.heartbeat(tw)
+	attrs := tw.Definitions[len(tw.Definitions)-1].Attributes
+	staleness := stalenessScore(st.Created, window)
+	coverage := coverageScore(st, attrs, time.Now().Add(-window))
+	ranged := rangeScore(page.States, attrs)
+
+	return healthScore(tw.ID, ts.cfg.HealthWeights, staleness, coverage, ranged), nil
+}
+
+func (ts *twinsService) DescribeTwin(ctx context.Context, token, twinID string) (TwinDescriptor, error) {
+	_, tw, err := ts.identifyTwin(ctx, token, twinID, Read)
+	if err != nil {
+		return TwinDescriptor{}, err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return TwinDescriptor{}, err
+	}
+
+	contentType := ts.cfg.ContentType
+	if contentType == "" {
+		contentType = senmlJSON
+	}
+
+	def := tw.Definitions[len(tw.Definitions)-1]
+	desc := TwinDescriptor{
+		TwinID:      tw.ID,
+		Name:        tw.Name,
+		Definition:  def.ID,
+		ContentType: contentType,
+		Delta:       def.Delta,
+		Attributes:  []AttributeDescriptor{},
+	}
+	for _, attr := range def.Attributes {
+		if !attr.PersistState || attr.DerivativeOf != "" {
+			continue
+		}
+		// Subtopics with unresolved placeholders never match a message.
+		subtopics := []string{}
+		for _, subtopic := range attr.Subtopics() {
+			if subtopic, ok := resolveSubtopic(subtopic, tw.Metadata); ok {
+				subtopics = append(subtopics, subtopic)
+			}
+		}
+		desc.Attributes = append(desc.Attributes, AttributeDescriptor{
+			Name:        attr.Name,
+			Channel:     attr.Channel,
+			Subtopics:   subtopics,
+			Unit:        attr.Unit,
+			MinInterval: attr.MinInterval,
+		})
+	}
+
+	return desc, nil
+}
+
+func (ts *twinsService) ListTwinsByStatus(ctx context.Context, token string, offset uint64, limit uint64, online bool) (Page, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return Page{}, ErrUnauthorizedAccess
+	}
+
+	if err := ts.checkLimit(limit); err != nil {
+		return Page{}, err
+	}
+
+	return ts.filterTwins(ctx, res.GetValue(), offset, limit, func(tw Twin) (bool, error) {
+		on, _, err := ts.status(ctx, tw)
+		return on == online, err
+	})
+}
+
+func (ts *twinsService) ListTwinsWithErrors(ctx context.Context, token string, offset uint64, limit uint64, window time.Duration) (Page, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return Page{}, ErrUnauthorizedAccess
+	}
+
+	if err := ts.checkLimit(limit); err != nil {
+		return Page{}, err
+	}
+
+	since := time.Now().Add(-window)
+	return ts.filterTwins(ctx, res.GetValue(), offset, limit, func(tw Twin) (bool, error) {
+		return tw.LastError != "" && tw.LastErrorAt.After(since), nil
+	})
+}
+
+// filterTwins retrieves the page of the owner's twins that match.
+func (ts *twinsService) filterTwins(ctx context.Context, owner string, offset, limit uint64, match func(Twin) (bool, error)) (Page, error) {
+	var matched []Twin
+	for o := uint64(0); ; o += statusPageSize {
+		page, err := ts.twins.RetrieveAll(ctx, owner, o, statusPageSize, "", nil)
+		if err != nil {
+			return Page{}, err
+		}
+
+		for _, tw := range page.Twins {
+			ok, err := match(tw)
+			if err != nil {
+				return Page{}, err
+			}
+			if ok {
+				matched = append(matched, tw)
+			}
+		}
+
+		if o+statusPageSize >= page.Total {
+			break
+		}
+	}
+
+	page := Page{
+		PageMetadata: PageMetadata{
+			Total:  uint64(len(matched)),
+			Offset: offset,
+			Limit:  limit,
+		},
+		Twins: []Twin{},
+	}
+	if offset < uint64(len(matched)) {
+		end := offset + limit
+		if end > uint64(len(matched)) || end < offset {
+			end = uint64(len(matched))
+		}
+		page.Twins = matched[offset:end]
+	}
+
+	return page, nil
+}
+
+// status reports twin as online if its last state was received within the
+// twin heartbeat window.
+func (ts *twinsService) status(ctx context.Context, tw Twin) (bool, time.Time, error) {
+	st, err := ts.states.RetrieveLast(ctx, tw.ID)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	if st.Created.IsZero() {
+		return false, time.Time{}, nil
+	}
+
+	return time.Since(st.Created) <= ts.heartbeat(tw), st.Created, nil
+}
+
+// heartbeat returns the time window within which a state of the twin must
+// be received for the twin to be considered online.
+func (ts *twinsService) heartbeat(tw Twin) time.Duration {
+	if tw.Heartbeat != 0 {
+		return tw.Heartbeat
+	}
+	if ts.cfg.Heartbeat != 0 {
+		return ts.cfg.Heartbeat
+	}
+	return defHeartbeat
+}
+
+func (ts *twinsService) SetMetadataSchema(ctx context.Context, token string, schema MetadataSchema) error {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return ErrUnauthorizedAccess
+	}
+
+	if !schema.Valid() {
+		return ErrMalformedEntity
+	}
+
+	return ts.twins.SaveMetadataSchema(ctx, res.GetValue(), schema)
+}
+
+func (ts *twinsService) checkMetadata(ctx context.Context, owner string, m Metadata) error {
+	schema, err := ts.twins.RetrieveMetadataSchema(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	return schema.Validate(m)
+}
+
+// checkThing verifies that the thing the twin is linked to exists, if thing
+// verification is enabled.
+func (ts *twinsService) checkThing(ctx context.Context, token, thingID string) error {
+	if thingID == "" || ts.cfg.Things == nil {
+		return nil
+	}
+
+	err := ts.cfg.Things.Verify(ctx, token, thingID)
+	if err == ErrNotFound {
+		return invalidField("thing_id", "unknown thing %q", thingID)
+	}
+
+	return err
+}
+
+func (ts *twinsService) ListAllTwinIDs(ctx context.Context, token, owner string) ([]string, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return nil, ErrUnauthorizedAccess
+	}
+
+	if owner == "" {
+		owner = res.GetValue()
+	}
+
+	if owner != res.GetValue() && (ts.cfg.AdminEmail == "" || res.GetValue() != ts.cfg.AdminEmail) {
+		return nil, ErrUnauthorizedAccess
+	}
+
+	return ts.twins.RetrieveIDs(ctx, owner)
+}
+
+func (ts *twinsService) ListStates(ctx context.Context, token string, offset uint64, limit uint64, id string, consistency Consistency, order Order, includeRaw bool) (StatesPage, error) {
+	return ts.listStates(ctx, token, id, "", offset, limit, consistency, order, includeRaw)
+}
+
+func (ts *twinsService) ListStatesByGroup(ctx context.Context, token, twinID, group string, offset uint64, limit uint64, consistency Consistency, order Order) (StatesPage, error) {
+	if group == "" {
+		return StatesPage{}, ErrMalformedEntity
+	}
+
+	return ts.listStates(ctx, token, twinID, group, offset, limit, consistency, order, false)
+}
+
+func (ts *twinsService) ListStatesBySource(ctx context.Context, token, twinID, source string, offset uint64, limit uint64, order Order) (StatesPage, error) {
+	user, tw, err := ts.identifyTwin(ctx, token, twinID, Read)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	if source == "" {
+		return StatesPage{}, ErrMalformedEntity
+	}
+
+	if err := ts.checkLimit(limit); err != nil {
+		return StatesPage{}, err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return StatesPage{}, err
+	}
+
+	page, err := ts.states.ListBySource(ctx, twinID, source, offset, limit, order)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	hidden := ts.hiddenAttributes(user, tw)
+	for i := range page.States {
+		page.States[i].Payload = omit(page.States[i].Payload, hidden)
+		page.States[i].Sums = omitSums(page.States[i].Sums, hidden)
+		page.States[i].Raw = nil
+	}
+
+	return page, nil
+}
+
+func (ts *twinsService) ListChannelStates(ctx context.Context, token, channelID string, offset, limit uint64) (StatesPage, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return StatesPage{}, ErrUnauthorizedAccess
+	}
+	user := res.GetValue()
+
+	if channelID == "" {
+		return StatesPage{}, ErrMalformedEntity
+	}
+
+	if err := ts.checkLimit(limit); err != nil {
+		return StatesPage{}, err
+	}
+
+	if ts.cfg.Things != nil {
+		if err := ts.cfg.Things.VerifyChannel(ctx, token, channelID); err != nil {
+			return StatesPage{}, err
+		}
+	}
+
+	tws, err := ts.twins.RetrieveByChannel(ctx, channelID)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	var ids []string
+	hidden := make(map[string]map[string]bool)
+	for _, tw := range tws {
+		// Without thing verification, channel access can't be checked, so
+		// only the user's own twins are included.
+		if ts.cfg.Things == nil && tw.Owner != user {
+			continue
+		}
+		if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+			return StatesPage{}, err
+		}
+		ids = append(ids, tw.ID)
+		hidden[tw.ID] = ts.hiddenAttributes(user, tw)
+	}
+
+	if len(ids) == 0 {
+		return StatesPage{
+			States:       []State{},
+			PageMetadata: PageMetadata{Offset: offset, Limit: limit},
+		}, nil
+	}
+
+	page, err := ts.states.RetrieveByTwins(ctx, ids, offset, limit)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	for i, st := range page.States {
+		page.States[i].Payload = omit(st.Payload, hidden[st.TwinID])
+		page.States[i].Sums = omitSums(st.Sums, hidden[st.TwinID])
+		page.States[i].Raw = nil
+	}
+
+	return page, nil
+}
+
+func (ts *twinsService) StreamExportStates(ctx context.Context, token, twinID string, w io.Writer) error {
+	user, tw, err := ts.identifyTwin(ctx, token, twinID, Read)
+	if err != nil {
+		return err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return err
+	}
+
+	hidden := ts.hiddenAttributes(user, tw)
+	enc := json.NewEncoder(w)
+	for offset := uint64(0); ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		page, err := ts.states.RetrieveAll(ctx, offset, exportBatchSize, twinID, Strong, Asc)
+		if err != nil {
+			return err
+		}
+
+		for _, st := range page.States {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			st.Payload = omit(st.Payload, hidden)
+			st.Sums = omitSums(st.Sums, hidden)
+			if err := enc.Encode(newExportedState(st)); err != nil {
+				return err
+			}
+		}
+
+		offset += uint64(len(page.States))
+		if len(page.States) < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+// listStates retrieves the states of the twin. If the group is set, values
+// of the attributes outside of the group are omitted. Raw SenML payloads
+// are omitted unless includeRaw is set.
+func (ts *twinsService) listStates(ctx context.Context, token, id, group string, offset uint64, limit uint64, consistency Consistency, order Order, includeRaw bool) (StatesPage, error) {
+	user, tw, err := ts.identifyTwin(ctx, token, id, Read)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	if err := ts.checkLimit(limit); err != nil {
+		return StatesPage{}, err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return StatesPage{}, err
+	}
+
+	var attrs map[string]bool
+	if group != "" {
+		if attrs, err = groupAttributes(tw, group); err != nil {
+			return StatesPage{}, err
+		}
+	}
+
+	page, err := ts.states.RetrieveAll(ctx, offset, limit, id, consistency, order)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	hidden := ts.hiddenAttributes(user, tw)
+	for i := range page.States {
+		if attrs != nil {
+			page.States[i].Payload = pick(page.States[i].Payload, attrs)
+		}
+		page.States[i].Payload = omit(page.States[i].Payload, hidden)
+		page.States[i].Sums = omitSums(page.States[i].Sums, hidden)
+		// Raw payloads may carry values of the hidden attributes.
+		if !includeRaw || len(hidden) > 0 {
+			page.States[i].Raw = nil
+		}
+	}
+
+	return page, nil
+}
+
+func (ts *twinsService) CurrentState(ctx context.Context, token, id string) (State, error) {
+	user, tw, err := ts.identifyTwin(ctx, token, id, Read)
+	if err != nil {
+		return State{}, err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return State{}, err
+	}
+
+	st, err := ts.states.RetrieveLast(ctx, id)
+	if err != nil {
+		return State{}, err
+	}
+	if st.Payload == nil {
+		return State{}, ErrNotFound
+	}
+
+	payload := make(map[string]interface{}, len(st.Payload))
+	for k, v := range st.Payload {
+		payload[k] = v
+	}
+	for k, v := range st.Smoothed {
+		if _, ok := payload[k]; ok {
+			payload[k] = v
+		}
+	}
+	if len(tw.Definitions) > 0 {
+		for _, attr := range tw.Definitions[len(tw.Definitions)-1].Attributes {
+			if _, ok := payload[attr.Name]; !ok && attr.Default != nil {
+				payload[attr.Name] = attr.Default
+			}
+		}
+	}
+	hidden := ts.hiddenAttributes(user, tw)
+	st.Payload = omit(payload, hidden)
+	st.Sums = omitSums(st.Sums, hidden)
+	st.Raw = nil
+
+	return st, nil
+}
+
+func (ts *twinsService) StateAt(ctx context.Context, token, id string, at time.Time) (State, error) {
+	user, tw, err := ts.identifyTwin(ctx, token, id, Read)
+	if err != nil {
+		return State{}, err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return State{}, err
+	}
+
+	var res State
+	var pending []string
+	found := false
+	for offset := uint64(0); ; offset += exportBatchSize {
+		page, err := ts.states.ListUntil(ctx, id, at, offset, exportBatchSize)
+		if err != nil {
+			return State{}, err
+		}
+
+		for _, st := range page.States {
+			if !found {
+				res = st
+				res.Payload = make(map[string]interface{}, len(st.Payload))
+				res.AttributeTimes = make(map[string]time.Time, len(st.Payload))
+				for name := range st.Payload {
+					pending = append(pending, name)
+				}
+				found = true
+			}
+			pending = reconstruct(&res, st, pending, at)
+			if len(pending) == 0 {
+				break
+			}
+		}
+
+		if len(pending) == 0 || offset+exportBatchSize >= page.Total {
+			break
+		}
+	}
+	if !found {
+		return State{}, ErrNotFound
+	}
+
+	res.Payload = omit(res.Payload, ts.hiddenAttributes(user, tw))
+	res.Smoothed = nil
+	res.Sums = nil
+	res.Raw = nil
+
+	return res, nil
+}
+
+// reconstruct copies to res the values of the pending attributes that st
+// holds and that were reported at or before the given time, and returns the
+// attributes still missing a value.
+func reconstruct(res *State, st State, pending []string, at time.Time) []string {
+	var missing []string
+	for _, name := range pending {
+		val, ok := st.Payload[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		t, timed := st.AttributeTimes[name]
+		if timed && t.After(at) {
+			missing = append(missing, name)
+			continue
+		}
+		res.Payload[name] = val
+		if timed {
+			res.AttributeTimes[name] = t
+		}
+	}
+
+	return missing
+}
+
+// hiddenAttributes returns the names of the twin attributes whose access
+// label the user isn't granted. The owner is granted all the labels.
+func (ts *twinsService) hiddenAttributes(user string, tw Twin) map[string]bool {
+	hidden := make(map[string]bool)
+	if user == tw.Owner || len(tw.Definitions) == 0 {
+		return hidden
+	}
+
+	granted := make(map[string]bool)
+	for _, label := range ts.cfg.AccessGrants[tw.Owner][user] {
+		granted[label] = true
+	}
+
+	for _, attr := range tw.Definitions[len(tw.Definitions)-1].Attributes {
+		if attr.Access != "" && !granted[attr.Access] {
+			hidden[attr.Name] = true
+		}
+	}
+
+	return hidden
+}
+
+// groupAttributes returns the names of the twin attributes in the group.
+// ErrNotFound is returned if no attribute belongs to the group.
+func groupAttributes(tw Twin, group string) (map[string]bool, error) {
+	attrs := make(map[string]bool)
+	if len(tw.Definitions) > 0 {
+		for _, attr := range tw.Definitions[len(tw.Definitions)-1].Attributes {
+			if attr.Group == group {
+				attrs[attr.Name] = true
+			}
+		}
+	}
+	if len(attrs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return attrs, nil
+}
+
+// pick returns a copy of the payload with the given attributes only.
+func pick(payload map[string]interface{}, attrs map[string]bool) map[string]interface{} {
+	res := make(map[string]interface{}, len(attrs))
+	for k, v := range payload {
+		if attrs[k] {
+			res[k] = v
+		}
+	}
+
+	return res
+}
+
+// omit returns a copy of the payload without the hidden attributes, or the
+// payload itself if no attribute is hidden.
+func omit(payload map[string]interface{}, hidden map[string]bool) map[string]interface{} {
+	if len(hidden) == 0 {
+		return payload
+	}
+
+	res := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if !hidden[k] {
+			res[k] = v
+		}
+	}
+
+	return res
+}
+
+// omitSums is omit applied to the attribute sums.
+func omitSums(sums map[string]float64, hidden map[string]bool) map[string]float64 {
+	if len(hidden) == 0 {
+		return sums
+	}
+
+	res := make(map[string]float64, len(sums))
+	for k, v := range sums {
+		if !hidden[k] {
+			res[k] = v
+		}
+	}
+
+	return res
+}
+
+func (ts *twinsService) AnnotateState(ctx context.Context, token, twinID string, stateID int64, note string) error {
+	if _, err := ts.identify(ctx, token, twinID, Write); err != nil {
+		return err
+	}
+
+	return ts.states.Annotate(ctx, twinID, stateID, note)
+}
+
+func (ts *twinsService) checkLimit(limit uint64) error {
+	if ts.cfg.MaxPageLimit > 0 && limit > ts.cfg.MaxPageLimit {
+		return ErrLimitExceeded
+	}
+	return nil
+}
+
+func (ts *twinsService) ReplayEvents(ctx context.Context, token string, fromSeq uint64) (<-chan Event, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return nil, ErrUnauthorizedAccess
+	}
+
+	if ts.cfg.AdminEmail == "" || res.GetValue() != ts.cfg.AdminEmail {
+		return nil, ErrUnauthorizedAccess
+	}
+
+	events, err := ts.events.since(fromSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (ts *twinsService) SaveStates(msg *messaging.Message) (SaveResult, error) {
+	// Messages carry no context, so each of them is assigned a request ID
+	// used to correlate the repository calls made while saving its states.
+	return ts.save(EnsureRequestID(context.Background()), msg)
+}
+
+func (ts *twinsService) save(ctx context.Context, msg *messaging.Message) (SaveResult, error) {
+	if ts.saves != nil {
+		if !ts.saves.acquire() {
+			return SaveResult{}, ErrOverloaded
+		}
+		defer ts.saves.release()
+	}
+
+	return ts.saveMessage(ctx, msg, make(twinIDs))
+}
+
+func (ts *twinsService) SaveStatesBatch(ctx context.Context, msgs []*messaging.Message) ([]SaveResult, error) {
+	ctx = EnsureRequestID(ctx)
+
+	resolved := make(twinIDs)
+	results := make([]SaveResult, len(msgs))
+	failed := make(map[string]error)
+	for i, msg := range msgs {
+		res, err := ts.saveMessage(ctx, msg, resolved)
+		if err != nil {
+			failed[strconv.Itoa(i)] = err
+		}
+		results[i] = res
+	}
+
+	if len(failed) > 0 {
+		return results, &BatchError{Errors: failed}
+	}
+
+	return results, nil
+}
+
+func (ts *twinsService) HandleDelivery(d Delivery) error {
+	msg := d.Message()
+	ctx := EnsureRequestID(context.Background())
+	if d.Attempt() > 1 {
+		ctx = withRedelivery(ctx)
+	}
+	_, err := ts.save(ctx, msg)
+	if err == nil {
+		return d.Ack()
+	}
+
+	if !permanent(err) && d.Attempt() <= ts.cfg.MaxRedeliveries {
+		if nerr := d.Nack(); nerr != nil {
+			return nerr
+		}
+		return err
+	}
+
+	// Messages that fail to be dead-lettered are redelivered, so they
+	// aren't lost.
+	if derr := ts.deadLetter(msg); derr != nil {
+		if nerr := d.Nack(); nerr != nil {
+			return nerr
+		}
+		return derr
+	}
+	if aerr := d.Ack(); aerr != nil {
+		return aerr
+	}
+
+	return err
+}
+
+// deadLetter publishes the message to the dead letter channel, keeping its
+// origin in the subtopic.
+func (ts *twinsService) deadLetter(msg *messaging.Message) error {
+	if ts.cfg.DeadLetterChannel == "" {
+		return nil
+	}
+
+	subtopic := msg.Channel
+	if msg.Subtopic != "" {
+		subtopic = fmt.Sprintf("%s.%s", subtopic, msg.Subtopic)
+	}
+	dl := messaging.Message{
+		Channel:   ts.cfg.DeadLetterChannel,
+		Subtopic:  subtopic,
+		Publisher: msg.Publisher,
+		Protocol:  msg.Protocol,
+		Payload:   msg.Payload,
+		Created:   msg.Created,
+	}
+
+	return ts.publisher.Publish(dl.Channel, dl)
+}
+
+// format returns the SenML format of the payload, given by the configured
+// content type. Without one, the content type is detected from the payload.
+func (ts *twinsService) format(payload []byte) (senml.Format, error) {
+	contentType := ts.cfg.ContentType
+	if contentType == "" {
+		contentType = detectContentType(payload)
+	}
+
+	format, ok := formats[contentType]
+	if !ok {
+		return 0, ErrUnsupportedContentType
+	}
+
+	return format, nil
+}
+
+// twinIDs caches ids of the twins matched against messages, along with the
+// twins derived from them, by message channel and subtopic.
+type twinIDs map[[2]string][]string
+
+func (ts *twinsService) saveMessage(ctx context.Context, msg *messaging.Message, resolved twinIDs) (SaveResult, error) {
+	res := SaveResult{RequestID: RequestID(ctx)}
+	ts.subs.record(msg.Channel, msg.Subtopic, time.Now())
+
+	ids, err := ts.matchingTwins(ctx, msg, resolved)
+	if err != nil {
+		return res, err
+	}
+
+	if ts.compressed(msg.Payload) {
+		payload, err := gunzip(msg.Payload, ts.cfg.MaxDecompressedSize)
+		if err == ErrPayloadTooLarge {
+			ts.recordError(ctx, fmt.Errorf("%s: decompressed payload exceeds %d bytes", err, ts.cfg.MaxDecompressedSize), ids...)
+			return res, err
+		}
+		if err != nil {
+			err := invalidField("payload", "malformed gzip compression")
+			ts.recordError(ctx, err, ids...)
+			return res, err
+		}
+		m := *msg
+		m.Payload = payload
+		msg = &m
+	}
+
+	format, err := ts.format(msg.Payload)
+	if err != nil {
+		return res, err
+	}
+
+	recs, invalid, err := decodeRecords(msg.Payload, format)
+	if err != nil {
+		err := invalidField("payload", "malformed SenML payload from %s: %s", msg.Publisher, err)
+		ts.recordError(ctx, err, ids...)
+		return res, err
+	}
+	if len(invalid) > 0 && ts.cfg.StrictSenML {
+		err := invalidRecords(invalid)
+		ts.recordError(ctx, err, ids...)
+		return res, err
+	}
+	res.Invalid = uint64(len(invalid))
+
+	// Oversized records are skipped, while the rest of the message is
+	// saved, and reported once it is.
+	var oversized error
+	if recs, res.Oversized = ts.limitRecords(recs); res.Oversized > 0 {
+		oversized = ErrPayloadTooLarge
+		ts.recordError(ctx, fmt.Errorf("%s: %d records exceed %d bytes", ErrPayloadTooLarge, res.Oversized, ts.cfg.MaxRecordSize), ids...)
+	}
+
+	if ts.writes != nil {
+		write := func() error {
+			var res SaveResult
+			if err := ts.saveStates(ctx, msg, recs, ids, ts.saveDeadline(), &res); err != nil {
+				return fmt.Errorf("request %s: %s", RequestID(ctx), err)
+			}
+			return nil
+		}
+		if !ts.writes.enqueue(write) {
+			return res, ErrBackpressure
+		}
+		res.Queued = true
+		return res, oversized
+	}
+
+	if err := ts.saveStates(ctx, msg, recs, ids, ts.saveDeadline(), &res); err != nil {
+		return res, err
+	}
+
+	return res, oversized
+}
+
+// limitRecords returns the records within the record size limit, along
+// with the number of records exceeding it.
+func (ts *twinsService) limitRecords(recs []senml.Record) ([]senml.Record, uint64) {
+	if ts.cfg.MaxRecordSize <= 0 {
+		return recs, 0
+	}
+
+	var oversized uint64
+	kept := make([]senml.Record, 0, len(recs))
+	for _, rec := range recs {
+		if ts.oversized(rec) {
+			oversized++
+			continue
+		}
+		kept = append(kept, rec)
+	}
+
+	return kept, oversized
+}
+
+func (ts *twinsService) oversized(rec senml.Record) bool {
+	return ts.cfg.MaxRecordSize > 0 && valueSize(rec) > ts.cfg.MaxRecordSize
+}
+
+// matchingTwins returns ids of the twins having an attribute matching the
+// message, along with the twins derived from them.
+func (ts *twinsService) matchingTwins(ctx context.Context, msg *messaging.Message, resolved twinIDs) ([]string, error) {
+	key := [2]string{msg.Channel, msg.Subtopic}
+	if ids, ok := resolved[key]; ok {
+		return ids, nil
+	}
+
+	ids, err := ts.twins.RetrieveByAttribute(ctx, msg.Channel, msg.Subtopic, ts.cfg.CaseInsensitiveMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	if ids, err = ts.withDerivatives(ctx, ids); err != nil {
+		return nil, err
+	}
+	resolved[key] = ids
+
+	return ids, nil
+}
+
+// saveDeadline returns the time persisting states from a message must end
+// by, or zero time if there's no timeout.
+func (ts *twinsService) saveDeadline() time.Time {
+	if ts.cfg.SaveTimeout <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ts.cfg.SaveTimeout)
+}
+
+func (ts *twinsService) saveStates(ctx context.Context, msg *messaging.Message, recs []senml.Record, ids []string, deadline time.Time, res *SaveResult) error {
+	matched := false
+	for _, id := range ids {
+		m, err := ts.saveState(ctx, msg, recs, id, deadline, res)
+		if err != nil {
+			ts.recordError(ctx, err, id)
+			return err
+		}
+		matched = matched || m
+	}
+	if !matched {
+		res.Unmatched = uint64(len(recs))
+	}
+
+	return nil
+}
+
+// recordError records the error as the last one encountered for the twins.
+// Failing to record it doesn't fail saving states, so it's only logged.
+func (ts *twinsService) recordError(ctx context.Context, err error, ids ...string) {
+	now := time.Now()
+	for _, id := range ids {
+		if rerr := ts.twins.SaveLastError(ctx, id, err.Error(), now); rerr != nil && ts.logger != nil {
+			ts.logger.Warn(fmt.Sprintf("Recording error for twin %s failed: %s", id, rerr))
+		}
+	}
+}
+
+func (ts *twinsService) logWriteError(err error) {
+	if ts.logger != nil {
+		ts.logger.Error(fmt.Sprintf("Asynchronous state write failed: %s", err))
+	}
+}
+
+func (ts *twinsService) PublishIngestionSummaries() ([]IngestionSummary, error) {
+	summaries := ts.ingestion.drain()
+	for _, summary := range summaries {
+		b, err := json.Marshal(summary)
+		if err != nil {
+			return summaries, err
+		}
+
+		msg := messaging.Message{
+			Channel:   ts.cfg.MonitoringChannel,
+			Subtopic:  ingestionSummaryOp,
+			Payload:   b,
+			Publisher: publisher,
+			Created:   time.Now().UnixNano(),
+		}
+		if err := ts.publisher.Publish(msg.Channel, msg); err != nil {
+			return summaries, err
+		}
+	}
+
+	return summaries, nil
+}
+
+func (ts *twinsService) SimulateIngestion(ctx context.Context, token, twinID string, payload []byte) (IngestionTrace, error) {
+	_, tw, err := ts.identifyTwin(ctx, token, twinID, Read)
+	if err != nil {
+		return IngestionTrace{}, err
+	}
+
+	var msg messaging.Message
+	if err := proto.Unmarshal(payload, &msg); err != nil {
+		return IngestionTrace{}, ErrMalformedEntity
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return IngestionTrace{}, err
+	}
+
+	if ts.compressed(msg.Payload) {
+		if msg.Payload, err = gunzip(msg.Payload, ts.cfg.MaxDecompressedSize); err != nil {
+			if err == ErrPayloadTooLarge {
+				return IngestionTrace{}, err
+			}
+			return IngestionTrace{}, ErrMalformedEntity
+		}
+	}
+
+	format, err := ts.format(msg.Payload)
+	if err != nil {
+		return IngestionTrace{}, err
+	}
+
+	recs, invalid, err := decodeRecords(msg.Payload, format)
+	if err != nil {
+		return IngestionTrace{}, ErrMalformedEntity
+	}
+
+	attr, matched := ts.persistedAttribute(tw, &msg)
+	trace := IngestionTrace{
+		TwinID:   tw.ID,
+		Channel:  msg.Channel,
+		Subtopic: msg.Subtopic,
+		Matched:  matched && ts.matchTwin(tw, &msg),
+		Invalid:  uint64(len(invalid)),
+		Rejected: len(invalid) > 0 && ts.cfg.StrictSenML,
+		Records:  []RecordTrace{},
+	}
+	if trace.Rejected {
+		return trace, nil
+	}
+
+	st, err := ts.states.RetrieveLast(ctx, tw.ID)
+	if err != nil {
+		return IngestionTrace{}, err
+	}
+	st = st.clone()
+
+	for _, rec := range ts.resolveRecords(recs) {
+		rt := RecordTrace{
+			Name:  rec.BaseName + rec.Name,
+			Unit:  rec.Unit,
+			Value: findValue(rec),
+		}
+		rt.Time, _ = resolveTime(rec.BaseTime + rec.Time)
+
+		if !trace.Matched {
+			rt.Action = actionNames[noop]
+			rt.Reason = "no matching attribute"
+			trace.Records = append(trace.Records, rt)
+			continue
+		}
+
+		rt.Attribute = attr.Name
+		if ts.oversized(rec) {
+			rt.Action = actionNames[drop]
+			rt.Reason = "payload too large"
+			trace.Records = append(trace.Records, rt)
+			continue
+		}
+		if !attr.ValueType.matches(rec) {
+			rt.Action = actionNames[drop]
+			rt.Reason = "type mismatch"
+			trace.Records = append(trace.Records, rt)
+			continue
+		}
+		if !attr.allows(rec) {
+			rt.Action = actionNames[drop]
+			rt.Reason = "value not allowed"
+			trace.Records = append(trace.Records, rt)
+			continue
+		}
+
+		last, seen := st.AttributeTimes[attr.Name]
+		prev := st.Payload[attr.Name]
+		action := ts.prepareState(&st, &tw, rec, &msg)
+		rt.Action = actionNames[action]
+		if action == drop {
+			rt.Reason = "conflicting value"
+			if seen && !last.Equal(rt.Time) && attr.duplicates(prev, round(findValue(rec), attr.Precision), last, rt.Time) {
+				rt.Reason = "duplicate value"
+			}
+			if attr.Unit != "" && rec.Unit != "" && rec.Unit != attr.Unit {
+				rt.Reason = "unit mismatch"
+			}
+			if seen && attr.MinInterval > 0 && rt.Time.Sub(last) < attr.MinInterval {
+				rt.Reason = "within minimal interval"
+			}
+		}
+		trace.Records = append(trace.Records, rt)
+	}
+
+	if trace.Matched {
+		trace.State = st
+	}
+
+	return trace, nil
+}
+
+func (ts *twinsService) ValidateDefinition(_ context.Context, def Definition) error {
+	return ts.validateDefinition(def.withDefaultSubtopics())
+}
+
+func (ts *twinsService) Authorize(ctx context.Context, token, id string, action Action) error {
+	if isTwinKey(token) {
+		_, err := ts.verifyKey(ctx, token, id, action)
+		return err
+	}
+
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return ErrUnauthorizedAccess
+	}
+
+	// Missing twins fail the same way as the twins owned by another user,
+	// so authorization doesn't reveal whether the twin exists.
+	if _, err := ts.checkOwner(ctx, res.GetValue(), id, action); err != nil {
+		if err == ErrNotFound {
+			return ts.errNotOwned()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (ts *twinsService) IssueTwinKey(ctx context.Context, token, twinID string, action Action, ttl time.Duration) (TwinKey, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return TwinKey{}, ErrUnauthorizedAccess
+	}
+
+	if ttl <= 0 || action < Read || action > Delete {
+		return TwinKey{}, ErrMalformedEntity
+	}
+
+	if _, err := ts.checkOwner(ctx, res.GetValue(), twinID, action); err != nil {
+		if err == ErrNotFound {
+			return TwinKey{}, ts.errNotOwned()
+		}
+		return TwinKey{}, err
+	}
+
+	secret, err := ts.uuidProvider.ID()
+	if err != nil {
+		return TwinKey{}, err
+	}
+
+	value := keyPrefix + secret
+	hash := hashKey(value)
+	key := TwinKey{
+		ID:      hash[:keyIDLen],
+		Hash:    hash,
+		Issuer:  res.GetValue(),
+		TwinID:  twinID,
+		Action:  action,
+		Expires: time.Now().Add(ttl),
+	}
+	if err := ts.twins.SaveKey(ctx, key); err != nil {
+		return TwinKey{}, err
+	}
+	key.Value = value
+
+	return key, nil
+}
+
+func (ts *twinsService) RevokeTwinKey(ctx context.Context, token, twinID, keyID string) error {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return ErrUnauthorizedAccess
+	}
+
+	if _, err := ts.checkOwner(ctx, res.GetValue(), twinID, Delete); err != nil {
+		if err == ErrNotFound {
+			return ts.errNotOwned()
+		}
+		return err
+	}
+
+	return ts.twins.RemoveKey(ctx, twinID, keyID)
+}
+
+func (ts *twinsService) RemoveExpiredKeys(ctx context.Context) (uint64, error) {
+	return ts.twins.RemoveExpiredKeys(ctx, time.Now())
+}
+
+// checkOwner returns the twin if the user is allowed to perform the action
+// on it. It returns ErrNotFound if the twin doesn't exist, and the error
+// reported for twins the user doesn't own otherwise.
+func (ts *twinsService) checkOwner(ctx context.Context, user, id string, action Action) (Twin, error) {
+	tw, err := ts.twins.RetrieveByID(ctx, id)
+	if err != nil {
+		return Twin{}, err
+	}
+
+	if !ts.allowed(user, tw, action) {
+		return Twin{}, ts.errNotOwned()
+	}
+
+	return tw, nil
+}
+
+// allowed reports whether the user is allowed to perform the action on the
+// twin. Twins are not shared, so the owner is allowed to perform any action.
+// The only exception are users granted access labels by the owner, who are
+// allowed to read the owner's twins, without the attributes they aren't
+// granted.
+func (ts *twinsService) allowed(user string, tw Twin, action Action) bool {
+	return tw.Owner == user || (action == Read && len(ts.cfg.AccessGrants[tw.Owner][user]) > 0)
+}
+
+// errNotOwned returns the error reported for a twin the user doesn't own.
+func (ts *twinsService) errNotOwned() error {
+	if ts.cfg.HideUnauthorized {
+		return ErrNotFound
+	}
+	return ErrUnauthorizedAccess
+}
+
+// identify returns the user the token belongs to, provided the user owns
+// the twin identified by the id. Twin keys are accepted only for the twin
+// and the action they are issued for, and identify their issuer.
+func (ts *twinsService) identify(ctx context.Context, token, id string, action Action) (string, error) {
+	user, _, err := ts.identifyTwin(ctx, token, id, action)
+	return user, err
+}
+
+// identifyTwin is identify that also returns the twin the ownership was
+// checked on, sparing the callers another retrieval of the twin.
+func (ts *twinsService) identifyTwin(ctx context.Context, token, id string, action Action) (string, Twin, error) {
+	user, err := ts.authenticate(ctx, token, id, action)
+	if err != nil {
+		return "", Twin{}, err
+	}
+
+	tw, err := ts.checkOwner(ctx, user, id, action)
+	if err != nil {
+		return "", Twin{}, err
+	}
+
+	return user, tw, nil
+}
+
+// authenticate returns the user the token belongs to. With fail-open reads,
+// reads are served to the user the token was last identified as while the
+// auth service is unavailable.
+func (ts *twinsService) authenticate(ctx context.Context, token, id string, action Action) (string, error) {
+	// Twin keys aren't known to the auth service.
+	if isTwinKey(token) {
+		return ts.verifyKey(ctx, token, id, action)
+	}
+
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		if !ts.cfg.FailOpenReads || action != Read || !unavailable(err) {
+			return "", ErrUnauthorizedAccess
+		}
+		user, ok := ts.identities.lookup(token)
+		if !ok {
+			return "", ErrUnauthorizedAccess
+		}
+		if ts.logger != nil {
+			ts.logger.Warn(fmt.Sprintf("DEGRADED: auth service unavailable, serving read of twin %s to cached identity %s: %s", id, user, err))
+		}
+		return user, nil
+	}
+
+	if ts.cfg.FailOpenReads {
+		ts.identities.save(token, res.GetValue())
+	}
+
+	return res.GetValue(), nil
+}
+
+func (ts *twinsService) ServiceStats(ctx context.Context, token string) (ServiceStats, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return ServiceStats{}, ErrUnauthorizedAccess
+	}
+
+	if ts.cfg.AdminEmail == "" || res.GetValue() != ts.cfg.AdminEmail {
+		return ServiceStats{}, ErrUnauthorizedAccess
+	}
+
+	tws, err := ts.twins.Count(ctx)
+	if err != nil {
+		return ServiceStats{}, err
+	}
+
+	sts, err := ts.states.CountSince(ctx, time.Time{})
+	if err != nil {
+		return ServiceStats{}, err
+	}
+
+	recent, err := ts.states.CountSince(ctx, time.Now().Add(-statsWindow))
+	if err != nil {
+		return ServiceStats{}, err
+	}
+
+	chs, err := ts.twins.CountChannels(ctx)
+	if err != nil {
+		return ServiceStats{}, err
+	}
+
+	return ServiceStats{
+		Twins:        uint64(tws),
+		States:       uint64(sts),
+		RecentStates: uint64(recent),
+		Channels:     uint64(chs),
+	}, nil
+}
+
+func (ts *twinsService) SetOwnerQuota(ctx context.Context, token, owner string, maxStates uint64) error {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return ErrUnauthorizedAccess
+	}
+
+	if ts.cfg.AdminEmail == "" || res.GetValue() != ts.cfg.AdminEmail {
+		return ErrUnauthorizedAccess
+	}
+
+	if owner == "" {
+		return ErrMalformedEntity
+	}
+
+	return ts.twins.SaveOwnerQuota(ctx, owner, maxStates)
+}
+
+func (ts *twinsService) OwnerUsage(ctx context.Context, token, owner string) (Usage, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return Usage{}, ErrUnauthorizedAccess
+	}
+
+	if owner == "" {
+		owner = res.GetValue()
+	}
+
+	if owner != res.GetValue() && (ts.cfg.AdminEmail == "" || res.GetValue() != ts.cfg.AdminEmail) {
+		return Usage{}, ErrUnauthorizedAccess
+	}
+
+	max, err := ts.twins.RetrieveOwnerQuota(ctx, owner)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	states, err := ts.countOwnerStates(ctx, owner)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return Usage{
+		Owner:     owner,
+		States:    states,
+		MaxStates: max,
+	}, nil
+}
+
+// countOwnerStates returns the total number of states of the twins of the
+// owner.
+func (ts *twinsService) countOwnerStates(ctx context.Context, owner string) (uint64, error) {
+	ids, err := ts.twins.RetrieveIDs(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	n, err := ts.states.CountByTwins(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(n), nil
+}
+
+func (ts *twinsService) SubscriptionInfo(ctx context.Context, token string) ([]SubInfo, error) {
+	res, err := ts.auth.Identify(ctx, &mainflux.Token{Value: token})
+	if err != nil {
+		return nil, ErrUnauthorizedAccess
+	}
+
+	if ts.cfg.AdminEmail == "" || res.GetValue() != ts.cfg.AdminEmail {
+		return nil, ErrUnauthorizedAccess
+	}
+
+	return ts.subs.list(), nil
+}
+
+func (ts *twinsService) VerifyStateChain(ctx context.Context, token, id string) (bool, int64, error) {
+	if _, err := ts.identify(ctx, token, id, Read); err != nil {
+		return false, 0, err
+	}
+
+	prev := State{ID: -1}
+	for offset := uint64(0); ; offset += verifyPageSize {
+		page, err := ts.states.RetrieveAll(ctx, offset, verifyPageSize, id, Strong, Asc)
+		if err != nil {
+			return false, 0, err
+		}
+
+		for _, st := range page.States {
+			sum, err := st.checksum()
+			if err != nil {
+				return false, 0, err
+			}
+			if st.ID != prev.ID+1 || st.PrevHash != prev.Hash || st.Hash != sum {
+				return false, st.ID, nil
+			}
+			prev = st
+		}
+
+		if uint64(len(page.States)) < verifyPageSize {
+			return true, -1, nil
+		}
+	}
+}
+
+func (ts *twinsService) Reindex(ctx context.Context, token, twinID string) error {
+	if _, err := ts.identify(ctx, token, twinID, Write); err != nil {
+		return err
+	}
+
+	return ts.states.Reindex(ctx, twinID)
+}
+
+func (ts *twinsService) BackfillDerived(ctx context.Context, token, twinID, derivedAttr string) error {
+	_, tw, err := ts.identifyTwin(ctx, token, twinID, Write)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.checkLock(ctx, twinID); err != nil {
+		return err
+	}
+	if len(tw.Definitions) == 0 {
+		return ErrMalformedEntity
+	}
+
+	def := tw.ingestionDefinition()
+	idx := findAttribute(derivedAttr, def.Attributes)
+	if idx < 0 {
+		return invalidField("attribute", "unknown attribute %q", derivedAttr)
+	}
+	attr := def.Attributes[idx]
+	if !attr.PersistState || attr.DerivativeOf == "" {
+		return invalidField("attribute", "attribute %q is not a persisted derivative", derivedAttr)
+	}
+
+	var (
+		prevHash string
+		prevVal  interface{}
+		prevTime time.Time
+		derived  interface{}
+		rh       rehash
+	)
+	// States rehashed before a failure stay changed, so they are reported
+	// either way.
+	defer func() { ts.publishRehash(rh) }()
+
+	for offset := uint64(0); ; offset += verifyPageSize {
+		page, err := ts.states.RetrieveAll(ctx, offset, verifyPageSize, twinID, Strong, Asc)
+		if err != nil {
+			return err
+		}
+
+		for _, st := range page.States {
+			hash := st.Hash
+			val, ok := st.Payload[attr.DerivativeOf]
+			t, set := st.AttributeTimes[attr.DerivativeOf]
+			if !set {
+				t = st.Created
+			}
+			if ok && t.After(prevTime) {
+				v1, ok1 := toFloat(prevVal)
+				v2, ok2 := toFloat(val)
+				if ok1 && ok2 {
+					derived = round((v2-v1)/t.Sub(prevTime).Seconds(), attr.Precision)
+				}
+				prevVal, prevTime = val, t
+			}
+
+			// Changing the payload changes the state hash, so the states
+			// following the first changed one are rehashed too.
+			st = st.clone()
+			if derived != nil && st.Payload != nil {
+				st.Payload[derivedAttr] = derived
+			}
+			st.PrevHash = prevHash
+			if st.Hash, err = st.checksum(); err != nil {
+				return err
+			}
+			prevHash = st.Hash
+			if st.Hash == hash {
+				continue
+			}
+			if err := ts.states.Update(ctx, st); err != nil {
+				return err
+			}
+			rh.add(twinID, rehashDerived, st.ID, hash)
+		}
+
+		if uint64(len(page.States)) < verifyPageSize {
+			return nil
+		}
+	}
+}
+
+func (ts *twinsService) StatesHistogram(ctx context.Context, token, twinID string, bucket time.Duration, from, to time.Time, loc *time.Location) ([]BucketCount, error) {
+	if _, err := ts.identify(ctx, token, twinID, Read); err != nil {
+		return nil, err
+	}
+
+	if bucket <= 0 || !from.Before(to) {
+		return nil, ErrMalformedEntity
+	}
+
+	if loc != nil && bucket%day == 0 {
+		return ts.localHistogram(ctx, twinID, int(bucket/day), from, to, loc)
+	}
+
+	n := to.Sub(from) / bucket
+	if to.Sub(from)%bucket != 0 {
+		n++
+	}
+	if n > maxBuckets {
+		return nil, ErrMalformedEntity
+	}
+
+	counts, err := ts.states.CountByBucket(ctx, twinID, from, to, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	hist := make([]BucketCount, n)
+	for i := range hist {
+		hist[i].Start = from.Add(time.Duration(i) * bucket)
+	}
+	for _, c := range counts {
+		if i := int(c.Start.Sub(from) / bucket); i >= 0 && i < len(hist) {
+			hist[i].Count = c.Count
+		}
+	}
+
+	return hist, nil
+}
+
+// localHistogram counts the states within buckets of whole local days. Days
+// vary in length across DST transitions, so the states are counted by local
+// day and the days summed into the buckets. Buckets cover whole days, so the
+// states of the day to falls within are counted, too.
+func (ts *twinsService) localHistogram(ctx context.Context, twinID string, days int, from, to time.Time, loc *time.Location) ([]BucketCount, error) {
+	y, m, d := from.In(loc).Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+
+	var hist []BucketCount
+	for t := start; t.Before(to); t = t.AddDate(0, 0, days) {
+		if len(hist) == maxBuckets {
+			return nil, ErrMalformedEntity
+		}
+		hist = append(hist, BucketCount{Start: t})
+	}
+
+	partitions, err := ts.states.CountByPartition(ctx, twinID, Daily, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	i := 0
+	for _, p := range partitions {
+		if p.Start.Before(start) || !p.Start.Before(to) {
+			continue
+		}
+		for i+1 < len(hist) && !p.Start.Before(hist[i+1].Start) {
+			i++
+		}
+		hist[i].Count += p.Count
+	}
+
+	return hist, nil
+}
+
+func (ts *twinsService) ListStatePartitions(ctx context.Context, token, twinID string, granularity Granularity, loc *time.Location) ([]Partition, error) {
+	if _, err := ts.identify(ctx, token, twinID, Read); err != nil {
+		return nil, err
+	}
+
+	if !granularity.valid() {
+		return nil, ErrMalformedEntity
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	partitions, err := ts.states.CountByPartition(ctx, twinID, granularity, loc)
+	if err != nil {
+		return nil, err
+	}
+	if partitions == nil {
+		partitions = []Partition{}
+	}
+
+	return partitions, nil
+}
+
+func (ts *twinsService) FindStates(ctx context.Context, token, twinID, attr string, op Operator, value float64, offset, limit uint64) (StatesPage, error) {
+	user, tw, err := ts.identifyTwin(ctx, token, twinID, Read)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	if attr == "" || !op.valid() {
+		return StatesPage{}, ErrMalformedEntity
+	}
+
+	if err := ts.checkLimit(limit); err != nil {
+		return StatesPage{}, err
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return StatesPage{}, err
+	}
+
+	hidden := ts.hiddenAttributes(user, tw)
+	if hidden[attr] {
+		return StatesPage{}, ErrUnauthorizedAccess
+	}
+
+	page, err := ts.states.ListByValue(ctx, twinID, attr, op, value, offset, limit)
+	if err != nil {
+		return StatesPage{}, err
+	}
+
+	for i := range page.States {
+		page.States[i].Payload = omit(page.States[i].Payload, hidden)
+		page.States[i].Sums = omitSums(page.States[i].Sums, hidden)
+		page.States[i].Raw = nil
+	}
+
+	return page, nil
+}
+
+func (ts *twinsService) RegisterUnitAlias(alias, canonical string) {
+	ts.units.register(alias, canonical)
+}
+
+func (ts *twinsService) saveState(ctx context.Context, msg *messaging.Message, recs []senml.Record, id string, deadline time.Time, res *SaveResult) (bool, error) {
+	var b []byte
+	var err error
+	var bf backfill
+	skip := false
+	defer func() {
+		if !skip {
+			ts.publish(&id, &err, crudOp["stateSucc"], crudOp["stateFail"], &b)
+		}
+		if !bf.From.IsZero() {
+			ts.publishBackfill(bf)
+		}
+	}()
+
+	tw, err := ts.twins.RetrieveByID(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("Retrieving twin for %s failed: %s", msg.Publisher, err)
+	}
+
+	if tw, err = ts.resolveDefinition(ctx, tw); err != nil {
+		return false, fmt.Errorf("Resolving definition for %s failed: %s", msg.Publisher, err)
+	}
+
+	// Twins having subtopic placeholders are retrieved regardless of their
+	// metadata, and twins regardless of their channel binding, so the ones
+	// not matching the message are skipped.
+	if !ts.matchTwin(tw, msg) {
+		skip = true
+		return false, nil
 	}
 
-	st, err := ts.states.RetrieveLast(context.TODO(), tw.ID)
+	st, err := ts.states.RetrieveLast(ctx, tw.ID)
 	if err != nil {
-		return fmt.Errorf("Retrieve last state for %s failed: %s", msg.Publisher, err)
+		return true, fmt.Errorf("Retrieve last state for %s failed: %s", msg.Publisher, err)
 	}
 
+	recs = ts.resolveRecords(recs)
+	attr, _ := ts.persistedAttribute(tw, msg)
+	mismatched := make(map[int]bool)
+	for i, rec := range recs {
+		if !attr.ValueType.matches(rec) {
+			mismatched[i] = true
+		}
+	}
+	if len(mismatched) > 0 {
+		if ts.cfg.RejectTypeMismatch {
+			return true, ErrTypeMismatch
+		}
+		ts.recordError(ctx, fmt.Errorf("%s: %d records of attribute %s aren't of type %s", ErrTypeMismatch, len(mismatched), attr.Name, attr.ValueType), tw.ID)
+	}
 	for _, rec := range recs {
-		action := prepareState(&st, &tw, rec, msg)
+		if !attr.allows(rec) {
+			return true, ErrInvalidValue
+		}
+	}
+
+	// States of the owner are only counted if the owner has a quota.
+	quota, err := ts.twins.RetrieveOwnerQuota(ctx, tw.Owner)
+	if err != nil {
+		return true, fmt.Errorf("Retrieve quota for %s failed: %s", msg.Publisher, err)
+	}
+	var used uint64
+	if quota > 0 {
+		if used, err = ts.countOwnerStates(ctx, tw.Owner); err != nil {
+			return true, fmt.Errorf("Count states for %s failed: %s", msg.Publisher, err)
+		}
+	}
+
+	// Twins linked to this one are recomputed once its states are saved.
+	changed := false
+	defer func() {
+		if changed {
+			ts.updateInputs(ctx, tw.ID, map[string]bool{tw.ID: true})
+		}
+	}()
+
+	for i, rec := range recs {
+		// Records are persisted one by one, so the ones persisted before
+		// the timeout are kept.
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return true, ErrPartialWrite
+		}
+
+		if mismatched[i] {
+			res.Dropped++
+			continue
+		}
+		// Redelivering a partially written message doesn't save the
+		// records persisted by an earlier delivery once more.
+		if redelivered(ctx) && persisted(st, attr, rec) {
+			res.Dropped++
+			continue
+		}
+
+		prev := st.Hash
+		prevCreated := st.Created
+		hasPrev := st.Payload != nil
+		action := ts.prepareState(&st, &tw, rec, msg)
+		if action == save {
+			st.PrevHash = prev
+			st.Backfilled = hasPrev && st.Created.Before(prevCreated)
+			if st.Backfilled {
+				bf.add(tw.ID, st.Created, prevCreated)
+			}
+		}
+		if action == update || action == save {
+			st.Raw = nil
+			if tw.Enabled(FeatureRawSenML, ts.cfg.StoreRawSenML) {
+				st.Raw = msg.Payload
+			}
+			st.Source = ""
+			if tw.Enabled(FeatureSourceCapture, ts.cfg.CaptureSource) {
+				st.Source = msg.Publisher
+			}
+			if st.Hash, err = st.checksum(); err != nil {
+				return true, fmt.Errorf("Checksum state for %s failed: %s", msg.Publisher, err)
+			}
+		}
+
 		switch action {
 		case noop:
-			return nil
+			return true, nil
+		case drop:
+			res.Dropped++
 		case update:
-			if err := ts.states.Update(context.TODO(), st); err != nil {
-				return fmt.Errorf("Update state for %s failed: %s", msg.Publisher, err)
+			if err := ts.states.Update(ctx, st); err != nil {
+				return true, fmt.Errorf("Update state for %s failed: %s", msg.Publisher, err)
 			}
+			res.Saved++
+			if ref := (StateRef{TwinID: tw.ID, ID: st.ID}); len(res.States) == 0 || res.States[len(res.States)-1] != ref {
+				res.States = append(res.States, ref)
+			}
+			changed = true
+			ts.countIngested(tw, msg)
 		case save:
-			if err := ts.states.Save(context.TODO(), st); err != nil {
-				return fmt.Errorf("Save state for %s failed: %s", msg.Publisher, err)
+			if quota > 0 && used >= quota {
+				return true, ErrQuotaExceeded
+			}
+			if err := ts.states.Save(ctx, st); err != nil {
+				return true, fmt.Errorf("Save state for %s failed: %s", msg.Publisher, err)
 			}
+			used++
+			res.Saved++
+			res.States = append(res.States, StateRef{TwinID: tw.ID, ID: st.ID})
+			changed = true
+			ts.countIngested(tw, msg)
 		}
 	}
 
 	id = msg.Publisher
 	b = msg.Payload
 
-	return nil
+	return true, nil
+}
+
+// updateInputs recomputes the twins linked to the source twin, and then the
+// twins linked to them in turn. The path holds the twins being recomputed,
+// guarding against cycles. Failures are recorded as the last errors of the
+// linked twins rather than failing the source twin states.
+func (ts *twinsService) updateInputs(ctx context.Context, sourceID string, path map[string]bool) {
+	linked, err := ts.twins.RetrieveByInput(ctx, sourceID)
+	if err != nil {
+		if ts.logger != nil {
+			ts.logger.Warn(fmt.Sprintf("Retrieving twins linked to %s failed: %s", sourceID, err))
+		}
+		return
+	}
+
+	for _, tw := range linked {
+		if path[tw.ID] {
+			continue
+		}
+		saved, err := ts.computeInputs(ctx, tw)
+		if err != nil {
+			ts.recordError(ctx, err, tw.ID)
+			continue
+		}
+		if saved {
+			path[tw.ID] = true
+			ts.updateInputs(ctx, tw.ID, path)
+			delete(path, tw.ID)
+		}
+	}
+}
+
+// computeInputs sets the linked attributes of the twin to the mean of the
+// current numeric values, or sums, of their source attributes. The state is updated
+// if it was created within the definition delta, and a new one is saved
+// otherwise. It reports whether the state was saved.
+func (ts *twinsService) computeInputs(ctx context.Context, tw Twin) (bool, error) {
+	tw, err := ts.resolveDefinition(ctx, tw)
+	if err != nil || len(tw.Definitions) == 0 {
+		return false, err
+	}
+	def := tw.Definitions[len(tw.Definitions)-1]
+
+	values := make(map[string][]float64)
+	sources := make(map[string]State)
+	for _, in := range tw.Inputs {
+		if idx := findAttribute(in.Attribute, def.Attributes); idx < 0 || !def.Attributes[idx].PersistState {
+			continue
+		}
+		src, ok := sources[in.SourceTwinID]
+		if !ok {
+			if src, err = ts.states.RetrieveLast(ctx, in.SourceTwinID); err != nil {
+				return false, err
+			}
+			sources[in.SourceTwinID] = src
+		}
+		if v, ok := in.SourceField.value(src, in.SourceAttribute); ok {
+			values[in.Attribute] = append(values[in.Attribute], v)
+		}
+	}
+	if len(values) == 0 {
+		return false, nil
+	}
+
+	st, err := ts.states.RetrieveLast(ctx, tw.ID)
+	if err != nil {
+		return false, err
+	}
+	st = st.clone()
+
+	now := time.Now()
+	update := st.Payload != nil && now.Sub(st.Created) <= time.Duration(def.Delta)
+	if st.Payload == nil {
+		st.Payload = make(map[string]interface{})
+		st.ID = -1
+	}
+	if st.AttributeTimes == nil {
+		st.AttributeTimes = make(map[string]time.Time)
+	}
+	st.TwinID = tw.ID
+	st.Definition = def.ID
+	st.Raw = nil
+	st.Source = ""
+
+	for name, vals := range values {
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		attr := def.Attributes[findAttribute(name, def.Attributes)]
+		st.Payload[name] = round(sum/float64(len(vals)), attr.Precision)
+		st.AttributeTimes[name] = now
+	}
+
+	if update {
+		if st.Hash, err = st.checksum(); err != nil {
+			return false, err
+		}
+		return true, ts.states.Update(ctx, st)
+	}
+
+	st.PrevHash = st.Hash
+	st.ID++
+	st.Created = now
+	st.Backfilled = false
+	if st.Hash, err = st.checksum(); err != nil {
+		return false, err
+	}
+
+	return true, ts.states.Save(ctx, st)
+}
+
+// countIngested counts the stored record for the twin attribute the message
+// is reported for. Records are counted only if the monitoring channel is set.
+func (ts *twinsService) countIngested(tw Twin, msg *messaging.Message) {
+	if ts.cfg.MonitoringChannel == "" {
+		return
+	}
+
+	if attr, ok := ts.persistedAttribute(tw, msg); ok {
+		ts.ingestion.record(tw.ID, attr.Name)
+	}
+}
+
+// persistedAttribute returns the persisted twin attribute the message
+// values are stored to.
+func (ts *twinsService) persistedAttribute(tw Twin, msg *messaging.Message) (Attribute, bool) {
+	for _, attr := range tw.Definitions[len(tw.Definitions)-1].Attributes {
+		if attr.PersistState && attr.Channel == msg.Channel && ts.matchTwinAttribute(attr, tw, msg.Subtopic) {
+			return attr, true
+		}
+	}
+
+	return Attribute{}, false
+}
+
+// resolveRecords applies the base time and unit to the records and
+// normalizes their units.
+func (ts *twinsService) resolveRecords(recs []senml.Record) []senml.Record {
+	var bt float64
+	var bu string
+	resolved := make([]senml.Record, len(recs))
+	for i, rec := range recs {
+		// Base time and unit apply to all the following records, up to the
+		// next record that has them.
+		if rec.BaseTime != 0 {
+			bt = rec.BaseTime
+		}
+		rec.BaseTime = bt
+		if rec.BaseUnit != "" {
+			bu = rec.BaseUnit
+		}
+		if rec.Unit == "" {
+			rec.Unit = bu
+		}
+		rec.Unit = ts.units.normalize(rec.Unit)
+		resolved[i] = rec
+	}
+
+	return resolved
 }
 
-func prepareState(st *State, tw *Twin, rec senml.Record, msg *messaging.Message) int {
-	def := tw.Definitions[len(tw.Definitions)-1]
+func (ts *twinsService) prepareState(st *State, tw *Twin, rec senml.Record, msg *messaging.Message) int {
+	def := tw.ingestionDefinition()
 	st.TwinID = tw.ID
 	st.Definition = def.ID
 
@@ -333,31 +3640,64 @@ func prepareState(st *State, tw *Twin, rec senml.Record, msg *messaging.Message)
 				delete(st.Payload, k)
 			}
 		}
+		for k := range st.Smoothed {
+			idx := findAttribute(k, def.Attributes)
+			if idx < 0 || !def.Attributes[idx].PersistState || def.Attributes[idx].Smoothing == 0 {
+				delete(st.Smoothed, k)
+			}
+		}
+		for k := range st.Sums {
+			if idx := findAttribute(k, def.Attributes); idx < 0 || !def.Attributes[idx].PersistState {
+				delete(st.Sums, k)
+			}
+		}
 	}
 
-	recSec := rec.BaseTime + rec.Time
-	recNano := recSec * nanosec
-	sec, dec := math.Modf(recSec)
-	recTime := time.Unix(int64(sec), int64(dec*nanosec))
+	now, timed := resolveTime(rec.BaseTime + rec.Time)
 
 	action := noop
 	for _, attr := range def.Attributes {
 		if !attr.PersistState {
 			continue
 		}
-		if attr.Channel == msg.Channel && attr.Subtopic == msg.Subtopic {
+		if attr.Channel == msg.Channel && ts.matchTwinAttribute(attr, *tw, msg.Subtopic) {
+			if last, ok := st.AttributeTimes[attr.Name]; ok && attr.MinInterval > 0 && now.Sub(last) < attr.MinInterval {
+				return drop
+			}
+			if attr.Unit != "" && rec.Unit != "" && rec.Unit != attr.Unit {
+				return drop
+			}
+
+			// Records reported for the same time as the last stored value
+			// conflict with it, and are resolved by the attribute policy.
+			val := round(findValue(rec), attr.Precision)
+			if last, ok := st.AttributeTimes[attr.Name]; ok && timed && last.Equal(now) && attr.Conflict.keep(st.Payload[attr.Name], val) {
+				return drop
+			}
+			if last, ok := st.AttributeTimes[attr.Name]; ok && !last.Equal(now) && attr.duplicates(st.Payload[attr.Name], val, last, now) {
+				return drop
+			}
+
 			action = update
-			delta := math.Abs(float64(st.Created.UnixNano()) - recNano)
-			if recNano == 0 || delta > float64(def.Delta) {
+			delta := math.Abs(float64(st.Created.UnixNano() - now.UnixNano()))
+			if !timed || delta > float64(def.Delta) {
 				action = save
 				st.ID++
-				st.Created = time.Now()
-				if recNano != 0 {
-					st.Created = recTime
-				}
+				st.Created = now
 			}
-			val := findValue(rec)
+			derive(st, def, attr, val, now)
+			smooth(st, attr, val)
 			st.Payload[attr.Name] = val
+			if rec.Sum != nil {
+				if st.Sums == nil {
+					st.Sums = make(map[string]float64)
+				}
+				st.Sums[attr.Name], _ = toFloat(round(*rec.Sum, attr.Precision))
+			}
+			if st.AttributeTimes == nil {
+				st.AttributeTimes = make(map[string]time.Time)
+			}
+			st.AttributeTimes[attr.Name] = now
 
 			break
 		}
@@ -366,6 +3706,554 @@ func prepareState(st *State, tw *Twin, rec senml.Record, msg *messaging.Message)
 	return action
 }
 
+// resolveTime resolves SenML record time given in seconds. As per RFC 8428,
+// missing time means the current time, and time below 2^28 is relative to
+// the current time, negative being in the past. It reports whether the
+// record time was set.
+func resolveTime(sec float64) (time.Time, bool) {
+	now := time.Now()
+	if sec == 0 {
+		return now, false
+	}
+	if sec < relativeTime {
+		return now.Add(time.Duration(sec * nanosec)), true
+	}
+
+	s, dec := math.Modf(sec)
+	return time.Unix(int64(s), int64(dec*nanosec)), true
+}
+
+// checkBase verifies that the base twin exists and that referencing it from
+// the twin with given id does not introduce a cycle.
+func (ts *twinsService) checkBase(ctx context.Context, id, baseID string) error {
+	visited := map[string]bool{}
+	for baseID != "" {
+		if baseID == id || visited[baseID] {
+			return ErrMalformedEntity
+		}
+		visited[baseID] = true
+
+		base, err := ts.twins.RetrieveByID(ctx, baseID)
+		if err != nil {
+			return ErrMalformedEntity
+		}
+		baseID = base.BaseTwinID
+	}
+	return nil
+}
+
+// resolveDefinition replaces the latest twin definition with the effective
+// one, inherited from the chain of base twins. Attributes of a derived twin
+// override base attributes having the same name. A removed base twin ends
+// the chain.
+func (ts *twinsService) resolveDefinition(ctx context.Context, tw Twin) (Twin, error) {
+	if tw.BaseTwinID == "" || len(tw.Definitions) == 0 {
+		return tw, nil
+	}
+
+	def := tw.Definitions[len(tw.Definitions)-1]
+	visited := map[string]bool{tw.ID: true}
+	for baseID := tw.BaseTwinID; baseID != "" && !visited[baseID]; {
+		visited[baseID] = true
+
+		base, err := ts.twins.RetrieveByID(ctx, baseID)
+		if err == ErrNotFound {
+			break
+		}
+		if err != nil {
+			return Twin{}, err
+		}
+		if len(base.Definitions) > 0 {
+			def = mergeDefinitions(base.Definitions[len(base.Definitions)-1], def)
+		}
+		baseID = base.BaseTwinID
+	}
+
+	defs := make([]Definition, len(tw.Definitions))
+	copy(defs, tw.Definitions)
+	defs[len(defs)-1] = def
+	tw.Definitions = defs
+
+	return tw, nil
+}
+
+// withDerivatives extends the list of twin ids with ids of all the twins
+// derived from them.
+func (ts *twinsService) withDerivatives(ctx context.Context, ids []string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		seen[id] = true
+	}
+
+	for i := 0; i < len(ids); i++ {
+		derived, err := ts.twins.RetrieveByBase(ctx, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range derived {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// mergeDefinitions merges the definition with the definition of its base
+// twin. The inherited attributes come first, in the order of the base
+// definition, followed by the attributes of the definition in their order.
+func mergeDefinitions(base, def Definition) Definition {
+	attrs := []Attribute{}
+	for _, attr := range base.Attributes {
+		if findAttribute(attr.Name, def.Attributes) < 0 {
+			attrs = append(attrs, attr)
+		}
+	}
+	def.Attributes = append(attrs, def.Attributes...)
+	return def
+}
+
+// matchTwin reports whether any attribute of the twin matches the message
+// channel and subtopic. Twins bound to another channel don't match.
+func (ts *twinsService) matchTwin(tw Twin, msg *messaging.Message) bool {
+	if tw.ChannelID != "" && tw.ChannelID != msg.Channel {
+		return false
+	}
+
+	for _, attr := range tw.Definitions[len(tw.Definitions)-1].Attributes {
+		if attr.Channel == msg.Channel && ts.matchTwinAttribute(attr, tw, msg.Subtopic) {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholder matches subtopic placeholders, e.g. {serial}.
+var placeholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// matchAttribute reports whether the message subtopic matches the attribute
+// subtopic or any of its aliases. Placeholders are compared as they are.
+func (ts *twinsService) matchAttribute(attr Attribute, msgSubtopic string) bool {
+	for _, subtopic := range attr.Subtopics() {
+		if ts.matchSubtopic(subtopic, msgSubtopic) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTwinAttribute reports whether the message subtopic matches the
+// attribute subtopic or any of its aliases, having placeholders resolved
+// from the twin metadata. Subtopics with unresolved placeholders don't
+// match.
+func (ts *twinsService) matchTwinAttribute(attr Attribute, tw Twin, msgSubtopic string) bool {
+	for _, subtopic := range attr.Subtopics() {
+		if subtopic, ok := resolveSubtopic(subtopic, tw.Metadata); ok && ts.matchSubtopic(subtopic, msgSubtopic) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSubtopic substitutes subtopic placeholders with the values of the
+// metadata keys they name. It reports whether all the placeholders were
+// resolved.
+func resolveSubtopic(subtopic string, metadata Metadata) (string, bool) {
+	ok := true
+	resolved := placeholder.ReplaceAllStringFunc(subtopic, func(p string) string {
+		val, found := metadata[p[1:len(p)-1]]
+		if !found {
+			ok = false
+			return p
+		}
+		return fmt.Sprint(val)
+	})
+
+	return resolved, ok
+}
+
+// validateDefinition checks the definition and returns DefinitionError
+// listing all the problems found, or nil if the definition is valid.
+func (ts *twinsService) validateDefinition(def Definition) error {
+	de := &DefinitionError{}
+	add := func(field, format string, args ...interface{}) {
+		fe := FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+		de.Fields = append(de.Fields, fe)
+		de.Problems = append(de.Problems, fe.String())
+	}
+
+	if len(def.Attributes) > maxAttributes {
+		add("attributes", "definition has %d attributes, at most %d allowed", len(def.Attributes), maxAttributes)
+	}
+
+	if def.Delta < 0 {
+		add("delta", "must not be negative")
+	}
+
+	names := make(map[string]bool)
+	for i, attr := range def.Attributes {
+		path := fmt.Sprintf("attributes[%d]", i)
+
+		switch {
+		case attr.Name == "":
+			add(path+".name", "must not be empty")
+		case names[attr.Name]:
+			add(path+".name", "duplicate name %q", attr.Name)
+		}
+		names[attr.Name] = true
+
+		if attr.MinInterval < 0 {
+			add(path+".min_interval", "must not be negative")
+		}
+
+		if attr.DedupWindow < 0 {
+			add(path+".dedup_window", "must not be negative")
+		}
+
+		if ts.cfg.ValidateUnits && attr.Unit != "" && !validUnit(attr.Unit) {
+			if canonical := ts.units.normalize(attr.Unit); validUnit(canonical) {
+				add(path+".unit", "unknown UCUM unit %q, use %q", attr.Unit, canonical)
+			} else {
+				add(path+".unit", "unknown UCUM unit %q", attr.Unit)
+			}
+		}
+
+		if attr.DedupEpsilon < 0 {
+			add(path+".dedup_epsilon", "must not be negative")
+		}
+
+		if attr.Smoothing < 0 || attr.Smoothing > 1 {
+			add(path+".smoothing", "must be within range [0, 1]")
+		}
+
+		if attr.Display != nil && attr.Display.Precision < 0 {
+			add(path+".display.precision", "must not be negative")
+		}
+
+		if attr.Precision != nil && (*attr.Precision < 0 || *attr.Precision > maxPrecision) {
+			add(path+".precision", "must be within range [0, %d]", maxPrecision)
+		}
+
+		if !attr.Conflict.valid() {
+			add(path+".conflict", "unknown policy %q", attr.Conflict)
+		}
+
+		if !attr.ValueType.valid() {
+			add(path+".value_type", "unknown value type %q", attr.ValueType)
+		}
+
+		if len(attr.AllowedValues) > 0 && attr.ValueType != "" && attr.ValueType != StringValue {
+			add(path+".allowed_values", "must only be set for string values")
+		}
+
+		switch attr.Default.(type) {
+		case nil, float64, string, bool:
+		default:
+			add(path+".default", "must be a number, string or boolean")
+		}
+
+		if attr.Range != nil && attr.Range.Min > attr.Range.Max {
+			add(path+".range", "min must not be greater than max")
+		}
+
+		if attr.DerivativeOf != "" && (attr.DerivativeOf == attr.Name || findAttribute(attr.DerivativeOf, def.Attributes) < 0) {
+			add(path+".derivative_of", "unknown attribute %q", attr.DerivativeOf)
+		}
+
+		// No alias may match a subtopic or an alias of another attribute on
+		// the same channel.
+		for k, alias := range attr.Aliases {
+			for j, other := range def.Attributes {
+				if i != j && attr.Channel == other.Channel && ts.matchAttribute(other, alias) {
+					add(fmt.Sprintf("%s.aliases[%d]", path, k), "alias %q collides with attribute %d", alias, j)
+				}
+			}
+		}
+	}
+
+	if len(de.Fields) > 0 {
+		return de
+	}
+	return nil
+}
+
+// checkDependencies returns DependencyError if attributes of the current
+// definition that the new one removes are still referenced by derived
+// attributes of the new definition.
+func checkDependencies(cur, def Definition) error {
+	de := &DependencyError{Dependents: make(map[string][]string)}
+	for _, attr := range def.Attributes {
+		if attr.DerivativeOf == "" || findAttribute(attr.DerivativeOf, def.Attributes) >= 0 {
+			continue
+		}
+		if findAttribute(attr.DerivativeOf, cur.Attributes) >= 0 {
+			de.Dependents[attr.DerivativeOf] = append(de.Dependents[attr.DerivativeOf], attr.Name)
+		}
+	}
+
+	if len(de.Dependents) > 0 {
+		return de
+	}
+	return nil
+}
+
+func (ts *twinsService) matchSubtopic(subtopic, msgSubtopic string) bool {
+	if ts.cfg.CaseInsensitiveMatch {
+		return strings.EqualFold(subtopic, msgSubtopic)
+	}
+	return subtopic == msgSubtopic
+}
+
+// decodeRecords decodes SenML records in the given format. Unlike
+// senml.Decode, it doesn't validate the records, so the records without
+// values are kept. Records are decoded one by one, the ones that fail to
+// decode are skipped and their indices returned. An error is returned only
+// if the pack itself can't be decoded.
+func decodeRecords(payload []byte, format senml.Format) ([]senml.Record, []int, error) {
+	switch format {
+	case senml.XML:
+		return decodeXMLRecords(payload)
+	case senml.CBOR:
+		var raws []cbor.RawMessage
+		if err := cbor.Unmarshal(payload, &raws); err != nil {
+			return nil, nil, err
+		}
+		var recs []senml.Record
+		var invalid []int
+		for i, raw := range raws {
+			var rec senml.Record
+			if err := cbor.Unmarshal(raw, &rec); err != nil {
+				invalid = append(invalid, i)
+				continue
+			}
+			recs = append(recs, rec)
+		}
+		return recs, invalid, nil
+	default:
+		var raws []json.RawMessage
+		if err := json.Unmarshal(payload, &raws); err != nil {
+			return nil, nil, err
+		}
+		var recs []senml.Record
+		var invalid []int
+		for i, raw := range raws {
+			var rec senml.Record
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				invalid = append(invalid, i)
+				continue
+			}
+			recs = append(recs, rec)
+		}
+		return recs, invalid, nil
+	}
+}
+
+func decodeXMLRecords(payload []byte) ([]senml.Record, []int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(payload))
+
+	var recs []senml.Record
+	var invalid []int
+	n := 0
+	root := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if !root {
+			if start.Name.Local != "sensml" {
+				return nil, nil, ErrMalformedEntity
+			}
+			root = true
+			continue
+		}
+		if start.Name.Local != "senml" {
+			if err := dec.Skip(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		n++
+		var rec senml.Record
+		if err := dec.DecodeElement(&rec, &start); err != nil {
+			// Attributes are decoded before the element content, so
+			// the rest of the element is skipped.
+			invalid = append(invalid, n-1)
+			if err := dec.Skip(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		recs = append(recs, rec)
+	}
+
+	if !root {
+		return nil, nil, ErrMalformedEntity
+	}
+
+	return recs, invalid, nil
+}
+
+// invalidRecords returns ValidationError reporting the records, identified by
+// their indices in the pack, that failed to decode.
+func invalidRecords(invalid []int) error {
+	ve := &ValidationError{}
+	for _, i := range invalid {
+		ve.Fields = append(ve.Fields, FieldError{
+			Field:   fmt.Sprintf("records[%d]", i),
+			Message: "malformed SenML record",
+		})
+	}
+	return ve
+}
+
+// compressed reports whether the payload is gzip-compressed, as declared by
+// the configured content encoding. Without one, the gzip magic number is used
+// as the hint. It can't collide with SenML, since neither JSON nor CBOR
+// arrays start with it.
+func (ts *twinsService) compressed(payload []byte) bool {
+	switch ts.cfg.ContentEncoding {
+	case gzipEncoding:
+		return true
+	case identityEncoding:
+		return false
+	default:
+		return len(payload) > 1 && payload[0] == 0x1f && payload[1] == 0x8b
+	}
+}
+
+// detectContentType returns the SenML content type of the payload, told by
+// its first significant byte: XML packs are documents, and CBOR packs are
+// arrays, encoded with the major type 4. Other payloads are taken for JSON,
+// so malformed ones fail to decode as before.
+func detectContentType(payload []byte) string {
+	p := bytes.TrimLeft(payload, " \t\r\n")
+	switch {
+	case len(p) > 0 && p[0] == '<':
+		return senmlXML
+	case len(p) > 0 && p[0]&0xe0 == 0x80:
+		return senmlCBOR
+	default:
+		return senmlJSON
+	}
+}
+
+// gunzip decompresses the payload. ErrPayloadTooLarge is returned if the
+// decompressed payload exceeds the limit, unless the limit is zero.
+func gunzip(payload []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, ErrPayloadTooLarge
+	}
+
+	return data, nil
+}
+
+// derive sets values of the attributes declared as time derivatives of the
+// source attribute, using the previously stored value of the source. The
+// derivatives are skipped if there is no previous numeric value.
+func derive(st *State, def Definition, src Attribute, val interface{}, t time.Time) {
+	last, ok := st.AttributeTimes[src.Name]
+	if !ok {
+		return
+	}
+
+	v1, ok1 := toFloat(st.Payload[src.Name])
+	v2, ok2 := toFloat(val)
+	dt := t.Sub(last).Seconds()
+	if !ok1 || !ok2 || dt <= 0 {
+		return
+	}
+
+	for _, attr := range def.Attributes {
+		if attr.PersistState && attr.DerivativeOf == src.Name {
+			st.Payload[attr.Name] = round((v2-v1)/dt, attr.Precision)
+		}
+	}
+}
+
+// smooth updates the moving average of the attribute with the value. The
+// first value initializes the average.
+func smooth(st *State, attr Attribute, val interface{}) {
+	if attr.Smoothing == 0 {
+		return
+	}
+
+	v, ok := toFloat(val)
+	if !ok {
+		return
+	}
+
+	if st.Smoothed == nil {
+		st.Smoothed = make(map[string]float64)
+	}
+	prev, ok := st.Smoothed[attr.Name]
+	if !ok {
+		st.Smoothed[attr.Name] = v
+		return
+	}
+	st.Smoothed[attr.Name] = attr.Smoothing*v + (1-attr.Smoothing)*prev
+}
+
+// round rounds the numeric value to the given number of decimal places.
+// Other values, and all the values if precision isn't set, are returned as
+// they are.
+func round(val interface{}, precision *int) interface{} {
+	if precision == nil {
+		return val
+	}
+
+	v, ok := toFloat(val)
+	if !ok {
+		return val
+	}
+	p := math.Pow(10, float64(*precision))
+	r := math.Round(v*p) / p
+
+	// Records may be shared by multiple twins, so the value they point to
+	// is left intact.
+	if _, ok := val.(*float64); ok {
+		return &r
+	}
+	return r
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case *float64:
+		if v == nil {
+			return 0, false
+		}
+		return *v, true
+	default:
+		return 0, false
+	}
+}
+
 func findValue(rec senml.Record) interface{} {
 	if rec.Value != nil {
 		return rec.Value
@@ -385,6 +4273,19 @@ func findValue(rec senml.Record) interface{} {
 	return nil
 }
 
+// valueSize returns the size in bytes of the string and data values of the
+// record, the only values whose size isn't fixed.
+func valueSize(rec senml.Record) int {
+	size := 0
+	if rec.StringValue != nil {
+		size += len(*rec.StringValue)
+	}
+	if rec.DataValue != nil {
+		size += len(*rec.DataValue)
+	}
+	return size
+}
+
 func findAttribute(name string, attrs []Attribute) (idx int) {
 	for idx, attr := range attrs {
 		if attr.Name == name {
@@ -394,11 +4295,71 @@ func findAttribute(name string, attrs []Attribute) (idx int) {
 	return -1
 }
 
-func (ts *twinsService) publish(twinID *string, err *error, succOp, failOp string, payload *[]byte) {
-	if ts.channelID == "" {
+// backfill is the time range states were inserted into the past of the twin.
+type backfill struct {
+	TwinID string    `json:"twin_id"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+}
+
+// add extends the range to cover the state created at the given time
+// before the state created at prev.
+func (bf *backfill) add(twinID string, created, prev time.Time) {
+	bf.TwinID = twinID
+	if bf.From.IsZero() || created.Before(bf.From) {
+		bf.From = created
+	}
+	if prev.After(bf.To) {
+		bf.To = prev
+	}
+}
+
+func (ts *twinsService) publishBackfill(bf backfill) {
+	b, err := json.Marshal(bf)
+	if err != nil {
+		return
+	}
+
+	ts.publish(&bf.TwinID, &err, backfillOp, backfillOp, &b)
+}
+
+// rehash is the range of stored states of the twin that were changed and
+// rehashed, and the reason they were changed. The hashes the states had
+// before are kept, so the amended chain can be told apart from a tampered
+// one.
+type rehash struct {
+	TwinID string           `json:"twin_id"`
+	Reason string           `json:"reason"`
+	From   int64            `json:"from"`
+	To     int64            `json:"to"`
+	Hashes map[int64]string `json:"hashes"`
+}
+
+// add extends the range to cover the state that was hashed to hash before
+// it was changed.
+func (rh *rehash) add(twinID, reason string, id int64, hash string) {
+	if rh.Hashes == nil {
+		rh.TwinID, rh.Reason, rh.From = twinID, reason, id
+		rh.Hashes = make(map[int64]string)
+	}
+	rh.To = id
+	rh.Hashes[id] = hash
+}
+
+func (ts *twinsService) publishRehash(rh rehash) {
+	if rh.Hashes == nil {
+		return
+	}
+
+	b, err := json.Marshal(rh)
+	if err != nil {
 		return
 	}
 
+	ts.publish(&rh.TwinID, &err, rehashOp, rehashOp, &b)
+}
+
+func (ts *twinsService) publish(twinID *string, err *error, succOp, failOp string, payload *[]byte) {
 	op := succOp
 	if *err != nil {
 		op = failOp
@@ -411,6 +4372,12 @@ func (ts *twinsService) publish(twinID *string, err *error, succOp, failOp strin
 		pl = []byte(fmt.Sprintf("{\"deleted\":\"%s\"}", *twinID))
 	}
 
+	ts.events.append(op, pl, time.Now())
+
+	if ts.channelID == "" {
+		return
+	}
+
 	msg := messaging.Message{
 		Channel:   ts.channelID,
 		Subtopic:  op,
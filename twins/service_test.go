@@ -4,16 +4,30 @@
 package twins_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mainflux/mainflux"
+	"github.com/mainflux/mainflux/pkg/messaging"
 	"github.com/mainflux/mainflux/pkg/uuid"
 	"github.com/mainflux/mainflux/twins"
 	"github.com/mainflux/mainflux/twins/mocks"
 	"github.com/mainflux/senml"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -39,7 +53,7 @@ func newService(tokens map[string]string) twins.Service {
 	uuidProvider := uuid.NewMock()
 	subs := map[string]string{"chanID": "chanID"}
 	broker := mocks.NewBroker(subs)
-	return twins.New(broker, auth, twinsRepo, statesRepo, uuidProvider, "chanID", nil)
+	return twins.New(broker, auth, twinsRepo, statesRepo, uuidProvider, "chanID", twins.Config{}, nil)
 }
 
 func TestAddTwin(t *testing.T) {
@@ -117,8 +131,96 @@ func TestUpdateTwin(t *testing.T) {
 	}
 }
 
-func TestViewTwin(t *testing.T) {
+func TestConditionalUpdateTwin(t *testing.T) {
 	svc := mocks.NewService(map[string]string{token: email})
+
+	saved, err := svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"state": "idle"}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s\n", err))
+
+	running := saved
+	running.Metadata = twins.Metadata{"state": "running"}
+	stopped := saved
+	stopped.Metadata = twins.Metadata{"state": "stopped"}
+
+	cases := []struct {
+		desc       string
+		twin       twins.Twin
+		token      string
+		conditions map[string]interface{}
+		state      string
+		err        error
+	}{
+		{
+			desc:       "update twin whose metadata matches conditions",
+			twin:       running,
+			token:      token,
+			conditions: map[string]interface{}{"state": "idle"},
+			state:      "running",
+			err:        nil,
+		},
+		{
+			desc:       "update twin whose metadata no longer matches conditions",
+			twin:       stopped,
+			token:      token,
+			conditions: map[string]interface{}{"state": "idle"},
+			state:      "running",
+			err:        twins.ErrConflict,
+		},
+		{
+			desc:       "update twin on missing metadata key",
+			twin:       stopped,
+			token:      token,
+			conditions: map[string]interface{}{"owner": "robot"},
+			state:      "running",
+			err:        twins.ErrConflict,
+		},
+		{
+			desc:       "update twin without conditions",
+			twin:       stopped,
+			token:      token,
+			conditions: map[string]interface{}{},
+			state:      "running",
+			err:        twins.ErrMalformedEntity,
+		},
+		{
+			desc:       "update twin with wrong credentials",
+			twin:       stopped,
+			token:      wrongToken,
+			conditions: map[string]interface{}{"state": "running"},
+			state:      "running",
+			err:        twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:       "update twin whose metadata matches new conditions",
+			twin:       stopped,
+			token:      token,
+			conditions: map[string]interface{}{"state": "running"},
+			state:      "stopped",
+			err:        nil,
+		},
+		{
+			desc:       "update non-existing twin",
+			twin:       twins.Twin{ID: wrongID, Metadata: twins.Metadata{"state": "running"}},
+			token:      token,
+			conditions: map[string]interface{}{"state": "stopped"},
+			state:      "stopped",
+			err:        twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.ConditionalUpdateTwin(context.Background(), tc.token, tc.twin, tc.conditions)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		tw, err := svc.ViewTwin(context.Background(), token, saved.ID)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s\n", err))
+		assert.Equal(t, tc.state, tw.Metadata["state"], fmt.Sprintf("%s: expected state %s got %v\n", tc.desc, tc.state, tw.Metadata["state"]))
+	}
+}
+
+func TestViewTwin(t *testing.T) {
+	otherToken := "other-token"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: "other@example.com"})
 	twin := twins.Twin{}
 	def := twins.Definition{}
 	saved, err := svc.AddTwin(context.Background(), token, twin, def)
@@ -139,6 +241,11 @@ func TestViewTwin(t *testing.T) {
 			token: wrongToken,
 			err:   twins.ErrUnauthorizedAccess,
 		},
+		"view twin owned by other user": {
+			id:    saved.ID,
+			token: otherToken,
+			err:   twins.ErrUnauthorizedAccess,
+		},
 		"view non-existing twin": {
 			id:    wrongID,
 			token: token,
@@ -152,6 +259,518 @@ func TestViewTwin(t *testing.T) {
 	}
 }
 
+func TestViewTwins(t *testing.T) {
+	otherToken := "other-token"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: "other@example.com"})
+
+	tw1, err := svc.AddTwin(context.Background(), token, twins.Twin{}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s\n", err))
+	tw2, err := svc.AddTwin(context.Background(), token, twins.Twin{}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s\n", err))
+	other, err := svc.AddTwin(context.Background(), otherToken, twins.Twin{}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s\n", err))
+
+	cases := []struct {
+		desc  string
+		token string
+		ids   []string
+		res   []string
+		err   error
+	}{
+		{
+			desc:  "view twins",
+			token: token,
+			ids:   []string{tw1.ID, tw2.ID},
+			res:   []string{tw1.ID, tw2.ID},
+			err:   nil,
+		},
+		{
+			desc:  "view twins with missing and other user's twins",
+			token: token,
+			ids:   []string{tw1.ID, wrongID, other.ID},
+			res:   []string{tw1.ID},
+			err: &twins.BatchError{Errors: map[string]error{
+				wrongID:  twins.ErrNotFound,
+				other.ID: twins.ErrUnauthorizedAccess,
+			}},
+		},
+		{
+			desc:  "view twins with wrong credentials",
+			token: wrongToken,
+			ids:   []string{tw1.ID},
+			res:   nil,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		tws, err := svc.ViewTwins(context.Background(), tc.token, tc.ids)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		var ids []string
+		for _, tw := range tws {
+			ids = append(ids, tw.ID)
+		}
+		assert.Equal(t, tc.res, ids, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.res, ids))
+	}
+}
+
+func TestDefinitionAttributeOrder(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName3, attrName1, attrName2}, []string{attrSubtopic3, attrSubtopic1, attrSubtopic2})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	reordered := mocks.CreateDefinition([]string{attrName2, attrName3, attrName1}, []string{attrSubtopic2, attrSubtopic3, attrSubtopic1})
+
+	cases := []struct {
+		desc  string
+		def   twins.Definition
+		names [][]string
+	}{
+		{
+			desc:  "keep attribute order of added twin",
+			names: [][]string{{attrName3, attrName1, attrName2}},
+		},
+		{
+			desc:  "keep attribute order of reordered definition",
+			def:   reordered,
+			names: [][]string{{attrName3, attrName1, attrName2}, {attrName2, attrName3, attrName1}},
+		},
+		{
+			desc:  "keep attribute order of definition saved again",
+			def:   reordered,
+			names: [][]string{{attrName3, attrName1, attrName2}, {attrName2, attrName3, attrName1}},
+		},
+	}
+
+	for _, tc := range cases {
+		if len(tc.def.Attributes) > 0 {
+			err := svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID}, tc.def)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		}
+
+		saved, err := svc.ViewTwin(context.Background(), token, tw.ID)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		var names [][]string
+		for _, def := range saved.Definitions {
+			var attrs []string
+			for _, attr := range def.Attributes {
+				attrs = append(attrs, attr.Name)
+			}
+			names = append(names, attrs)
+		}
+		assert.Equal(t, tc.names, names, fmt.Sprintf("%s: expected attributes %v got %v\n", tc.desc, tc.names, names))
+	}
+}
+
+func TestUpdateTwinNoop(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[0].Default = 10.0
+	def.Attributes[1].Display = &twins.DisplayHints{Label: "Humidity"}
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Name: "name"}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	// Definition is saved again as it's retrieved, like by the UI.
+	cur, err := svc.ViewTwin(context.Background(), token, tw.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	data, err := json.Marshal(cur.Definitions[0])
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	var saved twins.Definition
+	err = json.Unmarshal(data, &saved)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	changed := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+
+	cases := []struct {
+		desc        string
+		twin        twins.Twin
+		def         twins.Definition
+		revision    int
+		definitions int
+	}{
+		{
+			desc:        "update twin with current definition",
+			twin:        twins.Twin{ID: tw.ID},
+			def:         saved,
+			revision:    tw.Revision,
+			definitions: 1,
+		},
+		{
+			desc:        "update twin with current name",
+			twin:        twins.Twin{ID: tw.ID, Name: "name"},
+			revision:    tw.Revision,
+			definitions: 1,
+		},
+		{
+			desc:        "update twin with changed definition",
+			twin:        twins.Twin{ID: tw.ID},
+			def:         changed,
+			revision:    tw.Revision + 1,
+			definitions: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.UpdateTwin(context.Background(), token, tc.twin, tc.def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		got, err := svc.ViewTwin(context.Background(), token, tw.ID)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.revision, got.Revision, fmt.Sprintf("%s: expected revision %d got %d\n", tc.desc, tc.revision, got.Revision))
+		assert.Len(t, got.Definitions, tc.definitions, fmt.Sprintf("%s: expected %d definitions got %d\n", tc.desc, tc.definitions, len(got.Definitions)))
+	}
+}
+
+func TestDefinitionEqual(t *testing.T) {
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[0].Default = 10
+	def.Attributes[1].Display = &twins.DisplayHints{Label: "Humidity", Precision: 1}
+
+	data, err := json.Marshal(def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	var decoded twins.Definition
+	err = json.Unmarshal(data, &decoded)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	copied := def
+	copied.Attributes = append([]twins.Attribute{}, def.Attributes...)
+	copied.Attributes[0].Default = 10.0
+	copied.Attributes[0].Aliases = []string{}
+	copied.Attributes[1].Display = &twins.DisplayHints{Label: "Humidity", Precision: 1}
+	copied.ID = def.ID + 1
+	copied.Created = time.Now()
+
+	delta := def
+	delta.Delta = def.Delta + 1
+
+	swapped := def
+	swapped.Attributes = []twins.Attribute{def.Attributes[1], def.Attributes[0]}
+
+	unit := def
+	unit.Attributes = append([]twins.Attribute{}, def.Attributes...)
+	unit.Attributes[1].Unit = "C"
+
+	cases := []struct {
+		desc  string
+		def   twins.Definition
+		equal bool
+	}{
+		{
+			desc:  "compare definition serialized and deserialized",
+			def:   decoded,
+			equal: true,
+		},
+		{
+			desc:  "compare copied definition with other id",
+			def:   copied,
+			equal: true,
+		},
+		{
+			desc:  "compare definition with other delta",
+			def:   delta,
+			equal: false,
+		},
+		{
+			desc:  "compare definition with swapped attributes",
+			def:   swapped,
+			equal: false,
+		},
+		{
+			desc:  "compare definition with changed attribute",
+			def:   unit,
+			equal: false,
+		},
+	}
+
+	for _, tc := range cases {
+		equal := def.Equal(tc.def)
+		assert.Equal(t, tc.equal, equal, fmt.Sprintf("%s: expected %t got %t\n", tc.desc, tc.equal, equal))
+		equal = tc.def.Equal(def)
+		assert.Equal(t, tc.equal, equal, fmt.Sprintf("%s: expected symmetric %t got %t\n", tc.desc, tc.equal, equal))
+	}
+}
+
+func TestUpdateTwinDependencies(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2, "rate"}, []string{attrSubtopic1, attrSubtopic2, attrSubtopic3})
+	def.Attributes[2].DerivativeOf = attrName1
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc       string
+		def        twins.Definition
+		dependents map[string][]string
+	}{
+		{
+			desc:       "remove source of derived attribute",
+			def:        twins.Definition{Attributes: []twins.Attribute{def.Attributes[1], def.Attributes[2]}},
+			dependents: map[string][]string{attrName1: {"rate"}},
+		},
+		{
+			desc: "remove attribute without dependents",
+			def:  twins.Definition{Attributes: []twins.Attribute{def.Attributes[0], def.Attributes[2]}},
+		},
+		{
+			desc: "remove source along with derived attribute",
+			def:  twins.Definition{Attributes: []twins.Attribute{def.Attributes[1]}},
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID}, tc.def)
+		if tc.dependents == nil {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+			continue
+		}
+		assert.True(t, errors.Is(err, twins.ErrDependencyExists), fmt.Sprintf("%s: expected %s got %s\n", tc.desc, twins.ErrDependencyExists, err))
+		de, ok := err.(*twins.DependencyError)
+		require.True(t, ok, fmt.Sprintf("%s: expected dependency error got %s\n", tc.desc, err))
+		assert.Equal(t, tc.dependents, de.Dependents, fmt.Sprintf("%s: expected dependents %v got %v\n", tc.desc, tc.dependents, de.Dependents))
+	}
+}
+
+func TestLinkTwinInput(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	var sources []twins.Twin
+	var defs []twins.Definition
+	for i := 0; i < 2; i++ {
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{}, def)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		sources = append(sources, tw)
+		defs = append(defs, def)
+	}
+	target, err := svc.AddTwin(context.Background(), token, twins.Twin{}, mocks.CreateDefinition([]string{attrName2}, []string{attrSubtopic2}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	chained, err := svc.AddTwin(context.Background(), token, twins.Twin{}, mocks.CreateDefinition([]string{attrName3}, []string{attrSubtopic3}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc       string
+		token      string
+		target     string
+		targetAttr string
+		source     string
+		sourceAttr string
+		err        error
+	}{
+		{
+			desc:       "link input of first source",
+			token:      token,
+			target:     target.ID,
+			targetAttr: attrName2,
+			source:     sources[0].ID,
+			sourceAttr: attrName1,
+			err:        nil,
+		},
+		{
+			desc:       "link input of second source",
+			token:      token,
+			target:     target.ID,
+			targetAttr: attrName2,
+			source:     sources[1].ID,
+			sourceAttr: attrName1,
+			err:        nil,
+		},
+		{
+			desc:       "link input of linked twin",
+			token:      token,
+			target:     chained.ID,
+			targetAttr: attrName3,
+			source:     target.ID,
+			sourceAttr: attrName2,
+			err:        nil,
+		},
+		{
+			desc:       "link input with wrong token",
+			token:      wrongToken,
+			target:     target.ID,
+			targetAttr: attrName2,
+			source:     sources[0].ID,
+			sourceAttr: attrName1,
+			err:        twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:       "link input of non-existent twin",
+			token:      token,
+			target:     "missing",
+			targetAttr: attrName2,
+			source:     sources[0].ID,
+			sourceAttr: attrName1,
+			err:        twins.ErrNotFound,
+		},
+		{
+			desc:       "link input of twin to itself",
+			token:      token,
+			target:     target.ID,
+			targetAttr: attrName2,
+			source:     target.ID,
+			sourceAttr: attrName2,
+			err:        twins.ErrMalformedEntity,
+		},
+		{
+			desc:       "link input introducing cycle",
+			token:      token,
+			target:     sources[0].ID,
+			targetAttr: attrName1,
+			source:     chained.ID,
+			sourceAttr: attrName3,
+			err:        twins.ErrMalformedEntity,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.LinkTwinInput(context.Background(), tc.token, tc.target, tc.targetAttr, tc.source, tc.sourceAttr, twins.ValueField)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+
+	invalid := []struct {
+		desc        string
+		targetAttr  string
+		source      string
+		sourceAttr  string
+		sourceField twins.Field
+	}{
+		{
+			desc:       "link input of unknown attribute",
+			targetAttr: "unknown",
+			source:     sources[0].ID,
+			sourceAttr: attrName1,
+		},
+		{
+			desc:       "link input of unknown source twin",
+			targetAttr: attrName2,
+			source:     "missing",
+			sourceAttr: attrName1,
+		},
+		{
+			desc:       "link input of unknown source attribute",
+			targetAttr: attrName2,
+			source:     sources[0].ID,
+			sourceAttr: "unknown",
+		},
+		{
+			desc:        "link input of unknown source field",
+			targetAttr:  attrName2,
+			source:      sources[0].ID,
+			sourceAttr:  attrName1,
+			sourceField: "mean",
+		},
+	}
+
+	for _, tc := range invalid {
+		err := svc.LinkTwinInput(context.Background(), token, target.ID, tc.targetAttr, tc.source, tc.sourceAttr, tc.sourceField)
+		_, ok := err.(*twins.ValidationError)
+		assert.True(t, ok, fmt.Sprintf("%s: expected validation error got %s\n", tc.desc, err))
+	}
+
+	for i, v := range []float64{10, 20} {
+		val := v
+		message, err := mocks.CreateMessage(defs[i].Attributes[0], []senml.Record{{BaseName: attrName1, Value: &val}})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	for _, tc := range []struct {
+		desc string
+		id   string
+		attr string
+	}{
+		{desc: "compute linked attribute", id: target.ID, attr: attrName2},
+		{desc: "compute attribute linked to linked attribute", id: chained.ID, attr: attrName3},
+	} {
+		page, err := svc.ListStates(context.Background(), token, 0, 1, tc.id, twins.Strong, twins.Desc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected state\n", tc.desc))
+		v, ok := toFloat(page.States[0].Payload[tc.attr])
+		assert.True(t, ok, fmt.Sprintf("%s: expected numeric value\n", tc.desc))
+		assert.Equal(t, 15.0, v, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, 15.0, v))
+	}
+}
+
+func TestUpdateTwinsMetadata(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+	def := twins.Definition{}
+
+	n := 5
+	var ids []string
+	for i := 0; i < n; i++ {
+		model := "sensor"
+		if i%2 == 0 {
+			model = "gateway"
+		}
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"model": model}}, def)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s\n", err))
+		ids = append(ids, tw.ID)
+	}
+
+	cases := []struct {
+		desc    string
+		token   string
+		filter  twins.Metadata
+		patch   twins.Metadata
+		updated uint64
+		err     error
+	}{
+		{
+			desc:    "update metadata of matching twins",
+			token:   token,
+			filter:  twins.Metadata{"model": "gateway"},
+			patch:   twins.Metadata{"firmware": "v2"},
+			updated: 3,
+			err:     nil,
+		},
+		{
+			desc:    "update metadata with filter matching no twins",
+			token:   token,
+			filter:  twins.Metadata{"model": "camera"},
+			patch:   twins.Metadata{"firmware": "v2"},
+			updated: 0,
+			err:     nil,
+		},
+		{
+			desc:    "update metadata with empty filter",
+			token:   token,
+			filter:  twins.Metadata{},
+			patch:   twins.Metadata{"firmware": "v2"},
+			updated: 0,
+			err:     twins.ErrMalformedEntity,
+		},
+		{
+			desc:    "update metadata with wrong credentials",
+			token:   wrongToken,
+			filter:  twins.Metadata{"model": "gateway"},
+			patch:   twins.Metadata{"firmware": "v2"},
+			updated: 0,
+			err:     twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		updated, err := svc.UpdateTwinsMetadata(context.Background(), tc.token, tc.filter, tc.patch)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.updated, updated, fmt.Sprintf("%s: expected %d got %d\n", tc.desc, tc.updated, updated))
+	}
+
+	for i, id := range ids {
+		tw, err := svc.ViewTwin(context.Background(), token, id)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s\n", err))
+		if i%2 == 0 {
+			assert.Equal(t, "v2", tw.Metadata["firmware"], fmt.Sprintf("expected patched metadata for twin %s\n", id))
+			assert.Equal(t, "gateway", tw.Metadata["model"], fmt.Sprintf("expected preserved metadata for twin %s\n", id))
+			continue
+		}
+		assert.Nil(t, tw.Metadata["firmware"], fmt.Sprintf("expected unpatched metadata for twin %s\n", id))
+	}
+}
+
 func TestListTwins(t *testing.T) {
 	svc := mocks.NewService(map[string]string{token: email})
 	twin := twins.Twin{Name: twinName, Owner: email}
@@ -203,13 +822,53 @@ func TestListTwins(t *testing.T) {
 	}
 
 	for desc, tc := range cases {
-		page, err := svc.ListTwins(context.Background(), tc.token, tc.offset, tc.limit, twinName, tc.metadata)
+		page, err := svc.ListTwins(context.Background(), tc.token, tc.offset, tc.limit, twinName, tc.metadata, false)
 		size := uint64(len(page.Twins))
 		assert.Equal(t, tc.size, size, fmt.Sprintf("%s: expected %d got %d\n", desc, tc.size, size))
 		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", desc, tc.err, err))
 	}
 }
 
+func TestListTwinsDefinitions(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Name: twinName, Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	def = mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc            string
+		omitDefinitions bool
+		attributes      []int
+	}{
+		{
+			desc:            "list twins with definition history",
+			omitDefinitions: false,
+			attributes:      []int{1, 2},
+		},
+		{
+			desc:            "list twins without definitions",
+			omitDefinitions: true,
+			attributes:      []int{},
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.ListTwins(context.Background(), token, 0, 10, twinName, nil, tc.omitDefinitions)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.Twins, 1, fmt.Sprintf("%s: expected 1 twin got %d\n", tc.desc, len(page.Twins)))
+		defs := page.Twins[0].Definitions
+		require.Len(t, defs, len(tc.attributes), fmt.Sprintf("%s: expected %d definitions got %d\n", tc.desc, len(tc.attributes), len(defs)))
+		for i, def := range defs {
+			assert.Len(t, def.Attributes, tc.attributes[i], fmt.Sprintf("%s: expected %d attributes in definition %d got %d\n", tc.desc, tc.attributes[i], i, len(def.Attributes)))
+		}
+	}
+}
+
 func TestRemoveTwin(t *testing.T) {
 	svc := mocks.NewService(map[string]string{token: email})
 	twin := twins.Twin{}
@@ -250,20 +909,255 @@ func TestRemoveTwin(t *testing.T) {
 	}
 
 	for _, tc := range cases {
-		err := svc.RemoveTwin(context.Background(), tc.token, tc.id)
+		err := svc.RemoveTwin(context.Background(), tc.token, tc.id, false)
 		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
 	}
 }
 
-func TestSaveStates(t *testing.T) {
-	svc := mocks.NewService(map[string]string{token: email})
-
-	twin := twins.Twin{Owner: email}
-	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
-	attr := def.Attributes[0]
-	attrSansTwin := mocks.CreateDefinition([]string{attrName3}, []string{attrSubtopic3}).Attributes[0]
-	tw, err := svc.AddTwin(context.Background(), token, twin, def)
-	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+func TestRemoveTwinCascade(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	statesRepo := mocks.NewStateRepository()
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), statesRepo, uuid.NewMock(), "chanID", twins.Config{}, nil)
+
+	cases := []struct {
+		desc    string
+		cascade bool
+		states  int
+	}{
+		{
+			desc:    "remove twin retaining states",
+			cascade: false,
+			states:  numRecs,
+		},
+		{
+			desc:    "remove twin with states",
+			cascade: true,
+			states:  0,
+		},
+	}
+
+	for _, tc := range cases {
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(numRecs, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		err = svc.AnnotateState(context.Background(), token, tw.ID, 0, "note")
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		err = svc.RemoveTwin(context.Background(), token, tw.ID, tc.cascade)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+
+		page, err := statesRepo.RetrieveAll(context.Background(), 0, numRecs, tw.ID, twins.Strong, twins.Asc)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Len(t, page.States, tc.states, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.states, len(page.States)))
+
+		err = svc.RemoveTwin(context.Background(), token, tw.ID, true)
+		assert.Equal(t, twins.ErrNotFound, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, twins.ErrNotFound, err))
+	}
+}
+
+// failingRemoveStateRepository fails the given number of state removals.
+type failingRemoveStateRepository struct {
+	twins.StateRepository
+	failures *int
+}
+
+func (fsr failingRemoveStateRepository) RemoveAll(ctx context.Context, twinID string) error {
+	if *fsr.failures > 0 {
+		*fsr.failures--
+		return errors.New("failed to remove states")
+	}
+	return fsr.StateRepository.RemoveAll(ctx, twinID)
+}
+
+// failingRemoveTwinRepository fails the given number of twin removals.
+type failingRemoveTwinRepository struct {
+	twins.TwinRepository
+	failures *int
+}
+
+func (ftr failingRemoveTwinRepository) Remove(ctx context.Context, id string) error {
+	if *ftr.failures > 0 {
+		*ftr.failures--
+		return errors.New("failed to remove twin")
+	}
+	return ftr.TwinRepository.Remove(ctx, id)
+}
+
+func TestRemoveTwinCascadeFailure(t *testing.T) {
+	cases := []struct {
+		desc          string
+		stateFailures int
+		twinFailures  int
+		states        int
+	}{
+		{
+			desc:          "remove twin failing to remove states",
+			stateFailures: 1,
+			states:        numRecs,
+		},
+		{
+			desc:         "remove twin failing to remove twin after its states",
+			twinFailures: 1,
+			states:       0,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		stateFailures, twinFailures := tc.stateFailures, tc.twinFailures
+		statesRepo := failingRemoveStateRepository{StateRepository: mocks.NewStateRepository(), failures: &stateFailures}
+		twinsRepo := failingRemoveTwinRepository{TwinRepository: mocks.NewTwinRepository(), failures: &twinFailures}
+		svc := twins.New(broker, auth, twinsRepo, statesRepo, uuid.NewMock(), "chanID", twins.Config{}, nil)
+
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(numRecs, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		err = svc.RemoveTwin(context.Background(), token, tw.ID, true)
+		assert.NotNil(t, err, fmt.Sprintf("%s: expected error got nil\n", tc.desc))
+
+		// The twin is removed last, so it's left in place by the failure.
+		_, err = svc.ViewTwin(context.Background(), token, tw.ID)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		page, err := statesRepo.RetrieveAll(context.Background(), 0, numRecs, tw.ID, twins.Strong, twins.Asc)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Len(t, page.States, tc.states, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.states, len(page.States)))
+
+		err = svc.RemoveTwin(context.Background(), token, tw.ID, true)
+		assert.Nil(t, err, fmt.Sprintf("%s: retry: unexpected error: %s\n", tc.desc, err))
+
+		_, err = svc.ViewTwin(context.Background(), token, tw.ID)
+		assert.Equal(t, twins.ErrNotFound, err, fmt.Sprintf("%s: retry: expected %s got %s\n", tc.desc, twins.ErrNotFound, err))
+		page, err = statesRepo.RetrieveAll(context.Background(), 0, numRecs, tw.ID, twins.Strong, twins.Asc)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Len(t, page.States, 0, fmt.Sprintf("%s: retry: expected no states got %d\n", tc.desc, len(page.States)))
+	}
+}
+
+func TestArchiveTwin(t *testing.T) {
+	otherToken, otherEmail := "other-token", "other@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: otherEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	statesRepo := mocks.NewStateRepository()
+	archive := mocks.NewArchiveStore()
+	cfg := twins.Config{Archive: archive}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), statesRepo, uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	// More states than are retrieved at once while archiving.
+	n := numRecs + numRecs/2
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(n, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc    string
+		restore bool
+		token   string
+		twins   uint64
+		states  int
+		err     error
+	}{
+		{
+			desc:   "archive twin with wrong credentials",
+			token:  wrongToken,
+			twins:  1,
+			states: n,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "archive twin",
+			token:  token,
+			twins:  0,
+			states: 0,
+			err:    nil,
+		},
+		{
+			desc:   "archive archived twin",
+			token:  token,
+			twins:  0,
+			states: 0,
+			err:    twins.ErrNotFound,
+		},
+		{
+			desc:    "restore twin archived by other user",
+			restore: true,
+			token:   otherToken,
+			twins:   0,
+			states:  0,
+			err:     twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:    "restore archived twin",
+			restore: true,
+			token:   token,
+			twins:   1,
+			states:  n,
+			err:     nil,
+		},
+		{
+			desc:    "restore restored twin",
+			restore: true,
+			token:   token,
+			twins:   1,
+			states:  n,
+			err:     twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		var err error
+		if tc.restore {
+			err = svc.RestoreArchivedTwin(context.Background(), tc.token, tw.ID)
+		} else {
+			err = svc.ArchiveTwin(context.Background(), tc.token, tw.ID)
+		}
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		page, err := svc.ListTwins(context.Background(), token, 0, 10, "", nil, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.twins, page.Total, fmt.Sprintf("%s: expected %d twins got %d\n", tc.desc, tc.twins, page.Total))
+
+		sts, err := statesRepo.RetrieveAll(context.Background(), 0, uint64(n), tw.ID, twins.Strong, twins.Asc)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Len(t, sts.States, tc.states, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.states, len(sts.States)))
+	}
+
+	err = archive.Save(context.Background(), twins.Archive{Twin: tw})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	err = svc.RestoreArchivedTwin(context.Background(), token, tw.ID)
+	assert.Equal(t, twins.ErrConflict, err, fmt.Sprintf("restore twin over existing twin: expected %s got %s\n", twins.ErrConflict, err))
+
+	svc = newService(map[string]string{token: email})
+	err = svc.ArchiveTwin(context.Background(), token, tw.ID)
+	assert.Equal(t, twins.ErrArchiveUnavailable, err, fmt.Sprintf("archive twin without archive store: expected %s got %s\n", twins.ErrArchiveUnavailable, err))
+}
+
+func TestSaveStates(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	twin := twins.Twin{Owner: email}
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	attr := def.Attributes[0]
+	attrSansTwin := mocks.CreateDefinition([]string{attrName3}, []string{attrSubtopic3}).Attributes[0]
+	tw, err := svc.AddTwin(context.Background(), token, twin, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
 
 	recs := mocks.CreateSenML(numRecs, attrName1)
 	var ttlAdded uint64
@@ -309,19 +1203,95 @@ func TestSaveStates(t *testing.T) {
 		message, err := mocks.CreateMessage(tc.attr, tc.recs)
 		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
 
-		err = svc.SaveStates(message)
+		_, err = svc.SaveStates(message)
 		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
 
 		ttlAdded += tc.size
-		page, err := svc.ListStates(context.TODO(), token, 0, 10, tw.ID)
+		page, err := svc.ListStates(context.TODO(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
 		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
 		assert.Equal(t, ttlAdded, page.Total, fmt.Sprintf("%s: expected %d total got %d total\n", tc.desc, ttlAdded, page.Total))
 	}
 }
 
-func TestListStates(t *testing.T) {
+func TestSaveStatesBatch(t *testing.T) {
 	svc := mocks.NewService(map[string]string{token: email})
 
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attrSansTwin := mocks.CreateDefinition([]string{attrName3}, []string{attrSubtopic3}).Attributes[0]
+
+	recs := mocks.CreateSenML(numRecs, attrName1)
+	first, err := mocks.CreateMessage(def.Attributes[0], recs[:10])
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	second, err := mocks.CreateMessage(def.Attributes[0], recs[10:30])
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	sansTwin, err := mocks.CreateMessage(attrSansTwin, recs[30:40])
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	malformed, err := mocks.CreateMessage(def.Attributes[1], recs[40:50])
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	malformed.Payload = []byte("malformed")
+
+	cases := []struct {
+		desc  string
+		msgs  []*messaging.Message
+		saved []uint64
+		total uint64
+		err   map[string]error
+	}{
+		{
+			desc:  "save states from messages sharing subject",
+			msgs:  []*messaging.Message{first, second},
+			saved: []uint64{10, 20},
+			total: 30,
+		},
+		{
+			desc:  "save states from messages some of which fail",
+			msgs:  []*messaging.Message{sansTwin, first, malformed},
+			saved: []uint64{0, 10, 0},
+			total: 40,
+			err: map[string]error{
+				"0": twins.ErrNotFound,
+				"2": twins.ErrMalformedEntity,
+			},
+		},
+		{
+			desc:  "save states from no messages",
+			msgs:  []*messaging.Message{},
+			saved: []uint64{},
+			total: 40,
+		},
+	}
+
+	for _, tc := range cases {
+		res, err := svc.SaveStatesBatch(context.Background(), tc.msgs)
+		require.Len(t, res, len(tc.msgs), fmt.Sprintf("%s: expected %d results got %d\n", tc.desc, len(tc.msgs), len(res)))
+		for i, r := range res {
+			assert.Equal(t, tc.saved[i], r.Saved, fmt.Sprintf("%s: expected message %d to save %d got %d\n", tc.desc, i, tc.saved[i], r.Saved))
+		}
+
+		switch tc.err {
+		case nil:
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		default:
+			be, ok := err.(*twins.BatchError)
+			require.True(t, ok, fmt.Sprintf("%s: expected batch error got %s\n", tc.desc, err))
+			require.Len(t, be.Errors, len(tc.err), fmt.Sprintf("%s: expected %d errors got %d\n", tc.desc, len(tc.err), len(be.Errors)))
+			for i, expected := range tc.err {
+				assert.True(t, errors.Is(be.Errors[i], expected), fmt.Sprintf("%s: expected message %s to fail with %s got %s\n", tc.desc, i, expected, be.Errors[i]))
+			}
+		}
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		assert.Equal(t, tc.total, page.Total, fmt.Sprintf("%s: expected %d total got %d total\n", tc.desc, tc.total, page.Total))
+	}
+}
+
+func TestListStates(t *testing.T) {
+	otherToken := "other-token"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: "other@example.com"})
+
 	twin := twins.Twin{Owner: email}
 	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
 	attr := def.Attributes[0]
@@ -336,7 +1306,7 @@ func TestListStates(t *testing.T) {
 	recs := mocks.CreateSenML(numRecs, attrName1)
 	message, err := mocks.CreateMessage(attr, recs)
 	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
-	err = svc.SaveStates(message)
+	_, err = svc.SaveStates(message)
 	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
 
 	cases := []struct {
@@ -393,6 +1363,15 @@ func TestListStates(t *testing.T) {
 			size:   0,
 			err:    twins.ErrUnauthorizedAccess,
 		},
+		{
+			desc:   "get a list with token of user not owning the twin",
+			id:     tw.ID,
+			token:  otherToken,
+			offset: 0,
+			limit:  10,
+			size:   0,
+			err:    twins.ErrUnauthorizedAccess,
+		},
 		{
 			desc:   "get a list with id of non-existent twin",
 			id:     "1234567890",
@@ -400,7 +1379,7 @@ func TestListStates(t *testing.T) {
 			offset: 0,
 			limit:  10,
 			size:   0,
-			err:    nil,
+			err:    twins.ErrNotFound,
 		},
 		{
 			desc:   "get a list with id of existing twin without states ",
@@ -414,8 +1393,5984 @@ func TestListStates(t *testing.T) {
 	}
 
 	for _, tc := range cases {
-		page, err := svc.ListStates(context.TODO(), tc.token, tc.offset, tc.limit, tc.id)
+		page, err := svc.ListStates(context.TODO(), tc.token, tc.offset, tc.limit, tc.id, twins.Strong, twins.Asc, false)
 		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
 		assert.Equal(t, tc.size, len(page.States), fmt.Sprintf("%s: expected %d total got %d total\n", tc.desc, tc.size, len(page.States)))
 	}
 }
+
+func TestListStatesConsistency(t *testing.T) {
+	lag := 5
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	statesRepo := mocks.NewReplicatedStateRepository(lag)
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), statesRepo, uuid.NewMock(), "chanID", twins.Config{}, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	n := 10
+	message, err := mocks.CreateMessage(attr, mocks.CreateSenML(n, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		consistency twins.Consistency
+		size        int
+	}{
+		{
+			desc:        "list states with strong consistency",
+			consistency: twins.Strong,
+			size:        n,
+		},
+		{
+			desc:        "list states with eventual consistency",
+			consistency: twins.Eventual,
+			size:        n - lag,
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.ListStates(context.TODO(), token, 0, uint64(n), tw.ID, tc.consistency, twins.Asc, false)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		assert.Equal(t, tc.size, len(page.States), fmt.Sprintf("%s: expected %d states got %d states\n", tc.desc, tc.size, len(page.States)))
+	}
+}
+
+func TestVerifyStateChain(t *testing.T) {
+	otherToken := "other-token"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: "other@example.com"})
+	statesRepo := mocks.NewStateRepository()
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), statesRepo, uuid.NewMock(), "chanID", twins.Config{}, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	empty, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(attr, mocks.CreateSenML(numRecs, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	intact, broken, err := svc.VerifyStateChain(context.Background(), token, tw.ID)
+	assert.Nil(t, err, fmt.Sprintf("verify intact chain: unexpected error: %s\n", err))
+	assert.True(t, intact, "verify intact chain: expected intact chain\n")
+	assert.Equal(t, int64(-1), broken, fmt.Sprintf("verify intact chain: expected -1 got %d\n", broken))
+
+	tampered := int64(42)
+	page, err := statesRepo.RetrieveAll(context.Background(), uint64(tampered), 1, tw.ID, twins.Strong, twins.Asc)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Len(t, page.States, 1)
+	st := page.States[0]
+	st.Payload = map[string]interface{}{attrName1: "tampered"}
+	err = statesRepo.Update(context.Background(), st)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		id     string
+		token  string
+		intact bool
+		broken int64
+		err    error
+	}{
+		{
+			desc:   "verify tampered chain",
+			id:     tw.ID,
+			token:  token,
+			intact: false,
+			broken: tampered,
+			err:    nil,
+		},
+		{
+			desc:   "verify chain of twin without states",
+			id:     empty.ID,
+			token:  token,
+			intact: true,
+			broken: -1,
+			err:    nil,
+		},
+		{
+			desc:   "verify chain with wrong credentials",
+			id:     tw.ID,
+			token:  wrongToken,
+			intact: false,
+			broken: 0,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "verify chain of twin owned by other user",
+			id:     tw.ID,
+			token:  otherToken,
+			intact: false,
+			broken: 0,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "verify chain of non-existent twin",
+			id:     wrongID,
+			token:  token,
+			intact: false,
+			broken: 0,
+			err:    twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		intact, broken, err := svc.VerifyStateChain(context.Background(), tc.token, tc.id)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.intact, intact, fmt.Sprintf("%s: expected %t got %t\n", tc.desc, tc.intact, intact))
+		assert.Equal(t, tc.broken, broken, fmt.Sprintf("%s: expected %d got %d\n", tc.desc, tc.broken, broken))
+	}
+}
+
+func TestSaveStatesCaseInsensitive(t *testing.T) {
+	def := mocks.CreateDefinition([]string{attrName1}, []string{"Engine/Temp"})
+	attr := def.Attributes[0]
+
+	cases := []struct {
+		desc            string
+		caseInsensitive bool
+		subtopic        string
+		size            int
+		err             error
+	}{
+		{
+			desc:            "save states with exact subtopic and case-sensitive matching",
+			caseInsensitive: false,
+			subtopic:        "Engine/Temp",
+			size:            10,
+			err:             nil,
+		},
+		{
+			desc:            "save states with mixed-case subtopic and case-sensitive matching",
+			caseInsensitive: false,
+			subtopic:        "engine/TEMP",
+			size:            0,
+			err:             twins.ErrNotFound,
+		},
+		{
+			desc:            "save states with mixed-case subtopic and case-insensitive matching",
+			caseInsensitive: true,
+			subtopic:        "engine/TEMP",
+			size:            10,
+			err:             nil,
+		},
+		{
+			desc:            "save states with lower-case subtopic and case-insensitive matching",
+			caseInsensitive: true,
+			subtopic:        "engine/temp",
+			size:            10,
+			err:             nil,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{CaseInsensitiveMatch: tc.caseInsensitive}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		msgAttr := attr
+		msgAttr.Subtopic = tc.subtopic
+		message, err := mocks.CreateMessage(msgAttr, mocks.CreateSenML(10, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		_, err = svc.SaveStates(message)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		page, err := svc.ListStates(context.TODO(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.size, len(page.States), fmt.Sprintf("%s: expected %d states got %d states\n", tc.desc, tc.size, len(page.States)))
+	}
+}
+
+func TestTwinChannelBinding(t *testing.T) {
+	svc := newService(map[string]string{token: email})
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+
+	cases := []struct {
+		desc      string
+		channelID string
+		size      int
+	}{
+		{
+			desc:      "save states of twin bound to message channel",
+			channelID: attr.Channel,
+			size:      10,
+		},
+		{
+			desc:      "save states of twin bound to other channel",
+			channelID: "other",
+			size:      0,
+		},
+		{
+			desc:      "save states of unbound twin",
+			channelID: "",
+			size:      10,
+		},
+	}
+
+	var ids []string
+	for _, tc := range cases {
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, ChannelID: tc.channelID}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		ids = append(ids, tw.ID)
+	}
+
+	message, err := mocks.CreateMessage(attr, mocks.CreateSenML(10, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for i, tc := range cases {
+		page, err := svc.ListStates(context.Background(), token, 0, 10, ids[i], twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.size, len(page.States), fmt.Sprintf("%s: expected %d states got %d states\n", tc.desc, tc.size, len(page.States)))
+	}
+}
+
+func TestListChannelStates(t *testing.T) {
+	otherToken := "other-token"
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].Access = "secret"
+	attr := def.Attributes[0]
+
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: "other@example.com"})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{Things: mocks.NewThingVerifier(map[string]string{attr.Channel: token})}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	own, err := svc.AddTwin(context.Background(), token, twins.Twin{ChannelID: attr.Channel}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	other, err := svc.AddTwin(context.Background(), otherToken, twins.Twin{ChannelID: attr.Channel}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	value := 1.0
+	recs := mocks.CreateSenML(3, attrName1)
+	for i := range recs {
+		recs[i].Value = &value
+	}
+	message, err := mocks.CreateMessage(attr, recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc      string
+		token     string
+		channelID string
+		offset    uint64
+		limit     uint64
+		size      int
+		total     uint64
+		err       error
+	}{
+		{
+			desc:      "list states of channel",
+			token:     token,
+			channelID: attr.Channel,
+			limit:     10,
+			size:      6,
+			total:     6,
+			err:       nil,
+		},
+		{
+			desc:      "list states of channel with offset and limit",
+			token:     token,
+			channelID: attr.Channel,
+			offset:    1,
+			limit:     2,
+			size:      2,
+			total:     6,
+			err:       nil,
+		},
+		{
+			desc:      "list states of channel with wrong token",
+			token:     wrongToken,
+			channelID: attr.Channel,
+			limit:     10,
+			err:       twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:      "list states of channel the user can't access",
+			token:     otherToken,
+			channelID: attr.Channel,
+			limit:     10,
+			err:       twins.ErrNotFound,
+		},
+		{
+			desc:      "list states of non-existent channel",
+			token:     token,
+			channelID: "missing",
+			limit:     10,
+			err:       twins.ErrNotFound,
+		},
+		{
+			desc:      "list states of empty channel id",
+			token:     token,
+			channelID: "",
+			limit:     10,
+			err:       twins.ErrMalformedEntity,
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.ListChannelStates(context.Background(), tc.token, tc.channelID, tc.offset, tc.limit)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.size, len(page.States), fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.size, len(page.States)))
+		assert.Equal(t, tc.total, page.Total, fmt.Sprintf("%s: expected total %d got %d\n", tc.desc, tc.total, page.Total))
+	}
+
+	page, err := svc.ListChannelStates(context.Background(), token, attr.Channel, 0, 10)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	for i, st := range page.States {
+		if i > 0 {
+			assert.False(t, st.Created.After(page.States[i-1].Created), fmt.Sprintf("expected state %d not to be newer than the previous one\n", i))
+		}
+		switch st.TwinID {
+		case own.ID:
+			assert.Contains(t, st.Payload, attrName1, "expected attribute of own twin to be listed\n")
+		case other.ID:
+			assert.NotContains(t, st.Payload, attrName1, "expected hidden attribute of other twin to be omitted\n")
+		default:
+			t.Errorf("unexpected state of twin %s not bound to the channel", st.TwinID)
+		}
+	}
+
+	// Without thing verification only states of the user's own twins are
+	// listed.
+	svc = twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", twins.Config{}, nil)
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{ChannelID: attr.Channel}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), otherToken, twins.Twin{ChannelID: attr.Channel}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	page, err = svc.ListChannelStates(context.Background(), token, attr.Channel, 0, 10)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(3), page.Total, fmt.Sprintf("list states of own twins: expected total 3 got %d\n", page.Total))
+}
+
+func TestListMaxPageLimit(t *testing.T) {
+	maxLimit := uint64(20)
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{MaxPageLimit: maxLimit}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Name: twinName}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc  string
+		limit uint64
+		err   error
+	}{
+		{
+			desc:  "list with limit below max",
+			limit: maxLimit - 1,
+			err:   nil,
+		},
+		{
+			desc:  "list with limit equal to max",
+			limit: maxLimit,
+			err:   nil,
+		},
+		{
+			desc:  "list with limit above max",
+			limit: maxLimit + 1,
+			err:   twins.ErrLimitExceeded,
+		},
+		{
+			desc:  "list with max uint64 limit",
+			limit: math.MaxUint64,
+			err:   twins.ErrLimitExceeded,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := svc.ListTwins(context.Background(), token, 0, tc.limit, twinName, nil, false)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("list twins %s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		_, err = svc.ListStates(context.Background(), token, 0, tc.limit, tw.ID, twins.Strong, twins.Asc, false)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("list states %s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+}
+
+func TestTwinStatus(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+
+	active, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	message, err := mocks.CreateMessage(attr, mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	staleDef := mocks.CreateDefinition([]string{attrName2}, []string{attrSubtopic2})
+	staleAttr := staleDef.Attributes[0]
+	stale, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Heartbeat: time.Minute}, staleDef)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	recs := mocks.CreateSenML(1, attrName2)
+	recs[0].BaseTime = float64(time.Now().Add(-time.Hour).Unix())
+	message, err = mocks.CreateMessage(staleAttr, recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	silent, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc     string
+		id       string
+		token    string
+		online   bool
+		lastSeen bool
+		err      error
+	}{
+		{
+			desc:     "status of twin with recent state",
+			id:       active.ID,
+			token:    token,
+			online:   true,
+			lastSeen: true,
+			err:      nil,
+		},
+		{
+			desc:     "status of twin with state older than heartbeat",
+			id:       stale.ID,
+			token:    token,
+			online:   false,
+			lastSeen: true,
+			err:      nil,
+		},
+		{
+			desc:     "status of twin without states",
+			id:       silent.ID,
+			token:    token,
+			online:   false,
+			lastSeen: false,
+			err:      nil,
+		},
+		{
+			desc:  "status with wrong credentials",
+			id:    active.ID,
+			token: wrongToken,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "status of non-existing twin",
+			id:    wrongID,
+			token: token,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		online, lastSeen, err := svc.TwinStatus(context.Background(), tc.token, tc.id)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.online, online, fmt.Sprintf("%s: expected %t got %t\n", tc.desc, tc.online, online))
+		assert.Equal(t, tc.lastSeen, !lastSeen.IsZero(), fmt.Sprintf("%s: expected last seen %t got %t\n", tc.desc, tc.lastSeen, !lastSeen.IsZero()))
+	}
+
+	page, err := svc.ListTwinsByStatus(context.Background(), token, 0, 10, true)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(1), page.Total, fmt.Sprintf("list online twins: expected total 1 got %d\n", page.Total))
+
+	page, err = svc.ListTwinsByStatus(context.Background(), token, 0, 10, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(2), page.Total, fmt.Sprintf("list offline twins: expected total 2 got %d\n", page.Total))
+
+	page, err = svc.ListTwinsByStatus(context.Background(), token, 1, 10, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Len(t, page.Twins, 1, fmt.Sprintf("list offline twins with offset: expected 1 twin got %d\n", len(page.Twins)))
+
+	_, err = svc.ListTwinsByStatus(context.Background(), wrongToken, 0, 10, false)
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("list by status with wrong credentials: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+}
+
+func TestLastError(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	failing, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	healthy, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, mocks.CreateDefinition([]string{attrName2}, []string{attrSubtopic2}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	message.Payload = []byte("malformed")
+	_, saveErr := svc.SaveStates(message)
+	require.NotNil(t, saveErr, "expected error saving malformed message")
+
+	tw, err := svc.ViewTwin(context.Background(), token, failing.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, saveErr.Error(), tw.LastError, fmt.Sprintf("expected last error %s got %s\n", saveErr, tw.LastError))
+	assert.False(t, tw.LastErrorAt.IsZero(), "expected last error time to be set")
+
+	tw, err = svc.ViewTwin(context.Background(), token, healthy.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Empty(t, tw.LastError, fmt.Sprintf("expected no last error got %s\n", tw.LastError))
+
+	page, err := svc.ListTwinsWithErrors(context.Background(), token, 0, 10, time.Hour)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Len(t, page.Twins, 1, fmt.Sprintf("list twins with errors: expected 1 twin got %d\n", len(page.Twins)))
+	assert.Equal(t, failing.ID, page.Twins[0].ID, fmt.Sprintf("list twins with errors: expected %s got %s\n", failing.ID, page.Twins[0].ID))
+
+	time.Sleep(2 * time.Millisecond)
+	page, err = svc.ListTwinsWithErrors(context.Background(), token, 0, 10, time.Millisecond)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(0), page.Total, fmt.Sprintf("list twins with errors outside window: expected total 0 got %d\n", page.Total))
+
+	_, err = svc.ListTwinsWithErrors(context.Background(), wrongToken, 0, 10, time.Hour)
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("list twins with errors with wrong credentials: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+}
+
+func TestSaveStatesGzip(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	recs := mocks.CreateSenML(numRecs, attrName1)
+	message, err := mocks.CreateMessage(attr, recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(message.Payload)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Nil(t, zw.Close(), "unexpected error closing gzip writer")
+	compressed := buf.Bytes()
+
+	cases := []struct {
+		desc    string
+		payload []byte
+		size    uint64
+		err     error
+	}{
+		{
+			desc:    "save states from gzip-compressed payload",
+			payload: compressed,
+			size:    numRecs,
+			err:     nil,
+		},
+		{
+			desc:    "save states from corrupt gzip-compressed payload",
+			payload: append([]byte{0x1f, 0x8b}, compressed[10:]...),
+			size:    numRecs,
+			err:     twins.ErrMalformedEntity,
+		},
+		{
+			desc:    "save states from truncated gzip-compressed payload",
+			payload: compressed[:len(compressed)/2],
+			size:    numRecs,
+			err:     twins.ErrMalformedEntity,
+		},
+	}
+
+	for _, tc := range cases {
+		msg := *message
+		msg.Payload = tc.payload
+		_, err := svc.SaveStates(&msg)
+		assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.size, page.Total, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.size, page.Total))
+	}
+}
+
+func TestSaveStatesContentEncoding(t *testing.T) {
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(numRecs, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(message.Payload)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Nil(t, zw.Close(), "unexpected error closing gzip writer")
+	compressed := buf.Bytes()
+
+	cases := []struct {
+		desc     string
+		encoding string
+		limit    int
+		payload  []byte
+		size     uint64
+		err      error
+	}{
+		{
+			desc:     "save states from gzip payload within the decompressed size limit",
+			encoding: "gzip",
+			limit:    len(message.Payload),
+			payload:  compressed,
+			size:     numRecs,
+			err:      nil,
+		},
+		{
+			desc:     "save states from gzip payload exceeding the decompressed size limit",
+			encoding: "gzip",
+			limit:    len(message.Payload) - 1,
+			payload:  compressed,
+			size:     0,
+			err:      twins.ErrPayloadTooLarge,
+		},
+		{
+			desc:     "save states from sniffed gzip payload exceeding the decompressed size limit",
+			encoding: "",
+			limit:    len(message.Payload) - 1,
+			payload:  compressed,
+			size:     0,
+			err:      twins.ErrPayloadTooLarge,
+		},
+		{
+			desc:     "save states from uncompressed payload declared as gzip",
+			encoding: "gzip",
+			payload:  message.Payload,
+			size:     0,
+			err:      twins.ErrMalformedEntity,
+		},
+		{
+			desc:     "save states from gzip payload declared as identity",
+			encoding: "identity",
+			payload:  compressed,
+			size:     0,
+			err:      twins.ErrMalformedEntity,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{ContentEncoding: tc.encoding, MaxDecompressedSize: tc.limit}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		msg := *message
+		msg.Payload = tc.payload
+		_, err = svc.SaveStates(&msg)
+		assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.size, page.Total, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.size, page.Total))
+	}
+}
+
+func TestAttributeAliases(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[0].Aliases = []string{"gw1/engine", "gw2/motor"}
+
+	collision := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	collision.Attributes[1].Channel = collision.Attributes[0].Channel
+	collision.Attributes[1].Aliases = []string{attrSubtopic1}
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, collision)
+	assert.True(t, errors.Is(err, twins.ErrMalformedEntity), fmt.Sprintf("add twin with colliding alias: expected %s got %s\n", twins.ErrMalformedEntity, err))
+
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID}, collision)
+	assert.True(t, errors.Is(err, twins.ErrMalformedEntity), fmt.Sprintf("update twin with colliding alias: expected %s got %s\n", twins.ErrMalformedEntity, err))
+
+	attr := def.Attributes[0]
+	cases := []struct {
+		desc     string
+		subtopic string
+		size     uint64
+		err      error
+	}{
+		{
+			desc:     "save states with attribute subtopic",
+			subtopic: attr.Subtopic,
+			size:     1,
+			err:      nil,
+		},
+		{
+			desc:     "save states with first alias",
+			subtopic: "gw1/engine",
+			size:     2,
+			err:      nil,
+		},
+		{
+			desc:     "save states with second alias",
+			subtopic: "gw2/motor",
+			size:     3,
+			err:      nil,
+		},
+		{
+			desc:     "save states with unknown subtopic",
+			subtopic: "gw3/engine",
+			size:     3,
+			err:      twins.ErrNotFound,
+		},
+	}
+
+	for i, tc := range cases {
+		msgAttr := attr
+		msgAttr.Subtopic = tc.subtopic
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].Time = float64(i)
+		message, err := mocks.CreateMessage(msgAttr, recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		_, err = svc.SaveStates(message)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.size, page.Total, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.size, page.Total))
+	}
+}
+
+func TestLockTwin(t *testing.T) {
+	otherToken := "other-token"
+	otherEmail := "other@example.com"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: otherEmail})
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	update := twins.Twin{ID: tw.ID, Name: "updated"}
+
+	_, err = svc.LockTwin(context.Background(), token, tw.ID, 0)
+	assert.Equal(t, twins.ErrMalformedEntity, err, fmt.Sprintf("lock twin with zero ttl: expected %s got %s\n", twins.ErrMalformedEntity, err))
+
+	_, err = svc.LockTwin(context.Background(), token, wrongID, time.Minute)
+	assert.Equal(t, twins.ErrNotFound, err, fmt.Sprintf("lock non-existent twin: expected %s got %s\n", twins.ErrNotFound, err))
+
+	_, err = svc.LockTwin(context.Background(), wrongToken, tw.ID, time.Minute)
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("lock twin with wrong credentials: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+
+	key, err := svc.IssueTwinKey(context.Background(), token, tw.ID, twins.Write, time.Minute)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	writeKey := key.Value
+
+	lockToken, err := svc.LockTwin(context.Background(), token, tw.ID, time.Minute)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	locked := twins.WithLockToken(context.Background(), lockToken)
+	otherSession := twins.WithLockToken(context.Background(), "other-lock-token")
+
+	cases := []struct {
+		desc string
+		op   func() error
+		err  error
+	}{
+		{
+			desc: "extend lock with its token",
+			op: func() error {
+				extended, err := svc.LockTwin(locked, token, tw.ID, time.Minute)
+				if extended != lockToken {
+					return fmt.Errorf("expected lock token %s got %s", lockToken, extended)
+				}
+				return err
+			},
+			err: nil,
+		},
+		{
+			desc: "lock locked twin in another session of the holder",
+			op: func() error {
+				_, err := svc.LockTwin(context.Background(), token, tw.ID, time.Minute)
+				return err
+			},
+			err: twins.ErrLocked,
+		},
+		{
+			desc: "lock locked twin by user not owning it",
+			op: func() error {
+				_, err := svc.LockTwin(context.Background(), otherToken, tw.ID, time.Minute)
+				return err
+			},
+			err: twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "update locked twin with lock token",
+			op:   func() error { return svc.UpdateTwin(locked, token, update, twins.Definition{}) },
+			err:  nil,
+		},
+		{
+			desc: "update locked twin in another session of the holder",
+			op:   func() error { return svc.UpdateTwin(context.Background(), token, update, twins.Definition{}) },
+			err:  twins.ErrLocked,
+		},
+		{
+			desc: "update locked twin with wrong lock token",
+			op:   func() error { return svc.UpdateTwin(otherSession, token, update, twins.Definition{}) },
+			err:  twins.ErrLocked,
+		},
+		{
+			desc: "update locked twin with write key",
+			op:   func() error { return svc.UpdateTwin(context.Background(), writeKey, update, twins.Definition{}) },
+			err:  twins.ErrLocked,
+		},
+		{
+			desc: "update locked twin by user not owning it",
+			op:   func() error { return svc.UpdateTwin(locked, otherToken, update, twins.Definition{}) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "unlock twin without lock token",
+			op:   func() error { return svc.UnlockTwin(context.Background(), token, tw.ID) },
+			err:  twins.ErrLocked,
+		},
+		{
+			desc: "unlock twin by user not owning it",
+			op:   func() error { return svc.UnlockTwin(locked, otherToken, tw.ID) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "unlock twin with lock token",
+			op:   func() error { return svc.UnlockTwin(locked, token, tw.ID) },
+			err:  nil,
+		},
+		{
+			desc: "update unlocked twin with write key",
+			op:   func() error { return svc.UpdateTwin(context.Background(), writeKey, update, twins.Definition{}) },
+			err:  nil,
+		},
+		{
+			desc: "lock twin with short ttl",
+			op: func() error {
+				_, err := svc.LockTwin(context.Background(), token, tw.ID, time.Millisecond)
+				return err
+			},
+			err: nil,
+		},
+		{
+			desc: "update twin with expired lock",
+			op: func() error {
+				time.Sleep(5 * time.Millisecond)
+				return svc.UpdateTwin(context.Background(), writeKey, update, twins.Definition{})
+			},
+			err: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.op()
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+}
+
+func TestIssueTwinKey(t *testing.T) {
+	otherToken := "other-token"
+	otherEmail := "other@example.com"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: otherEmail})
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	other, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	issueCases := []struct {
+		desc   string
+		token  string
+		id     string
+		action twins.Action
+		ttl    time.Duration
+		err    error
+	}{
+		{
+			desc:   "issue key with wrong credentials",
+			token:  wrongToken,
+			id:     tw.ID,
+			action: twins.Read,
+			ttl:    time.Minute,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "issue key with zero ttl",
+			token:  token,
+			id:     tw.ID,
+			action: twins.Read,
+			ttl:    0,
+			err:    twins.ErrMalformedEntity,
+		},
+		{
+			desc:   "issue key for twin of other user",
+			token:  otherToken,
+			id:     tw.ID,
+			action: twins.Read,
+			ttl:    time.Minute,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "issue key for non-existent twin",
+			token:  token,
+			id:     wrongID,
+			action: twins.Read,
+			ttl:    time.Minute,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range issueCases {
+		_, err := svc.IssueTwinKey(context.Background(), tc.token, tc.id, tc.action, tc.ttl)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+
+	keys := make(map[string]twins.TwinKey)
+	for name, k := range map[string]struct {
+		action twins.Action
+		ttl    time.Duration
+	}{
+		"read":    {twins.Read, time.Minute},
+		"write":   {twins.Write, time.Minute},
+		"short":   {twins.Read, time.Millisecond},
+		"revoked": {twins.Read, time.Minute},
+	} {
+		key, err := svc.IssueTwinKey(context.Background(), token, tw.ID, k.action, k.ttl)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		keys[name] = key
+	}
+	readKey, writeKey, shortKey, revokedKey := keys["read"].Value, keys["write"].Value, keys["short"].Value, keys["revoked"].Value
+
+	revokeCases := []struct {
+		desc  string
+		token string
+		id    string
+		keyID string
+		err   error
+	}{
+		{
+			desc:  "revoke key with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			keyID: keys["revoked"].ID,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "revoke key of twin of other user",
+			token: otherToken,
+			id:    tw.ID,
+			keyID: keys["revoked"].ID,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "revoke key of other twin",
+			token: token,
+			id:    other.ID,
+			keyID: keys["revoked"].ID,
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "revoke key",
+			token: token,
+			id:    tw.ID,
+			keyID: keys["revoked"].ID,
+			err:   nil,
+		},
+		{
+			desc:  "revoke revoked key",
+			token: token,
+			id:    tw.ID,
+			keyID: keys["revoked"].ID,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range revokeCases {
+		err := svc.RevokeTwinKey(context.Background(), tc.token, tc.id, tc.keyID)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+	update := twins.Twin{ID: tw.ID, Name: "updated"}
+
+	cases := []struct {
+		desc string
+		op   func() error
+		err  error
+	}{
+		{
+			desc: "view twin with read key",
+			op: func() error {
+				_, err := svc.ViewTwin(context.Background(), readKey, tw.ID)
+				return err
+			},
+			err: nil,
+		},
+		{
+			desc: "list states with read key",
+			op: func() error {
+				_, err := svc.ListStates(context.Background(), readKey, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+				return err
+			},
+			err: nil,
+		},
+		{
+			desc: "view other twin with read key",
+			op: func() error {
+				_, err := svc.ViewTwin(context.Background(), readKey, other.ID)
+				return err
+			},
+			err: twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "update twin with read key",
+			op:   func() error { return svc.UpdateTwin(context.Background(), readKey, update, twins.Definition{}) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "update twin with write key",
+			op:   func() error { return svc.UpdateTwin(context.Background(), writeKey, update, twins.Definition{}) },
+			err:  nil,
+		},
+		{
+			desc: "authorize write with write key",
+			op:   func() error { return svc.Authorize(context.Background(), writeKey, tw.ID, twins.Write) },
+			err:  nil,
+		},
+		{
+			desc: "authorize delete with write key",
+			op:   func() error { return svc.Authorize(context.Background(), writeKey, tw.ID, twins.Delete) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "remove twin with write key",
+			op:   func() error { return svc.RemoveTwin(context.Background(), writeKey, tw.ID, false) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "list twins with read key",
+			op: func() error {
+				_, err := svc.ListTwins(context.Background(), readKey, 0, 10, "", nil, false)
+				return err
+			},
+			err: twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "view twin with expired key",
+			op: func() error {
+				time.Sleep(5 * time.Millisecond)
+				_, err := svc.ViewTwin(context.Background(), shortKey, tw.ID)
+				return err
+			},
+			err: twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "authorize read with expired key",
+			op:   func() error { return svc.Authorize(context.Background(), shortKey, tw.ID, twins.Read) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "view twin with revoked key",
+			op: func() error {
+				_, err := svc.ViewTwin(context.Background(), revokedKey, tw.ID)
+				return err
+			},
+			err: twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "authorize read with revoked key",
+			op:   func() error { return svc.Authorize(context.Background(), revokedKey, tw.ID, twins.Read) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "view twin with key hash",
+			op: func() error {
+				_, err := svc.ViewTwin(context.Background(), keys["read"].Hash, tw.ID)
+				return err
+			},
+			err: twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.op()
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+
+	removed, err := svc.RemoveExpiredKeys(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("remove expired keys: unexpected error: %s\n", err))
+	assert.Equal(t, uint64(1), removed, fmt.Sprintf("remove expired keys: expected %d removed keys got %d\n", 1, removed))
+	_, err = svc.ViewTwin(context.Background(), readKey, tw.ID)
+	assert.Nil(t, err, fmt.Sprintf("view twin with read key after removing expired keys: unexpected error: %s\n", err))
+}
+
+func TestListStatesOrder(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	n := 10
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(n, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		order  twins.Order
+		offset uint64
+		limit  uint64
+		ids    []int64
+	}{
+		{
+			desc:   "list first states in ascending order",
+			order:  twins.Asc,
+			offset: 0,
+			limit:  3,
+			ids:    []int64{0, 1, 2},
+		},
+		{
+			desc:   "list last states in ascending order",
+			order:  twins.Asc,
+			offset: 8,
+			limit:  3,
+			ids:    []int64{8, 9},
+		},
+		{
+			desc:   "list first states in descending order",
+			order:  twins.Desc,
+			offset: 0,
+			limit:  3,
+			ids:    []int64{9, 8, 7},
+		},
+		{
+			desc:   "list last states in descending order",
+			order:  twins.Desc,
+			offset: 8,
+			limit:  3,
+			ids:    []int64{1, 0},
+		},
+		{
+			desc:   "list states in descending order with offset equal to total",
+			order:  twins.Desc,
+			offset: uint64(n),
+			limit:  3,
+			ids:    nil,
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.ListStates(context.Background(), token, tc.offset, tc.limit, tw.ID, twins.Strong, tc.order, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		var ids []int64
+		for _, st := range page.States {
+			ids = append(ids, st.ID)
+		}
+		assert.Equal(t, tc.ids, ids, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.ids, ids))
+	}
+}
+
+func TestMetadataSchema(t *testing.T) {
+	otherToken := "other-token"
+	otherEmail := "other@example.com"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: otherEmail})
+
+	invalid := twins.MetadataSchema{Types: map[string]string{"serial": "text"}}
+	err := svc.SetMetadataSchema(context.Background(), token, invalid)
+	assert.Equal(t, twins.ErrMalformedEntity, err, fmt.Sprintf("set schema with unknown type: expected %s got %s\n", twins.ErrMalformedEntity, err))
+
+	err = svc.SetMetadataSchema(context.Background(), wrongToken, twins.MetadataSchema{})
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("set schema with wrong credentials: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+
+	schema := twins.MetadataSchema{
+		Required: []string{"serial"},
+		Types:    map[string]string{"serial": twins.StringType, "floor": twins.NumberType},
+	}
+	err = svc.SetMetadataSchema(context.Background(), token, schema)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc     string
+		token    string
+		metadata twins.Metadata
+		err      error
+	}{
+		{
+			desc:     "add twin with valid metadata",
+			token:    token,
+			metadata: twins.Metadata{"serial": "A-1", "floor": float64(2)},
+			err:      nil,
+		},
+		{
+			desc:     "add twin with valid metadata and unknown key",
+			token:    token,
+			metadata: twins.Metadata{"serial": "A-2", "room": "kitchen"},
+			err:      nil,
+		},
+		{
+			desc:     "add twin without required key",
+			token:    token,
+			metadata: twins.Metadata{"floor": float64(2)},
+			err:      twins.ErrSchemaViolation,
+		},
+		{
+			desc:     "add twin with wrong value type",
+			token:    token,
+			metadata: twins.Metadata{"serial": float64(1)},
+			err:      twins.ErrSchemaViolation,
+		},
+		{
+			desc:     "add twin of other user without required key",
+			token:    otherToken,
+			metadata: twins.Metadata{"floor": float64(2)},
+			err:      nil,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := svc.AddTwin(context.Background(), tc.token, twins.Twin{Metadata: tc.metadata}, twins.Definition{})
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"serial": "A-3"}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID, Metadata: twins.Metadata{"serial": "A-3", "floor": "second"}}, twins.Definition{})
+	assert.Equal(t, twins.ErrSchemaViolation, err, fmt.Sprintf("update twin with wrong value type: expected %s got %s\n", twins.ErrSchemaViolation, err))
+
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID, Metadata: twins.Metadata{"serial": "A-3", "floor": float64(3)}}, twins.Definition{})
+	assert.Nil(t, err, fmt.Sprintf("update twin with valid metadata: unexpected error: %s\n", err))
+}
+
+func TestReplayEvents(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail, EventLogSize: 3}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	n := 5
+	for i := 0; i < n; i++ {
+		_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc    string
+		token   string
+		fromSeq uint64
+		seqs    []uint64
+		err     error
+	}{
+		{
+			desc:    "replay retained events",
+			token:   adminToken,
+			fromSeq: 3,
+			seqs:    []uint64{3, 4, 5},
+			err:     nil,
+		},
+		{
+			desc:    "replay subset of retained events",
+			token:   adminToken,
+			fromSeq: 5,
+			seqs:    []uint64{5},
+			err:     nil,
+		},
+		{
+			desc:    "replay events not published yet",
+			token:   adminToken,
+			fromSeq: 6,
+			seqs:    nil,
+			err:     nil,
+		},
+		{
+			desc:    "replay evicted events",
+			token:   adminToken,
+			fromSeq: 1,
+			seqs:    nil,
+			err:     twins.ErrEventsEvicted,
+		},
+		{
+			desc:    "replay events as regular user",
+			token:   token,
+			fromSeq: 3,
+			seqs:    nil,
+			err:     twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:    "replay events with wrong credentials",
+			token:   wrongToken,
+			fromSeq: 3,
+			seqs:    nil,
+			err:     twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		ch, err := svc.ReplayEvents(context.Background(), tc.token, tc.fromSeq)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if err != nil {
+			continue
+		}
+
+		var seqs []uint64
+		for e := range ch {
+			seqs = append(seqs, e.Seq)
+		}
+		assert.Equal(t, tc.seqs, seqs, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.seqs, seqs))
+	}
+}
+
+func TestSaveStatesBackfill(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail, EventLogSize: 100}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attr := def.Attributes[0]
+
+	cases := []struct {
+		desc       string
+		time       float64
+		backfilled bool
+	}{
+		{
+			desc:       "save first record",
+			time:       1600000000,
+			backfilled: false,
+		},
+		{
+			desc:       "save newer record",
+			time:       1600000100,
+			backfilled: false,
+		},
+		{
+			desc:       "save record older than the last state",
+			time:       1600000050,
+			backfilled: true,
+		},
+	}
+
+	for i, tc := range cases {
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].BaseTime = 0
+		recs[0].Time = tc.time
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, i+1, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, i+1, len(page.States)))
+		st := page.States[i]
+		assert.Equal(t, tc.backfilled, st.Backfilled, fmt.Sprintf("%s: expected backfilled %t got %t\n", tc.desc, tc.backfilled, st.Backfilled))
+	}
+
+	events, err := svc.ReplayEvents(context.Background(), adminToken, 1)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	var backfills []map[string]interface{}
+	for ev := range events {
+		if ev.Operation != "backfill" {
+			continue
+		}
+		var bf map[string]interface{}
+		err := json.Unmarshal(ev.Payload, &bf)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		backfills = append(backfills, bf)
+	}
+	require.Len(t, backfills, 1, fmt.Sprintf("expected 1 backfill event got %d\n", len(backfills)))
+	expected := map[string]interface{}{
+		"twin_id": tw.ID,
+		"from":    time.Unix(1600000050, 0).Format(time.RFC3339Nano),
+		"to":      time.Unix(1600000100, 0).Format(time.RFC3339Nano),
+	}
+	assert.Equal(t, expected, backfills[0], fmt.Sprintf("expected backfill event %v got %v\n", expected, backfills[0]))
+}
+
+func TestListAllTwinIDs(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	n := 5
+	for i := 0; i < n; i++ {
+		_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc  string
+		token string
+		owner string
+		size  int
+		err   error
+	}{
+		{
+			desc:  "list ids of own twins",
+			token: token,
+			size:  n,
+			err:   nil,
+		},
+		{
+			desc:  "list ids of own twins with explicit owner",
+			token: token,
+			owner: email,
+			size:  n,
+			err:   nil,
+		},
+		{
+			desc:  "list ids of other user twins as admin",
+			token: adminToken,
+			owner: email,
+			size:  n,
+			err:   nil,
+		},
+		{
+			desc:  "list ids of own twins as admin",
+			token: adminToken,
+			size:  0,
+			err:   nil,
+		},
+		{
+			desc:  "list ids of other user twins as regular user",
+			token: token,
+			owner: adminEmail,
+			size:  0,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "list ids with wrong credentials",
+			token: wrongToken,
+			size:  0,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		ids, err := svc.ListAllTwinIDs(context.Background(), tc.token, tc.owner)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.size, len(ids), fmt.Sprintf("%s: expected %d ids got %d\n", tc.desc, tc.size, len(ids)))
+	}
+}
+
+func TestTwinInheritance(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	baseDef := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	base, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, baseDef)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	override := baseDef.Attributes[1]
+	override.Subtopic = attrSubtopic3
+	derivedDef := twins.Definition{Attributes: []twins.Attribute{override}}
+	derived, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, BaseTwinID: base.ID, Metadata: twins.Metadata{"serial": "SN-1"}, ThingID: "thing-1"}, derivedDef)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, BaseTwinID: "1234567890"}, derivedDef)
+	assert.Equal(t, twins.ErrMalformedEntity, err, fmt.Sprintf("add twin with non-existent base: expected %s got %s\n", twins.ErrMalformedEntity, err))
+
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: base.ID, BaseTwinID: derived.ID}, twins.Definition{})
+	assert.Equal(t, twins.ErrMalformedEntity, err, fmt.Sprintf("update twin with cyclic base: expected %s got %s\n", twins.ErrMalformedEntity, err))
+
+	tw, err := svc.ViewTwin(context.Background(), token, derived.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attrs := tw.Definitions[len(tw.Definitions)-1].Attributes
+	assert.Equal(t, []twins.Attribute{baseDef.Attributes[0], override}, attrs, fmt.Sprintf("view derived twin: expected %v got %v\n", []twins.Attribute{baseDef.Attributes[0], override}, attrs))
+
+	tw, err = svc.ViewTwinByMetadata(context.Background(), token, "serial", "SN-1")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attrs = tw.Definitions[len(tw.Definitions)-1].Attributes
+	assert.Equal(t, []twins.Attribute{baseDef.Attributes[0], override}, attrs, fmt.Sprintf("view derived twin by metadata: expected %v got %v\n", []twins.Attribute{baseDef.Attributes[0], override}, attrs))
+
+	tw, err = svc.ViewTwinByThing(context.Background(), token, "thing-1")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attrs = tw.Definitions[len(tw.Definitions)-1].Attributes
+	assert.Equal(t, []twins.Attribute{baseDef.Attributes[0], override}, attrs, fmt.Sprintf("view derived twin by thing: expected %v got %v\n", []twins.Attribute{baseDef.Attributes[0], override}, attrs))
+
+	// Changes to the base definition propagate to the derived twin.
+	baseDef.Attributes = append(baseDef.Attributes, mocks.CreateDefinition([]string{attrName3}, []string{attrSubtopic3}).Attributes[0])
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: base.ID}, baseDef)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	tw, err = svc.ViewTwin(context.Background(), token, derived.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attrs = tw.Definitions[len(tw.Definitions)-1].Attributes
+	assert.Equal(t, 3, len(attrs), fmt.Sprintf("view derived twin after base update: expected %d attributes got %d\n", 3, len(attrs)))
+
+	message, err := mocks.CreateMessage(baseDef.Attributes[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, id := range []string{base.ID, derived.ID} {
+		page, err := svc.ListStates(context.Background(), token, 0, 10, id, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		assert.Equal(t, 1, len(page.States), fmt.Sprintf("save inherited attribute state for %s: expected %d states got %d\n", id, 1, len(page.States)))
+	}
+}
+
+func TestDerivativeAttribute(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName3}, []string{attrSubtopic3})
+	def.Attributes = append(def.Attributes, twins.Attribute{Name: "acceleration", DerivativeOf: attrName3, PersistState: true})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	invalid := mocks.CreateDefinition([]string{attrName3}, []string{attrSubtopic3})
+	invalid.Attributes = append(invalid.Attributes, twins.Attribute{Name: "acceleration", DerivativeOf: attrName1, PersistState: true})
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, invalid)
+	assert.True(t, errors.Is(err, twins.ErrMalformedEntity), fmt.Sprintf("add twin with derivative of unknown attribute: expected %s got %s\n", twins.ErrMalformedEntity, err))
+
+	cases := []struct {
+		desc  string
+		time  float64
+		value float64
+		deriv interface{}
+	}{
+		{
+			desc:  "save first record",
+			time:  100,
+			value: 10,
+			deriv: nil,
+		},
+		{
+			desc:  "save second record",
+			time:  110,
+			value: 30,
+			deriv: 2.0,
+		},
+		{
+			desc:  "save third record",
+			time:  120,
+			value: 20,
+			deriv: -1.0,
+		},
+	}
+
+	for _, tc := range cases {
+		recs := mocks.CreateSenML(1, attrName3)
+		recs[0].Time = tc.time
+		value := tc.value
+		recs[0].Value = &value
+		message, err := mocks.CreateMessage(def.Attributes[0], recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		deriv := page.States[len(page.States)-1].Payload["acceleration"]
+		assert.Equal(t, tc.deriv, deriv, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.deriv, deriv))
+	}
+}
+
+func TestSaveStatesMinInterval(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].MinInterval = time.Minute
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attr := def.Attributes[0]
+
+	cases := []struct {
+		desc    string
+		time    float64
+		dropped uint64
+		size    uint64
+	}{
+		{
+			desc:    "save first record",
+			time:    100,
+			dropped: 0,
+			size:    1,
+		},
+		{
+			desc:    "save record within minimal interval",
+			time:    130,
+			dropped: 1,
+			size:    1,
+		},
+		{
+			desc:    "save record after minimal interval",
+			time:    170,
+			dropped: 0,
+			size:    2,
+		},
+		{
+			desc:    "save record within minimal interval of the last stored record",
+			time:    200,
+			dropped: 1,
+			size:    2,
+		},
+	}
+
+	for _, tc := range cases {
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].Time = tc.time
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		res, err := svc.SaveStates(message)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		assert.Equal(t, tc.dropped, res.Dropped, fmt.Sprintf("%s: expected %d dropped got %d\n", tc.desc, tc.dropped, res.Dropped))
+		assert.Equal(t, 1-tc.dropped, res.Saved, fmt.Sprintf("%s: expected %d saved got %d\n", tc.desc, 1-tc.dropped, res.Saved))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.size, page.Total, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.size, page.Total))
+	}
+}
+
+func TestSaveStatesDedup(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	for i := range def.Attributes {
+		def.Attributes[i].DedupWindow = time.Minute
+		def.Attributes[i].DedupEpsilon = 0.1
+	}
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	on, off := "on", "off"
+	cases := []struct {
+		desc    string
+		attr    twins.Attribute
+		time    float64
+		value   interface{}
+		dropped uint64
+	}{
+		{
+			desc:    "save first value",
+			attr:    def.Attributes[0],
+			time:    100,
+			value:   20.0,
+			dropped: 0,
+		},
+		{
+			desc:    "save value within epsilon and dedup window",
+			attr:    def.Attributes[0],
+			time:    130,
+			value:   20.05,
+			dropped: 1,
+		},
+		{
+			desc:    "save changed value within dedup window",
+			attr:    def.Attributes[0],
+			time:    140,
+			value:   21.0,
+			dropped: 0,
+		},
+		{
+			desc:    "save unchanged value within dedup window of the last stored value",
+			attr:    def.Attributes[0],
+			time:    190,
+			value:   21.0,
+			dropped: 1,
+		},
+		{
+			desc:    "save unchanged value after dedup window",
+			attr:    def.Attributes[0],
+			time:    210,
+			value:   21.0,
+			dropped: 0,
+		},
+		{
+			desc:    "save first string value",
+			attr:    def.Attributes[1],
+			time:    100,
+			value:   on,
+			dropped: 0,
+		},
+		{
+			desc:    "save equal string value within dedup window",
+			attr:    def.Attributes[1],
+			time:    110,
+			value:   on,
+			dropped: 1,
+		},
+		{
+			desc:    "save different string value within dedup window",
+			attr:    def.Attributes[1],
+			time:    120,
+			value:   off,
+			dropped: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		recs := mocks.CreateSenML(1, tc.attr.Name)
+		recs[0].Time = tc.time
+		switch v := tc.value.(type) {
+		case float64:
+			recs[0].Value = &v
+		case string:
+			recs[0].StringValue = &v
+		}
+		message, err := mocks.CreateMessage(tc.attr, recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		res, err := svc.SaveStates(message)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		assert.Equal(t, tc.dropped, res.Dropped, fmt.Sprintf("%s: expected %d dropped got %d\n", tc.desc, tc.dropped, res.Dropped))
+		assert.Equal(t, 1-tc.dropped, res.Saved, fmt.Sprintf("%s: expected %d saved got %d\n", tc.desc, 1-tc.dropped, res.Saved))
+	}
+
+	def.Attributes[0].DedupWindow = -time.Minute
+	def.Attributes[1].DedupEpsilon = -1
+	err = svc.ValidateDefinition(context.Background(), def)
+	de, ok := err.(*twins.DefinitionError)
+	require.True(t, ok, fmt.Sprintf("validate negative dedup settings: expected definition error got %s\n", err))
+	assert.Len(t, de.Fields, 2, fmt.Sprintf("validate negative dedup settings: expected 2 invalid fields got %v\n", de.Fields))
+}
+
+func TestListStatesBySource(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{CaptureSource: true}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for i, src := range []string{"gateway-1", "gateway-2", "gateway-1"} {
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].BaseTime = 0
+		recs[0].Time = float64(1600000000 + i)
+		message, err := mocks.CreateMessage(def.Attributes[0], recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		message.Publisher = src
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc   string
+		token  string
+		id     string
+		source string
+		ids    []int64
+		err    error
+	}{
+		{
+			desc:   "list states of source",
+			token:  token,
+			id:     tw.ID,
+			source: "gateway-1",
+			ids:    []int64{0, 2},
+			err:    nil,
+		},
+		{
+			desc:   "list states of other source",
+			token:  token,
+			id:     tw.ID,
+			source: "gateway-2",
+			ids:    []int64{1},
+			err:    nil,
+		},
+		{
+			desc:   "list states of unknown source",
+			token:  token,
+			id:     tw.ID,
+			source: "gateway-3",
+			err:    nil,
+		},
+		{
+			desc:   "list states without source",
+			token:  token,
+			id:     tw.ID,
+			source: "",
+			err:    twins.ErrMalformedEntity,
+		},
+		{
+			desc:   "list states of source with wrong credentials",
+			token:  wrongToken,
+			id:     tw.ID,
+			source: "gateway-1",
+			err:    twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.ListStatesBySource(context.Background(), tc.token, tc.id, tc.source, 0, 10, twins.Asc)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		var ids []int64
+		for _, st := range page.States {
+			assert.Equal(t, tc.source, st.Source, fmt.Sprintf("%s: expected source %s got %s\n", tc.desc, tc.source, st.Source))
+			ids = append(ids, st.ID)
+		}
+		assert.Equal(t, tc.ids, ids, fmt.Sprintf("%s: expected states %v got %v\n", tc.desc, tc.ids, ids))
+	}
+
+	// Sources aren't recorded unless enabled.
+	svc = mocks.NewService(map[string]string{token: email})
+	tw, err = svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Len(t, page.States, 1, fmt.Sprintf("expected single state got %d\n", len(page.States)))
+	assert.Empty(t, page.States[0].Source, fmt.Sprintf("expected no source got %s\n", page.States[0].Source))
+}
+
+func TestListStatesByGroup(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2, attrName3}, []string{attrSubtopic1, attrSubtopic2, attrSubtopic3})
+	def.Attributes[0].Group = "engine"
+	def.Attributes[1].Group = "climate"
+	def.Attributes[2].Group = "engine"
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, attr := range def.Attributes {
+		recs := mocks.CreateSenML(1, attr.Name)
+		recs[0].BaseTime = 0
+		recs[0].Time = 1600000000
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc  string
+		token string
+		group string
+		attrs []string
+		err   error
+	}{
+		{
+			desc:  "list states by group",
+			token: token,
+			group: "engine",
+			attrs: []string{attrName1, attrName3},
+			err:   nil,
+		},
+		{
+			desc:  "list states by another group",
+			token: token,
+			group: "climate",
+			attrs: []string{attrName2},
+			err:   nil,
+		},
+		{
+			desc:  "list states by non-existing group",
+			token: token,
+			group: "cabin",
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "list states by empty group",
+			token: token,
+			group: "",
+			err:   twins.ErrMalformedEntity,
+		},
+		{
+			desc:  "list states by group with wrong credentials",
+			token: wrongToken,
+			group: "engine",
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.ListStatesByGroup(context.Background(), tc.token, tw.ID, tc.group, 0, 10, twins.Strong, twins.Asc)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if err != nil {
+			continue
+		}
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected 1 state got %d\n", tc.desc, len(page.States)))
+		var attrs []string
+		for name := range page.States[0].Payload {
+			attrs = append(attrs, name)
+		}
+		assert.ElementsMatch(t, tc.attrs, attrs, fmt.Sprintf("%s: expected attributes %v got %v\n", tc.desc, tc.attrs, attrs))
+	}
+
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Len(t, page.States[0].Payload, 3, fmt.Sprintf("expected grouping not to affect stored state got %v\n", page.States[0].Payload))
+}
+
+// cancelingWriter cancels the export after the given number of writes.
+type cancelingWriter struct {
+	bytes.Buffer
+	writes int
+	cancel context.CancelFunc
+}
+
+func (cw *cancelingWriter) Write(p []byte) (int, error) {
+	cw.writes--
+	if cw.writes == 0 {
+		cw.cancel()
+	}
+	return cw.Buffer.Write(p)
+}
+
+func TestStreamExportStates(t *testing.T) {
+	svc := newService(map[string]string{token: email})
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	// More states than are retrieved at once while exporting.
+	n := 1500
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(n, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		token  string
+		id     string
+		cancel int
+		lines  int
+		err    error
+	}{
+		{
+			desc:  "export states",
+			token: token,
+			id:    tw.ID,
+			lines: n,
+			err:   nil,
+		},
+		{
+			desc:   "export states canceled mid-stream",
+			token:  token,
+			id:     tw.ID,
+			cancel: numRecs,
+			lines:  numRecs,
+			err:    context.Canceled,
+		},
+		{
+			desc:  "export states with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			lines: 0,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "export states of non-existent twin",
+			token: token,
+			id:    wrongID,
+			lines: 0,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx, cancel := context.WithCancel(context.Background())
+		w := &cancelingWriter{writes: tc.cancel, cancel: cancel}
+		err := svc.StreamExportStates(ctx, tc.token, tc.id, w)
+		cancel()
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		var ids []int64
+		dec := json.NewDecoder(&w.Buffer)
+		for dec.More() {
+			var st struct {
+				ID int64 `json:"id"`
+			}
+			require.Nil(t, dec.Decode(&st), fmt.Sprintf("%s: unexpected error decoding state", tc.desc))
+			ids = append(ids, st.ID)
+		}
+		assert.Len(t, ids, tc.lines, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.lines, len(ids)))
+		for i, id := range ids {
+			assert.Equal(t, int64(i), id, fmt.Sprintf("%s: expected state %d got %d\n", tc.desc, i, id))
+		}
+	}
+}
+
+func TestSaveStatesPrecision(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	precision := 1
+	def.Attributes[0].Precision = &precision
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc     string
+		attr     twins.Attribute
+		value    float64
+		expected float64
+	}{
+		{
+			desc:     "save value rounded to attribute precision",
+			attr:     def.Attributes[0],
+			value:    21.46,
+			expected: 21.5,
+		},
+		{
+			desc:     "save value of attribute without precision",
+			attr:     def.Attributes[1],
+			value:    41.46,
+			expected: 41.46,
+		},
+	}
+
+	for _, tc := range cases {
+		val := tc.value
+		message, err := mocks.CreateMessage(tc.attr, []senml.Record{{BaseName: tc.attr.Name, Value: &val}})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Desc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.NotEmpty(t, page.States, fmt.Sprintf("%s: expected states", tc.desc))
+		v, ok := page.States[0].Payload[tc.attr.Name].(*float64)
+		require.True(t, ok, fmt.Sprintf("%s: expected numeric value", tc.desc))
+		assert.Equal(t, tc.expected, *v, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.expected, *v))
+		assert.Equal(t, tc.value, val, fmt.Sprintf("%s: expected record value to be left intact", tc.desc))
+	}
+}
+
+func TestSaveStatesSum(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	target, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, mocks.CreateDefinition([]string{attrName2}, []string{attrSubtopic2}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	err = svc.LinkTwinInput(context.Background(), token, target.ID, attrName2, tw.ID, attrName1, twins.SumField)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	value := func(v float64) *float64 { return &v }
+	cases := []struct {
+		desc  string
+		rec   senml.Record
+		value float64
+		sum   float64
+	}{
+		{
+			desc:  "save record with value and sum",
+			rec:   senml.Record{BaseName: attrName1, Value: value(2.5), Sum: value(120)},
+			value: 2.5,
+			sum:   120,
+		},
+		{
+			desc:  "save record with value only",
+			rec:   senml.Record{BaseName: attrName1, Value: value(3)},
+			value: 3,
+			sum:   120,
+		},
+		{
+			desc:  "save record with sum only",
+			rec:   senml.Record{BaseName: attrName1, Sum: value(125)},
+			value: 125,
+			sum:   125,
+		},
+	}
+
+	for _, tc := range cases {
+		message, err := mocks.CreateMessage(def.Attributes[0], []senml.Record{tc.rec})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 1, tw.ID, twins.Strong, twins.Desc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected state\n", tc.desc))
+		v, ok := toFloat(page.States[0].Payload[attrName1])
+		assert.True(t, ok, fmt.Sprintf("%s: expected numeric value\n", tc.desc))
+		assert.Equal(t, tc.value, v, fmt.Sprintf("%s: expected value %v got %v\n", tc.desc, tc.value, v))
+		sum := page.States[0].Sums[attrName1]
+		assert.Equal(t, tc.sum, sum, fmt.Sprintf("%s: expected sum %v got %v\n", tc.desc, tc.sum, sum))
+
+		page, err = svc.ListStates(context.Background(), token, 0, 1, target.ID, twins.Strong, twins.Desc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected linked state\n", tc.desc))
+		v, ok = toFloat(page.States[0].Payload[attrName2])
+		assert.True(t, ok, fmt.Sprintf("%s: expected numeric linked value\n", tc.desc))
+		assert.Equal(t, tc.sum, v, fmt.Sprintf("%s: expected linked value %v got %v\n", tc.desc, tc.sum, v))
+	}
+}
+
+func TestSaveStatesFeatures(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	precision := 1
+	def.Attributes[0].Precision = &precision
+	def.Attributes[0].Smoothing = 0.5
+
+	cases := []struct {
+		desc     string
+		features map[string]bool
+		value    float64
+		smoothed bool
+		source   string
+	}{
+		{
+			desc:     "save state with default features",
+			features: nil,
+			value:    21.5,
+			smoothed: true,
+			source:   "",
+		},
+		{
+			desc:     "save state with smoothing disabled",
+			features: map[string]bool{twins.FeatureSmoothing: false},
+			value:    21.5,
+			smoothed: false,
+			source:   "",
+		},
+		{
+			desc:     "save state with rounding disabled",
+			features: map[string]bool{twins.FeatureRounding: false},
+			value:    21.46,
+			smoothed: true,
+			source:   "",
+		},
+		{
+			desc:     "save state with source capture enabled",
+			features: map[string]bool{twins.FeatureSourceCapture: true},
+			value:    21.5,
+			smoothed: true,
+			source:   "gateway-1",
+		},
+		{
+			desc:     "save state with unknown feature",
+			features: map[string]bool{"unknown": false},
+			value:    21.5,
+			smoothed: true,
+			source:   "",
+		},
+	}
+
+	ids := make([]string, len(cases))
+	for i, tc := range cases {
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Features: tc.features}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		ids[i] = tw.ID
+	}
+
+	val := 21.46
+	message, err := mocks.CreateMessage(def.Attributes[0], []senml.Record{{BaseName: attrName1, Value: &val}})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	message.Publisher = "gateway-1"
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for i, tc := range cases {
+		page, err := svc.ListStates(context.Background(), token, 0, 10, ids[i], twins.Strong, twins.Desc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected single state got %d\n", tc.desc, len(page.States)))
+		st := page.States[0]
+		v, ok := st.Payload[attrName1].(*float64)
+		require.True(t, ok, fmt.Sprintf("%s: expected numeric value", tc.desc))
+		assert.Equal(t, tc.value, *v, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.value, *v))
+		_, smoothed := st.Smoothed[attrName1]
+		assert.Equal(t, tc.smoothed, smoothed, fmt.Sprintf("%s: expected smoothed %t got %t\n", tc.desc, tc.smoothed, smoothed))
+		assert.Equal(t, tc.source, st.Source, fmt.Sprintf("%s: expected source %s got %s\n", tc.desc, tc.source, st.Source))
+	}
+}
+
+func TestUpdateTwinFeatures(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	features := map[string]bool{twins.FeatureSmoothing: false}
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID, Features: features}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	saved, err := svc.ViewTwin(context.Background(), token, tw.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, features, saved.Features, fmt.Sprintf("expected features %v got %v\n", features, saved.Features))
+	assert.Equal(t, tw.Revision+1, saved.Revision, fmt.Sprintf("expected revision %d got %d\n", tw.Revision+1, saved.Revision))
+	assert.False(t, saved.Enabled(twins.FeatureSmoothing, true), "expected smoothing to be disabled")
+	assert.True(t, saved.Enabled(twins.FeatureRounding, true), "expected rounding to be enabled by default")
+}
+
+func TestSaveStatesConflict(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	created := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		desc     string
+		policy   twins.ConflictPolicy
+		values   []float64
+		expected float64
+	}{
+		{
+			desc:     "resolve conflicting values by default",
+			policy:   "",
+			values:   []float64{20, 10, 15},
+			expected: 15,
+		},
+		{
+			desc:     "resolve conflicting values with last write wins",
+			policy:   twins.LastWriteWins,
+			values:   []float64{20, 10, 15},
+			expected: 15,
+		},
+		{
+			desc:     "resolve conflicting values with first write wins",
+			policy:   twins.FirstWriteWins,
+			values:   []float64{20, 10, 15},
+			expected: 20,
+		},
+		{
+			desc:     "resolve conflicting values with max value",
+			policy:   twins.MaxValue,
+			values:   []float64{10, 20, 15},
+			expected: 20,
+		},
+	}
+
+	for _, tc := range cases {
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		def.Attributes[0].Conflict = tc.policy
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		for _, v := range tc.values {
+			val := v
+			recs := []senml.Record{{BaseName: attrName1, BaseTime: float64(created.Unix()), Value: &val}}
+			message, err := mocks.CreateMessage(def.Attributes[0], recs)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+			_, err = svc.SaveStates(message)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		}
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected single state got %d\n", tc.desc, len(page.States)))
+		v, ok := page.States[0].Payload[attrName1].(*float64)
+		require.True(t, ok, fmt.Sprintf("%s: expected numeric value", tc.desc))
+		assert.Equal(t, tc.expected, *v, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.expected, *v))
+	}
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].Conflict = "random"
+	err := svc.ValidateDefinition(context.Background(), def)
+	_, ok := err.(*twins.DefinitionError)
+	assert.True(t, ok, fmt.Sprintf("validate unknown conflict policy: expected definition error got %s\n", err))
+}
+
+func TestSaveStatesValueType(t *testing.T) {
+	num, str := 21.5, "21.5"
+	recs := []senml.Record{
+		{BaseName: attrName1, Value: &num},
+		{BaseName: attrName1, Time: 1, StringValue: &str},
+		{BaseName: attrName1, Time: 2},
+	}
+
+	cases := []struct {
+		desc    string
+		reject  bool
+		saved   uint64
+		dropped uint64
+		err     error
+	}{
+		{
+			desc:    "save states with mismatched value type",
+			reject:  false,
+			saved:   2,
+			dropped: 1,
+			err:     nil,
+		},
+		{
+			desc:    "save states with mismatched value type rejecting mismatches",
+			reject:  true,
+			saved:   0,
+			dropped: 0,
+			err:     twins.ErrTypeMismatch,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{RejectTypeMismatch: tc.reject}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		def.Attributes[0].ValueType = twins.NumberValue
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(def.Attributes[0], recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		res, err := svc.SaveStates(message)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.saved, res.Saved, fmt.Sprintf("%s: expected %d saved records got %d\n", tc.desc, tc.saved, res.Saved))
+		assert.Equal(t, tc.dropped, res.Dropped, fmt.Sprintf("%s: expected %d dropped records got %d\n", tc.desc, tc.dropped, res.Dropped))
+
+		tw, err = svc.ViewTwin(context.Background(), token, tw.ID)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Contains(t, tw.LastError, twins.ErrTypeMismatch.Error(), fmt.Sprintf("%s: expected type mismatch error got %q\n", tc.desc, tw.LastError))
+	}
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].ValueType = "integer"
+	svc := mocks.NewService(map[string]string{token: email})
+	err := svc.ValidateDefinition(context.Background(), def)
+	_, ok := err.(*twins.DefinitionError)
+	assert.True(t, ok, fmt.Sprintf("validate unknown value type: expected definition error got %s\n", err))
+}
+
+func TestSaveStatesAllowedValues(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].AllowedValues = []string{"auto", "manual", "off"}
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	manual, boost, num := "manual", "boost", 21.5
+	cases := []struct {
+		desc  string
+		recs  []senml.Record
+		saved uint64
+		err   error
+	}{
+		{
+			desc:  "save states with allowed value",
+			recs:  []senml.Record{{BaseName: attrName1, Time: 1, StringValue: &manual}},
+			saved: 1,
+			err:   nil,
+		},
+		{
+			desc:  "save states with numeric value",
+			recs:  []senml.Record{{BaseName: attrName1, Time: 2, Value: &num}},
+			saved: 1,
+			err:   nil,
+		},
+		{
+			desc: "save states with value that is not allowed",
+			recs: []senml.Record{
+				{BaseName: attrName1, Time: 3, StringValue: &manual},
+				{BaseName: attrName1, Time: 4, StringValue: &boost},
+			},
+			saved: 0,
+			err:   twins.ErrInvalidValue,
+		},
+	}
+
+	for _, tc := range cases {
+		message, err := mocks.CreateMessage(def.Attributes[0], tc.recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		res, err := svc.SaveStates(message)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.saved, res.Saved, fmt.Sprintf("%s: expected %d saved records got %d\n", tc.desc, tc.saved, res.Saved))
+	}
+
+	tw, err = svc.ViewTwin(context.Background(), token, tw.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Contains(t, tw.LastError, twins.ErrInvalidValue.Error(), fmt.Sprintf("expected value not allowed error got %q\n", tw.LastError))
+
+	def.Attributes[0].ValueType = twins.NumberValue
+	err = svc.ValidateDefinition(context.Background(), def)
+	_, ok := err.(*twins.DefinitionError)
+	assert.True(t, ok, fmt.Sprintf("validate allowed values of numeric attribute: expected definition error got %s\n", err))
+}
+
+func TestSaveStatesRecordSize(t *testing.T) {
+	small, large := "c21hbGw=", strings.Repeat("A", 64)
+	recs := []senml.Record{
+		{BaseName: attrName1, DataValue: &small},
+		{BaseName: attrName1, Time: 1, DataValue: &large},
+		{BaseName: attrName1, Time: 2, StringValue: &large},
+	}
+
+	cases := []struct {
+		desc      string
+		limit     int
+		saved     uint64
+		oversized uint64
+		err       error
+	}{
+		{
+			desc:      "save states without record size limit",
+			limit:     0,
+			saved:     3,
+			oversized: 0,
+			err:       nil,
+		},
+		{
+			desc:      "save states within record size limit",
+			limit:     64,
+			saved:     3,
+			oversized: 0,
+			err:       nil,
+		},
+		{
+			desc:      "save states exceeding record size limit",
+			limit:     32,
+			saved:     1,
+			oversized: 2,
+			err:       twins.ErrPayloadTooLarge,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{MaxRecordSize: tc.limit}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(def.Attributes[0], recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		res, err := svc.SaveStates(message)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.saved, res.Saved, fmt.Sprintf("%s: expected %d saved records got %d\n", tc.desc, tc.saved, res.Saved))
+		assert.Equal(t, tc.oversized, res.Oversized, fmt.Sprintf("%s: expected %d oversized records got %d\n", tc.desc, tc.oversized, res.Oversized))
+
+		if tc.err == nil {
+			continue
+		}
+		tw, err = svc.ViewTwin(context.Background(), token, tw.ID)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Contains(t, tw.LastError, twins.ErrPayloadTooLarge.Error(), fmt.Sprintf("%s: expected payload too large error got %q\n", tc.desc, tw.LastError))
+	}
+}
+
+func TestSaveStatesUnmatched(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{"sensors/{serial}"})
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Metadata: twins.Metadata{"serial": "s1"}}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	matching, drifted := def.Attributes[0], def.Attributes[0]
+	matching.Subtopic = "sensors/s1"
+	drifted.Subtopic = "sensors/s2"
+
+	cases := []struct {
+		desc      string
+		attr      twins.Attribute
+		saved     uint64
+		unmatched uint64
+	}{
+		{
+			desc:      "save states matching attribute",
+			attr:      matching,
+			saved:     3,
+			unmatched: 0,
+		},
+		{
+			desc:      "save states matching no attribute",
+			attr:      drifted,
+			saved:     0,
+			unmatched: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		message, err := mocks.CreateMessage(tc.attr, mocks.CreateSenML(3, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		res, err := svc.SaveStates(message)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		assert.Equal(t, tc.saved, res.Saved, fmt.Sprintf("%s: expected %d saved records got %d\n", tc.desc, tc.saved, res.Saved))
+		assert.Equal(t, tc.unmatched, res.Unmatched, fmt.Sprintf("%s: expected %d unmatched records got %d\n", tc.desc, tc.unmatched, res.Unmatched))
+	}
+}
+
+func TestSaveStatesRefs(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc string
+		n    int
+		refs []twins.StateRef
+	}{
+		{
+			desc: "save first states",
+			n:    3,
+			refs: []twins.StateRef{{TwinID: tw.ID, ID: 0}, {TwinID: tw.ID, ID: 1}, {TwinID: tw.ID, ID: 2}},
+		},
+		{
+			desc: "save following state",
+			n:    1,
+			refs: []twins.StateRef{{TwinID: tw.ID, ID: 3}},
+		},
+	}
+
+	for _, tc := range cases {
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(tc.n, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		res, err := svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.refs, res.States, fmt.Sprintf("%s: expected states %v got %v\n", tc.desc, tc.refs, res.States))
+
+		for _, ref := range res.States {
+			err := svc.AnnotateState(context.Background(), token, ref.TwinID, ref.ID, tc.desc)
+			assert.Nil(t, err, fmt.Sprintf("%s: annotate state %d: unexpected error: %s\n", tc.desc, ref.ID, err))
+		}
+	}
+}
+
+func TestCurrentState(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[0].Smoothing = 0.5
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	empty, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for i, v := range []float64{10, 20, 40} {
+		attr := def.Attributes[i%2]
+		val := v
+		recs := []senml.Record{{BaseName: attr.Name, Value: &val}}
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc    string
+		token   string
+		id      string
+		payload map[string]float64
+		err     error
+	}{
+		{
+			desc:    "retrieve smoothed current state",
+			token:   token,
+			id:      tw.ID,
+			payload: map[string]float64{attrName1: 25, attrName2: 20},
+			err:     nil,
+		},
+		{
+			desc:  "retrieve current state of twin without states",
+			token: token,
+			id:    empty.ID,
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "retrieve current state with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "retrieve current state of non-existent twin",
+			token: token,
+			id:    wrongID,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		st, err := svc.CurrentState(context.Background(), tc.token, tc.id)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		for name, want := range tc.payload {
+			got, ok := toFloat(st.Payload[name])
+			assert.True(t, ok, fmt.Sprintf("%s: expected numeric value of %s got %v\n", tc.desc, name, st.Payload[name]))
+			assert.Equal(t, want, got, fmt.Sprintf("%s: expected %s %v got %v\n", tc.desc, name, want, got))
+		}
+	}
+
+	page, err := svc.ListStates(context.Background(), token, 0, 1, tw.ID, twins.Strong, twins.Desc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	raw, _ := toFloat(page.States[0].Payload[attrName1])
+	assert.Equal(t, 40.0, raw, fmt.Sprintf("expected raw value %v got %v\n", 40.0, raw))
+}
+
+func TestStateAt(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	now := time.Now()
+	for i, v := range []float64{10, 50, 30} {
+		attr := def.Attributes[i%2]
+		val := v
+		created := now.Add(time.Duration(i-3) * time.Hour)
+		recs := []senml.Record{{BaseName: attr.Name, BaseTime: float64(created.Unix()), Value: &val}}
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc    string
+		token   string
+		id      string
+		at      time.Time
+		payload map[string]float64
+		err     error
+	}{
+		{
+			desc:    "retrieve state at current time",
+			token:   token,
+			id:      tw.ID,
+			at:      now,
+			payload: map[string]float64{attrName1: 30, attrName2: 50},
+			err:     nil,
+		},
+		{
+			desc:    "retrieve state between updates of different attributes",
+			token:   token,
+			id:      tw.ID,
+			at:      now.Add(-90 * time.Minute),
+			payload: map[string]float64{attrName1: 10, attrName2: 50},
+			err:     nil,
+		},
+		{
+			desc:    "retrieve state before attribute reported",
+			token:   token,
+			id:      tw.ID,
+			at:      now.Add(-150 * time.Minute),
+			payload: map[string]float64{attrName1: 10},
+			err:     nil,
+		},
+		{
+			desc:  "retrieve state before first state",
+			token: token,
+			id:    tw.ID,
+			at:    now.Add(-4 * time.Hour),
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "retrieve state with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			at:    now,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "retrieve state of non-existent twin",
+			token: token,
+			id:    "missing",
+			at:    now,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		st, err := svc.StateAt(context.Background(), tc.token, tc.id, tc.at)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if tc.err != nil {
+			continue
+		}
+		assert.Len(t, st.Payload, len(tc.payload), fmt.Sprintf("%s: expected %d attributes got %d\n", tc.desc, len(tc.payload), len(st.Payload)))
+		for name, want := range tc.payload {
+			got, ok := toFloat(st.Payload[name])
+			assert.True(t, ok, fmt.Sprintf("%s: expected numeric value of %s got %v\n", tc.desc, name, st.Payload[name]))
+			assert.Equal(t, want, got, fmt.Sprintf("%s: expected %s %v got %v\n", tc.desc, name, want, got))
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(numRecs, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	before, err := svc.FindStates(context.Background(), token, tw.ID, attrName1, twins.Ge, 0, 0, numRecs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc  string
+		token string
+		id    string
+		err   error
+	}{
+		{
+			desc:  "reindex states",
+			token: token,
+			id:    tw.ID,
+			err:   nil,
+		},
+		{
+			desc:  "reindex states again",
+			token: token,
+			id:    tw.ID,
+			err:   nil,
+		},
+		{
+			desc:  "reindex states of non-existent twin",
+			token: token,
+			id:    "missing",
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "reindex states with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.Reindex(context.Background(), tc.token, tc.id)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		after, err := svc.FindStates(context.Background(), token, tw.ID, attrName1, twins.Ge, 0, 0, numRecs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		assert.Equal(t, before.States, after.States, fmt.Sprintf("%s: expected states %v got %v\n", tc.desc, before.States, after.States))
+	}
+}
+
+func TestBackfillDerived(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	statesRepo := mocks.NewStateRepository()
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail, EventLogSize: 100}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), statesRepo, uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for i, v := range []float64{10, 20, 40} {
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].Time = float64(100 + 10*i)
+		recs[0].Value = &v
+		message, err := mocks.CreateMessage(def.Attributes[0], recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	def.Attributes = append(def.Attributes, twins.Attribute{Name: "rate", DerivativeOf: attrName1, PersistState: true})
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	before, err := statesRepo.RetrieveAll(context.Background(), 0, 10, tw.ID, twins.Strong, twins.Asc)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc  string
+		token string
+		id    string
+		attr  string
+		err   error
+	}{
+		{
+			desc:  "backfill derived attribute",
+			token: token,
+			id:    tw.ID,
+			attr:  "rate",
+			err:   nil,
+		},
+		{
+			desc:  "backfill derived attribute again",
+			token: token,
+			id:    tw.ID,
+			attr:  "rate",
+			err:   nil,
+		},
+		{
+			desc:  "backfill attribute that is not derived",
+			token: token,
+			id:    tw.ID,
+			attr:  attrName1,
+			err:   twins.ErrMalformedEntity,
+		},
+		{
+			desc:  "backfill unknown attribute",
+			token: token,
+			id:    tw.ID,
+			attr:  "unknown",
+			err:   twins.ErrMalformedEntity,
+		},
+		{
+			desc:  "backfill derived attribute of non-existent twin",
+			token: token,
+			id:    "missing",
+			attr:  "rate",
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "backfill derived attribute with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			attr:  "rate",
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.BackfillDerived(context.Background(), tc.token, tc.id, tc.attr)
+		assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+
+	page, err := statesRepo.RetrieveAll(context.Background(), 0, 10, tw.ID, twins.Strong, twins.Asc)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Len(t, page.States, 3)
+	rates := []interface{}{nil, 1.0, 2.0}
+	for i, st := range page.States {
+		assert.Equal(t, rates[i], st.Payload["rate"], fmt.Sprintf("state %d: expected rate %v got %v\n", i, rates[i], st.Payload["rate"]))
+	}
+
+	intact, broken, err := svc.VerifyStateChain(context.Background(), token, tw.ID)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.True(t, intact, fmt.Sprintf("expected intact chain, broken at %d\n", broken))
+
+	events, err := svc.ReplayEvents(context.Background(), adminToken, 1)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	var rehashes []map[string]interface{}
+	for ev := range events {
+		if ev.Operation != "rehash" {
+			continue
+		}
+		var rh map[string]interface{}
+		err := json.Unmarshal(ev.Payload, &rh)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		rehashes = append(rehashes, rh)
+	}
+	// Backfilling the attribute again changes no state, so it isn't reported.
+	require.Len(t, rehashes, 1, fmt.Sprintf("expected 1 rehash event got %d\n", len(rehashes)))
+	expected := map[string]interface{}{
+		"twin_id": tw.ID,
+		"reason":  "backfill_derived",
+		"from":    1.0,
+		"to":      2.0,
+		"hashes": map[string]interface{}{
+			"1": before.States[1].Hash,
+			"2": before.States[2].Hash,
+		},
+	}
+	assert.Equal(t, expected, rehashes[0], fmt.Sprintf("expected rehash event %v got %v\n", expected, rehashes[0]))
+}
+
+func TestFindStates(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, v := range []float64{80, 95, 90, 100} {
+		val := v
+		recs := []senml.Record{{BaseName: attrName1, Value: &val}}
+		message, err := mocks.CreateMessage(def.Attributes[0], recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc   string
+		token  string
+		id     string
+		attr   string
+		op     twins.Operator
+		value  float64
+		offset uint64
+		limit  uint64
+		values []float64
+		total  uint64
+		err    error
+	}{
+		{
+			desc:   "find states with values greater than",
+			token:  token,
+			id:     tw.ID,
+			attr:   attrName1,
+			op:     twins.Gt,
+			value:  90,
+			limit:  10,
+			values: []float64{95, 100},
+			total:  2,
+		},
+		{
+			desc:   "find states with values greater than or equal to",
+			token:  token,
+			id:     tw.ID,
+			attr:   attrName1,
+			op:     twins.Ge,
+			value:  90,
+			limit:  10,
+			values: []float64{95, 90, 100},
+			total:  3,
+		},
+		{
+			desc:   "find states with values less than",
+			token:  token,
+			id:     tw.ID,
+			attr:   attrName1,
+			op:     twins.Lt,
+			value:  90,
+			limit:  10,
+			values: []float64{80},
+			total:  1,
+		},
+		{
+			desc:   "find states with values less than or equal to",
+			token:  token,
+			id:     tw.ID,
+			attr:   attrName1,
+			op:     twins.Le,
+			value:  90,
+			limit:  10,
+			values: []float64{80, 90},
+			total:  2,
+		},
+		{
+			desc:   "find states with values equal to",
+			token:  token,
+			id:     tw.ID,
+			attr:   attrName1,
+			op:     twins.Eq,
+			value:  90,
+			limit:  10,
+			values: []float64{90},
+			total:  1,
+		},
+		{
+			desc:   "find page of states",
+			token:  token,
+			id:     tw.ID,
+			attr:   attrName1,
+			op:     twins.Ge,
+			value:  90,
+			offset: 1,
+			limit:  1,
+			values: []float64{90},
+			total:  3,
+		},
+		{
+			desc:   "find states by unknown attribute",
+			token:  token,
+			id:     tw.ID,
+			attr:   attrName2,
+			op:     twins.Gt,
+			value:  0,
+			limit:  10,
+			values: []float64{},
+			total:  0,
+		},
+		{
+			desc:  "find states with invalid operator",
+			token: token,
+			id:    tw.ID,
+			attr:  attrName1,
+			op:    twins.Operator(-1),
+			limit: 10,
+			err:   twins.ErrMalformedEntity,
+		},
+		{
+			desc:  "find states without attribute",
+			token: token,
+			id:    tw.ID,
+			op:    twins.Gt,
+			limit: 10,
+			err:   twins.ErrMalformedEntity,
+		},
+		{
+			desc:  "find states with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			attr:  attrName1,
+			op:    twins.Gt,
+			limit: 10,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "find states of non-existent twin",
+			token: token,
+			id:    wrongID,
+			attr:  attrName1,
+			op:    twins.Gt,
+			limit: 10,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.FindStates(context.Background(), tc.token, tc.id, tc.attr, tc.op, tc.value, tc.offset, tc.limit)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, tc.total, page.Total, fmt.Sprintf("%s: expected total %d got %d\n", tc.desc, tc.total, page.Total))
+		values := []float64{}
+		for _, st := range page.States {
+			v, _ := toFloat(st.Payload[tc.attr])
+			values = append(values, v)
+		}
+		assert.Equal(t, tc.values, values, fmt.Sprintf("%s: expected values %v got %v\n", tc.desc, tc.values, values))
+	}
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case *float64:
+		if v == nil {
+			return 0, false
+		}
+		return *v, true
+	default:
+		return 0, false
+	}
+}
+
+func TestAttributeDefaults(t *testing.T) {
+	svc := newService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2, attrName3}, []string{attrSubtopic1, attrSubtopic2, attrSubtopic3})
+	def.Attributes[0].Default = 0.0
+	def.Attributes[1].Default = 40.0
+	def.Attributes[2].Default = "idle"
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Len(t, page.States, 1, fmt.Sprintf("expected 1 state got %d\n", len(page.States)))
+	stored := page.States[0].Payload
+	_, ok := stored[attrName2]
+	assert.False(t, ok, "list states: expected no default value in stored state\n")
+
+	st, err := svc.CurrentState(context.Background(), token, tw.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, stored[attrName1], st.Payload[attrName1], fmt.Sprintf("current state of reported attribute: expected %v got %v\n", stored[attrName1], st.Payload[attrName1]))
+	assert.Equal(t, 40.0, st.Payload[attrName2], fmt.Sprintf("current state of unreported attribute: expected %v got %v\n", 40.0, st.Payload[attrName2]))
+	assert.Equal(t, "idle", st.Payload[attrName3], fmt.Sprintf("current state of unreported attribute: expected %v got %v\n", "idle", st.Payload[attrName3]))
+
+	invalid := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	invalid.Attributes[0].Default = map[string]interface{}{"value": 1}
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, invalid)
+	assert.True(t, errors.Is(err, twins.ErrMalformedEntity), fmt.Sprintf("add twin with structured default: expected %s got %s\n", twins.ErrMalformedEntity, err))
+}
+
+func TestStoreRawSenML(t *testing.T) {
+	otherToken := "other-token"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: "other@example.com"})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{StoreRawSenML: true, AccessGrants: map[string]map[string][]string{email: {"other@example.com": {"camera"}}}}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+	disabled := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	hiddenDef := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	hiddenDef.Attributes[0].Access = "gps"
+	hiddenTw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, hiddenDef)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	disabledTw, err := disabled.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	recs := mocks.CreateSenML(1, attrName1)
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	raw := message.Payload
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = disabled.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(raw)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Nil(t, zw.Close(), "unexpected error closing gzip writer")
+	compressed, err := mocks.CreateMessage(hiddenDef.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	compressed.Payload = buf.Bytes()
+	_, err = svc.SaveStates(compressed)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc       string
+		svc        twins.Service
+		token      string
+		id         string
+		includeRaw bool
+		raw        []byte
+	}{
+		{
+			desc:       "list states with raw payloads",
+			svc:        svc,
+			token:      token,
+			id:         tw.ID,
+			includeRaw: true,
+			raw:        raw,
+		},
+		{
+			desc:       "list states without raw payloads",
+			svc:        svc,
+			token:      token,
+			id:         tw.ID,
+			includeRaw: false,
+			raw:        nil,
+		},
+		{
+			desc:       "list states with raw decompressed payloads",
+			svc:        svc,
+			token:      token,
+			id:         hiddenTw.ID,
+			includeRaw: true,
+			raw:        raw,
+		},
+		{
+			desc:       "list states with raw payloads carrying hidden attributes",
+			svc:        svc,
+			token:      otherToken,
+			id:         hiddenTw.ID,
+			includeRaw: true,
+			raw:        nil,
+		},
+		{
+			desc:       "list states with raw payloads not stored",
+			svc:        disabled,
+			token:      token,
+			id:         disabledTw.ID,
+			includeRaw: true,
+			raw:        nil,
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := tc.svc.ListStates(context.Background(), tc.token, 0, 10, tc.id, twins.Strong, twins.Asc, tc.includeRaw)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected 1 state got %d\n", tc.desc, len(page.States)))
+		assert.Equal(t, tc.raw, page.States[0].Raw, fmt.Sprintf("%s: expected raw payload %s got %s\n", tc.desc, tc.raw, page.States[0].Raw))
+	}
+}
+
+func TestAttributeAccess(t *testing.T) {
+	grantedToken := "granted-token"
+	grantedEmail := "granted@example.com"
+	otherToken := "other-token"
+	otherEmail := "other@example.com"
+	strangerToken := "stranger-token"
+	strangerEmail := "stranger@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, grantedToken: grantedEmail, otherToken: otherEmail, strangerToken: strangerEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AccessGrants: map[string]map[string][]string{
+		email:         {grantedEmail: {"gps"}, otherEmail: {"camera"}},
+		strangerEmail: {grantedEmail: {"gps"}},
+	}}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[1].Access = "gps"
+	def.Delta = math.MaxInt64
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, attr := range def.Attributes {
+		message, err := mocks.CreateMessage(attr, mocks.CreateSenML(1, attr.Name))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc  string
+		token string
+		attrs []string
+	}{
+		{
+			desc:  "read states as owner",
+			token: token,
+			attrs: []string{attrName1, attrName2},
+		},
+		{
+			desc:  "read states as user granted access label",
+			token: grantedToken,
+			attrs: []string{attrName1, attrName2},
+		},
+		{
+			desc:  "read states as user not granted access label",
+			token: otherToken,
+			attrs: []string{attrName1},
+		},
+	}
+
+	for _, tc := range cases {
+		page, err := svc.ListStates(context.Background(), tc.token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, 1, fmt.Sprintf("%s: expected 1 state got %d\n", tc.desc, len(page.States)))
+		var attrs []string
+		for name := range page.States[0].Payload {
+			attrs = append(attrs, name)
+		}
+		assert.ElementsMatch(t, tc.attrs, attrs, fmt.Sprintf("%s: expected attributes %v got %v\n", tc.desc, tc.attrs, attrs))
+
+		st, err := svc.CurrentState(context.Background(), tc.token, tw.ID)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		attrs = nil
+		for name := range st.Payload {
+			attrs = append(attrs, name)
+		}
+		assert.ElementsMatch(t, tc.attrs, attrs, fmt.Sprintf("%s: expected current attributes %v got %v\n", tc.desc, tc.attrs, attrs))
+	}
+
+	_, err = svc.ListStates(context.Background(), strangerToken, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("read states as user not granted any label: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+	_, err = svc.CurrentState(context.Background(), strangerToken, tw.ID)
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("read current state as user not granted any label: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+
+	// Grants are scoped to the twins of the granting owner.
+	otherTw, err := svc.AddTwin(context.Background(), otherToken, twins.Twin{Owner: otherEmail}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.ViewTwin(context.Background(), grantedToken, otherTw.ID)
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("read twin of owner not granting labels: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+	_, err = svc.ListStates(context.Background(), grantedToken, 0, 10, otherTw.ID, twins.Strong, twins.Asc, false)
+	assert.Equal(t, twins.ErrUnauthorizedAccess, err, fmt.Sprintf("read states of owner not granting labels: expected %s got %s\n", twins.ErrUnauthorizedAccess, err))
+
+	hidden := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", twins.Config{AccessGrants: cfg.AccessGrants, HideUnauthorized: true}, nil)
+	otherTw, err = hidden.AddTwin(context.Background(), otherToken, twins.Twin{Owner: otherEmail}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = hidden.ViewTwin(context.Background(), grantedToken, otherTw.ID)
+	assert.Equal(t, twins.ErrNotFound, err, fmt.Sprintf("read hidden twin of owner not granting labels: expected %s got %s\n", twins.ErrNotFound, err))
+}
+
+func TestAnnotateState(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(2, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc    string
+		token   string
+		id      string
+		stateID int64
+		note    string
+		notes   []string
+		err     error
+	}{
+		{
+			desc:    "annotate state",
+			token:   token,
+			id:      tw.ID,
+			stateID: 1,
+			note:    "sensor recalibrated",
+			notes:   []string{"", "sensor recalibrated"},
+			err:     nil,
+		},
+		{
+			desc:    "edit state annotation",
+			token:   token,
+			id:      tw.ID,
+			stateID: 1,
+			note:    "sensor replaced",
+			notes:   []string{"", "sensor replaced"},
+			err:     nil,
+		},
+		{
+			desc:    "annotate non-existent state",
+			token:   token,
+			id:      tw.ID,
+			stateID: 5,
+			note:    "note",
+			notes:   []string{"", "sensor replaced"},
+			err:     twins.ErrNotFound,
+		},
+		{
+			desc:    "annotate state of non-existent twin",
+			token:   token,
+			id:      wrongID,
+			stateID: 0,
+			note:    "note",
+			notes:   []string{"", "sensor replaced"},
+			err:     twins.ErrNotFound,
+		},
+		{
+			desc:    "annotate state with wrong credentials",
+			token:   wrongToken,
+			id:      tw.ID,
+			stateID: 0,
+			note:    "note",
+			notes:   []string{"", "sensor replaced"},
+			err:     twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:    "remove state annotation",
+			token:   token,
+			id:      tw.ID,
+			stateID: 1,
+			note:    "",
+			notes:   []string{"", ""},
+			err:     nil,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.AnnotateState(context.Background(), tc.token, tc.id, tc.stateID, tc.note)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		var notes []string
+		for _, st := range page.States {
+			notes = append(notes, st.Note)
+		}
+		assert.Equal(t, tc.notes, notes, fmt.Sprintf("%s: expected notes %v got %v\n", tc.desc, tc.notes, notes))
+	}
+}
+
+func TestSaveStatesTime(t *testing.T) {
+	base := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		desc  string
+		recs  []senml.Record
+		times []time.Duration
+	}{
+		{
+			desc:  "save record without time",
+			recs:  []senml.Record{{BaseName: attrName1}},
+			times: []time.Duration{0},
+		},
+		{
+			desc:  "save record with negative time",
+			recs:  []senml.Record{{BaseName: attrName1, Time: -60}},
+			times: []time.Duration{-time.Minute},
+		},
+		{
+			desc:  "save record with negative time relative to current time",
+			recs:  []senml.Record{{BaseName: attrName1, BaseTime: -120, Time: 60}},
+			times: []time.Duration{-time.Minute},
+		},
+	}
+
+	for _, tc := range cases {
+		svc := mocks.NewService(map[string]string{token: email})
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(def.Attributes[0], tc.recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		before := time.Now()
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		after := time.Now()
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		require.Len(t, page.States, len(tc.times), fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, len(tc.times), len(page.States)))
+		for i, d := range tc.times {
+			created := page.States[i].Created
+			ok := !created.Before(before.Add(d)) && !created.After(after.Add(d))
+			assert.True(t, ok, fmt.Sprintf("%s: expected state created between %s and %s got %s\n", tc.desc, before.Add(d), after.Add(d), created))
+		}
+	}
+
+	svc := mocks.NewService(map[string]string{token: email})
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	recs := []senml.Record{
+		{BaseName: attrName1, BaseTime: float64(base.Unix())},
+		{BaseName: attrName1, Time: 10},
+		{BaseName: attrName1, Time: -10},
+	}
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Len(t, page.States, len(recs), fmt.Sprintf("expected %d states got %d\n", len(recs), len(page.States)))
+	for i, d := range []time.Duration{0, 10 * time.Second, -10 * time.Second} {
+		expected := base.Add(d)
+		created := page.States[i].Created
+		assert.True(t, expected.Equal(created), fmt.Sprintf("save records relative to base time: expected %s got %s\n", expected, created))
+	}
+}
+
+func TestSubtopicPlaceholders(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{"engine.{serial}"})
+	tw1, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Metadata: twins.Metadata{"serial": "42"}}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	tw2, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Metadata: twins.Metadata{"serial": 7}}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	tw3, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc     string
+		subtopic string
+		totals   map[string]uint64
+	}{
+		{
+			desc:     "save state with subtopic resolved from string metadata",
+			subtopic: "engine.42",
+			totals:   map[string]uint64{tw1.ID: 1, tw2.ID: 0, tw3.ID: 0},
+		},
+		{
+			desc:     "save state with subtopic resolved from number metadata",
+			subtopic: "engine.7",
+			totals:   map[string]uint64{tw1.ID: 1, tw2.ID: 1, tw3.ID: 0},
+		},
+		{
+			desc:     "save state with unresolved subtopic",
+			subtopic: "engine.{serial}",
+			totals:   map[string]uint64{tw1.ID: 1, tw2.ID: 1, tw3.ID: 0},
+		},
+	}
+
+	for _, tc := range cases {
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		message.Subtopic = tc.subtopic
+		_, err = svc.SaveStates(message)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+
+		for id, total := range tc.totals {
+			page, err := svc.ListStates(context.Background(), token, 0, 10, id, twins.Strong, twins.Asc, false)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+			assert.Len(t, page.States, int(total), fmt.Sprintf("%s: expected %d states of twin %s got %d\n", tc.desc, total, id, len(page.States)))
+		}
+	}
+}
+
+func TestUnitAliases(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{UnitAliases: map[string]string{"C": "Cel"}}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].Unit = "Cel"
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc    string
+		alias   string
+		recs    []senml.Record
+		saved   uint64
+		dropped uint64
+	}{
+		{
+			desc:  "save record in canonical unit",
+			recs:  []senml.Record{{BaseName: attrName1, Unit: "Cel"}},
+			saved: 1,
+		},
+		{
+			desc:  "save record in configured unit alias",
+			recs:  []senml.Record{{BaseName: attrName1, Unit: "C"}},
+			saved: 1,
+		},
+		{
+			desc:    "save record in unknown unit alias",
+			recs:    []senml.Record{{BaseName: attrName1, Unit: "degC"}},
+			dropped: 1,
+		},
+		{
+			desc:  "save record in registered unit alias",
+			alias: "degC",
+			recs:  []senml.Record{{BaseName: attrName1, Unit: "degC"}},
+			saved: 1,
+		},
+		{
+			desc:  "save record without unit",
+			recs:  []senml.Record{{BaseName: attrName1}},
+			saved: 1,
+		},
+		{
+			desc:    "save records in other base unit",
+			recs:    []senml.Record{{BaseName: attrName1, BaseUnit: "K"}, {BaseName: attrName1}},
+			dropped: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		if tc.alias != "" {
+			svc.RegisterUnitAlias(tc.alias, "Cel")
+		}
+		message, err := mocks.CreateMessage(def.Attributes[0], tc.recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		res, err := svc.SaveStates(message)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		assert.Equal(t, tc.saved, res.Saved, fmt.Sprintf("%s: expected %d saved got %d\n", tc.desc, tc.saved, res.Saved))
+		assert.Equal(t, tc.dropped, res.Dropped, fmt.Sprintf("%s: expected %d dropped got %d\n", tc.desc, tc.dropped, res.Dropped))
+	}
+}
+
+func TestCoverageReport(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	recs := mocks.CreateSenML(1, attrName1)
+	recs[0].BaseTime = float64(time.Now().Add(-time.Minute).Unix())
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		token  string
+		id     string
+		window time.Duration
+		report map[string]bool
+		err    error
+	}{
+		{
+			desc:   "retrieve coverage report",
+			token:  token,
+			id:     tw.ID,
+			window: time.Hour,
+			report: map[string]bool{attrName1: true, attrName2: false},
+			err:    nil,
+		},
+		{
+			desc:   "retrieve coverage report with short window",
+			token:  token,
+			id:     tw.ID,
+			window: time.Second,
+			report: map[string]bool{attrName1: false, attrName2: false},
+			err:    nil,
+		},
+		{
+			desc:   "retrieve coverage report with wrong credentials",
+			token:  wrongToken,
+			id:     tw.ID,
+			window: time.Hour,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "retrieve coverage report with zero window",
+			token:  token,
+			id:     tw.ID,
+			window: 0,
+			err:    twins.ErrMalformedEntity,
+		},
+		{
+			desc:   "retrieve coverage report of non-existent twin",
+			token:  token,
+			id:     wrongID,
+			window: time.Hour,
+			err:    twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		report, err := svc.CoverageReport(context.Background(), tc.token, tc.id, tc.window)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.report, report, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.report, report))
+	}
+}
+
+func TestLatestAttributeValues(t *testing.T) {
+	otherToken := "other-token"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: "other@example.com"})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	tw1, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	tw2, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	other, err := svc.AddTwin(context.Background(), otherToken, twins.Twin{}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	recs := mocks.CreateSenML(1, attrName1)
+	recs[0].BaseTime = float64(time.Now().Add(-time.Minute).Unix())
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc  string
+		token string
+		ids   []string
+		attr  string
+		res   []string
+		err   error
+	}{
+		{
+			desc:  "retrieve latest values",
+			token: token,
+			ids:   []string{tw1.ID, tw2.ID},
+			attr:  attrName1,
+			res:   []string{tw1.ID, tw2.ID},
+			err:   nil,
+		},
+		{
+			desc:  "retrieve latest values of attribute without values",
+			token: token,
+			ids:   []string{tw1.ID, tw2.ID},
+			attr:  attrName2,
+			res:   []string{},
+			err:   nil,
+		},
+		{
+			desc:  "retrieve latest values with missing and other user's twins",
+			token: token,
+			ids:   []string{tw1.ID, "missing", other.ID},
+			attr:  attrName1,
+			res:   []string{tw1.ID},
+			err: &twins.BatchError{Errors: map[string]error{
+				"missing": twins.ErrNotFound,
+				other.ID:  twins.ErrUnauthorizedAccess,
+			}},
+		},
+		{
+			desc:  "retrieve latest values without attribute",
+			token: token,
+			ids:   []string{tw1.ID},
+			attr:  "",
+			err:   twins.ErrMalformedEntity,
+		},
+		{
+			desc:  "retrieve latest values with wrong credentials",
+			token: wrongToken,
+			ids:   []string{tw1.ID},
+			attr:  attrName1,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		values, err := svc.LatestAttributeValues(context.Background(), tc.token, tc.ids, tc.attr)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if tc.res == nil {
+			continue
+		}
+		assert.Len(t, values, len(tc.res), fmt.Sprintf("%s: expected %d values got %d\n", tc.desc, len(tc.res), len(values)))
+		for _, id := range tc.res {
+			v, ok := values[id]
+			assert.True(t, ok, fmt.Sprintf("%s: expected value of twin %s\n", tc.desc, id))
+			assert.True(t, v.Age >= time.Minute-time.Second, fmt.Sprintf("%s: expected age of at least a minute got %s\n", tc.desc, v.Age))
+		}
+	}
+}
+
+func TestLatestAttributeValuesAccess(t *testing.T) {
+	grantedToken := "granted-token"
+	grantedEmail := "granted@example.com"
+	otherToken := "other-token"
+	otherEmail := "other@example.com"
+	strangerToken := "stranger-token"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, grantedToken: grantedEmail, otherToken: otherEmail, strangerToken: "stranger@example.com"})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AccessGrants: map[string]map[string][]string{email: {grantedEmail: {"gps"}, otherEmail: {"camera"}}}}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[1].Access = "gps"
+	def.Delta = math.MaxInt64
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	for _, attr := range def.Attributes {
+		message, err := mocks.CreateMessage(attr, mocks.CreateSenML(1, attr.Name))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	cases := []struct {
+		desc  string
+		token string
+		attr  string
+		res   int
+		err   error
+	}{
+		{
+			desc:  "retrieve latest value of labeled attribute as owner",
+			token: token,
+			attr:  attrName2,
+			res:   1,
+			err:   nil,
+		},
+		{
+			desc:  "retrieve latest value of labeled attribute as user granted the label",
+			token: grantedToken,
+			attr:  attrName2,
+			res:   1,
+			err:   nil,
+		},
+		{
+			desc:  "retrieve latest value of hidden attribute as user not granted the label",
+			token: otherToken,
+			attr:  attrName2,
+			res:   0,
+			err:   nil,
+		},
+		{
+			desc:  "retrieve latest value of unlabeled attribute as user not granted the label",
+			token: otherToken,
+			attr:  attrName1,
+			res:   1,
+			err:   nil,
+		},
+		{
+			desc:  "retrieve latest value as user not granted any label",
+			token: strangerToken,
+			attr:  attrName1,
+			res:   0,
+			err:   &twins.BatchError{Errors: map[string]error{tw.ID: twins.ErrUnauthorizedAccess}},
+		},
+	}
+
+	for _, tc := range cases {
+		values, err := svc.LatestAttributeValues(context.Background(), tc.token, []string{tw.ID}, tc.attr)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Len(t, values, tc.res, fmt.Sprintf("%s: expected %d values got %d\n", tc.desc, tc.res, len(values)))
+	}
+}
+
+func TestTwinHealth(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{HealthWeights: twins.HealthWeights{Staleness: 2, Range: 2}}
+	twinsRepo := mocks.NewTwinRepository()
+	statesRepo := mocks.NewStateRepository()
+	svc := mocks.NewService(map[string]string{token: email})
+	weighted := twins.New(broker, auth, twinsRepo, statesRepo, uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[0].Range = &twins.ValueRange{Min: 0, Max: 10}
+	reporting, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	silentDef := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	silent, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, silentDef)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	weightedTwin, err := weighted.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	recs := mocks.CreateSenML(4, attrName1)
+	for i, v := range []float64{1, 2, 3, 50} {
+		v := v
+		recs[i].BaseTime = float64(time.Now().Add(-time.Minute).Unix())
+		recs[i].Value = &v
+	}
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = weighted.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc    string
+		svc     twins.Service
+		token   string
+		id      string
+		score   int
+		factors []int
+		err     error
+	}{
+		{
+			desc:    "retrieve health of reporting twin",
+			svc:     svc,
+			token:   token,
+			id:      reporting.ID,
+			score:   75,
+			factors: []int{100, 50, 75},
+			err:     nil,
+		},
+		{
+			desc:    "retrieve health of silent twin",
+			svc:     svc,
+			token:   token,
+			id:      silent.ID,
+			score:   33,
+			factors: []int{0, 0, 100},
+			err:     nil,
+		},
+		{
+			desc:    "retrieve health weighted as configured",
+			svc:     weighted,
+			token:   token,
+			id:      weightedTwin.ID,
+			score:   88,
+			factors: []int{100, 50, 75},
+			err:     nil,
+		},
+		{
+			desc:  "retrieve health with wrong credentials",
+			svc:   svc,
+			token: wrongToken,
+			id:    reporting.ID,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "retrieve health of non-existent twin",
+			svc:   svc,
+			token: token,
+			id:    wrongID,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		hs, err := tc.svc.TwinHealth(context.Background(), tc.token, tc.id)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, tc.score, hs.Score, fmt.Sprintf("%s: expected score %d got %d\n", tc.desc, tc.score, hs.Score))
+		var factors []int
+		for _, f := range hs.Factors {
+			factors = append(factors, f.Score)
+		}
+		assert.Equal(t, tc.factors, factors, fmt.Sprintf("%s: expected factor scores %v got %v\n", tc.desc, tc.factors, factors))
+	}
+}
+
+func TestDescribeTwin(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2, "rate", "label"}, []string{"{room}/" + attrSubtopic1, attrSubtopic2, attrSubtopic1, "label"})
+	def.Attributes[0].Aliases = []string{"{floor}/" + attrSubtopic1}
+	def.Attributes[0].Unit = "Cel"
+	def.Attributes[1].MinInterval = time.Second
+	def.Attributes[2].DerivativeOf = attrName1
+	def.Attributes[3].PersistState = false
+	def.Delta = 10
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Name: twinName, Metadata: twins.Metadata{"room": "kitchen"}}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc       string
+		token      string
+		id         string
+		descriptor twins.TwinDescriptor
+		err        error
+	}{
+		{
+			desc:  "describe twin",
+			token: token,
+			id:    tw.ID,
+			descriptor: twins.TwinDescriptor{
+				TwinID:      tw.ID,
+				Name:        twinName,
+				Definition:  0,
+				ContentType: "application/senml+json",
+				Delta:       10,
+				Attributes: []twins.AttributeDescriptor{
+					{
+						Name:      attrName1,
+						Channel:   def.Attributes[0].Channel,
+						Subtopics: []string{"kitchen/" + attrSubtopic1},
+						Unit:      "Cel",
+					},
+					{
+						Name:        attrName2,
+						Channel:     def.Attributes[1].Channel,
+						Subtopics:   []string{attrSubtopic2},
+						MinInterval: time.Second,
+					},
+				},
+			},
+			err: nil,
+		},
+		{
+			desc:  "describe twin with wrong credentials",
+			token: wrongToken,
+			id:    tw.ID,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "describe non-existent twin",
+			token: token,
+			id:    wrongID,
+			err:   twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		desc, err := svc.DescribeTwin(context.Background(), tc.token, tc.id)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.descriptor, desc, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.descriptor, desc))
+	}
+}
+
+func TestStatesHistogram(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	from := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	recs := mocks.CreateSenML(10, attrName1)
+	for i := range recs {
+		recs[i].BaseTime = float64(from.Unix())
+	}
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		token  string
+		id     string
+		bucket time.Duration
+		to     time.Time
+		counts []uint64
+		err    error
+	}{
+		{
+			desc:   "retrieve histogram",
+			token:  token,
+			id:     tw.ID,
+			bucket: 3 * time.Second,
+			to:     from.Add(10 * time.Second),
+			counts: []uint64{3, 3, 3, 1},
+			err:    nil,
+		},
+		{
+			desc:   "retrieve histogram with empty buckets",
+			token:  token,
+			id:     tw.ID,
+			bucket: 5 * time.Second,
+			to:     from.Add(20 * time.Second),
+			counts: []uint64{5, 5, 0, 0},
+			err:    nil,
+		},
+		{
+			desc:   "retrieve histogram with wrong credentials",
+			token:  wrongToken,
+			id:     tw.ID,
+			bucket: time.Second,
+			to:     from.Add(10 * time.Second),
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "retrieve histogram of non-existent twin",
+			token:  token,
+			id:     wrongID,
+			bucket: time.Second,
+			to:     from.Add(10 * time.Second),
+			err:    twins.ErrNotFound,
+		},
+		{
+			desc:   "retrieve histogram with zero bucket",
+			token:  token,
+			id:     tw.ID,
+			bucket: 0,
+			to:     from.Add(10 * time.Second),
+			err:    twins.ErrMalformedEntity,
+		},
+		{
+			desc:   "retrieve histogram with empty time range",
+			token:  token,
+			id:     tw.ID,
+			bucket: time.Second,
+			to:     from,
+			err:    twins.ErrMalformedEntity,
+		},
+		{
+			desc:   "retrieve histogram with too many buckets",
+			token:  token,
+			id:     tw.ID,
+			bucket: time.Millisecond,
+			to:     from.Add(10 * time.Second),
+			err:    twins.ErrMalformedEntity,
+		},
+	}
+
+	for _, tc := range cases {
+		hist, err := svc.StatesHistogram(context.Background(), tc.token, tc.id, tc.bucket, from, tc.to, nil)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		var counts []uint64
+		for i, b := range hist {
+			start := from.Add(time.Duration(i) * tc.bucket)
+			assert.True(t, start.Equal(b.Start), fmt.Sprintf("%s: expected bucket start %s got %s\n", tc.desc, start, b.Start))
+			counts = append(counts, b.Count)
+		}
+		assert.Equal(t, tc.counts, counts, fmt.Sprintf("%s: expected counts %v got %v\n", tc.desc, tc.counts, counts))
+	}
+}
+
+func TestListStatePartitions(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	jan1 := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	jan2 := jan1.AddDate(0, 0, 1)
+	feb2 := jan1.AddDate(0, 1, 1)
+	offsets := []time.Duration{0, time.Hour, 25 * time.Hour, feb2.Sub(jan1)}
+	recs := mocks.CreateSenML(len(offsets), attrName1)
+	for i := range recs {
+		recs[i].BaseTime = float64(jan1.Unix())
+		recs[i].Time = offsets[i].Seconds()
+	}
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		token       string
+		id          string
+		granularity twins.Granularity
+		partitions  []twins.Partition
+		err         error
+	}{
+		{
+			desc:        "list daily partitions",
+			token:       token,
+			id:          tw.ID,
+			granularity: twins.Daily,
+			partitions:  []twins.Partition{{Start: jan1, Count: 2}, {Start: jan2, Count: 1}, {Start: feb2, Count: 1}},
+			err:         nil,
+		},
+		{
+			desc:        "list monthly partitions",
+			token:       token,
+			id:          tw.ID,
+			granularity: twins.Monthly,
+			partitions:  []twins.Partition{{Start: jan1, Count: 3}, {Start: jan1.AddDate(0, 1, 0), Count: 1}},
+			err:         nil,
+		},
+		{
+			desc:        "list yearly partitions",
+			token:       token,
+			id:          tw.ID,
+			granularity: twins.Yearly,
+			partitions:  []twins.Partition{{Start: jan1, Count: 4}},
+			err:         nil,
+		},
+		{
+			desc:        "list partitions with invalid granularity",
+			token:       token,
+			id:          tw.ID,
+			granularity: twins.Granularity(-1),
+			err:         twins.ErrMalformedEntity,
+		},
+		{
+			desc:        "list partitions with wrong credentials",
+			token:       wrongToken,
+			id:          tw.ID,
+			granularity: twins.Daily,
+			err:         twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:        "list partitions of non-existent twin",
+			token:       token,
+			id:          wrongID,
+			granularity: twins.Daily,
+			err:         twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		partitions, err := svc.ListStatePartitions(context.Background(), tc.token, tc.id, tc.granularity, nil)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if err != nil {
+			continue
+		}
+		require.Len(t, partitions, len(tc.partitions), fmt.Sprintf("%s: expected %d partitions got %d\n", tc.desc, len(tc.partitions), len(partitions)))
+		for i, p := range partitions {
+			assert.True(t, tc.partitions[i].Start.Equal(p.Start), fmt.Sprintf("%s: expected partition start %s got %s\n", tc.desc, tc.partitions[i].Start, p.Start))
+			assert.Equal(t, tc.partitions[i].Count, p.Count, fmt.Sprintf("%s: expected partition count %d got %d\n", tc.desc, tc.partitions[i].Count, p.Count))
+		}
+	}
+}
+
+func TestStatesHistogramTimezone(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	// DST starts in New York on March 8 2020, so the day lasts 23 hours.
+	loc, err := time.LoadLocation("America/New_York")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	mar7 := time.Date(2020, time.March, 7, 0, 0, 0, 0, loc)
+	mar8 := time.Date(2020, time.March, 8, 0, 0, 0, 0, loc)
+	mar9 := time.Date(2020, time.March, 9, 0, 0, 0, 0, loc)
+	times := []time.Time{mar7.Add(12 * time.Hour), mar9.Add(-30 * time.Minute), mar9.Add(30 * time.Minute)}
+	recs := mocks.CreateSenML(len(times), attrName1)
+	for i := range recs {
+		recs[i].BaseTime = float64(times[i].Unix())
+		recs[i].Time = 0
+	}
+	message, err := mocks.CreateMessage(def.Attributes[0], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	from, to := mar7.Add(10*time.Hour), time.Date(2020, time.March, 10, 0, 0, 0, 0, loc)
+	hist, err := svc.StatesHistogram(context.Background(), token, tw.ID, 24*time.Hour, from, to, loc)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	expected := []twins.BucketCount{{Start: mar7, Count: 1}, {Start: mar8, Count: 1}, {Start: mar9, Count: 1}}
+	require.Len(t, hist, len(expected), fmt.Sprintf("expected %d buckets got %d\n", len(expected), len(hist)))
+	for i, b := range hist {
+		assert.True(t, expected[i].Start.Equal(b.Start), fmt.Sprintf("expected bucket start %s got %s\n", expected[i].Start, b.Start))
+		assert.Equal(t, expected[i].Count, b.Count, fmt.Sprintf("expected bucket count %d got %d\n", expected[i].Count, b.Count))
+	}
+
+	partitions, err := svc.ListStatePartitions(context.Background(), token, tw.ID, twins.Daily, loc)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Len(t, partitions, len(expected), fmt.Sprintf("expected %d partitions got %d\n", len(expected), len(partitions)))
+	for i, p := range partitions {
+		assert.True(t, expected[i].Start.Equal(p.Start), fmt.Sprintf("expected partition start %s got %s\n", expected[i].Start, p.Start))
+		assert.Equal(t, expected[i].Count, p.Count, fmt.Sprintf("expected partition count %d got %d\n", expected[i].Count, p.Count))
+	}
+}
+
+func TestServiceStats(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(numRecs, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	recs := mocks.CreateSenML(1, attrName2)
+	recs[0].BaseTime = float64(time.Now().Add(-2 * time.Hour).Unix())
+	message, err = mocks.CreateMessage(def.Attributes[1], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc  string
+		token string
+		stats twins.ServiceStats
+		err   error
+	}{
+		{
+			desc:  "retrieve stats as admin",
+			token: adminToken,
+			stats: twins.ServiceStats{
+				Twins:        2,
+				States:       numRecs + 1,
+				RecentStates: numRecs,
+				Channels:     2,
+			},
+			err: nil,
+		},
+		{
+			desc:  "retrieve stats as regular user",
+			token: token,
+			stats: twins.ServiceStats{},
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "retrieve stats with wrong credentials",
+			token: wrongToken,
+			stats: twins.ServiceStats{},
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		stats, err := svc.ServiceStats(context.Background(), tc.token)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.stats, stats, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.stats, stats))
+	}
+}
+
+func TestSetOwnerQuota(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	cases := []struct {
+		desc  string
+		token string
+		owner string
+		max   uint64
+		err   error
+	}{
+		{
+			desc:  "set quota as admin",
+			token: adminToken,
+			owner: email,
+			max:   100,
+			err:   nil,
+		},
+		{
+			desc:  "remove quota as admin",
+			token: adminToken,
+			owner: email,
+			max:   0,
+			err:   nil,
+		},
+		{
+			desc:  "set quota as regular user",
+			token: token,
+			owner: email,
+			max:   100,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "set quota with wrong credentials",
+			token: wrongToken,
+			owner: email,
+			max:   100,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "set quota without owner",
+			token: adminToken,
+			owner: "",
+			max:   100,
+			err:   twins.ErrMalformedEntity,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.SetOwnerQuota(context.Background(), tc.token, tc.owner, tc.max)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+}
+
+func TestOwnerUsage(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	otherToken := "other-token"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail, otherToken: "other@example.com"})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(numRecs, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	err = svc.SetOwnerQuota(context.Background(), adminToken, email, 1000)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc  string
+		token string
+		owner string
+		usage twins.Usage
+		err   error
+	}{
+		{
+			desc:  "retrieve usage as owner",
+			token: token,
+			owner: email,
+			usage: twins.Usage{Owner: email, States: numRecs, MaxStates: 1000},
+			err:   nil,
+		},
+		{
+			desc:  "retrieve usage as admin",
+			token: adminToken,
+			owner: email,
+			usage: twins.Usage{Owner: email, States: numRecs, MaxStates: 1000},
+			err:   nil,
+		},
+		{
+			desc:  "retrieve usage of owner without twins",
+			token: otherToken,
+			owner: "",
+			usage: twins.Usage{Owner: "other@example.com"},
+			err:   nil,
+		},
+		{
+			desc:  "retrieve usage of other owner",
+			token: otherToken,
+			owner: email,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "retrieve usage with wrong credentials",
+			token: wrongToken,
+			owner: email,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		usage, err := svc.OwnerUsage(context.Background(), tc.token, tc.owner)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.usage, usage, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.usage, usage))
+	}
+}
+
+func TestSaveStatesQuota(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	err = svc.SetOwnerQuota(context.Background(), adminToken, email, 2)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(3, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	res, err := svc.SaveStates(message)
+	assert.Equal(t, twins.ErrQuotaExceeded, err, fmt.Sprintf("save states over quota: expected %s got %s\n", twins.ErrQuotaExceeded, err))
+	assert.Equal(t, uint64(2), res.Saved, fmt.Sprintf("save states over quota: expected %d saved states got %d\n", 2, res.Saved))
+
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(2), page.Total, fmt.Sprintf("save states over quota: expected %d states got %d\n", 2, page.Total))
+
+	err = svc.SetOwnerQuota(context.Background(), adminToken, email, 0)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err = mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(3, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	assert.Nil(t, err, fmt.Sprintf("save states without quota: unexpected error: %s\n", err))
+}
+
+func TestSubscriptionInfo(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	begin := time.Now()
+	for i := 0; i < 3; i++ {
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+	message, err := mocks.CreateMessage(def.Attributes[1], mocks.CreateSenML(1, attrName2))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	counts := map[string]uint64{
+		fmt.Sprintf("channels.%s.%s", def.Attributes[0].Channel, attrSubtopic1): 3,
+		fmt.Sprintf("channels.%s.%s", def.Attributes[1].Channel, attrSubtopic2): 1,
+	}
+
+	cases := []struct {
+		desc   string
+		token  string
+		counts map[string]uint64
+		err    error
+	}{
+		{
+			desc:   "retrieve subscription info as admin",
+			token:  adminToken,
+			counts: counts,
+			err:    nil,
+		},
+		{
+			desc:   "retrieve subscription info as regular user",
+			token:  token,
+			counts: map[string]uint64{},
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "retrieve subscription info with wrong credentials",
+			token:  wrongToken,
+			counts: map[string]uint64{},
+			err:    twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		infos, err := svc.SubscriptionInfo(context.Background(), tc.token)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		got := map[string]uint64{}
+		for _, info := range infos {
+			got[info.Subject] = info.Messages
+			assert.False(t, info.LastMessage.Before(begin), fmt.Sprintf("%s: expected last message after %s got %s\n", tc.desc, begin, info.LastMessage))
+		}
+		assert.Equal(t, tc.counts, got, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.counts, got))
+	}
+}
+
+func TestViewTwinByMetadata(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email, "other-token": "other@example.com"})
+
+	unique, err := svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"serial": "SN-1", "rack": float64(1)}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"serial": "SN-2", "rack": float64(2)}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{Metadata: twins.Metadata{"serial": "SN-3", "rack": float64(2)}}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc  string
+		token string
+		key   string
+		value interface{}
+		id    string
+		err   error
+	}{
+		{
+			desc:  "view twin by unique metadata value",
+			token: token,
+			key:   "serial",
+			value: "SN-1",
+			id:    unique.ID,
+			err:   nil,
+		},
+		{
+			desc:  "view twin by unique numeric metadata value",
+			token: token,
+			key:   "rack",
+			value: float64(1),
+			id:    unique.ID,
+			err:   nil,
+		},
+		{
+			desc:  "view twin by metadata value shared by many twins",
+			token: token,
+			key:   "rack",
+			value: float64(2),
+			err:   twins.ErrConflict,
+		},
+		{
+			desc:  "view twin by non-existent metadata value",
+			token: token,
+			key:   "serial",
+			value: "SN-4",
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "view twin by metadata value of other user",
+			token: "other-token",
+			key:   "serial",
+			value: "SN-1",
+			err:   twins.ErrNotFound,
+		},
+		{
+			desc:  "view twin by empty metadata key",
+			token: token,
+			key:   "",
+			value: "SN-1",
+			err:   twins.ErrMalformedEntity,
+		},
+		{
+			desc:  "view twin by metadata with wrong credentials",
+			token: wrongToken,
+			key:   "serial",
+			value: "SN-1",
+			err:   twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		tw, err := svc.ViewTwinByMetadata(context.Background(), tc.token, tc.key, tc.value)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.id, tw.ID, fmt.Sprintf("%s: expected twin %s got %s\n", tc.desc, tc.id, tw.ID))
+	}
+}
+
+func TestViewTwinByThing(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email, "other-token": "other@example.com"})
+
+	linked, err := svc.AddTwin(context.Background(), token, twins.Twin{ThingID: "thing-1"}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{ThingID: "thing-2"}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.AddTwin(context.Background(), token, twins.Twin{ThingID: "thing-2"}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc    string
+		token   string
+		thingID string
+		id      string
+		err     error
+	}{
+		{
+			desc:    "view twin by thing",
+			token:   token,
+			thingID: "thing-1",
+			id:      linked.ID,
+			err:     nil,
+		},
+		{
+			desc:    "view twin by thing linked to many twins",
+			token:   token,
+			thingID: "thing-2",
+			err:     twins.ErrConflict,
+		},
+		{
+			desc:    "view twin by non-linked thing",
+			token:   token,
+			thingID: "thing-3",
+			err:     twins.ErrNotFound,
+		},
+		{
+			desc:    "view twin by thing of other user",
+			token:   "other-token",
+			thingID: "thing-1",
+			err:     twins.ErrNotFound,
+		},
+		{
+			desc:    "view twin by empty thing",
+			token:   token,
+			thingID: "",
+			err:     twins.ErrMalformedEntity,
+		},
+		{
+			desc:    "view twin by thing with wrong credentials",
+			token:   wrongToken,
+			thingID: "thing-1",
+			err:     twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		tw, err := svc.ViewTwinByThing(context.Background(), tc.token, tc.thingID)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.id, tw.ID, fmt.Sprintf("%s: expected twin %s got %s\n", tc.desc, tc.id, tw.ID))
+	}
+}
+
+func TestVerifyThing(t *testing.T) {
+	otherToken := "other-token"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: "other@example.com"})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{Things: mocks.NewThingVerifier(map[string]string{"thing": token, "other-thing": otherToken})}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	cases := []struct {
+		desc    string
+		thingID string
+		valid   bool
+	}{
+		{
+			desc:    "add twin linked to existing thing",
+			thingID: "thing",
+			valid:   true,
+		},
+		{
+			desc:    "add twin not linked to any thing",
+			thingID: "",
+			valid:   true,
+		},
+		{
+			desc:    "add twin linked to non-existing thing",
+			thingID: "missing",
+			valid:   false,
+		},
+		{
+			desc:    "add twin linked to thing of other user",
+			thingID: "other-thing",
+			valid:   false,
+		},
+	}
+
+	for _, tc := range cases {
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{ThingID: tc.thingID}, twins.Definition{})
+		if tc.valid {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+			assert.Equal(t, tc.thingID, tw.ThingID, fmt.Sprintf("%s: expected thing %s got %s\n", tc.desc, tc.thingID, tw.ThingID))
+			continue
+		}
+		_, ok := err.(*twins.ValidationError)
+		assert.True(t, ok, fmt.Sprintf("%s: expected validation error got %s\n", tc.desc, err))
+	}
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID, ThingID: "missing"}, twins.Definition{})
+	_, ok := err.(*twins.ValidationError)
+	assert.True(t, ok, fmt.Sprintf("link twin to non-existing thing: expected validation error got %s\n", err))
+}
+
+func TestHideUnauthorized(t *testing.T) {
+	otherToken := "other-token"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: "other@example.com"})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{HideUnauthorized: true}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc string
+		op   func() error
+		err  error
+	}{
+		{
+			desc: "authorize owner",
+			op:   func() error { return svc.Authorize(context.Background(), token, tw.ID, twins.Read) },
+			err:  nil,
+		},
+		{
+			desc: "authorize other user",
+			op:   func() error { return svc.Authorize(context.Background(), otherToken, tw.ID, twins.Read) },
+			err:  twins.ErrNotFound,
+		},
+		{
+			desc: "authorize action on non-existing twin",
+			op:   func() error { return svc.Authorize(context.Background(), otherToken, wrongID, twins.Read) },
+			err:  twins.ErrNotFound,
+		},
+		{
+			desc: "authorize with wrong credentials",
+			op:   func() error { return svc.Authorize(context.Background(), wrongToken, tw.ID, twins.Read) },
+			err:  twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc: "issue key for twin of other user",
+			op: func() error {
+				_, err := svc.IssueTwinKey(context.Background(), otherToken, tw.ID, twins.Read, time.Minute)
+				return err
+			},
+			err: twins.ErrNotFound,
+		},
+		{
+			desc: "view twin of other user",
+			op: func() error {
+				_, err := svc.ViewTwin(context.Background(), otherToken, tw.ID)
+				return err
+			},
+			err: twins.ErrNotFound,
+		},
+		{
+			desc: "view twins of other user",
+			op: func() error {
+				_, err := svc.ViewTwins(context.Background(), otherToken, []string{tw.ID})
+				if be, ok := err.(*twins.BatchError); ok {
+					return be.Errors[tw.ID]
+				}
+				return err
+			},
+			err: twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.op()
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+}
+
+// outageAuth fails to identify tokens as if the auth service was unreachable
+// while it's down.
+type outageAuth struct {
+	mainflux.AuthNServiceClient
+	down bool
+}
+
+func (oa *outageAuth) Identify(ctx context.Context, in *mainflux.Token, opts ...grpc.CallOption) (*mainflux.UserID, error) {
+	if oa.down {
+		return nil, status.Error(codes.Unavailable, "auth service unavailable")
+	}
+	return oa.AuthNServiceClient.Identify(ctx, in, opts...)
+}
+
+func TestFailOpenReads(t *testing.T) {
+	otherToken := "other-token"
+	auth := &outageAuth{AuthNServiceClient: mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: email})}
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+
+	for _, failOpen := range []bool{true, false} {
+		auth.down = false
+		cfg := twins.Config{FailOpenReads: failOpen, IdentityTTL: time.Minute}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		_, err = svc.ViewTwin(context.Background(), token, tw.ID)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+		auth.down = true
+		readErr := twins.ErrUnauthorizedAccess
+		if failOpen {
+			readErr = nil
+		}
+
+		cases := []struct {
+			desc string
+			op   func() error
+			err  error
+		}{
+			{
+				desc: "view twin during auth outage",
+				op: func() error {
+					_, err := svc.ViewTwin(context.Background(), token, tw.ID)
+					return err
+				},
+				err: readErr,
+			},
+			{
+				desc: "list states during auth outage",
+				op: func() error {
+					_, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+					return err
+				},
+				err: readErr,
+			},
+			{
+				desc: "view twin with token not identified before auth outage",
+				op: func() error {
+					_, err := svc.ViewTwin(context.Background(), otherToken, tw.ID)
+					return err
+				},
+				err: twins.ErrUnauthorizedAccess,
+			},
+			{
+				desc: "update twin during auth outage",
+				op: func() error {
+					return svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID, Name: "updated"}, twins.Definition{})
+				},
+				err: twins.ErrUnauthorizedAccess,
+			},
+		}
+
+		for _, tc := range cases {
+			err := tc.op()
+			assert.Equal(t, tc.err, err, fmt.Sprintf("%s with fail-open reads %t: expected %s got %s\n", tc.desc, failOpen, tc.err, err))
+		}
+	}
+}
+
+func TestFailOpenReadsCacheSize(t *testing.T) {
+	otherToken := "other-token"
+	auth := &outageAuth{AuthNServiceClient: mocks.NewAuthNServiceClient(map[string]string{token: email, otherToken: email})}
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{FailOpenReads: true, IdentityTTL: time.Minute, IdentityCacheSize: 1}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	for _, tkn := range []string{token, otherToken} {
+		_, err = svc.ViewTwin(context.Background(), tkn, tw.ID)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	auth.down = true
+	cases := []struct {
+		desc  string
+		token string
+		err   error
+	}{
+		{
+			desc:  "view twin with evicted identity during auth outage",
+			token: token,
+			err:   twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:  "view twin with cached identity during auth outage",
+			token: otherToken,
+			err:   nil,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := svc.ViewTwin(context.Background(), tc.token, tw.ID)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	otherToken := "other-token"
+	svc := mocks.NewService(map[string]string{token: email, otherToken: "other@example.com"})
+
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{}, twins.Definition{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc   string
+		token  string
+		id     string
+		action twins.Action
+		err    error
+	}{
+		{
+			desc:   "authorize owner to read twin",
+			token:  token,
+			id:     tw.ID,
+			action: twins.Read,
+			err:    nil,
+		},
+		{
+			desc:   "authorize owner to write twin",
+			token:  token,
+			id:     tw.ID,
+			action: twins.Write,
+			err:    nil,
+		},
+		{
+			desc:   "authorize owner to delete twin",
+			token:  token,
+			id:     tw.ID,
+			action: twins.Delete,
+			err:    nil,
+		},
+		{
+			desc:   "authorize other user to read twin",
+			token:  otherToken,
+			id:     tw.ID,
+			action: twins.Read,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "authorize with wrong credentials",
+			token:  wrongToken,
+			id:     tw.ID,
+			action: twins.Read,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:   "authorize action on non-existing twin",
+			token:  token,
+			id:     wrongID,
+			action: twins.Read,
+			err:    twins.ErrUnauthorizedAccess,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.Authorize(context.Background(), tc.token, tc.id, tc.action)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+}
+
+func TestSaveStatesContentTypes(t *testing.T) {
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+
+	recs := mocks.CreateSenML(numRecs, attrName1)
+	pack := senml.Pack{Records: recs}
+	jsonPayload, err := senml.Encode(pack, senml.JSON)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	cborPayload, err := senml.Encode(pack, senml.CBOR)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	xmlPayload, err := senml.Encode(pack, senml.XML)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		contentType string
+		payload     []byte
+		size        uint64
+		invalid     bool
+		err         error
+	}{
+		{
+			desc:        "save states from JSON payload with default content type",
+			contentType: "",
+			payload:     jsonPayload,
+			size:        numRecs,
+			err:         nil,
+		},
+		{
+			desc:        "save states from JSON payload",
+			contentType: "application/senml+json",
+			payload:     jsonPayload,
+			size:        numRecs,
+			err:         nil,
+		},
+		{
+			desc:        "save states from CBOR payload",
+			contentType: "application/senml+cbor",
+			payload:     cborPayload,
+			size:        numRecs,
+			err:         nil,
+		},
+		{
+			desc:        "save states from XML payload",
+			contentType: "application/senml+xml",
+			payload:     xmlPayload,
+			size:        numRecs,
+			err:         nil,
+		},
+		{
+			desc:        "save states from JSON payload with CBOR content type",
+			contentType: "application/senml+cbor",
+			payload:     jsonPayload,
+			size:        0,
+			invalid:     true,
+		},
+		{
+			desc:        "save states with unsupported content type",
+			contentType: "application/octet-stream",
+			payload:     jsonPayload,
+			size:        0,
+			err:         twins.ErrUnsupportedContentType,
+		},
+		{
+			desc:        "save states from detected CBOR payload",
+			contentType: "",
+			payload:     cborPayload,
+			size:        numRecs,
+			err:         nil,
+		},
+		{
+			desc:        "save states from detected XML payload",
+			contentType: "",
+			payload:     xmlPayload,
+			size:        numRecs,
+			err:         nil,
+		},
+		{
+			desc:        "save states from payload of undetected content type",
+			contentType: "",
+			payload:     []byte("temperature=21"),
+			size:        0,
+			invalid:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{ContentType: tc.contentType}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		message.Payload = tc.payload
+
+		_, err = svc.SaveStates(message)
+		if tc.invalid {
+			assert.NotNil(t, err, fmt.Sprintf("%s: expected error got nil\n", tc.desc))
+		} else {
+			assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		}
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.size, page.Total, fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.size, page.Total))
+	}
+}
+
+func TestSaveStatesStrictSenML(t *testing.T) {
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	attr := def.Attributes[0]
+
+	jsonPayload := []byte(fmt.Sprintf(`[{"bn":"%s","v":1},{"bn":"%s","v":"invalid"}]`, attrName1, attrName1))
+	xmlPayload := []byte(fmt.Sprintf(`<sensml xmlns="urn:ietf:params:xml:ns:senml"><senml bn="%s" v="1"></senml><senml bn="%s" v="invalid"></senml></sensml>`, attrName1, attrName1))
+	val := 1.0
+	cborPayload, err := cbor.Marshal([]interface{}{
+		senml.Record{BaseName: attrName1, Value: &val},
+		map[int]string{-2: attrName1, 2: "invalid"},
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc        string
+		contentType string
+		payload     []byte
+		strict      bool
+		saved       uint64
+		invalid     uint64
+		rejected    bool
+	}{
+		{
+			desc:        "save states from JSON payload with invalid record in lenient mode",
+			contentType: "application/senml+json",
+			payload:     jsonPayload,
+			saved:       1,
+			invalid:     1,
+		},
+		{
+			desc:        "save states from CBOR payload with invalid record in lenient mode",
+			contentType: "application/senml+cbor",
+			payload:     cborPayload,
+			saved:       1,
+			invalid:     1,
+		},
+		{
+			desc:        "save states from XML payload with invalid record in lenient mode",
+			contentType: "application/senml+xml",
+			payload:     xmlPayload,
+			saved:       1,
+			invalid:     1,
+		},
+		{
+			desc:        "save states from JSON payload with invalid record in strict mode",
+			contentType: "application/senml+json",
+			payload:     jsonPayload,
+			strict:      true,
+			rejected:    true,
+		},
+		{
+			desc:        "save states from CBOR payload with invalid record in strict mode",
+			contentType: "application/senml+cbor",
+			payload:     cborPayload,
+			strict:      true,
+			rejected:    true,
+		},
+		{
+			desc:        "save states from XML payload with invalid record in strict mode",
+			contentType: "application/senml+xml",
+			payload:     xmlPayload,
+			strict:      true,
+			rejected:    true,
+		},
+		{
+			desc:        "save states from malformed pack in lenient mode",
+			contentType: "application/senml+json",
+			payload:     []byte(`{"bn":"invalid"}`),
+			rejected:    true,
+		},
+		{
+			desc:        "save states from malformed XML pack in lenient mode",
+			contentType: "application/senml+xml",
+			payload:     []byte(`<senml bn="invalid"></senml>`),
+			rejected:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{ContentType: tc.contentType, StrictSenML: tc.strict}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(attr, nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		message.Payload = tc.payload
+
+		res, err := svc.SaveStates(message)
+		if tc.rejected {
+			assert.NotNil(t, err, fmt.Sprintf("%s: expected error got nil\n", tc.desc))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		}
+		assert.Equal(t, tc.saved, res.Saved, fmt.Sprintf("%s: expected %d saved got %d\n", tc.desc, tc.saved, res.Saved))
+		assert.Equal(t, tc.invalid, res.Invalid, fmt.Sprintf("%s: expected %d invalid got %d\n", tc.desc, tc.invalid, res.Invalid))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Len(t, page.States, int(tc.saved), fmt.Sprintf("%s: expected %d states got %d\n", tc.desc, tc.saved, len(page.States)))
+	}
+}
+
+func TestPublishIngestionSummaries(t *testing.T) {
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+
+	cases := []struct {
+		desc     string
+		channel  string
+		recs     map[string]int
+		expected map[string]uint64
+	}{
+		{
+			desc:     "publish summaries of records stored per attribute",
+			channel:  "monitoring",
+			recs:     map[string]int{attrName1: 3, attrName2: 1},
+			expected: map[string]uint64{attrName1: 3, attrName2: 1},
+		},
+		{
+			desc:    "publish summaries without monitoring channel",
+			channel: "",
+			recs:    map[string]int{attrName1: 3, attrName2: 1},
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{MonitoringChannel: tc.channel}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		for _, attr := range def.Attributes {
+			message, err := mocks.CreateMessage(attr, mocks.CreateSenML(tc.recs[attr.Name], attr.Name))
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+			_, err = svc.SaveStates(message)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		}
+
+		summaries, err := svc.PublishIngestionSummaries()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		if tc.expected == nil {
+			assert.Empty(t, summaries, fmt.Sprintf("%s: expected no summaries got %d\n", tc.desc, len(summaries)))
+			continue
+		}
+		require.Len(t, summaries, 1, fmt.Sprintf("%s: expected 1 summary got %d\n", tc.desc, len(summaries)))
+		assert.Equal(t, tw.ID, summaries[0].TwinID, fmt.Sprintf("%s: expected twin %s got %s\n", tc.desc, tw.ID, summaries[0].TwinID))
+		assert.Equal(t, tc.expected, summaries[0].Attributes, fmt.Sprintf("%s: expected %v got %v\n", tc.desc, tc.expected, summaries[0].Attributes))
+
+		summaries, err = svc.PublishIngestionSummaries()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+		assert.Empty(t, summaries, fmt.Sprintf("%s: expected counts reset after publishing got %d summaries\n", tc.desc, len(summaries)))
+	}
+}
+
+func TestSimulateIngestion(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+	def.Attributes[1].MinInterval = time.Minute
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	val := 21.5
+	recs := mocks.CreateSenML(1, attrName1)
+	recs[0].Value = &val
+
+	message := func(attr twins.Attribute) []byte {
+		msg, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		b, err := proto.Marshal(msg)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		return b
+	}
+
+	msg, err := mocks.CreateMessage(def.Attributes[1], recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(msg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	other := def.Attributes[0]
+	other.Channel = "other"
+
+	cases := []struct {
+		desc      string
+		token     string
+		id        string
+		payload   []byte
+		matched   bool
+		attribute string
+		action    string
+		reason    string
+		err       error
+	}{
+		{
+			desc:      "simulate ingestion of matching message",
+			token:     token,
+			id:        tw.ID,
+			payload:   message(def.Attributes[0]),
+			matched:   true,
+			attribute: attrName1,
+			action:    "updated",
+			err:       nil,
+		},
+		{
+			desc:      "simulate ingestion of message within attribute minimal interval",
+			token:     token,
+			id:        tw.ID,
+			payload:   message(def.Attributes[1]),
+			matched:   true,
+			attribute: attrName2,
+			action:    "dropped",
+			reason:    "within minimal interval",
+			err:       nil,
+		},
+		{
+			desc:    "simulate ingestion of message not matching the twin",
+			token:   token,
+			id:      tw.ID,
+			payload: message(other),
+			matched: false,
+			action:  "ignored",
+			reason:  "no matching attribute",
+			err:     nil,
+		},
+		{
+			desc:    "simulate ingestion of malformed message",
+			token:   token,
+			id:      tw.ID,
+			payload: []byte("malformed"),
+			err:     twins.ErrMalformedEntity,
+		},
+		{
+			desc:    "simulate ingestion with wrong credentials",
+			token:   wrongToken,
+			id:      tw.ID,
+			payload: message(def.Attributes[0]),
+			err:     twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:    "simulate ingestion for non-existing twin",
+			token:   token,
+			id:      wrongID,
+			payload: message(def.Attributes[0]),
+			err:     twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		trace, err := svc.SimulateIngestion(context.Background(), tc.token, tc.id, tc.payload)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, tc.matched, trace.Matched, fmt.Sprintf("%s: expected matched %t got %t\n", tc.desc, tc.matched, trace.Matched))
+		require.Len(t, trace.Records, 1, fmt.Sprintf("%s: expected 1 record got %d\n", tc.desc, len(trace.Records)))
+		rt := trace.Records[0]
+		assert.Equal(t, tc.attribute, rt.Attribute, fmt.Sprintf("%s: expected attribute %s got %s\n", tc.desc, tc.attribute, rt.Attribute))
+		assert.Equal(t, tc.action, rt.Action, fmt.Sprintf("%s: expected action %s got %s\n", tc.desc, tc.action, rt.Action))
+		assert.Equal(t, tc.reason, rt.Reason, fmt.Sprintf("%s: expected reason %s got %s\n", tc.desc, tc.reason, rt.Reason))
+		v, _ := toFloat(rt.Value)
+		assert.Equal(t, val, v, fmt.Sprintf("%s: expected value %v got %v\n", tc.desc, val, v))
+	}
+
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(1), page.Total, fmt.Sprintf("expected simulation not to persist states got %d states\n", page.Total))
+	assert.NotContains(t, page.States[0].Payload, attrName1, "expected simulation not to modify the stored state\n")
+}
+
+// blockingStateRepository blocks state saves until released.
+type blockingStateRepository struct {
+	twins.StateRepository
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bsr blockingStateRepository) Save(ctx context.Context, st twins.State) error {
+	bsr.started <- struct{}{}
+	<-bsr.release
+	return bsr.StateRepository.Save(ctx, st)
+}
+
+func TestSaveStatesAsync(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	stateRepo := blockingStateRepository{
+		StateRepository: mocks.NewStateRepository(),
+		started:         make(chan struct{}, 10),
+		release:         make(chan struct{}),
+	}
+	cfg := twins.Config{AsyncWrites: true, WriteQueueSize: 1}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), stateRepo, uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attr := def.Attributes[0]
+
+	recs := mocks.CreateSenML(1, attrName1)
+	recs[0].Time = 100
+	message, err := mocks.CreateMessage(attr, recs)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	res, err := svc.SaveStates(message)
+	assert.Nil(t, err, fmt.Sprintf("save states with empty queue: unexpected error: %s\n", err))
+	assert.True(t, res.Queued, "save states with empty queue: expected records to be queued\n")
+	<-stateRepo.started
+
+	cases := []struct {
+		desc   string
+		time   float64
+		err    error
+		queued bool
+	}{
+		{
+			desc:   "save states while write is in progress",
+			time:   200,
+			err:    nil,
+			queued: true,
+		},
+		{
+			desc:   "save states with full queue",
+			time:   300,
+			err:    twins.ErrBackpressure,
+			queued: false,
+		},
+	}
+
+	for _, tc := range cases {
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].Time = tc.time
+		message, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		res, err := svc.SaveStates(message)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		assert.Equal(t, tc.queued, res.Queued, fmt.Sprintf("%s: expected queued %t got %t\n", tc.desc, tc.queued, res.Queued))
+	}
+
+	close(stateRepo.release)
+	persisted := func() bool {
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		return err == nil && page.Total == 2
+	}
+	assert.Eventually(t, persisted, time.Second, 10*time.Millisecond, "expected queued states to be persisted\n")
+}
+
+func TestSaveStatesConcurrencyLimit(t *testing.T) {
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	stateRepo := blockingStateRepository{
+		StateRepository: mocks.NewStateRepository(),
+		started:         make(chan struct{}, 10),
+		release:         make(chan struct{}),
+	}
+	cfg := twins.Config{MaxConcurrentSaves: 1, SaveQueueTimeout: 10 * time.Millisecond}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), stateRepo, uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attr := def.Attributes[0]
+
+	message := func(at float64) *messaging.Message {
+		recs := mocks.CreateSenML(1, attrName1)
+		recs[0].Time = at
+		msg, err := mocks.CreateMessage(attr, recs)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		return msg
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := svc.SaveStates(message(100))
+		done <- err
+	}()
+	<-stateRepo.started
+
+	_, err = svc.SaveStates(message(200))
+	assert.Equal(t, twins.ErrOverloaded, err, fmt.Sprintf("save states over the limit: expected %s got %s\n", twins.ErrOverloaded, err))
+
+	close(stateRepo.release)
+	err = <-done
+	assert.Nil(t, err, fmt.Sprintf("save states within the limit: unexpected error: %s\n", err))
+
+	_, err = svc.SaveStates(message(300))
+	assert.Nil(t, err, fmt.Sprintf("save states after release: unexpected error: %s\n", err))
+
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(2), page.Total, fmt.Sprintf("expected 2 states got %d\n", page.Total))
+}
+
+// slowStateRepository delays state saves.
+type slowStateRepository struct {
+	twins.StateRepository
+	delay time.Duration
+}
+
+func (ssr slowStateRepository) Save(ctx context.Context, st twins.State) error {
+	time.Sleep(ssr.delay)
+	return ssr.StateRepository.Save(ctx, st)
+}
+
+func TestSaveStatesTimeout(t *testing.T) {
+	total := 5
+
+	cases := []struct {
+		desc    string
+		timeout time.Duration
+		partial bool
+		err     error
+	}{
+		{
+			desc:    "save states without timeout",
+			timeout: 0,
+			partial: false,
+			err:     nil,
+		},
+		{
+			desc:    "save states exceeding timeout",
+			timeout: 60 * time.Millisecond,
+			partial: true,
+			err:     twins.ErrPartialWrite,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		stateRepo := slowStateRepository{StateRepository: mocks.NewStateRepository(), delay: 40 * time.Millisecond}
+		cfg := twins.Config{SaveTimeout: tc.timeout}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), stateRepo, uuid.NewMock(), "chanID", cfg, nil)
+
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(total, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		res, err := svc.SaveStates(message)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, res.Saved, page.Total, fmt.Sprintf("%s: expected %d persisted states got %d\n", tc.desc, res.Saved, page.Total))
+		if tc.partial {
+			assert.True(t, res.Saved > 0 && res.Saved < uint64(total), fmt.Sprintf("%s: expected some of the records to be saved got %d\n", tc.desc, res.Saved))
+			continue
+		}
+		assert.Equal(t, uint64(total), res.Saved, fmt.Sprintf("%s: expected %d saved records got %d\n", tc.desc, total, res.Saved))
+	}
+}
+
+// failingStateRepository fails the given number of state saves.
+type failingStateRepository struct {
+	twins.StateRepository
+	failures *int
+}
+
+func (fsr failingStateRepository) Save(ctx context.Context, st twins.State) error {
+	if *fsr.failures > 0 {
+		*fsr.failures--
+		return errors.New("failed to save state")
+	}
+	return fsr.StateRepository.Save(ctx, st)
+}
+
+func TestHandleDelivery(t *testing.T) {
+	deadLetterChan := "dead-letters"
+
+	cases := []struct {
+		desc        string
+		failures    int
+		redeliver   int
+		malformed   bool
+		failPublish bool
+		deliveries  int
+		acked       bool
+		deadLetters int
+	}{
+		{
+			desc:       "handle delivery saved on first attempt",
+			failures:   0,
+			redeliver:  3,
+			deliveries: 1,
+			acked:      true,
+		},
+		{
+			desc:       "handle delivery saved after redelivery",
+			failures:   2,
+			redeliver:  3,
+			deliveries: 3,
+			acked:      true,
+		},
+		{
+			desc:        "handle delivery failing after all redeliveries",
+			failures:    10,
+			redeliver:   2,
+			deliveries:  3,
+			acked:       true,
+			deadLetters: 1,
+		},
+		{
+			desc:        "handle delivery of malformed message",
+			redeliver:   3,
+			malformed:   true,
+			deliveries:  1,
+			acked:       true,
+			deadLetters: 1,
+		},
+		{
+			desc:        "handle delivery failing to be dead-lettered",
+			failures:    10,
+			redeliver:   0,
+			failPublish: true,
+			deliveries:  5,
+			acked:       false,
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewRedeliveringBroker()
+		failures := tc.failures
+		stateRepo := failingStateRepository{StateRepository: mocks.NewStateRepository(), failures: &failures}
+		cfg := twins.Config{MaxRedeliveries: tc.redeliver, DeadLetterChannel: deadLetterChan}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), stateRepo, uuid.NewMock(), "", cfg, nil)
+
+		def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+		_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		if tc.malformed {
+			message.Payload = []byte("malformed")
+		}
+
+		broker.SetFailing(tc.failPublish)
+		deliveries, acked := broker.Deliver(message, svc.HandleDelivery, 5)
+		assert.Equal(t, tc.deliveries, deliveries, fmt.Sprintf("%s: expected %d deliveries got %d\n", tc.desc, tc.deliveries, deliveries))
+		assert.Equal(t, tc.acked, acked, fmt.Sprintf("%s: expected acked %t got %t\n", tc.desc, tc.acked, acked))
+
+		dls := broker.Published(deadLetterChan)
+		assert.Len(t, dls, tc.deadLetters, fmt.Sprintf("%s: expected %d dead letters got %d\n", tc.desc, tc.deadLetters, len(dls)))
+		for _, dl := range dls {
+			subtopic := fmt.Sprintf("%s.%s", message.Channel, message.Subtopic)
+			assert.Equal(t, subtopic, dl.Subtopic, fmt.Sprintf("%s: expected dead letter subtopic %s got %s\n", tc.desc, subtopic, dl.Subtopic))
+			assert.Equal(t, message.Payload, dl.Payload, fmt.Sprintf("%s: expected dead letter payload %s got %s\n", tc.desc, message.Payload, dl.Payload))
+		}
+	}
+}
+
+func TestHandleDeliveryPartialWrite(t *testing.T) {
+	total := 5
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+	broker := mocks.NewRedeliveringBroker()
+	stateRepo := slowStateRepository{StateRepository: mocks.NewStateRepository(), delay: 40 * time.Millisecond}
+	cfg := twins.Config{SaveTimeout: 60 * time.Millisecond, MaxRedeliveries: total}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), stateRepo, uuid.NewMock(), "", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(total, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	deliveries, acked := broker.Deliver(message, svc.HandleDelivery, total)
+	assert.True(t, deliveries > 1, fmt.Sprintf("expected partially written message to be redelivered got %d deliveries\n", deliveries))
+	assert.True(t, acked, "expected redelivered message to be acked")
+
+	page, err := svc.ListStates(context.Background(), token, 0, 10, tw.ID, twins.Strong, twins.Asc, false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(total), page.Total, fmt.Sprintf("expected %d states got %d\n", total, page.Total))
+	for i, st := range page.States {
+		assert.Equal(t, int64(i), st.ID, fmt.Sprintf("expected state %d got %d\n", i, st.ID))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := twins.WithRequestID(context.Background(), "request")
+
+	cases := []struct {
+		desc      string
+		ctx       context.Context
+		generated bool
+		id        string
+	}{
+		{
+			desc: "ensure request ID of context carrying it",
+			ctx:  ctx,
+			id:   "request",
+		},
+		{
+			desc:      "ensure request ID of context not carrying it",
+			ctx:       context.Background(),
+			generated: true,
+		},
+	}
+
+	for _, tc := range cases {
+		id := twins.RequestID(twins.EnsureRequestID(tc.ctx))
+		if tc.generated {
+			assert.NotEmpty(t, id, fmt.Sprintf("%s: expected generated request ID\n", tc.desc))
+			continue
+		}
+		assert.Equal(t, tc.id, id, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.id, id))
+	}
+
+	svc := mocks.NewService(map[string]string{token: email})
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	_, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		message, err := mocks.CreateMessage(def.Attributes[0], mocks.CreateSenML(1, attrName1))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		res, err := svc.SaveStates(message)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		assert.NotEmpty(t, res.RequestID, "save states: expected request ID\n")
+		ids[res.RequestID] = true
+	}
+	assert.Len(t, ids, 2, fmt.Sprintf("save states: expected distinct request IDs got %v\n", ids))
+}
+
+func TestValidateDefinition(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	valid := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+
+	invalid := mocks.CreateDefinition([]string{attrName1, attrName1, ""}, []string{attrSubtopic1, attrSubtopic2, attrSubtopic3})
+	invalid.Delta = -1
+	invalid.Attributes[1].Channel = invalid.Attributes[0].Channel
+	invalid.Attributes[1].Aliases = []string{attrSubtopic1}
+	invalid.Attributes[2].Smoothing = 1.5
+	invalid.Attributes[2].Range = &twins.ValueRange{Min: 1, Max: 0}
+	precision := -1
+	invalid.Attributes[2].Precision = &precision
+
+	var names, subtopics []string
+	for i := 0; i <= 100; i++ {
+		names = append(names, fmt.Sprintf("%s-%d", attrName1, i))
+		subtopics = append(subtopics, fmt.Sprintf("%s-%d", attrSubtopic1, i))
+	}
+	large := mocks.CreateDefinition(names, subtopics)
+
+	cases := []struct {
+		desc     string
+		def      twins.Definition
+		problems int
+	}{
+		{
+			desc:     "validate valid definition",
+			def:      valid,
+			problems: 0,
+		},
+		{
+			desc:     "validate empty definition",
+			def:      twins.Definition{},
+			problems: 0,
+		},
+		{
+			desc:     "validate definition with many problems",
+			def:      invalid,
+			problems: 7,
+		},
+		{
+			desc:     "validate definition with too many attributes",
+			def:      large,
+			problems: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.ValidateDefinition(context.Background(), tc.def)
+		if tc.problems == 0 {
+			assert.Nil(t, err, fmt.Sprintf("%s: expected no error got %s\n", tc.desc, err))
+			continue
+		}
+		de, ok := err.(*twins.DefinitionError)
+		require.True(t, ok, fmt.Sprintf("%s: expected definition error got %s\n", tc.desc, err))
+		assert.Len(t, de.Problems, tc.problems, fmt.Sprintf("%s: expected %d problems got %v\n", tc.desc, tc.problems, de.Problems))
+
+		_, err = svc.AddTwin(context.Background(), token, twins.Twin{}, tc.def)
+		assert.True(t, errors.Is(err, twins.ErrMalformedEntity), fmt.Sprintf("%s: expected %s got %s\n", tc.desc, twins.ErrMalformedEntity, err))
+		ve, ok := err.(*twins.ValidationError)
+		require.True(t, ok, fmt.Sprintf("%s: expected validation error got %s\n", tc.desc, err))
+		assert.Len(t, ve.Fields, tc.problems, fmt.Sprintf("%s: expected %d invalid fields got %v\n", tc.desc, tc.problems, ve.Fields))
+	}
+}
+
+func TestValidateDefinitionUnits(t *testing.T) {
+	cases := []struct {
+		desc     string
+		validate bool
+		unit     string
+		err      string
+	}{
+		{
+			desc:     "validate UCUM unit",
+			validate: true,
+			unit:     "Cel",
+			err:      "",
+		},
+		{
+			desc:     "validate unit alias",
+			validate: true,
+			unit:     "degC",
+			err:      `unknown UCUM unit "degC", use "Cel"`,
+		},
+		{
+			desc:     "validate unknown unit",
+			validate: true,
+			unit:     "celsius",
+			err:      `unknown UCUM unit "celsius"`,
+		},
+		{
+			desc:     "validate unknown unit without unit validation",
+			validate: false,
+			unit:     "celsius",
+			err:      "",
+		},
+	}
+
+	for _, tc := range cases {
+		auth := mocks.NewAuthNServiceClient(map[string]string{token: email})
+		broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+		cfg := twins.Config{ValidateUnits: tc.validate, UnitAliases: map[string]string{"degC": "Cel"}}
+		svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+		def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{attrSubtopic1, attrSubtopic2})
+		def.Attributes[1].Unit = tc.unit
+		_, err := svc.AddTwin(context.Background(), token, twins.Twin{}, def)
+		if tc.err == "" {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s\n", tc.desc, err))
+			continue
+		}
+		assert.True(t, errors.Is(err, twins.ErrMalformedEntity), fmt.Sprintf("%s: expected %s got %s\n", tc.desc, twins.ErrMalformedEntity, err))
+		ve, ok := err.(*twins.ValidationError)
+		require.True(t, ok, fmt.Sprintf("%s: expected validation error got %s\n", tc.desc, err))
+		require.Len(t, ve.Fields, 1, fmt.Sprintf("%s: expected 1 invalid field got %v\n", tc.desc, ve.Fields))
+		assert.Equal(t, twins.FieldError{Field: "definition.attributes[1].unit", Message: tc.err}, ve.Fields[0], fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, ve.Fields[0]))
+	}
+}
+
+func TestDefaultSubtopic(t *testing.T) {
+	svc := mocks.NewService(map[string]string{token: email})
+
+	def := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{"", attrSubtopic2})
+	tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, "", def.Attributes[0].Subtopic, "expected the added definition to be left intact")
+
+	tw, err = svc.ViewTwin(context.Background(), token, tw.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attrs := tw.Definitions[len(tw.Definitions)-1].Attributes
+	assert.Equal(t, attrName1, attrs[0].Subtopic, fmt.Sprintf("expected subtopic %s got %s", attrName1, attrs[0].Subtopic))
+	assert.Equal(t, attrSubtopic2, attrs[1].Subtopic, fmt.Sprintf("expected subtopic %s got %s", attrSubtopic2, attrs[1].Subtopic))
+
+	message, err := mocks.CreateMessage(attrs[0], mocks.CreateSenML(1, attrName1))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, attrName1, message.Subtopic, fmt.Sprintf("expected message subtopic %s got %s", attrName1, message.Subtopic))
+	res, err := svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, uint64(1), res.Saved, fmt.Sprintf("expected 1 saved record got %d", res.Saved))
+
+	update := mocks.CreateDefinition([]string{attrName2}, []string{""})
+	err = svc.UpdateTwin(context.Background(), token, twins.Twin{ID: tw.ID}, update)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	tw, err = svc.ViewTwin(context.Background(), token, tw.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	attrs = tw.Definitions[len(tw.Definitions)-1].Attributes
+	assert.Equal(t, attrName2, attrs[0].Subtopic, fmt.Sprintf("expected updated subtopic %s got %s", attrName2, attrs[0].Subtopic))
+
+	// Aliases collide with the defaulted subtopics.
+	colliding := mocks.CreateDefinition([]string{attrName1, attrName2}, []string{"", attrSubtopic2})
+	colliding.Attributes[1].Channel = colliding.Attributes[0].Channel
+	colliding.Attributes[1].Aliases = []string{attrName1}
+	err = svc.ValidateDefinition(context.Background(), colliding)
+	de, ok := err.(*twins.DefinitionError)
+	require.True(t, ok, fmt.Sprintf("expected definition error got %s", err))
+	assert.Len(t, de.Fields, 1, fmt.Sprintf("expected 1 invalid field got %v", de.Fields))
+}
+
+func TestMigrateDefinitions(t *testing.T) {
+	adminToken := "admin-token"
+	adminEmail := "admin@example.com"
+	auth := mocks.NewAuthNServiceClient(map[string]string{token: email, adminToken: adminEmail})
+	broker := mocks.NewBroker(map[string]string{"chanID": "chanID"})
+	cfg := twins.Config{AdminEmail: adminEmail, EventLogSize: 100}
+	svc := twins.New(broker, auth, mocks.NewTwinRepository(), mocks.NewStateRepository(), uuid.NewMock(), "chanID", cfg, nil)
+
+	def := mocks.CreateDefinition([]string{attrName1}, []string{attrSubtopic1})
+	def.Attributes[0].Unit = "C"
+	var ids []string
+	for i := 0; i < 2; i++ {
+		tw, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Metadata: twins.Metadata{"model": "sensor"}}, def)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		ids = append(ids, tw.ID)
+	}
+	stale, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Metadata: twins.Metadata{"model": "sensor"}}, mocks.CreateDefinition([]string{attrName2}, []string{attrSubtopic2}))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	other, err := svc.AddTwin(context.Background(), token, twins.Twin{Owner: email, Metadata: twins.Metadata{"model": "gateway"}}, def)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	val := 20.0
+	message, err := mocks.CreateMessage(def.Attributes[0], []senml.Record{{BaseName: attrName1, Value: &val}})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.SaveStates(message)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	hashes := make(map[string]string)
+	for _, id := range ids {
+		page, err := svc.ListStates(context.Background(), token, 0, 1, id, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		hashes[id] = page.States[0].Hash
+	}
+
+	migration := twins.Migration{
+		Steps: []twins.MigrationStep{
+			{Op: twins.RenameAttribute, Attribute: attrName1, To: "temp"},
+			{Op: twins.ChangeUnit, Attribute: "temp", To: "F", Scale: 1.8, Offset: 32},
+		},
+	}
+
+	cases := []struct {
+		desc      string
+		token     string
+		filter    twins.Metadata
+		migration twins.Migration
+		migrated  []string
+		failed    []string
+		err       error
+	}{
+		{
+			desc:      "migrate definitions with wrong credentials",
+			token:     wrongToken,
+			filter:    twins.Metadata{"model": "sensor"},
+			migration: migration,
+			err:       twins.ErrUnauthorizedAccess,
+		},
+		{
+			desc:      "migrate definitions with empty filter",
+			token:     token,
+			filter:    twins.Metadata{},
+			migration: migration,
+			err:       twins.ErrMalformedEntity,
+		},
+		{
+			desc:      "migrate definitions without steps",
+			token:     token,
+			filter:    twins.Metadata{"model": "sensor"},
+			migration: twins.Migration{},
+			err:       twins.ErrMalformedEntity,
+		},
+		{
+			desc:      "migrate definitions of matching twins",
+			token:     token,
+			filter:    twins.Metadata{"model": "sensor"},
+			migration: migration,
+			migrated:  ids,
+			failed:    []string{stale.ID},
+		},
+	}
+
+	for _, tc := range cases {
+		mr, err := svc.MigrateDefinitions(context.Background(), tc.token, tc.filter, tc.migration)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+		if err != nil {
+			continue
+		}
+		assert.ElementsMatch(t, tc.migrated, mr.Migrated, fmt.Sprintf("%s: expected migrated %v got %v\n", tc.desc, tc.migrated, mr.Migrated))
+		var failed []string
+		for id := range mr.Failed {
+			failed = append(failed, id)
+		}
+		assert.ElementsMatch(t, tc.failed, failed, fmt.Sprintf("%s: expected failed %v got %v\n", tc.desc, tc.failed, failed))
+	}
+
+	for _, id := range ids {
+		tw, err := svc.ViewTwin(context.Background(), token, id)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		attr := tw.Definitions[len(tw.Definitions)-1].Attributes[0]
+		assert.Equal(t, "temp", attr.Name, fmt.Sprintf("expected renamed attribute for twin %s\n", id))
+		assert.Equal(t, "F", attr.Unit, fmt.Sprintf("expected changed unit for twin %s\n", id))
+
+		page, err := svc.ListStates(context.Background(), token, 0, 10, id, twins.Strong, twins.Asc, false)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		require.Len(t, page.States, 1, fmt.Sprintf("expected single state for twin %s\n", id))
+		st := page.States[0]
+		assert.Equal(t, tw.Definitions[len(tw.Definitions)-1].ID, st.Definition, fmt.Sprintf("expected state of migrated definition for twin %s\n", id))
+		assert.Equal(t, 68.0, st.Payload["temp"], fmt.Sprintf("expected converted value for twin %s\n", id))
+		assert.Nil(t, st.Payload[attrName1], fmt.Sprintf("expected renamed value for twin %s\n", id))
+	}
+
+	tw, err := svc.ViewTwin(context.Background(), token, other.ID)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, 1, len(tw.Definitions), "expected unmigrated twin not matching the filter")
+
+	events, err := svc.ReplayEvents(context.Background(), adminToken, 1)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	rehashes := make(map[string]map[string]interface{})
+	for ev := range events {
+		if ev.Operation != "rehash" {
+			continue
+		}
+		var rh map[string]interface{}
+		err := json.Unmarshal(ev.Payload, &rh)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		rehashes[rh["twin_id"].(string)] = rh
+	}
+	require.Len(t, rehashes, len(ids), fmt.Sprintf("expected %d rehash events got %d\n", len(ids), len(rehashes)))
+	for _, id := range ids {
+		expected := map[string]interface{}{
+			"twin_id": id,
+			"reason":  "migration",
+			"from":    0.0,
+			"to":      0.0,
+			"hashes":  map[string]interface{}{"0": hashes[id]},
+		}
+		assert.Equal(t, expected, rehashes[id], fmt.Sprintf("expected rehash event %v got %v\n", expected, rehashes[id]))
+	}
+}
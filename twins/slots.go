@@ -0,0 +1,50 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import "time"
+
+// slots limits the number of messages processed concurrently. Messages that
+// exceed the limit wait for a slot to be released.
+type slots struct {
+	sem     chan struct{}
+	timeout time.Duration
+}
+
+func newSlots(size int, timeout time.Duration) *slots {
+	return &slots{
+		sem:     make(chan struct{}, size),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot, waiting for one to be released if all of them are
+// taken. It reports false if no slot is released within the timeout. Zero
+// timeout waits indefinitely.
+func (s *slots) acquire() bool {
+	if s.timeout <= 0 {
+		s.sem <- struct{}{}
+		return true
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *slots) release() {
+	<-s.sem
+}
@@ -5,6 +5,9 @@ package twins
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"time"
 )
 
@@ -15,8 +18,109 @@ type State struct {
 	Definition int
 	Created    time.Time
 	Payload    map[string]interface{}
+	Hash       string
+	PrevHash   string
+	// AttributeTimes holds the time of the last stored value of each
+	// attribute and is used to enforce attribute minimal interval.
+	AttributeTimes map[string]time.Time
+	// Note is an annotation attached by an operator. It isn't covered by the
+	// state hash.
+	Note string
+	// Smoothed holds the exponentially weighted moving averages of the
+	// attributes that declare a smoothing factor. It isn't covered by the
+	// state hash.
+	Smoothed map[string]float64
+	// Sums holds the last sum, i.e. the integrated value such as the total
+	// energy, reported by SenML records of each attribute. Sums are kept
+	// apart from the values the records may carry as well, and aren't
+	// covered by the state hash.
+	Sums map[string]float64
+	// Backfilled reports that the state was created from records older
+	// than the state preceding it, so aggregates covering its time may be
+	// stale.
+	Backfilled bool
+	// Raw is the SenML payload of the message the state was last saved or
+	// updated from. It's stored only if raw payloads storage is enabled and
+	// isn't covered by the state hash.
+	Raw []byte
+	// Source is the publisher of the message the state was last saved or
+	// updated from. It's recorded only if source capture is enabled and
+	// isn't covered by the state hash.
+	Source string
 }
 
+// clone returns a copy of the state that doesn't share maps with it.
+func (st State) clone() State {
+	if st.Payload != nil {
+		payload := make(map[string]interface{}, len(st.Payload))
+		for k, v := range st.Payload {
+			payload[k] = v
+		}
+		st.Payload = payload
+	}
+	if st.AttributeTimes != nil {
+		times := make(map[string]time.Time, len(st.AttributeTimes))
+		for k, v := range st.AttributeTimes {
+			times[k] = v
+		}
+		st.AttributeTimes = times
+	}
+	if st.Smoothed != nil {
+		smoothed := make(map[string]float64, len(st.Smoothed))
+		for k, v := range st.Smoothed {
+			smoothed[k] = v
+		}
+		st.Smoothed = smoothed
+	}
+	if st.Sums != nil {
+		sums := make(map[string]float64, len(st.Sums))
+		for k, v := range st.Sums {
+			sums[k] = v
+		}
+		st.Sums = sums
+	}
+
+	return st
+}
+
+// checksum computes SHA-256 hash of the state content chained to the hash
+// of the previous state. Creation time is truncated to milliseconds to match
+// the precision of the underlying storage.
+func (st State) checksum() (string, error) {
+	payload, err := json.Marshal(st.Payload)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal([]interface{}{
+		st.PrevHash,
+		st.TwinID,
+		st.ID,
+		st.Definition,
+		st.Created.UnixNano() / millisec,
+		json.RawMessage(payload),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Consistency represents the read consistency level used when retrieving
+// states.
+type Consistency int
+
+const (
+	// Strong consistency reads states from the primary storage and reflects
+	// all the acknowledged writes.
+	Strong Consistency = iota
+	// Eventual consistency allows states to be read from a replica or cache
+	// which may lag behind the primary storage.
+	Eventual
+)
+
 // StatesPage contains page related metadata as well as a list of twins that
 // belong to this page.
 type StatesPage struct {
@@ -24,6 +128,99 @@ type StatesPage struct {
 	States []State
 }
 
+// BucketCount is the number of states created within the time bucket
+// starting at Start.
+type BucketCount struct {
+	Start time.Time
+	Count uint64
+}
+
+// Order represents the order in which states are retrieved.
+type Order int
+
+const (
+	// Asc order retrieves the oldest states first.
+	Asc Order = iota
+	// Desc order retrieves the newest states first.
+	Desc
+)
+
+// Operator represents the comparison attribute values are matched with.
+type Operator int
+
+const (
+	// Gt matches values greater than the reference value.
+	Gt Operator = iota
+	// Ge matches values greater than or equal to the reference value.
+	Ge
+	// Lt matches values less than the reference value.
+	Lt
+	// Le matches values less than or equal to the reference value.
+	Le
+	// Eq matches values equal to the reference value.
+	Eq
+)
+
+// Match reports whether the value compares to the reference value as
+// required by the operator.
+func (op Operator) Match(val, ref float64) bool {
+	switch op {
+	case Gt:
+		return val > ref
+	case Ge:
+		return val >= ref
+	case Lt:
+		return val < ref
+	case Le:
+		return val <= ref
+	case Eq:
+		return val == ref
+	default:
+		return false
+	}
+}
+
+func (op Operator) valid() bool {
+	return op >= Gt && op <= Eq
+}
+
+// Granularity represents the calendar periods states are partitioned into.
+type Granularity int
+
+const (
+	// Daily partitions states by day.
+	Daily Granularity = iota
+	// Monthly partitions states by month.
+	Monthly
+	// Yearly partitions states by year.
+	Yearly
+)
+
+// Truncate returns the start of the period, in the location, the time falls
+// within.
+func (g Granularity) Truncate(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch g {
+	case Monthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	case Yearly:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
+
+func (g Granularity) valid() bool {
+	return g >= Daily && g <= Yearly
+}
+
+// Partition is the number of states created within the calendar period
+// starting at Start.
+type Partition struct {
+	Start time.Time
+	Count uint64
+}
+
 // StateRepository specifies a state persistence API.
 type StateRepository interface {
 	// Save persists the state
@@ -32,12 +229,68 @@ type StateRepository interface {
 	// Update updates the state
 	Update(context.Context, State) error
 
+	// Annotate sets the note of the state with given id that belongs to
+	// the twin specified by twinID.
+	Annotate(ctx context.Context, twinID string, id int64, note string) error
+
+	// RemoveAll removes all the states, along with their notes, that belong
+	// to the twin specified by twinID.
+	RemoveAll(ctx context.Context, twinID string) error
+
+	// Reindex rebuilds the indexes the states of the twin specified by
+	// twinID are queried by, such as the attribute and creation time ones.
+	Reindex(ctx context.Context, twinID string) error
+
 	// Count returns the number of states related to state
 	Count(context.Context, Twin) (int64, error)
 
-	// RetrieveAll retrieves the subset of states related to twin specified by id
-	RetrieveAll(ctx context.Context, offset uint64, limit uint64, id string) (StatesPage, error)
+	// CountSince returns the number of states of all twins created at or
+	// after the given time. Zero time counts all the states.
+	CountSince(ctx context.Context, since time.Time) (int64, error)
+
+	// CountByTwins returns the total number of states of the twins
+	// specified by ids.
+	CountByTwins(ctx context.Context, ids []string) (int64, error)
+
+	// RetrieveAll retrieves the subset of states related to twin specified by
+	// id, using the provided read consistency, in the provided order.
+	RetrieveAll(ctx context.Context, offset uint64, limit uint64, id string, consistency Consistency, order Order) (StatesPage, error)
 
 	// RetrieveLast retrieves the last saved state
 	RetrieveLast(ctx context.Context, id string) (State, error)
+
+	// RetrieveByTwins retrieves the subset of states of the twins specified
+	// by ids, newest first.
+	RetrieveByTwins(ctx context.Context, ids []string, offset, limit uint64) (StatesPage, error)
+
+	// ListUntil retrieves the subset of states of twin specified by id
+	// created at or before the given time, newest first.
+	ListUntil(ctx context.Context, id string, until time.Time, offset, limit uint64) (StatesPage, error)
+
+	// ListByAttribute retrieves the subset of states of twin specified by
+	// id whose payload contains the attribute, created between from and to
+	// inclusive and sorted by creation time. Zero to means no upper bound.
+	ListByAttribute(ctx context.Context, id, attr string, from, to time.Time, offset, limit uint64) (StatesPage, error)
+
+	// ListByValue retrieves the subset of states of twin specified by id
+	// whose numeric value of the attribute matches the operator applied to
+	// the given value, sorted by creation time.
+	ListByValue(ctx context.Context, id, attr string, op Operator, value float64, offset, limit uint64) (StatesPage, error)
+
+	// ListBySource retrieves the subset of states of twin specified by id
+	// last saved or updated from messages of the given publisher, in the
+	// provided order.
+	ListBySource(ctx context.Context, id, source string, offset, limit uint64, order Order) (StatesPage, error)
+
+	// CountByBucket returns the number of states of twin specified by id
+	// created within each bucket of the given size, starting at from and
+	// ending before to. Buckets without states are omitted, and the rest are
+	// sorted by start time.
+	CountByBucket(ctx context.Context, id string, from, to time.Time, bucket time.Duration) ([]BucketCount, error)
+
+	// CountByPartition returns the number of states of twin specified by id
+	// created within each calendar period of the given granularity, in the
+	// location. Periods without states are omitted, and the rest are sorted
+	// by start time.
+	CountByPartition(ctx context.Context, id string, granularity Granularity, loc *time.Location) ([]Partition, error)
 }
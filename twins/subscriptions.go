@@ -0,0 +1,68 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// subjectPrefix is the prefix of the message broker subjects channel
+// messages are published to.
+const subjectPrefix = "channels"
+
+// SubInfo describes the traffic received on a message broker subject.
+type SubInfo struct {
+	Subject     string
+	Messages    uint64
+	LastMessage time.Time
+}
+
+// subscriptions counts the messages received per subject.
+type subscriptions struct {
+	mu       sync.Mutex
+	subjects map[string]SubInfo
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		subjects: make(map[string]SubInfo),
+	}
+}
+
+func (s *subscriptions) record(channel, subtopic string, t time.Time) {
+	subject := fmt.Sprintf("%s.%s", subjectPrefix, channel)
+	if subtopic != "" {
+		subject = fmt.Sprintf("%s.%s", subject, subtopic)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := s.subjects[subject]
+	info.Subject = subject
+	info.Messages++
+	if t.After(info.LastMessage) {
+		info.LastMessage = t
+	}
+	s.subjects[subject] = info
+}
+
+// list returns the subjects sorted by name.
+func (s *subscriptions) list() []SubInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]SubInfo, 0, len(s.subjects))
+	for _, info := range s.subjects {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Subject < infos[j].Subject
+	})
+
+	return infos
+}
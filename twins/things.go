@@ -0,0 +1,18 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import "context"
+
+// ThingVerifier verifies the things twins are linked to, and the channels
+// their states are read from.
+type ThingVerifier interface {
+	// Verify checks that the thing identified by thingID exists and is
+	// accessible with the token. ErrNotFound is returned if it isn't.
+	Verify(ctx context.Context, token, thingID string) error
+
+	// VerifyChannel checks that the channel identified by chanID exists and
+	// is accessible with the token. ErrNotFound is returned if it isn't.
+	VerifyChannel(ctx context.Context, token, chanID string) error
+}
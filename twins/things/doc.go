@@ -0,0 +1,6 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package things contains the thing verifier backed by the Mainflux things
+// service.
+package things
@@ -0,0 +1,65 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package things
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+	mfsdk "github.com/mainflux/mainflux/pkg/sdk/go"
+	"github.com/mainflux/mainflux/twins"
+)
+
+var (
+	errNotFound  = status(http.StatusNotFound)
+	errForbidden = status(http.StatusForbidden)
+)
+
+var _ twins.ThingVerifier = (*thingVerifier)(nil)
+
+type thingVerifier struct {
+	sdk mfsdk.SDK
+}
+
+// NewThingVerifier instantiates thing verifier fetching things from the
+// things service through the SDK.
+func NewThingVerifier(sdk mfsdk.SDK) twins.ThingVerifier {
+	return &thingVerifier{
+		sdk: sdk,
+	}
+}
+
+func (tv *thingVerifier) Verify(_ context.Context, token, thingID string) error {
+	_, err := tv.sdk.Thing(thingID, token)
+
+	// Things the user can't access are reported as missing, so the twin
+	// can't be linked to them either way.
+	return notFound(err)
+}
+
+func (tv *thingVerifier) VerifyChannel(_ context.Context, token, chanID string) error {
+	_, err := tv.sdk.Channel(chanID, token)
+	return notFound(err)
+}
+
+// notFound maps the errors of fetching entities the user can't access to
+// twins.ErrNotFound.
+func notFound(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Contains(err, errNotFound) || errors.Contains(err, errForbidden) {
+		return twins.ErrNotFound
+	}
+
+	return err
+}
+
+// status is the error the SDK wraps failed fetches with for the status code.
+func status(code int) error {
+	return errors.New(fmt.Sprintf("%d %s", code, http.StatusText(code)))
+}
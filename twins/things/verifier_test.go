@@ -0,0 +1,131 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package things_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mfsdk "github.com/mainflux/mainflux/pkg/sdk/go"
+	"github.com/mainflux/mainflux/twins"
+	"github.com/mainflux/mainflux/twins/things"
+	"github.com/stretchr/testify/assert"
+)
+
+const token = "token"
+
+func TestVerify(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/things/existing":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"existing","name":"thing"}`))
+		case "/things/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tv := things.NewThingVerifier(mfsdk.NewSDK(mfsdk.Config{BaseURL: ts.URL}))
+
+	cases := []struct {
+		desc    string
+		token   string
+		thingID string
+		err     error
+	}{
+		{
+			desc:    "verify existing thing",
+			token:   token,
+			thingID: "existing",
+			err:     nil,
+		},
+		{
+			desc:    "verify non-existing thing",
+			token:   token,
+			thingID: "missing",
+			err:     twins.ErrNotFound,
+		},
+		{
+			desc:    "verify thing with wrong token",
+			token:   "wrong",
+			thingID: "existing",
+			err:     twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tv.Verify(context.Background(), tc.token, tc.thingID)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+
+	err := tv.Verify(context.Background(), token, "broken")
+	assert.NotNil(t, err, "verify thing with failing things service: expected error")
+	assert.NotEqual(t, twins.ErrNotFound, err, "verify thing with failing things service: expected error other than not found")
+}
+
+func TestVerifyChannel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/channels/existing":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"existing","name":"channel"}`))
+		case "/channels/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tv := things.NewThingVerifier(mfsdk.NewSDK(mfsdk.Config{BaseURL: ts.URL}))
+
+	cases := []struct {
+		desc   string
+		token  string
+		chanID string
+		err    error
+	}{
+		{
+			desc:   "verify existing channel",
+			token:  token,
+			chanID: "existing",
+			err:    nil,
+		},
+		{
+			desc:   "verify non-existing channel",
+			token:  token,
+			chanID: "missing",
+			err:    twins.ErrNotFound,
+		},
+		{
+			desc:   "verify channel with wrong token",
+			token:  "wrong",
+			chanID: "existing",
+			err:    twins.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tv.VerifyChannel(context.Background(), tc.token, tc.chanID)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, tc.err, err))
+	}
+
+	err := tv.VerifyChannel(context.Background(), token, "broken")
+	assert.NotNil(t, err, "verify channel with failing things service: expected error")
+	assert.NotEqual(t, twins.ErrNotFound, err, "verify channel with failing things service: expected error other than not found")
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+
+	"github.com/mainflux/mainflux/twins"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+const (
+	saveArchiveOp     = "save_archive"
+	retrieveArchiveOp = "retrieve_archive"
+	removeArchiveOp   = "remove_archive"
+)
+
+var (
+	_ twins.ArchiveStore = (*archiveStoreMiddleware)(nil)
+)
+
+type archiveStoreMiddleware struct {
+	tracer opentracing.Tracer
+	store  twins.ArchiveStore
+}
+
+// ArchiveStoreMiddleware tracks request and their latency, and adds spans
+// to context.
+func ArchiveStoreMiddleware(tracer opentracing.Tracer, store twins.ArchiveStore) twins.ArchiveStore {
+	return archiveStoreMiddleware{
+		tracer: tracer,
+		store:  store,
+	}
+}
+
+func (asm archiveStoreMiddleware) Save(ctx context.Context, arch twins.Archive) error {
+	span := createSpan(ctx, asm.tracer, saveArchiveOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return asm.store.Save(ctx, arch)
+}
+
+func (asm archiveStoreMiddleware) Retrieve(ctx context.Context, id string) (twins.Archive, error) {
+	span := createSpan(ctx, asm.tracer, retrieveArchiveOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return asm.store.Retrieve(ctx, id)
+}
+
+func (asm archiveStoreMiddleware) Remove(ctx context.Context, id string) error {
+	span := createSpan(ctx, asm.tracer, removeArchiveOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return asm.store.Remove(ctx, id)
+}
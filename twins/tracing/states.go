@@ -5,6 +5,7 @@ package tracing
 
 import (
 	"context"
+	"time"
 
 	"github.com/mainflux/mainflux/twins"
 	opentracing "github.com/opentracing/opentracing-go"
@@ -13,9 +14,21 @@ import (
 const (
 	saveStateOp         = "save_state"
 	updateStateOp       = "update_state"
+	annotateStateOp     = "annotate_state"
+	removeAllStatesOp   = "remove_all_states"
+	reindexStatesOp     = "reindex_states"
 	countStatesOp       = "count_states"
+	countStatesSinceOp  = "count_states_since"
 	retrieveAllStatesOp = "retrieve_all_states"
+	listByAttributeOp   = "list_states_by_attribute"
+	listByValueOp       = "list_states_by_value"
+	listBySourceOp      = "list_states_by_source"
 	retrieveLastStateOp = "retrieve_states_by_attribute"
+	retrieveByTwinsOp   = "retrieve_states_by_twins"
+	listUntilOp         = "list_states_until"
+	countByTwinsOp      = "count_states_by_twins"
+	countByBucketOp     = "count_states_by_bucket"
+	countByPartitionOp  = "count_states_by_partition"
 )
 
 var (
@@ -52,6 +65,30 @@ func (trm stateRepositoryMiddleware) Update(ctx context.Context, st twins.State)
 	return trm.repo.Update(ctx, st)
 }
 
+func (trm stateRepositoryMiddleware) Annotate(ctx context.Context, twinID string, id int64, note string) error {
+	span := createSpan(ctx, trm.tracer, annotateStateOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.Annotate(ctx, twinID, id, note)
+}
+
+func (trm stateRepositoryMiddleware) RemoveAll(ctx context.Context, twinID string) error {
+	span := createSpan(ctx, trm.tracer, removeAllStatesOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RemoveAll(ctx, twinID)
+}
+
+func (trm stateRepositoryMiddleware) Reindex(ctx context.Context, twinID string) error {
+	span := createSpan(ctx, trm.tracer, reindexStatesOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.Reindex(ctx, twinID)
+}
+
 func (trm stateRepositoryMiddleware) Count(ctx context.Context, tw twins.Twin) (int64, error) {
 	span := createSpan(ctx, trm.tracer, countStatesOp)
 	defer span.Finish()
@@ -60,12 +97,44 @@ func (trm stateRepositoryMiddleware) Count(ctx context.Context, tw twins.Twin) (
 	return trm.repo.Count(ctx, tw)
 }
 
-func (trm stateRepositoryMiddleware) RetrieveAll(ctx context.Context, offset, limit uint64, id string) (twins.StatesPage, error) {
+func (trm stateRepositoryMiddleware) CountSince(ctx context.Context, since time.Time) (int64, error) {
+	span := createSpan(ctx, trm.tracer, countStatesSinceOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.CountSince(ctx, since)
+}
+
+func (trm stateRepositoryMiddleware) CountByTwins(ctx context.Context, ids []string) (int64, error) {
+	span := createSpan(ctx, trm.tracer, countByTwinsOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.CountByTwins(ctx, ids)
+}
+
+func (trm stateRepositoryMiddleware) RetrieveAll(ctx context.Context, offset, limit uint64, id string, consistency twins.Consistency, order twins.Order) (twins.StatesPage, error) {
 	span := createSpan(ctx, trm.tracer, retrieveAllStatesOp)
 	defer span.Finish()
 	ctx = opentracing.ContextWithSpan(ctx, span)
 
-	return trm.repo.RetrieveAll(ctx, offset, limit, id)
+	return trm.repo.RetrieveAll(ctx, offset, limit, id, consistency, order)
+}
+
+func (trm stateRepositoryMiddleware) RetrieveByTwins(ctx context.Context, ids []string, offset, limit uint64) (twins.StatesPage, error) {
+	span := createSpan(ctx, trm.tracer, retrieveByTwinsOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveByTwins(ctx, ids, offset, limit)
+}
+
+func (trm stateRepositoryMiddleware) ListUntil(ctx context.Context, id string, until time.Time, offset, limit uint64) (twins.StatesPage, error) {
+	span := createSpan(ctx, trm.tracer, listUntilOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.ListUntil(ctx, id, until, offset, limit)
 }
 
 func (trm stateRepositoryMiddleware) RetrieveLast(ctx context.Context, id string) (twins.State, error) {
@@ -75,3 +144,43 @@ func (trm stateRepositoryMiddleware) RetrieveLast(ctx context.Context, id string
 
 	return trm.repo.RetrieveLast(ctx, id)
 }
+
+func (trm stateRepositoryMiddleware) ListByAttribute(ctx context.Context, id, attr string, from, to time.Time, offset, limit uint64) (twins.StatesPage, error) {
+	span := createSpan(ctx, trm.tracer, listByAttributeOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.ListByAttribute(ctx, id, attr, from, to, offset, limit)
+}
+
+func (trm stateRepositoryMiddleware) ListByValue(ctx context.Context, id, attr string, op twins.Operator, value float64, offset, limit uint64) (twins.StatesPage, error) {
+	span := createSpan(ctx, trm.tracer, listByValueOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.ListByValue(ctx, id, attr, op, value, offset, limit)
+}
+
+func (trm stateRepositoryMiddleware) ListBySource(ctx context.Context, id, source string, offset, limit uint64, order twins.Order) (twins.StatesPage, error) {
+	span := createSpan(ctx, trm.tracer, listBySourceOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.ListBySource(ctx, id, source, offset, limit, order)
+}
+
+func (trm stateRepositoryMiddleware) CountByBucket(ctx context.Context, id string, from, to time.Time, bucket time.Duration) ([]twins.BucketCount, error) {
+	span := createSpan(ctx, trm.tracer, countByBucketOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.CountByBucket(ctx, id, from, to, bucket)
+}
+
+func (trm stateRepositoryMiddleware) CountByPartition(ctx context.Context, id string, granularity twins.Granularity, loc *time.Location) ([]twins.Partition, error) {
+	span := createSpan(ctx, trm.tracer, countByPartitionOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.CountByPartition(ctx, id, granularity, loc)
+}
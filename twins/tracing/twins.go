@@ -5,18 +5,43 @@ package tracing
 
 import (
 	"context"
+	"time"
 
 	"github.com/mainflux/mainflux/twins"
 	opentracing "github.com/opentracing/opentracing-go"
 )
 
+const requestIDTag = "request_id"
+
 const (
 	saveTwinOp                 = "save_twin"
 	updateTwinOp               = "update_twin"
+	updateTwinIfOp             = "update_twin_if"
 	retrieveTwinByIDOp         = "retrieve_twin_by_id"
 	retrieveAllTwinsOp         = "retrieve_all_twins"
+	retrieveTwinIDsOp          = "retrieve_twin_ids"
+	retrieveTwinsByMetadataOp  = "retrieve_twins_by_metadata"
+	retrieveTwinsByThingOp     = "retrieve_twins_by_thing"
+	retrieveTwinsByChannelOp   = "retrieve_twins_by_channel"
+	retrieveTwinsByInputOp     = "retrieve_twins_by_input"
 	retrieveTwinsByAttributeOp = "retrieve_twins_by_attribute"
+	retrieveTwinsByBaseOp      = "retrieve_twins_by_base"
+	updateTwinsMetadataOp      = "update_twins_metadata"
+	saveLastErrorOp            = "save_last_error"
 	removeTwinOp               = "remove_twin"
+	saveMetadataSchemaOp       = "save_metadata_schema"
+	retrieveMetadataSchemaOp   = "retrieve_metadata_schema"
+	saveOwnerQuotaOp           = "save_owner_quota"
+	retrieveOwnerQuotaOp       = "retrieve_owner_quota"
+	saveKeyOp                  = "save_key"
+	retrieveKeyOp              = "retrieve_key"
+	removeKeyOp                = "remove_key"
+	removeExpiredKeysOp        = "remove_expired_keys"
+	saveLockOp                 = "save_lock"
+	retrieveLockOp             = "retrieve_lock"
+	removeLockOp               = "remove_lock"
+	countTwinsOp               = "count_twins"
+	countChannelsOp            = "count_channels"
 )
 
 var (
@@ -53,6 +78,14 @@ func (trm twinRepositoryMiddleware) Update(ctx context.Context, tw twins.Twin) e
 	return trm.repo.Update(ctx, tw)
 }
 
+func (trm twinRepositoryMiddleware) UpdateIf(ctx context.Context, tw twins.Twin, conditions twins.Metadata) error {
+	span := createSpan(ctx, trm.tracer, updateTwinIfOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.UpdateIf(ctx, tw, conditions)
+}
+
 func (trm twinRepositoryMiddleware) RetrieveByID(ctx context.Context, id string) (twins.Twin, error) {
 	span := createSpan(ctx, trm.tracer, retrieveTwinByIDOp)
 	defer span.Finish()
@@ -69,12 +102,76 @@ func (trm twinRepositoryMiddleware) RetrieveAll(ctx context.Context, owner strin
 	return trm.repo.RetrieveAll(ctx, owner, offset, limit, name, metadata)
 }
 
-func (trm twinRepositoryMiddleware) RetrieveByAttribute(ctx context.Context, channel, subtopic string) ([]string, error) {
+func (trm twinRepositoryMiddleware) RetrieveByAttribute(ctx context.Context, channel, subtopic string, caseInsensitive bool) ([]string, error) {
 	span := createSpan(ctx, trm.tracer, retrieveAllTwinsOp)
 	defer span.Finish()
 	ctx = opentracing.ContextWithSpan(ctx, span)
 
-	return trm.repo.RetrieveByAttribute(ctx, channel, subtopic)
+	return trm.repo.RetrieveByAttribute(ctx, channel, subtopic, caseInsensitive)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveByBase(ctx context.Context, baseID string) ([]string, error) {
+	span := createSpan(ctx, trm.tracer, retrieveTwinsByBaseOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveByBase(ctx, baseID)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveIDs(ctx context.Context, owner string) ([]string, error) {
+	span := createSpan(ctx, trm.tracer, retrieveTwinIDsOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveIDs(ctx, owner)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveByMetadata(ctx context.Context, owner string, filter twins.Metadata, limit uint64) ([]twins.Twin, error) {
+	span := createSpan(ctx, trm.tracer, retrieveTwinsByMetadataOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveByMetadata(ctx, owner, filter, limit)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveByThing(ctx context.Context, owner, thingID string, limit uint64) ([]twins.Twin, error) {
+	span := createSpan(ctx, trm.tracer, retrieveTwinsByThingOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveByThing(ctx, owner, thingID, limit)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveByChannel(ctx context.Context, channelID string) ([]twins.Twin, error) {
+	span := createSpan(ctx, trm.tracer, retrieveTwinsByChannelOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveByChannel(ctx, channelID)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveByInput(ctx context.Context, sourceID string) ([]twins.Twin, error) {
+	span := createSpan(ctx, trm.tracer, retrieveTwinsByInputOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveByInput(ctx, sourceID)
+}
+
+func (trm twinRepositoryMiddleware) UpdateMetadata(ctx context.Context, owner string, filter, patch twins.Metadata) (uint64, error) {
+	span := createSpan(ctx, trm.tracer, updateTwinsMetadataOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.UpdateMetadata(ctx, owner, filter, patch)
+}
+
+func (trm twinRepositoryMiddleware) SaveLastError(ctx context.Context, id, msg string, at time.Time) error {
+	span := createSpan(ctx, trm.tracer, saveLastErrorOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.SaveLastError(ctx, id, msg, at)
 }
 
 func (trm twinRepositoryMiddleware) Remove(ctx context.Context, id string) error {
@@ -85,12 +182,124 @@ func (trm twinRepositoryMiddleware) Remove(ctx context.Context, id string) error
 	return trm.repo.Remove(ctx, id)
 }
 
+func (trm twinRepositoryMiddleware) Count(ctx context.Context) (int64, error) {
+	span := createSpan(ctx, trm.tracer, countTwinsOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.Count(ctx)
+}
+
+func (trm twinRepositoryMiddleware) CountChannels(ctx context.Context) (int64, error) {
+	span := createSpan(ctx, trm.tracer, countChannelsOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.CountChannels(ctx)
+}
+
+func (trm twinRepositoryMiddleware) SaveMetadataSchema(ctx context.Context, owner string, schema twins.MetadataSchema) error {
+	span := createSpan(ctx, trm.tracer, saveMetadataSchemaOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.SaveMetadataSchema(ctx, owner, schema)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveMetadataSchema(ctx context.Context, owner string) (twins.MetadataSchema, error) {
+	span := createSpan(ctx, trm.tracer, retrieveMetadataSchemaOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveMetadataSchema(ctx, owner)
+}
+
+func (trm twinRepositoryMiddleware) SaveOwnerQuota(ctx context.Context, owner string, maxStates uint64) error {
+	span := createSpan(ctx, trm.tracer, saveOwnerQuotaOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.SaveOwnerQuota(ctx, owner, maxStates)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveOwnerQuota(ctx context.Context, owner string) (uint64, error) {
+	span := createSpan(ctx, trm.tracer, retrieveOwnerQuotaOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveOwnerQuota(ctx, owner)
+}
+
+func (trm twinRepositoryMiddleware) SaveKey(ctx context.Context, key twins.TwinKey) error {
+	span := createSpan(ctx, trm.tracer, saveKeyOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.SaveKey(ctx, key)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveKey(ctx context.Context, hash string) (twins.TwinKey, error) {
+	span := createSpan(ctx, trm.tracer, retrieveKeyOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveKey(ctx, hash)
+}
+
+func (trm twinRepositoryMiddleware) RemoveKey(ctx context.Context, twinID, id string) error {
+	span := createSpan(ctx, trm.tracer, removeKeyOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RemoveKey(ctx, twinID, id)
+}
+
+func (trm twinRepositoryMiddleware) RemoveExpiredKeys(ctx context.Context, before time.Time) (uint64, error) {
+	span := createSpan(ctx, trm.tracer, removeExpiredKeysOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RemoveExpiredKeys(ctx, before)
+}
+
+func (trm twinRepositoryMiddleware) SaveLock(ctx context.Context, lk twins.TwinLock) error {
+	span := createSpan(ctx, trm.tracer, saveLockOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.SaveLock(ctx, lk)
+}
+
+func (trm twinRepositoryMiddleware) RetrieveLock(ctx context.Context, twinID string) (twins.TwinLock, error) {
+	span := createSpan(ctx, trm.tracer, retrieveLockOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RetrieveLock(ctx, twinID)
+}
+
+func (trm twinRepositoryMiddleware) RemoveLock(ctx context.Context, twinID, token string) error {
+	span := createSpan(ctx, trm.tracer, removeLockOp)
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	return trm.repo.RemoveLock(ctx, twinID, token)
+}
+
 func createSpan(ctx context.Context, tracer opentracing.Tracer, opName string) opentracing.Span {
+	var span opentracing.Span
 	if parentSpan := opentracing.SpanFromContext(ctx); parentSpan != nil {
-		return tracer.StartSpan(
+		span = tracer.StartSpan(
 			opName,
 			opentracing.ChildOf(parentSpan.Context()),
 		)
+	} else {
+		span = tracer.StartSpan(opName)
 	}
-	return tracer.StartSpan(opName)
+
+	if id := twins.RequestID(ctx); id != "" {
+		span.SetTag(requestIDTag, id)
+	}
+
+	return span
 }
@@ -5,21 +5,316 @@ package twins
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/mainflux/senml"
 )
 
 // Metadata stores arbitrary twin data
 type Metadata map[string]interface{}
 
+// Metadata value types supported by MetadataSchema.
+const (
+	StringType = "string"
+	NumberType = "number"
+	BoolType   = "bool"
+	ObjectType = "object"
+	ArrayType  = "array"
+)
+
+// MetadataSchema describes top level metadata keys of the twins that belong
+// to a single owner.
+type MetadataSchema struct {
+	// Required lists the keys that metadata must contain.
+	Required []string `json:"required,omitempty"`
+	// Types maps the keys to the types of their values.
+	Types map[string]string `json:"types,omitempty"`
+}
+
+// Valid reports whether the schema uses only the supported value types.
+func (ms MetadataSchema) Valid() bool {
+	for _, t := range ms.Types {
+		switch t {
+		case StringType, NumberType, BoolType, ObjectType, ArrayType:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the metadata against the schema and returns
+// ErrSchemaViolation if a required key is missing or a value has the wrong
+// type.
+func (ms MetadataSchema) Validate(m Metadata) error {
+	for _, k := range ms.Required {
+		if _, ok := m[k]; !ok {
+			return ErrSchemaViolation
+		}
+	}
+
+	for k, v := range m {
+		t, ok := ms.Types[k]
+		if ok && !hasType(v, t) {
+			return ErrSchemaViolation
+		}
+	}
+
+	return nil
+}
+
+func hasType(v interface{}, t string) bool {
+	switch v.(type) {
+	case string:
+		return t == StringType
+	case float64, float32, int, int32, int64, uint, uint32, uint64:
+		return t == NumberType
+	case bool:
+		return t == BoolType
+	case map[string]interface{}, Metadata:
+		return t == ObjectType
+	case []interface{}:
+		return t == ArrayType
+	default:
+		return false
+	}
+}
+
 // Attribute stores individual attribute data
 type Attribute struct {
-	Name         string `json:"name"`
-	Channel      string `json:"channel"`
-	Subtopic     string `json:"subtopic"`
-	PersistState bool   `json:"persist_state"`
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	// Subtopic is the subtopic of the messages reporting the attribute
+	// values. Attributes saved without one default to their name.
+	Subtopic     string        `json:"subtopic"`
+	Aliases      []string      `json:"aliases,omitempty"`
+	PersistState bool          `json:"persist_state"`
+	MinInterval  time.Duration `json:"min_interval,omitempty"`
+	DerivativeOf string        `json:"derivative_of,omitempty"`
+	Unit         string        `json:"unit,omitempty"`
+	Display      *DisplayHints `json:"display,omitempty"`
+	// Smoothing is the factor of the exponentially weighted moving average
+	// the current state value is smoothed with. Zero disables smoothing.
+	Smoothing float64 `json:"smoothing,omitempty"`
+	// Access is the label a user other than the twin owner must be granted
+	// to read the attribute values. Values of unlabeled attributes are
+	// readable to everyone allowed to read the twin.
+	Access string `json:"access,omitempty"`
+	// Group organizes attributes for presentation and querying. It has no
+	// effect on ingestion.
+	Group string `json:"group,omitempty"`
+	// Default is the value shown in the current state until the attribute
+	// reports one. It isn't stored in states.
+	Default interface{} `json:"default,omitempty"`
+	// Range is the range numeric values of the attribute are expected to
+	// fall within. Values out of the range are stored nevertheless, but
+	// lower the twin health score.
+	Range *ValueRange `json:"range,omitempty"`
+	// Precision is the number of decimal places numeric values of the
+	// attribute are rounded to before they are stored. Values are stored as
+	// reported if it isn't set.
+	Precision *int `json:"precision,omitempty"`
+	// Conflict is the policy resolving records reported with the same time
+	// as the last stored value of the attribute. Last write wins if it isn't
+	// set.
+	Conflict ConflictPolicy `json:"conflict,omitempty"`
+	// ValueType is the type values of the attribute are expected to be of.
+	// Values of any type are stored if it isn't set.
+	ValueType ValueType `json:"value_type,omitempty"`
+	// DedupWindow is the time after the last stored value of the attribute
+	// within which records duplicating it are dropped. Zero disables
+	// deduplication.
+	DedupWindow time.Duration `json:"dedup_window,omitempty"`
+	// DedupEpsilon is the difference below which numeric values within the
+	// dedup window are considered duplicates. Other values are duplicates
+	// only if they are equal.
+	DedupEpsilon float64 `json:"dedup_epsilon,omitempty"`
+	// AllowedValues are the string values the attribute may take. Messages
+	// carrying any other string value of the attribute are rejected. Values
+	// aren't restricted if it's empty.
+	AllowedValues []string `json:"allowed_values,omitempty"`
+}
+
+// duplicates reports whether the value reported at the given time
+// duplicates the last stored value of the attribute, stored at last.
+// Records older than the last stored value never duplicate it.
+func (attr Attribute) duplicates(stored, val interface{}, last, now time.Time) bool {
+	if d := now.Sub(last); attr.DedupWindow <= 0 || d < 0 || d >= attr.DedupWindow {
+		return false
+	}
+
+	s, ok1 := toFloat(stored)
+	v, ok2 := toFloat(val)
+	if ok1 && ok2 {
+		diff := math.Abs(s - v)
+		return diff == 0 || diff < attr.DedupEpsilon
+	}
+
+	return stored != nil && reflect.DeepEqual(plainValue(stored), plainValue(val))
+}
+
+// allows reports whether the string value of the record is one of the
+// allowed values of the attribute. Records without a string value are
+// always allowed.
+func (attr Attribute) allows(rec senml.Record) bool {
+	if len(attr.AllowedValues) == 0 || rec.StringValue == nil {
+		return true
+	}
+
+	for _, v := range attr.AllowedValues {
+		if v == *rec.StringValue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// plainValue dereferences the string and bool values records point to, so
+// they compare equal to the stored ones.
+func plainValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case *string:
+		if v != nil {
+			return *v
+		}
+	case *bool:
+		if v != nil {
+			return *v
+		}
+	}
+	return val
+}
+
+// ValueType is the type of the SenML record value.
+type ValueType string
+
+const (
+	// NumberValue is the type of numeric values and sums.
+	NumberValue ValueType = "number"
+	// BoolValue is the type of boolean values.
+	BoolValue ValueType = "bool"
+	// StringValue is the type of string values.
+	StringValue ValueType = "string"
+	// DataValue is the type of data values.
+	DataValue ValueType = "data"
+)
+
+// matches reports whether the record value is of the value type. Records
+// without value match any type.
+func (vt ValueType) matches(rec senml.Record) bool {
+	switch vt {
+	case NumberValue:
+		return rec.Value != nil || rec.Sum != nil || findValue(rec) == nil
+	case BoolValue:
+		return rec.BoolValue != nil || findValue(rec) == nil
+	case StringValue:
+		return rec.StringValue != nil || findValue(rec) == nil
+	case DataValue:
+		return rec.DataValue != nil || findValue(rec) == nil
+	default:
+		return true
+	}
+}
+
+func (vt ValueType) valid() bool {
+	switch vt {
+	case "", NumberValue, BoolValue, StringValue, DataValue:
+		return true
+	default:
+		return false
+	}
+}
+
+// ConflictPolicy decides which of the values reported for the same time is
+// stored.
+type ConflictPolicy string
+
+const (
+	// LastWriteWins stores the value saved last.
+	LastWriteWins ConflictPolicy = "last_write_wins"
+	// FirstWriteWins keeps the value saved first and drops the rest.
+	FirstWriteWins ConflictPolicy = "first_write_wins"
+	// MaxValue stores the greatest numeric value, regardless of the order
+	// the values are saved in. Non-numeric values are resolved as if last
+	// write wins.
+	MaxValue ConflictPolicy = "max_value"
+)
+
+// keep reports whether the stored value is kept over the value reported for
+// the same time.
+func (cp ConflictPolicy) keep(stored, val interface{}) bool {
+	switch cp {
+	case FirstWriteWins:
+		return true
+	case MaxValue:
+		s, ok1 := toFloat(stored)
+		v, ok2 := toFloat(val)
+		return ok1 && ok2 && s >= v
+	default:
+		return false
+	}
+}
+
+func (cp ConflictPolicy) valid() bool {
+	switch cp {
+	case "", LastWriteWins, FirstWriteWins, MaxValue:
+		return true
+	default:
+		return false
+	}
+}
+
+// ValueRange is an inclusive range of numeric values.
+type ValueRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
 }
 
-// Definition stores entity's attributes
+func (vr ValueRange) contains(v float64) bool {
+	return v >= vr.Min && v <= vr.Max
+}
+
+// DisplayHints describe how the attribute is rendered by user interfaces.
+// They have no effect on states.
+type DisplayHints struct {
+	Label     string `json:"label,omitempty"`
+	Chart     string `json:"chart,omitempty"`
+	Color     string `json:"color,omitempty"`
+	Precision int    `json:"precision"`
+}
+
+// Subtopics returns attribute subtopic followed by its aliases.
+func (attr Attribute) Subtopics() []string {
+	return append([]string{attr.Subtopic}, attr.Aliases...)
+}
+
+// withDefaultSubtopics returns the definition with the subtopic of each
+// attribute that doesn't set one defaulted to the attribute name. The
+// definition itself is left intact.
+func (def Definition) withDefaultSubtopics() Definition {
+	attrs := make([]Attribute, len(def.Attributes))
+	copy(attrs, def.Attributes)
+	for i := range attrs {
+		if attrs[i].Subtopic == "" {
+			attrs[i].Subtopic = attrs[i].Name
+		}
+	}
+	if def.Attributes != nil {
+		def.Attributes = attrs
+	}
+
+	return def
+}
+
+// Definition stores entity's attributes. Attributes are kept in the order
+// they are declared in, which clients may rely on, e.g. for display.
 type Definition struct {
 	ID         int         `json:"id"`
 	Created    time.Time   `json:"created"`
@@ -27,6 +322,166 @@ type Definition struct {
 	Delta      int64       `json:"delta"`
 }
 
+// Equal reports whether the definitions describe the same attributes, in the
+// same order, and delta. IDs and creation times are ignored, and attributes
+// are compared as serialized, so a definition equals itself after a JSON
+// round trip, e.g. regardless of nil and empty aliases or numeric types of
+// default values.
+func (def Definition) Equal(other Definition) bool {
+	if def.Delta != other.Delta || len(def.Attributes) != len(other.Attributes) {
+		return false
+	}
+	if len(def.Attributes) == 0 {
+		return true
+	}
+
+	a, err := normalize(def.Attributes)
+	if err != nil {
+		return false
+	}
+	b, err := normalize(other.Attributes)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// normalize returns the value as it is decoded after it is serialized.
+func normalize(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var n interface{}
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// TwinDescriptor describes the messages the twin expects, as derived from
+// its current definition.
+type TwinDescriptor struct {
+	TwinID      string                `json:"twin_id"`
+	Name        string                `json:"name"`
+	Definition  int                   `json:"definition"`
+	ContentType string                `json:"content_type"`
+	Delta       int64                 `json:"delta"`
+	Attributes  []AttributeDescriptor `json:"attributes"`
+}
+
+// AttributeDescriptor describes the messages that update the attribute.
+// Subtopics have their placeholders resolved.
+type AttributeDescriptor struct {
+	Name        string        `json:"name"`
+	Channel     string        `json:"channel"`
+	Subtopics   []string      `json:"subtopics"`
+	Unit        string        `json:"unit,omitempty"`
+	MinInterval time.Duration `json:"min_interval,omitempty"`
+}
+
+// FieldError describes the problem with a single field of an entity. The
+// field is identified by its path, e.g. definition.attributes[0].name.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (fe FieldError) String() string {
+	return fmt.Sprintf("%s: %s", fe.Field, fe.Message)
+}
+
+// ValidationError lists the fields of an entity that failed validation. It
+// matches ErrMalformedEntity.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (ve *ValidationError) Error() string {
+	msgs := make([]string, len(ve.Fields))
+	for i, fe := range ve.Fields {
+		msgs[i] = fe.String()
+	}
+	return fmt.Sprintf("%s: %s", ErrMalformedEntity, strings.Join(msgs, "; "))
+}
+
+// Is reports whether the target is ErrMalformedEntity.
+func (ve *ValidationError) Is(target error) bool {
+	return target == ErrMalformedEntity
+}
+
+// invalidField returns ValidationError reporting the single field.
+func invalidField(field, format string, args ...interface{}) error {
+	return &ValidationError{
+		Fields: []FieldError{{Field: field, Message: fmt.Sprintf(format, args...)}},
+	}
+}
+
+// DependencyError lists the derived attributes, by the removed attribute
+// they depend on, that prevent a definition update.
+type DependencyError struct {
+	Dependents map[string][]string
+}
+
+func (de *DependencyError) Error() string {
+	attrs := make([]string, 0, len(de.Dependents))
+	for attr := range de.Dependents {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+
+	msgs := make([]string, len(attrs))
+	for i, attr := range attrs {
+		msgs[i] = fmt.Sprintf("%s is the source of %s", attr, strings.Join(de.Dependents[attr], ", "))
+	}
+	return fmt.Sprintf("%s: %s", ErrDependencyExists, strings.Join(msgs, "; "))
+}
+
+// Is reports whether the target is ErrDependencyExists.
+func (de *DependencyError) Is(target error) bool {
+	return target == ErrDependencyExists
+}
+
+// DefinitionError lists all the problems found in a definition, along with
+// the paths of the fields they were found in.
+type DefinitionError struct {
+	Problems []string
+	Fields   []FieldError
+}
+
+// validationError returns ValidationError listing the problems, with field
+// paths prefixed by the path of the definition.
+func (de *DefinitionError) validationError(prefix string) error {
+	ve := &ValidationError{}
+	for _, fe := range de.Fields {
+		fe.Field = fmt.Sprintf("%s.%s", prefix, fe.Field)
+		ve.Fields = append(ve.Fields, fe)
+	}
+	return ve
+}
+
+func (de *DefinitionError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrMalformedEntity, strings.Join(de.Problems, "; "))
+}
+
+// BatchError maps ids of the entities a batch operation failed for to the
+// errors.
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (be *BatchError) Error() string {
+	var msgs []string
+	for id, err := range be.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", id, err))
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, "; ")
+}
+
 // Twin is a Mainflux data system representation. Each twin is owned
 // by a single user, and is assigned with the unique identifier.
 type Twin struct {
@@ -38,8 +493,38 @@ type Twin struct {
 	Revision    int
 	Definitions []Definition
 	Metadata    Metadata
+	Heartbeat   time.Duration
+	BaseTwinID  string
+	// ChannelID is the channel the twin is bound to. Bound twins are updated
+	// only by messages published to it, while unbound twins are updated by
+	// messages from any channel.
+	ChannelID string
+	// ThingID is the Mainflux thing the twin shadows.
+	ThingID string
+	// Inputs link attributes of the twin to attributes of other twins they
+	// are computed from.
+	Inputs []TwinInput
+	// Features toggle ingestion behaviors of the twin, e.g. smoothing, by
+	// name. Unknown features are ignored.
+	Features map[string]bool
+	// LastError is the error last encountered while saving states of the
+	// twin, and LastErrorAt the time it occurred.
+	LastError   string
+	LastErrorAt time.Time
 }
 
+// Action represents an operation performed on a twin.
+type Action int
+
+const (
+	// Read covers retrieving the twin and its states.
+	Read Action = iota
+	// Write covers updating the twin and its states.
+	Write
+	// Delete covers removing the twin.
+	Delete
+)
+
 // PageMetadata contains page metadata that helps navigation.
 type PageMetadata struct {
 	Total  uint64
@@ -54,6 +539,47 @@ type Page struct {
 	Twins []Twin
 }
 
+// TwinInput links the twin attribute to the attribute of the source twin.
+// The attribute holds the mean of the current numeric values of all the
+// source attributes it's linked to.
+type TwinInput struct {
+	Attribute       string
+	SourceTwinID    string
+	SourceAttribute string
+	// SourceField is the field of the source attribute the input is
+	// computed from.
+	SourceField Field
+}
+
+// Field selects the SenML record field of an attribute.
+type Field string
+
+const (
+	// ValueField is the value of the attribute. It's the field used if
+	// none is set.
+	ValueField Field = "value"
+	// SumField is the sum of the attribute, i.e. its integrated value.
+	SumField Field = "sum"
+)
+
+// value returns the numeric value of the attribute field in the state.
+func (f Field) value(st State, attr string) (float64, bool) {
+	if f == SumField {
+		v, ok := st.Sums[attr]
+		return v, ok
+	}
+	return toFloat(st.Payload[attr])
+}
+
+func (f Field) valid() bool {
+	switch f {
+	case "", ValueField, SumField:
+		return true
+	default:
+		return false
+	}
+}
+
 // TwinRepository specifies a twin persistence API.
 type TwinRepository interface {
 	// Save persists the twin
@@ -63,16 +589,105 @@ type TwinRepository interface {
 	// returned to indicate operation failure.
 	Update(context.Context, Twin) error
 
+	// UpdateIf performs an update to the existing twin only if its stored
+	// metadata matches the conditions on top level keys. ErrConflict is
+	// returned if it doesn't.
+	UpdateIf(ctx context.Context, tw Twin, conditions Metadata) error
+
 	// RetrieveByID retrieves the twin having the provided identifier.
 	RetrieveByID(ctx context.Context, id string) (Twin, error)
 
 	// RetrieveByAttribute retrieves twin ids whose definition contains
-	// the attribute with given channel and subtopic
-	RetrieveByAttribute(ctx context.Context, channel, subtopic string) ([]string, error)
+	// the attribute with given channel and subtopic. Subtopics are compared
+	// ignoring case if caseInsensitive is set. Twins having an attribute on
+	// the channel whose subtopic contains placeholders are retrieved too.
+	RetrieveByAttribute(ctx context.Context, channel, subtopic string, caseInsensitive bool) ([]string, error)
+
+	// RetrieveByBase retrieves ids of the twins which reference the base
+	// twin having the provided identifier.
+	RetrieveByBase(ctx context.Context, baseID string) ([]string, error)
 
 	// RetrieveAll retrieves the subset of twins owned by the specified user.
 	RetrieveAll(context.Context, string, uint64, uint64, string, Metadata) (Page, error)
 
+	// RetrieveIDs retrieves ids of all the twins owned by the specified user.
+	RetrieveIDs(ctx context.Context, owner string) ([]string, error)
+
+	// RetrieveByMetadata retrieves at most limit twins owned by the specified
+	// user whose metadata matches the filter on top level keys.
+	RetrieveByMetadata(ctx context.Context, owner string, filter Metadata, limit uint64) ([]Twin, error)
+
+	// RetrieveByThing retrieves at most limit twins owned by the specified
+	// user that are linked to the thing.
+	RetrieveByThing(ctx context.Context, owner, thingID string, limit uint64) ([]Twin, error)
+
+	// RetrieveByChannel retrieves twins of all users that are bound to the
+	// channel.
+	RetrieveByChannel(ctx context.Context, channelID string) ([]Twin, error)
+
+	// RetrieveByInput retrieves twins of all users having an attribute
+	// linked to an attribute of the source twin.
+	RetrieveByInput(ctx context.Context, sourceID string) ([]Twin, error)
+
+	// UpdateMetadata merges the patch into metadata of the twins owned by the
+	// specified user whose metadata matches the filter on top level keys. It
+	// returns the number of updated twins.
+	UpdateMetadata(ctx context.Context, owner string, filter, patch Metadata) (uint64, error)
+
+	// SaveLastError records the error last encountered for the twin having
+	// the provided identifier, leaving the rest of the twin unchanged.
+	SaveLastError(ctx context.Context, id, msg string, at time.Time) error
+
 	// Remove removes the twin having the provided identifier.
 	Remove(ctx context.Context, id string) error
+
+	// SaveMetadataSchema persists the metadata schema of the specified
+	// user, replacing the existing one.
+	SaveMetadataSchema(ctx context.Context, owner string, schema MetadataSchema) error
+
+	// RetrieveMetadataSchema retrieves the metadata schema of the specified
+	// user. Empty schema is returned if the user has not set one.
+	RetrieveMetadataSchema(ctx context.Context, owner string) (MetadataSchema, error)
+
+	// SaveOwnerQuota sets the maximum number of states the twins of the
+	// specified user can have in total. Zero removes the quota.
+	SaveOwnerQuota(ctx context.Context, owner string, maxStates uint64) error
+
+	// RetrieveOwnerQuota retrieves the state quota of the specified user.
+	// Zero is returned if the user has no quota.
+	RetrieveOwnerQuota(ctx context.Context, owner string) (uint64, error)
+
+	// SaveKey persists the twin key, without its value.
+	SaveKey(ctx context.Context, key TwinKey) error
+
+	// RetrieveKey retrieves the twin key having the provided value hash.
+	RetrieveKey(ctx context.Context, hash string) (TwinKey, error)
+
+	// RemoveKey removes the key of the twin having the provided id.
+	// ErrNotFound is returned if the twin has no such key.
+	RemoveKey(ctx context.Context, twinID, id string) error
+
+	// RemoveExpiredKeys removes the twin keys that expired before the
+	// provided time, and returns the number of removed keys.
+	RemoveExpiredKeys(ctx context.Context, before time.Time) (uint64, error)
+
+	// SaveLock persists the twin lock, replacing the lock of the twin if it
+	// has the same token or has expired. ErrLocked is returned otherwise.
+	SaveLock(ctx context.Context, lk TwinLock) error
+
+	// RetrieveLock retrieves the lock of the twin having the provided
+	// identifier, expired or not.
+	RetrieveLock(ctx context.Context, twinID string) (TwinLock, error)
+
+	// RemoveLock removes the lock of the twin having the provided identifier
+	// if it has the token or has expired. ErrLocked is returned if the twin
+	// is locked with another token.
+	RemoveLock(ctx context.Context, twinID, token string) error
+
+	// Count returns the total number of twins.
+	Count(ctx context.Context) (int64, error)
+
+	// CountChannels returns the number of distinct channels referenced by
+	// attributes of the latest twin definitions.
+	CountChannels(ctx context.Context) (int64, error)
 }
@@ -0,0 +1,76 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+import "sync"
+
+// unitAliases maps unit aliases reported by devices to canonical units.
+type unitAliases struct {
+	mu      sync.RWMutex
+	aliases map[string]string
+}
+
+func newUnitAliases(aliases map[string]string) *unitAliases {
+	ua := &unitAliases{
+		aliases: make(map[string]string),
+	}
+	for alias, canonical := range aliases {
+		ua.aliases[alias] = canonical
+	}
+
+	return ua
+}
+
+func (ua *unitAliases) register(alias, canonical string) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+
+	ua.aliases[alias] = canonical
+}
+
+// normalize returns the canonical unit, or the unit itself if it has no
+// registered alias.
+func (ua *unitAliases) normalize(unit string) string {
+	ua.mu.RLock()
+	defer ua.mu.RUnlock()
+
+	if canonical, ok := ua.aliases[unit]; ok {
+		return canonical
+	}
+
+	return unit
+}
+
+// ucumUnits are the vetted units attribute units are validated against: the
+// units of the SenML units registry, defined in RFC 8428 and RFC 8798, which
+// are UCUM codes apart from a few SenML extensions such as lat and lon.
+var ucumUnits = map[string]bool{
+	// RFC 8428 units.
+	"m": true, "kg": true, "g": true, "s": true, "A": true, "K": true,
+	"cd": true, "mol": true, "Hz": true, "rad": true, "sr": true, "N": true,
+	"Pa": true, "J": true, "W": true, "C": true, "V": true, "F": true,
+	"Ohm": true, "S": true, "Wb": true, "T": true, "H": true, "Cel": true,
+	"lm": true, "lx": true, "Bq": true, "Gy": true, "Sv": true, "kat": true,
+	"m2": true, "m3": true, "l": true, "m/s": true, "m/s2": true,
+	"m3/s": true, "l/s": true, "W/m2": true, "cd/m2": true, "bit": true,
+	"bit/s": true, "lat": true, "lon": true, "pH": true, "dB": true,
+	"dBW": true, "Bspl": true, "count": true, "/": true, "%": true,
+	"%RH": true, "%EL": true, "EL": true, "1/s": true, "1/min": true,
+	"beat/min": true, "beats": true, "S/m": true, "B": true, "VA": true,
+	"VAs": true, "var": true, "vars": true, "J/m": true, "kg/m3": true,
+	"deg": true, "NTU": true,
+	// RFC 8798 secondary units.
+	"ms": true, "min": true, "h": true, "MHz": true, "kW": true,
+	"kVA": true, "kvar": true, "Ah": true, "Wh": true, "kWh": true,
+	"varh": true, "kvarh": true, "kVAh": true, "Wh/km": true, "KiB": true,
+	"GB": true, "Mbit/s": true, "B/s": true, "MB/s": true, "mV": true,
+	"mA": true, "dBm": true, "ug/m3": true, "mm/h": true, "m/h": true,
+	"ppm": true, "/100": true, "/1000": true, "hPa": true, "mm": true,
+	"cm": true, "km": true, "km/h": true,
+}
+
+// validUnit reports whether the unit is one of the vetted UCUM units.
+func validUnit(unit string) bool {
+	return ucumUnits[unit]
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package twins
+
+// writeQueue persists states asynchronously. Writes are executed one at a
+// time, in the order they were enqueued, so that the states of a twin are
+// always derived from its previously persisted state.
+type writeQueue struct {
+	writes  chan func() error
+	onError func(error)
+}
+
+func newWriteQueue(size int, onError func(error)) *writeQueue {
+	wq := &writeQueue{
+		writes:  make(chan func() error, size),
+		onError: onError,
+	}
+	go wq.run()
+
+	return wq
+}
+
+// enqueue queues the write and reports false if the queue is full.
+func (wq *writeQueue) enqueue(write func() error) bool {
+	select {
+	case wq.writes <- write:
+		return true
+	default:
+		return false
+	}
+}
+
+func (wq *writeQueue) run() {
+	for write := range wq.writes {
+		if err := write(); err != nil {
+			wq.onError(err)
+		}
+	}
+}